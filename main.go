@@ -17,40 +17,226 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/ccding/go-stun/serve"
 	"github.com/ccding/go-stun/stun"
 )
 
 func main() {
-	var serverAddr = flag.String("s", stun.DefaultServerAddr, "STUN server address")
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[2:])
+		return
+	}
+	var serverAddr = flag.String("s", "", "STUN server address, comma-separated addresses tried in order, or ws:// URL of a gateway, the best public server if empty")
 	var v = flag.Bool("v", false, "verbose mode")
 	var vv = flag.Bool("vv", false, "double verbose mode (includes -v)")
-	var vvv = flag.Bool("vvv", false, "triple verbose mode (includes -v and -vv)")
+	var vvv = flag.Bool("vvv", false, "triple verbose mode, logging every attribute (includes -v and -vv)")
+	var localAddr = flag.String("l", "", "local address to bind to")
+	var iface = flag.String("i", "", "network interface to bind to")
+	var ipOnly = flag.Bool("ip", false, "only print the external IP")
+	var software = flag.String("software", stun.DefaultSoftwareName, "SOFTWARE attribute of requests")
+	var verifyAddr = flag.String("verify", "", "second STUN server address to cross-check the external IP (with -ip)")
+	var timeout = flag.Duration("timeout", 0, "total timeout, 0 for no limit")
+	var testTimeout = flag.Duration("test-timeout", 0, "timeout of each test, 0 for the full retransmission schedule")
+	var jsonOut = flag.Bool("json", false, "print the result as JSON")
+	var ping = flag.Int("ping", 0, "only send the number of binding requests and print their round-trip times")
+	var portMin = flag.Int("port-min", 0, "lowest local port to bind to, with -port-max")
+	var portMax = flag.Int("port-max", 0, "highest local port to bind to, with -port-min")
+	var username = flag.String("user", "", "username of the short-term credential")
+	var password = flag.String("password", "", "password of the short-term credential")
+	var strict = flag.Bool("strict", false, "discard responses without a valid MESSAGE-INTEGRITY (with -password)")
+	var legacy = flag.Bool("legacy", false, "accept RFC 3489 servers which do not echo the magic cookie")
+	var storePath = flag.String("store", "", "file to record the result in, printing the changes since the last recorded one")
+	var conformance = flag.Bool("conformance", false, "only check the package against the RFC 5769 test vectors")
+	var rate = flag.Float64("rate", 0, "transactions per second per server, 0 for no limit")
 	flag.Parse()
 
+	if *conformance {
+		report := stun.Conformance()
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Creates a STUN client. NewClientWithConnection can also be used if
 	// you want to handle the UDP listener by yourself.
 	client := stun.NewClient()
-	// The default addr (stun.DefaultServerAddr) will be used unless we
-	// call SetServerAddr.
-	client.SetServerAddr(*serverAddr)
+	// The best of stun.PublicServers will be used unless we call
+	// SetServerAddr with a non-empty address.
+	if strings.HasPrefix(*serverAddr, "ws://") || strings.HasPrefix(*serverAddr, "wss://") {
+		// STUN over a WebSocket to a gateway, which relays to the
+		// STUN server.
+		client.SetServerWebSocket(*serverAddr, nil)
+	} else if servers := strings.Split(*serverAddr, ","); len(servers) > 1 {
+		// The discovery tries the servers in order until one answers,
+		// the other requests use the first one.
+		client.SetServerAddr(servers[0])
+		client.SetServers(servers, nil)
+	} else {
+		client.SetServerAddr(*serverAddr)
+	}
+	client.SetSoftware(*software)
+	// The UDP listener binds to an unspecified address unless we call
+	// SetLocalAddr or SetInterface.
+	client.SetLocalAddr(*localAddr)
+	client.SetInterface(*iface)
+	client.SetPortRange(*portMin, *portMax)
+	client.SetCredential(*username, *password)
+	client.SetStrictIntegrity(*strict)
+	client.SetLegacyCompat(*legacy)
+	if *rate > 0 {
+		client.SetRateLimiter(stun.NewRateLimiter(*rate, 1, 0))
+	}
 	// Non verbose mode will be used by default unless we call
-	// SetVerbose(true) or SetVVerbose(true).
+	// SetVerbose(true), SetVVerbose(true) or SetTrace(true).
 	client.SetVerbose(*v || *vv || *vvv)
 	client.SetVVerbose(*vv || *vvv)
-	// Discover the NAT and return the result.
-	nat, host, err := client.Discover()
+	client.SetTrace(*vvv)
+	// Without timeouts, each unanswered test takes 9.5 seconds of
+	// retransmissions.
+	client.SetTimeout(*timeout)
+	client.SetTestTimeout(*testTimeout)
+	if *ping > 0 {
+		stats, err := client.Ping(context.Background(), *ping)
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("%d sent, %d received, %.0f%% loss\n", stats.Sent, stats.Received, 100*stats.Loss())
+		if stats.Received > 0 {
+			fmt.Println("RTT min/mean/max/jitter:", stats.Min, stats.Mean, stats.Max, stats.Jitter)
+		}
+		return
+	}
+	if *ipOnly {
+		// ExternalIP only performs the first test, and cross-checks
+		// the IP with the second server if SetVerifyServerAddr is
+		// called.
+		client.SetVerifyServerAddr(*verifyAddr)
+		ip, err := client.ExternalIP(context.Background())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("External IP:", ip)
+		return
+	}
+	// The result is recorded by the store, and compared with the last
+	// recorded one.
+	var store *stun.FileStore
+	var prev *stun.Record
+	if *storePath != "" {
+		store = stun.NewFileStore(*storePath)
+		if records, err := store.Records(); err == nil && len(records) > 0 {
+			prev = &records[len(records)-1]
+		}
+		client.SetResultStore(store)
+	}
+	// Discover the NAT and return the result. Discover returns the NAT
+	// type and the host only, DiscoverResult returns the details.
+	result, err := client.DiscoverResult()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	if prev != nil {
+		if records, err := store.Records(); err == nil && len(records) > 0 {
+			for _, c := range stun.Diff(*prev, records[len(records)-1]) {
+				fmt.Println(c)
+			}
+		}
+	}
+	if *jsonOut {
+		// The NAT type and the hosts are encoded with stable names, so
+		// the output of different runs can be compared.
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(string(b))
+		return
+	}
 
-	fmt.Println("NAT Type:", nat)
-	if host != nil {
+	fmt.Println("NAT Type:", result.NAT)
+	if result.LocalAddr != nil {
+		fmt.Println("Local Port:", result.LocalAddr.Port())
+	}
+	if len(result.Hosts) > 0 && result.Hosts[0] != nil {
+		host := result.Hosts[0]
 		fmt.Println("External IP Family:", host.Family())
 		fmt.Println("External IP:", host.IP())
 		fmt.Println("External Port:", host.Port())
 	}
+	if host := result.OtherFamilyHost; host != nil {
+		fmt.Println("External IP of the Other Family:", host.IP())
+		fmt.Println("External Port of the Other Family:", host.Port())
+	}
+	if result.NAT64 {
+		if result.NAT64Prefix != nil {
+			fmt.Println("NAT64 Prefix:", result.NAT64Prefix)
+		} else {
+			fmt.Println("The server is reached through a NAT64")
+		}
+	}
+	if result.AddrDiscrepancy() {
+		fmt.Println("CHANGED-ADDRESS", result.ChangedAddr, "disagrees with OTHER-ADDRESS", result.OtherAddr)
+	}
+	for _, resp := range result.Responses {
+		if resp.MappedRewritten() {
+			fmt.Println("MAPPED-ADDRESS", resp.MappedAddr, "of", resp.Test, "disagrees with XOR-MAPPED-ADDRESS", resp.XorMappedAddr, "and was rewritten on the path")
+		}
+		if resp.OriginRewritten() {
+			fmt.Println("The response of", resp.Test, "came from", resp.From, "but RESPONSE-ORIGIN is", resp.Origin())
+		}
+	}
+	if result.Partial() {
+		fmt.Println("The server provides no changed address, the NAT type is partial")
+	}
+	if result.ServerSoftware != "" {
+		fmt.Println("Server Software:", result.ServerSoftware)
+	}
+	if loss := result.Loss; loss.Retransmitted > 0 || loss.TimedOut > 0 {
+		fmt.Printf("Transactions: %d, %d retransmitted, %d timed out, %.0f%% requests lost\n",
+			loss.Transactions, loss.Retransmitted, loss.TimedOut, 100*loss.LossRate())
+	}
+	if result.Dialect != stun.DialectUnknown {
+		fmt.Println("Server Dialect:", result.Dialect)
+	}
+}
+
+// serveMain runs the HTTP probe service of the serve subcommand.
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var addr = fs.String("addr", ":8080", "HTTP address to listen on")
+	var servers = fs.String("s", "", "comma-separated STUN servers clients may query, the first is the default, the best public server if empty")
+	var timeout = fs.Duration("timeout", serve.DefaultTimeout, "timeout of each discovery")
+	var testTimeout = fs.Duration("test-timeout", time.Second, "timeout of each test")
+	var concurrent = fs.Int("concurrent", serve.DefaultMaxConcurrent, "number of discoveries run at the same time")
+	fs.Parse(args)
+
+	cfg := serve.Config{
+		Timeout:       *timeout,
+		MaxConcurrent: *concurrent,
+		Configure: func(c *stun.Client) {
+			c.SetTestTimeout(*testTimeout)
+		},
+	}
+	if *servers != "" {
+		cfg.Servers = strings.Split(*servers, ",")
+	}
+	fmt.Println("Serving /discover and /ip on", *addr)
+	if err := http.ListenAndServe(*addr, serve.NewHandler(cfg)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,251 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package measure runs the STUN discovery against many servers concurrently
+// and aggregates the results, for measuring fleets of servers or the NAT
+// behavior seen through them.
+//
+//	report := measure.Run(measure.Config{
+//		Servers:     []string{"stun.ekiga.net:3478", "stun1.l.google.com:19302"},
+//		Concurrency: 4,
+//	})
+//
+// Stream and StreamFrom yield the stats of each server as soon as it is
+// probed instead, for lists of servers too large to keep all stats of.
+package measure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// DefaultConcurrency is the number of servers probed at the same time if it
+// is not configured.
+const DefaultConcurrency = 8
+
+// Config configures a measurement.
+type Config struct {
+	Servers     []string // addresses of the STUN servers
+	Concurrency int      // servers probed at the same time, DefaultConcurrency if 0
+	Rounds      int      // discoveries per server, 1 if 0
+
+	// NewClient returns the client used for a discovery, e.g. to set
+	// the local address. stun.NewClient is used if it is nil. The server
+	// address is set on the returned client.
+	NewClient func() *stun.Client
+}
+
+// ServerStats is the aggregated result of the discoveries against a server.
+type ServerStats struct {
+	Server      string
+	Runs        int
+	Failures    int // discoveries which returned an error
+	FailureRate float64
+	LastError   error
+
+	// Round trip times of the transactions answered without
+	// retransmission (Karn's algorithm).
+	RTTs    []time.Duration
+	MinRTT  time.Duration
+	MeanRTT time.Duration
+	MaxRTT  time.Duration
+
+	NATTypes map[stun.NATType]int // NAT types of the successful discoveries
+	NAT      stun.NATType         // the most frequent NAT type, NATError if none
+}
+
+// Report is the result of a measurement.
+type Report struct {
+	Servers []*ServerStats // in the order of Config.Servers
+
+	// NAT is the NAT type reported by most servers, and Agreement is the
+	// fraction of the servers with a successful discovery reporting it.
+	NAT       stun.NATType
+	Agreement float64
+}
+
+// Run probes all servers and returns the report. It blocks until all
+// discoveries are done.
+func Run(cfg Config) *Report {
+	stats := make([]*ServerStats, len(cfg.Servers))
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, server := range cfg.Servers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, server string) {
+			defer wg.Done()
+			stats[i] = probe(context.Background(), cfg, server)
+			<-sem
+		}(i, server)
+	}
+	wg.Wait()
+	return newReport(stats)
+}
+
+// Stream probes the servers of the config like Run, but sends the stats of
+// each server on the returned channel as soon as its discoveries are done,
+// in the order they complete, and keeps none of them. See StreamFrom.
+func Stream(ctx context.Context, cfg Config) <-chan *ServerStats {
+	servers := make(chan string)
+	go func() {
+		defer close(servers)
+		for _, server := range cfg.Servers {
+			select {
+			case servers <- server:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return StreamFrom(ctx, cfg, servers)
+}
+
+// StreamFrom probes the servers received from servers, ignoring
+// Config.Servers, and sends the stats of each on the returned channel as
+// soon as its discoveries are done. At most Config.Concurrency servers are
+// probed at the same time, and the next ones are taken only once the stats
+// are received, so the memory used is bounded however many servers there
+// are. The channel is closed once servers is closed and all are probed, or
+// once ctx is done, which cancels the discoveries in progress.
+func StreamFrom(ctx context.Context, cfg Config, servers <-chan string) <-chan *ServerStats {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	out := make(chan *ServerStats)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var server string
+				var ok bool
+				select {
+				case server, ok = <-servers:
+				case <-ctx.Done():
+					return
+				}
+				if !ok {
+					return
+				}
+				s := probe(ctx, cfg, server)
+				select {
+				case out <- s:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// probe runs the discoveries against the server, each with a new client, as
+// clients are not safe for concurrent use.
+func probe(ctx context.Context, cfg Config, server string) *ServerStats {
+	s := &ServerStats{Server: server, NATTypes: make(map[stun.NATType]int)}
+	rounds := cfg.Rounds
+	if rounds <= 0 {
+		rounds = 1
+	}
+	for i := 0; i < rounds; i++ {
+		var client *stun.Client
+		if cfg.NewClient != nil {
+			client = cfg.NewClient()
+		} else {
+			client = stun.NewClient()
+		}
+		client.SetServerAddr(server)
+		sent := make(map[string]time.Time)
+		client.OnEvent(func(e stun.Event) {
+			switch e.Type {
+			case stun.EventRequestSent:
+				sent[string(e.TransactionID)] = e.Time
+			case stun.EventResponseReceived:
+				if t, ok := sent[string(e.TransactionID)]; ok && e.Attempt == 1 {
+					s.RTTs = append(s.RTTs, e.Time.Sub(t))
+				}
+			}
+		})
+		r, err := client.DiscoverResultContext(ctx)
+		s.Runs++
+		if err != nil {
+			s.Failures++
+			s.LastError = err
+			continue
+		}
+		s.NATTypes[r.NAT]++
+	}
+	s.FailureRate = float64(s.Failures) / float64(s.Runs)
+	s.NAT = majority(s.NATTypes)
+	if len(s.RTTs) > 0 {
+		var sum time.Duration
+		s.MinRTT, s.MaxRTT = s.RTTs[0], s.RTTs[0]
+		for _, rtt := range s.RTTs {
+			sum += rtt
+			if rtt < s.MinRTT {
+				s.MinRTT = rtt
+			}
+			if rtt > s.MaxRTT {
+				s.MaxRTT = rtt
+			}
+		}
+		s.MeanRTT = sum / time.Duration(len(s.RTTs))
+	}
+	return s
+}
+
+func newReport(stats []*ServerStats) *Report {
+	r := &Report{Servers: stats}
+	votes := make(map[stun.NATType]int)
+	total := 0
+	for _, s := range stats {
+		if len(s.NATTypes) > 0 {
+			votes[s.NAT]++
+			total++
+		}
+	}
+	r.NAT = majority(votes)
+	if total > 0 {
+		r.Agreement = float64(votes[r.NAT]) / float64(total)
+	}
+	return r
+}
+
+// majority returns the most frequent NAT type, preferring the smaller value
+// on ties so the result is deterministic.
+func majority(counts map[stun.NATType]int) stun.NATType {
+	best, bestCount := stun.NATError, 0
+	for nat, count := range counts {
+		if count > bestCount || (count == bestCount && nat < best) {
+			best, bestCount = nat, count
+		}
+	}
+	return best
+}
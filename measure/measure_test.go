@@ -0,0 +1,93 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package measure
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func TestNewReport(t *testing.T) {
+	stats := []*ServerStats{
+		{NATTypes: map[stun.NATType]int{stun.NATFull: 2}, NAT: stun.NATFull},
+		{NATTypes: map[stun.NATType]int{stun.NATFull: 1}, NAT: stun.NATFull},
+		{NATTypes: map[stun.NATType]int{stun.NATSymmetric: 1}, NAT: stun.NATSymmetric},
+		{NATTypes: map[stun.NATType]int{}, NAT: stun.NATError},
+	}
+	r := newReport(stats)
+	if r.NAT != stun.NATFull {
+		t.Errorf("NAT error: %v", r.NAT)
+	}
+	if r.Agreement < 0.66 || r.Agreement > 0.67 {
+		t.Errorf("Agreement error: %v", r.Agreement)
+	}
+}
+
+func TestMajority(t *testing.T) {
+	if nat := majority(map[stun.NATType]int{}); nat != stun.NATError {
+		t.Errorf("majority error: %v", nat)
+	}
+	if nat := majority(map[stun.NATType]int{stun.NATSymmetric: 1, stun.NATFull: 1}); nat != stun.NATFull {
+		t.Errorf("majority error: %v", nat)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var servers []string
+	for i := 0; i < 5; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP error: %v", err)
+		}
+		s := stun.NewServer(conn)
+		go s.Serve()
+		defer s.Close()
+		servers = append(servers, conn.LocalAddr().String())
+	}
+	cfg := Config{
+		Servers:     servers,
+		Concurrency: 2,
+		NewClient: func() *stun.Client {
+			c := stun.NewClient()
+			c.SetLocalAddr("127.0.0.1:0")
+			c.SetTestTimeout(time.Second)
+			return c
+		},
+	}
+	seen := make(map[string]bool)
+	for s := range Stream(context.Background(), cfg) {
+		if s.Runs != 1 || s.Failures != 0 || s.NAT != stun.NATNone {
+			t.Errorf("stats of %s error: %+v", s.Server, s)
+		}
+		seen[s.Server] = true
+	}
+	if len(seen) != len(servers) {
+		t.Errorf("Stream error: %d of %d servers", len(seen), len(servers))
+	}
+	// The channel is closed once ctx is done, even if the stats are not
+	// received.
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := Stream(ctx, cfg)
+	<-ch
+	cancel()
+	for range ch {
+	}
+}
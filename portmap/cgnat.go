@@ -0,0 +1,124 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package portmap
+
+import (
+	"net"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// sharedAddrSpace is the Shared Address Space of carrier-grade NATs (RFC
+// 6598).
+var sharedAddrSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// CGNATReport is the outcome of DetectCGNAT. The addresses are nil if they
+// could not be found.
+type CGNATReport struct {
+	NAT       stun.NATType // NAT type discovered via STUN
+	LocalIP   net.IP       // local address towards the gateway
+	GatewayIP net.IP       // address of the default gateway
+	MappedIP  net.IP       // mapped address discovered via STUN
+
+	// GatewayExternalIP is the external address the gateway reports via
+	// NAT-PMP, which tells the NAT of the gateway from the NATs beyond.
+	GatewayExternalIP net.IP
+
+	// CGNAT reports whether the host is likely behind a carrier-grade
+	// NAT, and DoubleNAT whether it is likely behind more than one level
+	// of NAT. Reason explains the verdict.
+	CGNAT     bool
+	DoubleNAT bool
+	Reason    string
+}
+
+// DetectCGNAT runs the STUN discovery with the client and compares the
+// local address, the address space of the default gateway and the mapped
+// address, and the external address of the gateway if it supports NAT-PMP,
+// to tell whether the host is behind a carrier-grade NAT, whose addresses
+// are in the Shared Address Space 100.64.0.0/10 of RFC 6598, or behind
+// layered NATs. It is a heuristic for IPv4: a carrier-grade NAT with private
+// addresses behind a home gateway without NAT-PMP looks like a single NAT.
+func DetectCGNAT(client *stun.Client) (*CGNATReport, error) {
+	r := &CGNATReport{}
+	gateway, err := DefaultGateway()
+	extIP := make(chan net.IP, 1)
+	if err == nil {
+		r.GatewayIP = gateway
+		r.LocalIP, _ = localIPTo(gateway)
+		// The gateway is queried while the discovery runs.
+		go func() {
+			ip, _ := natpmpExternalIP(gateway)
+			extIP <- ip
+		}()
+	} else {
+		extIP <- nil
+	}
+	nat, host, err := client.Discover()
+	r.GatewayExternalIP = <-extIP
+	if err != nil {
+		return nil, err
+	}
+	r.NAT = nat
+	if host != nil {
+		r.MappedIP = net.ParseIP(host.IP())
+	}
+	r.classify()
+	return r, nil
+}
+
+// classify sets the verdict of the report from its addresses.
+func (r *CGNATReport) classify() {
+	mapped := r.MappedIP.To4()
+	switch {
+	case mapped == nil:
+		r.Reason = "no IPv4 mapped address"
+	case r.LocalIP != nil && r.LocalIP.Equal(mapped):
+		r.Reason = "the local address is the mapped address, there is no NAT"
+	case isSharedAddr(r.LocalIP):
+		r.CGNAT = true
+		r.Reason = "the local address " + r.LocalIP.String() + " is in the shared address space"
+	case isSharedAddr(r.GatewayIP):
+		r.CGNAT = true
+		r.DoubleNAT = isPrivate(r.LocalIP)
+		r.Reason = "the gateway " + r.GatewayIP.String() + " is in the shared address space"
+	case isSharedAddr(r.GatewayExternalIP):
+		r.CGNAT, r.DoubleNAT = true, true
+		r.Reason = "the external address " + r.GatewayExternalIP.String() + " of the gateway is in the shared address space"
+	case r.GatewayExternalIP != nil && isPrivate(r.GatewayExternalIP):
+		r.DoubleNAT = true
+		r.Reason = "the external address " + r.GatewayExternalIP.String() + " of the gateway is private"
+	case r.GatewayExternalIP != nil && !r.GatewayExternalIP.Equal(mapped):
+		r.DoubleNAT = true
+		r.Reason = "the external address " + r.GatewayExternalIP.String() + " of the gateway is not the mapped address"
+	case isSharedAddr(mapped):
+		r.CGNAT = true
+		r.Reason = "the mapped address " + mapped.String() + " is in the shared address space, the STUN server is inside the carrier network"
+	case isPrivate(mapped):
+		r.Reason = "the mapped address " + mapped.String() + " is private, the STUN server is not on the Internet"
+	default:
+		r.Reason = "no sign of a carrier-grade or layered NAT"
+	}
+}
+
+func isSharedAddr(ip net.IP) bool {
+	return ip != nil && sharedAddrSpace.Contains(ip)
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip != nil && ip.IsPrivate()
+}
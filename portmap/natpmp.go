@@ -0,0 +1,95 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const natpmpPort = 5351
+
+// MapNATPMP requests a mapping from the gateway via NAT-PMP (RFC 6886). A
+// lifetime of 0 deletes the mapping of internalPort.
+func MapNATPMP(gateway net.IP, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	var op byte
+	switch protocol {
+	case "udp":
+		op = 1
+	case "tcp":
+		op = 2
+	default:
+		return nil, ErrProtocol
+	}
+	var extIP net.IP
+	if lifetime > 0 {
+		var err error
+		if extIP, err = natpmpExternalIP(gateway); err != nil {
+			return nil, err
+		}
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := exchange(gateway, natpmpPort, req, natpmpCheck(op, 16))
+	if err != nil {
+		return nil, err
+	}
+	if err = natpmpResult(resp); err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Method:       MethodNATPMP,
+		Protocol:     protocol,
+		Gateway:      gateway,
+		InternalPort: int(binary.BigEndian.Uint16(resp[8:10])),
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:12])),
+		ExternalIP:   extIP,
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second,
+	}, nil
+}
+
+// natpmpExternalIP requests the external address of the gateway via
+// NAT-PMP.
+func natpmpExternalIP(gateway net.IP) (net.IP, error) {
+	resp, err := exchange(gateway, natpmpPort, []byte{0, 0}, natpmpCheck(0, 12))
+	if err != nil {
+		return nil, err
+	}
+	if err = natpmpResult(resp); err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), resp[8:12]...)), nil
+}
+
+// natpmpCheck accepts version 0 responses to the opcode op.
+func natpmpCheck(op byte, length int) func([]byte) bool {
+	return func(b []byte) bool {
+		return len(b) >= length && b[0] == 0 && b[1] == 128+op
+	}
+}
+
+func natpmpResult(resp []byte) error {
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	pcpPort    = 5351
+	pcpVersion = 2
+	pcpOpMap   = 1
+	pcpLength  = 60 // header and MAP opcode
+)
+
+// ErrPCPUnsupported is returned when the gateway only speaks NAT-PMP.
+var ErrPCPUnsupported = errors.New("PCP is not supported by the gateway")
+
+// MapPCP requests a mapping from the gateway via the MAP opcode of PCP (RFC
+// 6887).
+func MapPCP(gateway net.IP, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pcpMap(gateway, protocol, internalPort, externalPort, lifetime, nonce)
+}
+
+func pcpMap(gateway net.IP, protocol string, internalPort, externalPort int, lifetime time.Duration, nonce []byte) (*Mapping, error) {
+	proto, err := protocolNumber(protocol)
+	if err != nil {
+		return nil, err
+	}
+	clientIP, err := localIPTo(gateway)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, pcpLength)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], clientIP.To16())
+	copy(req[24:36], nonce)
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:44], uint16(externalPort))
+	copy(req[44:60], net.IPv4zero.To16())
+	resp, err := exchange(gateway, pcpPort, req, func(b []byte) bool {
+		// A NAT-PMP only gateway answers with version 0.
+		if len(b) >= 4 && b[0] == 0 {
+			return true
+		}
+		return len(b) >= pcpLength && b[0] == pcpVersion &&
+			b[1] == 0x80|pcpOpMap && bytes.Equal(b[24:36], nonce)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pcpVersion {
+		return nil, ErrPCPUnsupported
+	}
+	if resp[3] != 0 {
+		return nil, fmt.Errorf("PCP result code %d", resp[3])
+	}
+	extIP := net.IP(append([]byte(nil), resp[44:60]...))
+	if ip4 := extIP.To4(); ip4 != nil {
+		extIP = ip4
+	}
+	return &Mapping{
+		Method:       MethodPCP,
+		Protocol:     protocol,
+		Gateway:      gateway,
+		InternalPort: int(binary.BigEndian.Uint16(resp[40:42])),
+		ExternalPort: int(binary.BigEndian.Uint16(resp[42:44])),
+		ExternalIP:   extIP,
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second,
+		nonce:        nonce,
+	}, nil
+}
+
+// localIPTo returns the local address used to reach the gateway.
+func localIPTo(gateway net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gateway, Port: pcpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package portmap requests port mappings from the gateway via PCP (RFC
+// 6887), NAT-PMP (RFC 6886) and UPnP IGD. It is intended as the fallback when
+// the STUN discovery reports a NAT type which makes UDP hole punching
+// unlikely to work. DetectCGNAT tells whether the NAT is a carrier-grade or
+// layered one, where mappings of the gateway are not enough.
+//
+//	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 5000})
+//	client := stun.NewClientWithConnection(conn)
+//	result, err := portmap.Discover(client, 5000, time.Hour)
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// Port mapping methods.
+const (
+	MethodPCP    = "pcp"
+	MethodNATPMP = "nat-pmp"
+	MethodUPnP   = "upnp"
+)
+
+var (
+	// ErrNoGateway is returned when the default gateway is not found.
+	ErrNoGateway = errors.New("no default gateway found")
+	// ErrNoResponse is returned when the gateway does not respond.
+	ErrNoResponse = errors.New("no response from the gateway")
+	// ErrProtocol is returned for protocols other than "udp" and "tcp".
+	ErrProtocol = errors.New("protocol must be udp or tcp")
+)
+
+// Mapping is a port mapping granted by the gateway.
+type Mapping struct {
+	Method       string        // method which created the mapping
+	Protocol     string        // "udp" or "tcp"
+	Gateway      net.IP        // address of the gateway
+	InternalPort int           // local port
+	ExternalPort int           // port on the external address
+	ExternalIP   net.IP        // external address, may be nil for UPnP
+	Lifetime     time.Duration // lifetime granted, 0 means infinite
+
+	nonce       []byte // PCP mapping nonce
+	controlURL  string // UPnP control URL
+	serviceType string // UPnP service type
+}
+
+// External returns the external transport address of the mapping.
+func (m *Mapping) External() string {
+	return net.JoinHostPort(m.ExternalIP.String(), fmt.Sprint(m.ExternalPort))
+}
+
+// Map requests a mapping of the local port internalPort from the default
+// gateway. externalPort is the suggested external port, 0 means no
+// preference. PCP, NAT-PMP and UPnP IGD are tried in order and the first
+// granted mapping is returned.
+func Map(protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	if protocol != "udp" && protocol != "tcp" {
+		return nil, ErrProtocol
+	}
+	gateway, err := DefaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	m, pcpErr := MapPCP(gateway, protocol, internalPort, externalPort, lifetime)
+	if pcpErr == nil {
+		return m, nil
+	}
+	m, natpmpErr := MapNATPMP(gateway, protocol, internalPort, externalPort, lifetime)
+	if natpmpErr == nil {
+		return m, nil
+	}
+	m, upnpErr := MapUPnP(protocol, internalPort, externalPort, lifetime)
+	if upnpErr == nil {
+		return m, nil
+	}
+	return nil, fmt.Errorf("all methods failed: pcp: %v; nat-pmp: %v; upnp: %v",
+		pcpErr, natpmpErr, upnpErr)
+}
+
+// Delete removes the mapping from the gateway.
+func Delete(m *Mapping) error {
+	switch m.Method {
+	case MethodPCP:
+		_, err := pcpMap(m.Gateway, m.Protocol, m.InternalPort, 0, 0, m.nonce)
+		return err
+	case MethodNATPMP:
+		_, err := MapNATPMP(m.Gateway, m.Protocol, m.InternalPort, 0, 0)
+		return err
+	case MethodUPnP:
+		return upnpDelete(m)
+	}
+	return fmt.Errorf("unknown method %q", m.Method)
+}
+
+// Result is the result of the STUN discovery together with the port mapping
+// attempted for it.
+type Result struct {
+	NAT     stun.NATType // NAT type discovered via STUN
+	Host    *stun.Host   // mapped address discovered via STUN
+	Mapping *Mapping     // port mapping, nil if not needed or failed
+	MapErr  error        // error of the port mapping, if any
+}
+
+// Discover performs the STUN discovery with the client and, if the NAT is
+// symmetric or port restricted, requests a UDP mapping of internalPort, which
+// should be the local port of the connection used by the client.
+func Discover(client *stun.Client, internalPort int, lifetime time.Duration) (*Result, error) {
+	nat, host, err := client.Discover()
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{NAT: nat, Host: host}
+	if nat == stun.NATSymmetric || nat == stun.NATPortRestricted {
+		result.Mapping, result.MapErr = Map("udp", internalPort, 0, lifetime)
+	}
+	return result, nil
+}
+
+// exchange sends req to the gateway and returns the first response accepted
+// by check. The request is retransmitted starting with an interval of 250ms,
+// doubling every retransmit, as required by RFC 6886 and RFC 6887.
+func exchange(gateway net.IP, port int, req []byte, check func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gateway, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	timeout := initialTimeout
+	buf := make([]byte, maxPacketSize)
+	for i := 0; i < numRetransmit; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		timeout *= 2
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if check(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+	return nil, ErrNoResponse
+}
+
+const (
+	numRetransmit  = 4
+	initialTimeout = 250 * time.Millisecond
+	maxPacketSize  = 1100
+)
+
+func protocolNumber(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return 17, nil
+	case "tcp":
+		return 6, nil
+	}
+	return 0, ErrProtocol
+}
@@ -0,0 +1,80 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package portmap
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseProcRoute(t *testing.T) {
+	route := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\n" +
+		"eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\n"
+	ip, err := parseProcRoute(strings.NewReader(route))
+	if err != nil {
+		t.Fatalf("parseProcRoute error: %v", err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("parseProcRoute error: got %v", ip)
+	}
+	_, err = parseProcRoute(strings.NewReader(route[:strings.LastIndex(route[:len(route)-1], "\n")+1]))
+	if err != ErrNoGateway {
+		t.Errorf("parseProcRoute error: expected ErrNoGateway, got %v", err)
+	}
+}
+
+func TestXMLValue(t *testing.T) {
+	b := []byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">` +
+		`<s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">` +
+		`<NewExternalIPAddress>1.2.3.4</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	if v := xmlValue(b, "NewExternalIPAddress"); v != "1.2.3.4" {
+		t.Errorf("xmlValue error: got %q", v)
+	}
+	if v := xmlValue(b, "errorCode"); v != "" {
+		t.Errorf("xmlValue error: got %q", v)
+	}
+}
+
+func TestClassifyCGNAT(t *testing.T) {
+	ip := func(s string) net.IP {
+		if s == "" {
+			return nil
+		}
+		return net.ParseIP(s)
+	}
+	for _, tt := range []struct {
+		local, gateway, external, mapped string
+		cgnat, double                    bool
+	}{
+		{"203.0.113.5", "203.0.113.1", "", "203.0.113.5", false, false},
+		{"192.168.1.5", "192.168.1.1", "", "203.0.113.5", false, false},
+		{"192.168.1.5", "192.168.1.1", "203.0.113.5", "203.0.113.5", false, false},
+		{"100.64.3.5", "100.64.0.1", "", "203.0.113.5", true, false},
+		{"192.168.1.5", "192.168.1.1", "100.72.9.1", "203.0.113.5", true, true},
+		{"192.168.1.5", "192.168.1.1", "10.1.2.3", "203.0.113.5", false, true},
+		{"192.168.1.5", "192.168.1.1", "198.51.100.7", "203.0.113.5", false, true},
+		{"192.168.1.5", "", "", "100.65.0.1", true, false},
+	} {
+		r := &CGNATReport{LocalIP: ip(tt.local), GatewayIP: ip(tt.gateway), GatewayExternalIP: ip(tt.external), MappedIP: ip(tt.mapped)}
+		r.classify()
+		if r.CGNAT != tt.cgnat || r.DoubleNAT != tt.double || r.Reason == "" {
+			t.Errorf("classify %+v error: get CGNAT %v, double NAT %v: %s", tt, r.CGNAT, r.DoubleNAT, r.Reason)
+		}
+	}
+}
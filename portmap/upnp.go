@@ -0,0 +1,280 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTarget  = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpTimeout = 3 * time.Second
+)
+
+// ErrNoIGD is returned when no UPnP internet gateway device is found.
+var ErrNoIGD = errors.New("no UPnP internet gateway device found")
+
+// upnpServiceTypes are the services which provide AddPortMapping.
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// find returns the first service of the given type in the device tree.
+func (d *upnpDevice) find(serviceType string) *upnpService {
+	for i := range d.Services {
+		if d.Services[i].ServiceType == serviceType {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].find(serviceType); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// MapUPnP requests a mapping via the AddPortMapping action of the first UPnP
+// internet gateway device found on the local network.
+func MapUPnP(protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	if protocol != "udp" && protocol != "tcp" {
+		return nil, ErrProtocol
+	}
+	location, err := ssdpSearch()
+	if err != nil {
+		return nil, err
+	}
+	controlURL, serviceType, err := upnpControl(location)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	gateway := net.ParseIP(host)
+	clientIP, err := localIPTo(gateway)
+	if err != nil {
+		return nil, err
+	}
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	_, err = upnpCall(controlURL, serviceType, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", strconv.Itoa(internalPort)},
+		{"NewInternalClient", clientIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "go-stun"},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{
+		Method:       MethodUPnP,
+		Protocol:     protocol,
+		Gateway:      gateway,
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+		Lifetime:     lifetime,
+		controlURL:   controlURL,
+		serviceType:  serviceType,
+	}
+	// The external address is informational, so failures are not fatal.
+	if resp, err := upnpCall(controlURL, serviceType, "GetExternalIPAddress", nil); err == nil {
+		m.ExternalIP = net.ParseIP(xmlValue(resp, "NewExternalIPAddress"))
+	}
+	return m, nil
+}
+
+func upnpDelete(m *Mapping) error {
+	_, err := upnpCall(m.controlURL, m.serviceType, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+		{"NewProtocol", strings.ToUpper(m.Protocol)},
+	})
+	return err
+}
+
+// ssdpSearch multicasts an SSDP M-SEARCH for internet gateway devices and
+// returns the location of the device description of the first answer.
+func ssdpSearch() (string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + ssdpTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(req), addr); err != nil {
+		return "", err
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(upnpTimeout)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return "", ErrNoIGD
+			}
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// upnpControl fetches the device description and returns the control URL
+// and the type of the service providing port mappings.
+func upnpControl(location string) (string, string, error) {
+	client := &http.Client{Timeout: upnpTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var root upnpRoot
+	if err = xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return "", "", err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	for _, serviceType := range upnpServiceTypes {
+		if s := root.Device.find(serviceType); s != nil {
+			u, err := base.Parse(s.ControlURL)
+			if err != nil {
+				return "", "", err
+			}
+			return u.String(), serviceType, nil
+		}
+	}
+	return "", "", ErrNoIGD
+}
+
+// upnpCall invokes the SOAP action of the service and returns the response
+// body. Arguments are sent in order, as some devices require.
+func upnpCall(controlURL, serviceType, action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		if err := xml.EscapeText(&body, []byte(arg[1])); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequest("POST", controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, serviceType, action))
+	client := &http.Client{Timeout: upnpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP %s: %s (error code %s)", action, resp.Status, xmlValue(b, "errorCode"))
+	}
+	return b, nil
+}
+
+// xmlValue returns the text of the first element with the local name.
+func xmlValue(b []byte, name string) string {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == name {
+			var v string
+			if d.DecodeElement(&v, &se) != nil {
+				return ""
+			}
+			return strings.TrimSpace(v)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package serve exposes the STUN discovery over HTTP, so monitoring systems
+// and programs in other languages can query the NAT status of the host
+// without linking the library.
+//
+//	http.Handle("/", serve.NewHandler(serve.Config{
+//		Servers: []string{"stun.ekiga.net:3478"},
+//	}))
+//
+// The handler answers GET requests of two endpoints with JSON:
+//
+//	/discover  the stun.DiscoveryResult of a discovery
+//	/ip        {"ip": "203.0.113.7"}, the external IP, in a single round trip
+//
+// The optional query parameter server selects one of the configured servers.
+// Failures are answered with {"error": "..."}.
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// Defaults of Config.
+const (
+	DefaultTimeout       = 10 * time.Second
+	DefaultMaxConcurrent = 4
+)
+
+// Config configures a Handler.
+type Config struct {
+	// Servers are the STUN servers the clients may query, the first one
+	// being the default. Other servers are refused, so the handler cannot
+	// be used to send packets anywhere. If empty, NewHandler selects the
+	// best of stun.PublicServers once, stun.DefaultServerAddr if none
+	// answers, and the server parameter is refused.
+	Servers []string
+
+	// Timeout limits each discovery, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// MaxConcurrent is the number of discoveries run at the same time,
+	// DefaultMaxConcurrent if zero. Further requests wait for a slot
+	// until they are canceled.
+	MaxConcurrent int
+
+	// Configure, if not nil, configures the client of each request, e.g.
+	// with SetLocalAddr or SetCredential, before its server is set.
+	Configure func(*stun.Client)
+}
+
+// Handler is an http.Handler running discoveries on demand.
+type Handler struct {
+	cfg           Config
+	defaultServer string        // the server of the requests without one
+	sem           chan struct{} // slots of the concurrent discoveries
+	mux           *http.ServeMux
+}
+
+// NewHandler returns a handler with the config.
+func NewHandler(cfg Config) *Handler {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = DefaultMaxConcurrent
+	}
+	h := &Handler{cfg: cfg, sem: make(chan struct{}, cfg.MaxConcurrent), mux: http.NewServeMux()}
+	if len(cfg.Servers) > 0 {
+		h.defaultServer = cfg.Servers[0]
+	} else {
+		h.defaultServer = selectDefault(cfg)
+	}
+	h.mux.HandleFunc("/discover", h.discover)
+	h.mux.HandleFunc("/ip", h.externalIP)
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) discover(w http.ResponseWriter, r *http.Request) {
+	c, ctx, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	result, err := c.DiscoverResultContext(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) externalIP(w http.ResponseWriter, r *http.Request) {
+	c, ctx, done, ok := h.client(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	ip, err := c.ExternalIP(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		IP string `json:"ip"`
+	}{ip.String()})
+}
+
+// client checks the request and waits for a slot, returning the client for
+// the server of the request and the context of the discovery, which done
+// releases. It answers the request itself if ok is false.
+func (h *Handler) client(w http.ResponseWriter, r *http.Request) (c *stun.Client, ctx context.Context, done func(), ok bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return nil, nil, nil, false
+	}
+	server, ok := h.server(r.URL.Query().Get("server"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "server not allowed")
+		return nil, nil, nil, false
+	}
+	select {
+	case h.sem <- struct{}{}:
+	case <-r.Context().Done():
+		writeError(w, http.StatusServiceUnavailable, r.Context().Err().Error())
+		return nil, nil, nil, false
+	}
+	c = stun.NewClient()
+	if h.cfg.Configure != nil {
+		h.cfg.Configure(c)
+	}
+	c.SetServerAddr(server)
+	ctx, cancel := context.WithTimeout(r.Context(), h.cfg.Timeout)
+	return c, ctx, func() {
+		cancel()
+		c.Close()
+		<-h.sem
+	}, true
+}
+
+// selectDefault returns the best of stun.PublicServers for a client
+// configured with the config, stun.DefaultServerAddr if none answers.
+func selectDefault(cfg Config) string {
+	c := stun.NewClient()
+	defer c.Close()
+	if cfg.Configure != nil {
+		cfg.Configure(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	server, err := c.SelectBest(ctx, stun.PublicServers)
+	if err != nil {
+		return stun.DefaultServerAddr
+	}
+	return server
+}
+
+// server returns the server to query for the parameter, the default one if
+// it is empty.
+func (h *Handler) server(param string) (string, bool) {
+	if param == "" {
+		return h.defaultServer, true
+	}
+	for _, s := range h.cfg.Servers {
+		if s == param {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,113 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package serve
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func TestHandler(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := stun.NewServer(conn)
+	go s.Serve()
+	defer s.Close()
+	h := NewHandler(Config{
+		Servers: []string{conn.LocalAddr().String()},
+		Timeout: 2 * time.Second,
+		Configure: func(c *stun.Client) {
+			c.SetLocalAddr("127.0.0.1:0")
+			c.SetTestTimeout(300 * time.Millisecond)
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ip")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	var ip struct{ IP string }
+	err = json.NewDecoder(resp.Body).Decode(&ip)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || ip.IP != "127.0.0.1" {
+		t.Errorf("/ip error: %d %+v %v", resp.StatusCode, ip, err)
+	}
+
+	resp, err = http.Get(ts.URL + "/discover?server=" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	var result stun.DiscoveryResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(result.Hosts) == 0 || result.Hosts[0].IP() != "127.0.0.1" {
+		t.Errorf("/discover error: %d %+v %v", resp.StatusCode, result, err)
+	}
+
+	// Other servers are refused.
+	resp, err = http.Get(ts.URL + "/discover?server=192.0.2.1:3478")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("server parameter error: expected %d, get %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, err = http.Post(ts.URL+"/ip", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Post error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("method error: expected %d, get %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestHandlerDefaultServer(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := stun.NewServer(conn)
+	go s.Serve()
+	defer s.Close()
+	defer func(servers []string) { stun.PublicServers = servers }(stun.PublicServers)
+	stun.PublicServers = []string{"127.0.0.1:1", conn.LocalAddr().String()}
+	cfg := Config{
+		Timeout: 500 * time.Millisecond,
+		Configure: func(c *stun.Client) {
+			c.SetLocalAddr("127.0.0.1:0")
+		},
+	}
+	if h := NewHandler(cfg); h.defaultServer != conn.LocalAddr().String() {
+		t.Errorf("default server error: expected %v, get %v", conn.LocalAddr(), h.defaultServer)
+	}
+	stun.PublicServers = []string{"127.0.0.1:1"}
+	if h := NewHandler(cfg); h.defaultServer != stun.DefaultServerAddr {
+		t.Errorf("default server error: expected %v, get %v", stun.DefaultServerAddr, h.defaultServer)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxDatagramSize is the size of the datagrams read by the adapters, which
+// return io.ErrShortBuffer for those longer than the buffer of the reader.
+const maxDatagramSize = 65536
+
+// PacketConnFromConn adapts a connected datagram connection, such as the
+// net.Conn of an ICE agent, a QUIC datagram path or a socket of a userspace
+// WireGuard stack, to a net.PacketConn for NewClientWithConnection. Reads
+// return the remote address of conn, and writes go to it whatever their
+// address, so the server address of the client must be the remote one.
+// Datagrams longer than the buffer of a read are discarded with
+// io.ErrShortBuffer, which the client skips.
+func PacketConnFromConn(conn net.Conn) net.PacketConn {
+	return &connectedConn{conn: conn, buf: make([]byte, maxDatagramSize)}
+}
+
+type connectedConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	buf  []byte
+}
+
+func (c *connectedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > len(b) {
+		return 0, c.conn.RemoteAddr(), io.ErrShortBuffer
+	}
+	return copy(b, c.buf[:n]), c.conn.RemoteAddr(), nil
+}
+
+func (c *connectedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.conn.Write(b)
+}
+
+func (c *connectedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *connectedConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *connectedConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *connectedConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *connectedConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// WrapPacketConn returns a net.PacketConn emulating the read and write
+// deadlines for conn, whose deadline methods may fail or be ignored, as for
+// some multiplexers and tunnels. The client relies on the read deadlines to
+// retransmit, and sets write deadlines so writes blocked by a congested
+// transport do not stall it. A goroutine reads conn until the wrapper is
+// closed, so conn must not be read by others; datagrams longer than the
+// buffer of a read are discarded with io.ErrShortBuffer.
+func WrapPacketConn(conn net.PacketConn) net.PacketConn {
+	d := &deadlineConn{
+		conn:    conn,
+		packets: make(chan datagram),
+		closed:  make(chan struct{}),
+		rd:      newDeadline(),
+		wd:      newDeadline(),
+	}
+	go d.readLoop()
+	return d
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+	err  error
+}
+
+type deadlineConn struct {
+	conn      net.PacketConn
+	packets   chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+	rd        *deadline
+	wd        *deadline
+}
+
+// readLoop reads the datagrams of conn until it fails, handing each to a
+// reader.
+func (d *deadlineConn) readLoop() {
+	for {
+		b := make([]byte, maxDatagramSize)
+		n, addr, err := d.conn.ReadFrom(b)
+		select {
+		case d.packets <- datagram{b[:n], addr, err}:
+		case <-d.closed:
+			return
+		}
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (d *deadlineConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-d.packets:
+		if p.err != nil {
+			return 0, p.addr, p.err
+		}
+		if len(p.b) > len(b) {
+			return 0, p.addr, io.ErrShortBuffer
+		}
+		return copy(b, p.b), p.addr, nil
+	case <-d.rd.wait():
+		return 0, nil, d.opError("read", os.ErrDeadlineExceeded)
+	case <-d.closed:
+		return 0, nil, d.opError("read", net.ErrClosed)
+	}
+}
+
+func (d *deadlineConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-d.wd.wait():
+		return 0, d.opError("write", os.ErrDeadlineExceeded)
+	default:
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := d.conn.WriteTo(b, addr)
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-d.wd.wait():
+		return 0, d.opError("write", os.ErrDeadlineExceeded)
+	}
+}
+
+func (d *deadlineConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: d.conn.LocalAddr(), Err: err}
+}
+
+func (d *deadlineConn) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return d.conn.Close()
+}
+
+func (d *deadlineConn) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *deadlineConn) SetDeadline(t time.Time) error {
+	d.rd.set(t)
+	d.wd.set(t)
+	return nil
+}
+
+func (d *deadlineConn) SetReadDeadline(t time.Time) error {
+	d.rd.set(t)
+	return nil
+}
+
+func (d *deadlineConn) SetWriteDeadline(t time.Time) error {
+	d.wd.set(t)
+	return nil
+}
+
+// deadline is a deadline whose channel is closed once it passes, which
+// setting it again resets.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{done: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, the channel is closed or about to be.
+		d.done = make(chan struct{})
+	}
+	select {
+	case <-d.done:
+		d.done = make(chan struct{})
+	default:
+	}
+	d.timer = nil
+	if t.IsZero() {
+		return
+	}
+	done := d.done
+	if dur := time.Until(t); dur > 0 {
+		d.timer = time.AfterFunc(dur, func() { close(done) })
+		return
+	}
+	close(done)
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.done
+}
+
+// OnForeignPacket sets a callback which is passed the packets the client
+// reads while waiting for responses which are not responses of its
+// transactions: those which are not STUN messages, and the STUN messages of
+// other transactions, such as the connectivity checks of ICE peers. When the
+// connection of the client is shared with other protocols, such as DTLS or
+// media, the callback hands their packets back to the transport stack. The
+// packet is valid during the call only. A nil callback drops them.
+func (c *Client) OnForeignPacket(f func(b []byte, addr net.Addr)) {
+	c.onForeign = f
+}
+
+func (c *Client) foreign(b []byte, addr net.Addr) {
+	if c.onForeign != nil {
+		c.onForeign(b, addr)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// noDeadlineConn is a connection whose deadlines are not supported.
+type noDeadlineConn struct {
+	net.PacketConn
+}
+
+var errNoDeadline = errors.New("deadlines not supported")
+
+func (noDeadlineConn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (noDeadlineConn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (noDeadlineConn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
+
+func TestWrapPacketConn(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer peer.Close()
+	// An oversized packet and a packet of another protocol arrive before
+	// the response.
+	peer.WriteTo(make([]byte, 2*maxPacketSize), conn.LocalAddr())
+	peer.WriteTo([]byte("media"), conn.LocalAddr())
+	wrapped := WrapPacketConn(noDeadlineConn{conn})
+	defer wrapped.Close()
+	c := NewClientWithConnection(wrapped)
+	c.SetServerAddr(addr.String())
+	var foreign []string
+	c.OnForeignPacket(func(b []byte, from net.Addr) {
+		foreign = append(foreign, string(b))
+	})
+	host, err := c.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if host.String() != conn.LocalAddr().String() {
+		t.Errorf("mapped address error: expected %v, get %v", conn.LocalAddr(), host)
+	}
+	if len(foreign) != 1 || foreign[0] != "media" || c.Stats().Malformed != 2 {
+		t.Errorf("foreign packets error: %q, stats %+v", foreign, c.Stats())
+	}
+	// The read deadlines are emulated, so an unanswered request times out.
+	c.SetServerAddr(peer.LocalAddr().String())
+	c.SetTestTimeout(200 * time.Millisecond)
+	start := time.Now()
+	if _, err = c.Keepalive(); err == nil {
+		t.Errorf("Keepalive error: expected a timeout")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Keepalive timeout error: took %v", d)
+	}
+}
+
+func TestPacketConnFromConn(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, addr)
+	if err != nil {
+		t.Fatalf("DialUDP error: %v", err)
+	}
+	pc := PacketConnFromConn(conn)
+	defer pc.Close()
+	c := NewClientWithConnection(pc)
+	c.SetServerAddr(addr.String())
+	host, err := c.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if host.String() != conn.LocalAddr().String() {
+		t.Errorf("mapped address error: expected %v, get %v", conn.LocalAddr(), host)
+	}
+}
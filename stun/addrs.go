@@ -0,0 +1,72 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrNoAddr is returned by DiscoverAddrs without addresses.
+var ErrNoAddr = errors.New("no server address")
+
+// DiscoverAddrs performs the discovery with the resolved addresses of the
+// server, tried in order until one answers, without resolving any name: the
+// server address of the client is ignored, and the changed address of the
+// server is used as the IP in the response. It is meant for callers which
+// resolve and pin the addresses themselves, e.g. against DNS rebinding. The
+// result is never nil, even if an error is returned.
+func (c *Client) DiscoverAddrs(addrs []*net.UDPAddr) (*DiscoveryResult, error) {
+	return c.DiscoverAddrsContext(context.Background(), addrs)
+}
+
+// DiscoverAddrsContext is DiscoverAddrs with a context, which aborts the
+// discovery with the error of the context once it is done.
+func (c *Client) DiscoverAddrsContext(ctx context.Context, addrs []*net.UDPAddr) (*DiscoveryResult, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	r, err := &DiscoveryResult{NAT: NATError}, ErrNoAddr
+	for _, addr := range addrs {
+		r, err = c.discoverAddr(ctx, addr)
+		if ctx.Err() != nil {
+			return r, err
+		}
+		if err == nil && r.NAT != NATBlocked {
+			c.storeResult(addr.String(), r)
+			return r, nil
+		}
+		c.logger.Debugln("Server", addr, "failed:", r.NAT, err)
+	}
+	return r, err
+}
+
+// discoverAddr performs the discovery with the address.
+func (c *Client) discoverAddr(ctx context.Context, addr *net.UDPAddr) (*DiscoveryResult, error) {
+	r := &DiscoveryResult{NAT: NATError}
+	ctx, loss := withLossCounter(ctx)
+	defer func() { r.Loss = loss.snapshot() }()
+	conn, done, err := c.listen(addr)
+	if err != nil {
+		return r, err
+	}
+	defer done()
+	r.LocalAddr = newHostFromStr(conn.LocalAddr().String())
+	r.NAT, r.Hosts, err = c.discoverAll(ctx, conn, addr, r)
+	r.detectNAT64(addr)
+	return r, err
+}
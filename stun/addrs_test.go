@@ -0,0 +1,56 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoverAddrs(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	// Nothing listens on the first address, so the second one is used.
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	deadAddr := dead.LocalAddr().(*net.UDPAddr)
+	dead.Close()
+	c := NewClient()
+	// The server address must not be resolved.
+	c.SetServerAddr("invalid.invalid:3478")
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetTestTimeout(200 * time.Millisecond)
+	store := &MemoryStore{}
+	c.SetResultStore(store)
+	r, err := c.DiscoverAddrs([]*net.UDPAddr{deadAddr, addr})
+	if err != nil {
+		t.Fatalf("DiscoverAddrs error: %v", err)
+	}
+	if r.NAT == NATBlocked || r.NAT == NATError {
+		t.Errorf("NAT type error: get %v", r.NAT)
+	}
+	records, _ := store.Records()
+	if len(records) != 1 || records[0].Server != addr.String() {
+		t.Errorf("store error: expected a record of %v, get %v", addr, records)
+	}
+	if _, err := c.DiscoverAddrs(nil); err != ErrNoAddr {
+		t.Errorf("DiscoverAddrs error: expected %v, get %v", ErrNoAddr, err)
+	}
+}
@@ -31,22 +31,69 @@ type attribute struct {
 func newAttribute(types uint16, value []byte) *attribute {
 	att := new(attribute)
 	att.types = types
+	// The length is the length of the value prior to padding, as required
+	// by RFC 5389, the padding is accounted for by packet.addAttribute.
+	att.length = uint16(len(value))
 	att.value = padding(value)
-	att.length = uint16(len(att.value))
 	return att
 }
 
 func newFingerprintAttribute(packet *packet) *attribute {
-	crc := crc32.ChecksumIEEE(packet.bytes()) ^ fingerprint
+	b := getBuffer()
+	crc := crc32.ChecksumIEEE(packet.appendTo(*b)) ^ fingerprint
+	putBuffer(b)
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, crc)
 	return newAttribute(attributeFingerprint, buf)
 }
 
+// verifyFingerprint checks the FINGERPRINT attribute of the raw packet, which
+// must be the last attribute (RFC 5389 Section 15.5).
+func verifyFingerprint(packetBytes []byte) bool {
+	n := len(packetBytes)
+	if n < 28 || binary.BigEndian.Uint16(packetBytes[n-8:]) != attributeFingerprint ||
+		binary.BigEndian.Uint16(packetBytes[n-6:]) != 4 {
+		return false
+	}
+	return crc32.ChecksumIEEE(packetBytes[:n-8])^fingerprint == binary.BigEndian.Uint32(packetBytes[n-4:])
+}
+
 func newSoftwareAttribute(name string) *attribute {
 	return newAttribute(attributeSoftware, []byte(name))
 }
 
+func newUsernameAttribute(username string) *attribute {
+	return newAttribute(attributeUsername, []byte(username))
+}
+
+func newErrorCodeAttribute(code int, reason string) *attribute {
+	value := make([]byte, 4, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+	value = append(value, reason...)
+	return newAttribute(attributeErrorCode, value)
+}
+
+func newUnknownAttributesAttribute(types []uint16) *attribute {
+	value := make([]byte, 2*len(types))
+	for i, t := range types {
+		binary.BigEndian.PutUint16(value[2*i:], t)
+	}
+	return newAttribute(attributeUnknownAttributes, value)
+}
+
+// newPaddingAttribute returns a PADDING attribute with n bytes of value (RFC
+// 5780 Section 7.6).
+func newPaddingAttribute(n int) *attribute {
+	return newAttribute(attributePadding, make([]byte, n))
+}
+
+func newResponsePortAttribute(port uint16) *attribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint16(value, port)
+	return newAttribute(attributeResponsePort, value)
+}
+
 func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
 	value := make([]byte, 4)
 	if changeIP {
@@ -104,3 +151,35 @@ func (v *attribute) rawAddr() *Host {
 	host.ip = net.IP(v.value[4:]).String()
 	return host
 }
+
+// newAddrAttribute encodes the address into a MAPPED-ADDRESS style
+// attribute (RFC 5389 Section 15.1).
+func newAddrAttribute(types uint16, addr *net.UDPAddr) *attribute {
+	family, ip := addrFamily(addr.IP)
+	value := make([]byte, 4, 4+len(ip))
+	value[1] = byte(family)
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	value = append(value, ip...)
+	return newAttribute(types, value)
+}
+
+// newXorAddrAttribute encodes the address into a XOR-MAPPED-ADDRESS style
+// attribute (RFC 5389 Section 15.2).
+func newXorAddrAttribute(types uint16, addr *net.UDPAddr, transID []byte) *attribute {
+	family, ip := addrFamily(addr.IP)
+	value := make([]byte, 4+len(ip))
+	value[1] = byte(family)
+	x := binary.BigEndian.Uint16(transID[:2])
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^x)
+	for i := range ip {
+		value[i+4] = ip[i] ^ transID[i]
+	}
+	return newAttribute(types, value)
+}
+
+func addrFamily(ip net.IP) (uint16, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return attributeFamilyIPv4, ip4
+	}
+	return attributeFamilyIPV6, ip.To16()
+}
@@ -0,0 +1,173 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by the discovery when all servers set by
+// SetServers are skipped for their cooldown.
+var ErrCircuitOpen = errors.New("all servers are in cooldown")
+
+// Defaults of the BreakerConfig.
+const (
+	DefaultBreakerThreshold  = 3
+	DefaultBreakerBackoff    = 30 * time.Second
+	DefaultBreakerMaxBackoff = 10 * time.Minute
+)
+
+// BreakerConfig configures a Breaker. Zero values select the defaults.
+type BreakerConfig struct {
+	Threshold  int           // failures in a row opening the circuit of a server
+	Backoff    time.Duration // first cooldown of an open circuit
+	MaxBackoff time.Duration // cooldowns double up to it
+}
+
+// Breaker is a circuit breaker tracking the failures of servers. Once a
+// server fails Threshold times in a row, its circuit opens and it is skipped
+// for a cooldown, after which a single attempt is allowed: a success closes
+// the circuit, a failure opens it again for twice the cooldown, up to
+// MaxBackoff. A Breaker is safe for concurrent use, so clients may share
+// one.
+type Breaker struct {
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu      sync.Mutex
+	servers map[string]*breakerState
+}
+
+type breakerState struct {
+	failures int           // failures in a row
+	cooldown time.Duration // of the last opening, zero if closed
+	until    time.Time     // end of the cooldown
+}
+
+// NewBreaker returns a breaker with the config.
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = DefaultBreakerThreshold
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBreakerBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultBreakerMaxBackoff
+	}
+	return &Breaker{cfg: cfg, now: time.Now, servers: make(map[string]*breakerState)}
+}
+
+// Allow reports whether the server may be tried: its circuit is closed, or
+// its cooldown is over. The attempt after the cooldown is the only one
+// until it is reported, or for another cooldown if it is not.
+func (b *Breaker) Allow(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.servers[server]
+	if s == nil || s.cooldown == 0 {
+		return true
+	}
+	now := b.now()
+	if now.Before(s.until) {
+		return false
+	}
+	s.until = now.Add(s.cooldown)
+	return true
+}
+
+// Success reports a successful attempt of the server, closing its circuit.
+func (b *Breaker) Success(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.servers, server)
+}
+
+// Failure reports a failed attempt of the server, opening its circuit once
+// the failures reach the threshold.
+func (b *Breaker) Failure(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.servers[server]
+	if s == nil {
+		s = &breakerState{}
+		b.servers[server] = s
+	}
+	s.failures++
+	if s.failures < b.cfg.Threshold {
+		return
+	}
+	if s.cooldown == 0 {
+		s.cooldown = b.cfg.Backoff
+	} else if s.cooldown *= 2; s.cooldown > b.cfg.MaxBackoff {
+		s.cooldown = b.cfg.MaxBackoff
+	}
+	s.until = b.now().Add(s.cooldown)
+}
+
+// Until returns the end of the cooldown of the server, zero if its circuit
+// is closed.
+func (b *Breaker) Until(server string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s := b.servers[server]; s != nil && s.cooldown > 0 {
+		return s.until
+	}
+	return time.Time{}
+}
+
+// SetServers sets the servers the discovery tries in order, instead of the
+// one of SetServerAddr: the next one is tried when a server fails or does
+// not answer, and the servers whose circuit is open in the breaker are
+// skipped, so a failing server is not probed again by every discovery. A nil
+// breaker selects a new one with the default config. ErrCircuitOpen is
+// returned if all servers are skipped. Only the discovery honors the
+// servers; the other requests still use the server of SetServerAddr.
+func (c *Client) SetServers(servers []string, b *Breaker) {
+	if b == nil {
+		b = NewBreaker(BreakerConfig{})
+	}
+	c.servers = append([]string(nil), servers...)
+	c.breaker = b
+}
+
+// discoverServers performs the discovery with the first server of
+// SetServers which succeeds. Failures caused by ctx are not held against
+// the servers.
+func (c *Client) discoverServers(ctx context.Context, progress func(Progress)) (*DiscoveryResult, error) {
+	r, err := &DiscoveryResult{NAT: NATError}, ErrCircuitOpen
+	for _, server := range c.servers {
+		if !c.breaker.Allow(server) {
+			c.logger.Debugln("Skip server", server, "in cooldown")
+			continue
+		}
+		r, err = c.discoverServer(ctx, serverAddress(server), progress)
+		if ctx.Err() != nil {
+			return r, err
+		}
+		if err == nil && r.NAT != NATBlocked {
+			c.breaker.Success(server)
+			return r, nil
+		}
+		c.logger.Debugln("Server", server, "failed:", r.NAT, err)
+		c.breaker.Failure(server)
+	}
+	return r, err
+}
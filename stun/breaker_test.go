@@ -0,0 +1,96 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(BreakerConfig{Threshold: 2, Backoff: time.Second, MaxBackoff: 3 * time.Second})
+	b.now = func() time.Time { return now }
+	b.Failure("a")
+	if !b.Allow("a") || !b.Until("a").IsZero() {
+		t.Errorf("Allow error: circuit open below the threshold")
+	}
+	b.Failure("a")
+	if b.Allow("a") || !b.Until("a").Equal(now.Add(time.Second)) {
+		t.Errorf("Allow error: circuit closed at the threshold, until %v", b.Until("a"))
+	}
+	if !b.Allow("b") {
+		t.Errorf("Allow error: other server skipped")
+	}
+	// A single attempt after the cooldown, which doubles on failure up to
+	// the maximum.
+	for _, cooldown := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		now = b.Until("a")
+		if !b.Allow("a") || b.Allow("a") {
+			t.Errorf("Allow error: expected a single attempt after the cooldown")
+		}
+		b.Failure("a")
+		if got := b.Until("a").Sub(now); got != cooldown {
+			t.Errorf("cooldown error: expected %v, get %v", cooldown, got)
+		}
+	}
+	now = b.Until("a")
+	b.Allow("a")
+	b.Success("a")
+	if !b.Allow("a") || !b.Until("a").IsZero() {
+		t.Errorf("Success error: circuit not closed")
+	}
+}
+
+func TestServers(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer dead.Close()
+	c := NewClient()
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetTestTimeout(100 * time.Millisecond)
+	b := NewBreaker(BreakerConfig{Threshold: 1})
+	c.SetServers([]string{dead.LocalAddr().String(), addr.String()}, b)
+	var deadRequests int
+	c.OnEvent(func(e Event) {
+		if e.Type == EventRequestSent && e.Addr.String() == dead.LocalAddr().String() {
+			deadRequests++
+		}
+	})
+	for i := 0; i < 2; i++ {
+		r, err := c.DiscoverResult()
+		if err != nil || r.NAT != NATNone {
+			t.Fatalf("DiscoverResult error: %v %v", r.NAT, err)
+		}
+	}
+	if deadRequests != 1 || b.Until(dead.LocalAddr().String()).IsZero() {
+		t.Errorf("breaker error: %d requests to the failing server", deadRequests)
+	}
+	// The other requests keep the server of SetServerAddr.
+	if c.serverAddr != "" {
+		t.Errorf("server address error: expected none, get %v", c.serverAddr)
+	}
+	c.SetServers([]string{dead.LocalAddr().String()}, b)
+	if _, err := c.DiscoverResult(); err != ErrCircuitOpen {
+		t.Errorf("DiscoverResult error: expected ErrCircuitOpen, get %v", err)
+	}
+}
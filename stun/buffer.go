@@ -0,0 +1,43 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"sync"
+)
+
+// bufferPool holds the buffers packets are encoded into and read into, so
+// the transactions do not allocate them each time.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, maxPacketSize)
+		return &b
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putBuffer returns the buffer to the pool. The buffer must not be used
+// afterwards, including the slices of it.
+func putBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
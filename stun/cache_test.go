@@ -0,0 +1,55 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientCache(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetCacheTTL(time.Minute)
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	received := s.Stats().Received
+	cached, err := c.DiscoverResult()
+	if err != nil || s.Stats().Received != received {
+		t.Fatalf("cache error: the server was contacted, %v", err)
+	}
+	if cached == r || cached.NAT != r.NAT || len(cached.Hosts) != len(r.Hosts) {
+		t.Errorf("cache error: expected a copy of %+v, get %+v", r, cached)
+	}
+	// A result of another server is not cached.
+	s2, addr2 := newTestServer(t)
+	defer s2.Close()
+	c.SetServerAddr(addr2.String())
+	if _, err = c.DiscoverResult(); err != nil || s2.Stats().Received == 0 {
+		t.Errorf("cache error: the cached result of another server was used, %v", err)
+	}
+	c.SetServerAddr(addr.String())
+	c.Invalidate()
+	if _, err = c.DiscoverResult(); err != nil || s.Stats().Received == received {
+		t.Errorf("Invalidate error: the server was not contacted, %v", err)
+	}
+}
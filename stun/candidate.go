@@ -0,0 +1,204 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+// CandidateType is the type of an ICE candidate.
+type CandidateType int
+
+// Candidate types.
+const (
+	CandidateHost CandidateType = iota
+	CandidateServerReflexive
+	CandidateRelayed
+)
+
+var candidateTypeStr = map[CandidateType]string{
+	CandidateHost:            "host",
+	CandidateServerReflexive: "srflx",
+	CandidateRelayed:         "relay",
+}
+
+func (t CandidateType) String() string {
+	if s, ok := candidateTypeStr[t]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// preference returns the type preference recommended by RFC 8445 Section
+// 5.1.2.2.
+func (t CandidateType) preference() uint32 {
+	switch t {
+	case CandidateHost:
+		return 126
+	case CandidateServerReflexive:
+		return 100
+	}
+	return 0
+}
+
+// Candidate is an ICE candidate (RFC 8445 Section 5.1.1).
+type Candidate struct {
+	Type       CandidateType
+	Addr       *Host  // transport address of the candidate
+	Base       *Host  // local address the candidate is derived from
+	Priority   uint32 // computed as RFC 8445 Section 5.1.2.1
+	Foundation string // same for candidates of the same type, base IP and server
+	Component  int
+}
+
+// String returns the candidate in the format of the SDP candidate attribute.
+func (c *Candidate) String() string {
+	return fmt.Sprintf("candidate:%s %d udp %d %s %d typ %s",
+		c.Foundation, c.Component, c.Priority, c.Addr.IP(), c.Addr.Port(), c.Type)
+}
+
+func newCandidate(t CandidateType, addr, base *Host, localPref uint32, server string) *Candidate {
+	const component = 1
+	return &Candidate{
+		Type:       t,
+		Addr:       addr,
+		Base:       base,
+		Priority:   t.preference()<<24 | localPref<<8 | (256 - component),
+		Foundation: fmt.Sprint(crc32.ChecksumIEEE([]byte(t.String() + base.IP() + server))),
+		Component:  component,
+	}
+}
+
+// GatherCandidates gathers the candidates of the connection the client was
+// created with, for component 1: a host candidate for each address of the
+// connection, the server reflexive candidate discovered via the STUN server,
+// and the relayed candidate allocated via turn if it is not nil. The TURN
+// client must use the same connection; its allocation is left open for the
+// caller to use and close.
+//
+// The server reflexive and relayed candidates are omitted if the servers do
+// not respond, in which case the error is nil.
+func (c *Client) GatherCandidates(turn *TURNClient) ([]*Candidate, error) {
+	if c.conn == nil {
+		return nil, ErrNoConn
+	}
+	local := newHostFromStr(c.conn.LocalAddr().String())
+	if local == nil {
+		return nil, ErrInvalidLocalAddr
+	}
+	bases, err := hostAddrs(local)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*Candidate, 0, len(bases)+2)
+	// Prefer the addresses in the order of the interfaces (RFC 8421).
+	localPref := uint32(65535)
+	for _, base := range bases {
+		candidates = append(candidates, newCandidate(CandidateHost, base, base, localPref, ""))
+		localPref--
+	}
+	c.defaultServer(context.Background())
+	serverUDPAddr, err := c.resolveUDPAddr(context.Background(), "udp", c.serverAddr)
+	if err != nil {
+		return candidates, err
+	}
+	resp, err := c.test1(context.Background(), c.conn, serverUDPAddr)
+	if err != nil {
+		return candidates, err
+	}
+	// A server reflexive candidate equal to a host candidate is redundant.
+	if resp != nil && resp.mappedAddr != nil && !containsHost(bases, resp.mappedAddr) {
+		candidates = append(candidates, newCandidate(CandidateServerReflexive,
+			resp.mappedAddr, reflexiveBase(bases, local, serverUDPAddr), 65535, c.serverAddr))
+	}
+	if turn != nil {
+		relayed, err := turn.Allocate()
+		if errors.Is(err, ErrNoResponse) {
+			return candidates, nil
+		}
+		if err != nil {
+			return candidates, err
+		}
+		// The relayed candidate is its own base (RFC 8445 Section 5.1.1.2).
+		candidates = append(candidates, newCandidate(CandidateRelayed,
+			relayed, relayed, 65535, turn.server.String()))
+	}
+	return candidates, nil
+}
+
+// reflexiveBase returns the host candidate the server reflexive candidate of
+// the requests to server comes from, its base (RFC 8445 Section 5.1.1.2):
+// the one of the source address the routing table selects for the server if
+// the connection is bound to an unspecified address.
+func reflexiveBase(bases []*Host, local *Host, server *net.UDPAddr) *Host {
+	if len(bases) == 1 {
+		return bases[0]
+	}
+	if ip := routeSource("udp", server.String()); ip != nil {
+		for _, base := range bases {
+			if net.ParseIP(base.IP()).Equal(ip) {
+				return base
+			}
+		}
+	}
+	if len(bases) > 0 {
+		return bases[0]
+	}
+	return local
+}
+
+// hostAddrs returns the local addresses of the connection. If it is bound to
+// an unspecified address, all global unicast addresses of the same family on
+// the interfaces are used.
+func hostAddrs(local *Host) ([]*Host, error) {
+	ip := net.ParseIP(local.IP())
+	if !ip.IsUnspecified() {
+		return []*Host{local}, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	v4 := ip.To4() != nil
+	hosts := make([]*Host, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		// A socket bound to [::] also accepts IPv4 on dual stack hosts.
+		if v4 && ipNet.IP.To4() == nil {
+			continue
+		}
+		family, _ := addrFamily(ipNet.IP)
+		hosts = append(hosts, &Host{family, ipNet.IP.String(), local.Port()})
+	}
+	return hosts, nil
+}
+
+func containsHost(hosts []*Host, h *Host) bool {
+	for _, host := range hosts {
+		if host.TransportAddr() == h.TransportAddr() {
+			return true
+		}
+	}
+	return false
+}
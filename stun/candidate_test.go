@@ -0,0 +1,102 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCandidatePriority(t *testing.T) {
+	host := &Host{attributeFamilyIPv4, "192.168.0.2", 5000}
+	c := newCandidate(CandidateHost, host, host, 65535, "")
+	if c.Priority != 2130706431 {
+		t.Errorf("host priority error: %d", c.Priority)
+	}
+	c = newCandidate(CandidateServerReflexive, host, host, 65535, "a")
+	if c.Priority != 1694498815 {
+		t.Errorf("srflx priority error: %d", c.Priority)
+	}
+	c = newCandidate(CandidateRelayed, host, host, 65535, "a")
+	if c.Priority != 16777215 {
+		t.Errorf("relay priority error: %d", c.Priority)
+	}
+}
+
+func TestGatherCandidates(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	if _, err := NewClient().GatherCandidates(nil); err != ErrNoConn {
+		t.Errorf("GatherCandidates error: expected %v, get %v", ErrNoConn, err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr.String())
+	candidates, err := c.GatherCandidates(nil)
+	if err != nil {
+		t.Fatalf("GatherCandidates error: %v", err)
+	}
+	// Without a NAT, the server reflexive candidate is redundant.
+	if len(candidates) != 1 || candidates[0].Type != CandidateHost {
+		t.Errorf("GatherCandidates error: %v", candidates)
+	}
+}
+
+func TestGatherRelayedCandidate(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	f, sconn := newAuthTURN(t)
+	defer sconn.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr.String())
+	turn := NewTURNClient(conn, sconn.LocalAddr().(*net.UDPAddr), testTURNUsername, testTURNPassword)
+	candidates, err := c.GatherCandidates(turn)
+	if err != nil {
+		t.Fatalf("GatherCandidates error: %v", err)
+	}
+	if len(candidates) != 2 || candidates[1].Type != CandidateRelayed {
+		t.Fatalf("GatherCandidates error: %v", candidates)
+	}
+	relayed := candidates[1]
+	if relayed.Addr.TransportAddr() != f.relayed.String() || relayed.Base != relayed.Addr {
+		t.Errorf("relayed candidate error: expected %v based on itself, get %v based on %v", f.relayed, relayed.Addr, relayed.Base)
+	}
+}
+
+func TestReflexiveBase(t *testing.T) {
+	local := &Host{attributeFamilyIPv4, "0.0.0.0", 5000}
+	loopback := &Host{attributeFamilyIPv4, "127.0.0.1", 5000}
+	other := &Host{attributeFamilyIPv4, "192.0.2.7", 5000}
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}
+	// The base is the host candidate routed to the server, not the
+	// unspecified address.
+	if base := reflexiveBase([]*Host{other, loopback}, local, server); base != loopback {
+		t.Errorf("reflexiveBase error: expected %v, get %v", loopback, base)
+	}
+	if base := reflexiveBase(nil, local, server); base != local {
+		t.Errorf("reflexiveBase error: expected %v, get %v", local, base)
+	}
+}
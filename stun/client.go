@@ -17,9 +17,13 @@
 package stun
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
+	"io"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // Client is a STUN client, which can be set STUN server address and is used
@@ -29,6 +33,54 @@ type Client struct {
 	softwareName string
 	conn         net.PacketConn
 	logger       *Logger
+	validation   ValidationPolicy
+	addrPolicy   ChangedAddrPolicy
+	localAddr    string
+	iface        string
+	keepalive    KeepaliveMode
+	dtls         *DTLSConfig
+	dtlsConn     net.PacketConn // DTLS association over conn
+	cacheTTL     time.Duration
+	cache        *DiscoveryResult
+	cacheServer  string // server address of the cached result
+	cacheTime    time.Time
+	onEvent      func(Event)
+	verifyAddr   string
+	dedupWindow  time.Duration
+	transactions transactionLog
+	raceDelay    time.Duration
+	eventMu      sync.Mutex
+	dumpMu       sync.Mutex
+	dump         io.Writer
+	dumpFormat   DumpFormat
+	dumpHeader   bool // whether the pcapng header is written
+	socket       SocketConfig
+	probeTimeout time.Duration
+	timeout      time.Duration
+	testTimeout  time.Duration
+	reuse        bool
+	ownConn      bool // whether conn is created by the client for reuse
+	resolver     Resolver
+	record       bool // whether the messages of the discovery are recorded
+	statsMu      sync.Mutex
+	stats        ClientStats
+	txConfig     TransactionConfig
+	onTx         func(*Transaction)
+	portMin      int
+	portMax      int
+	wsURL        string      // URL of the WebSocket gateway
+	wsTLS        *tls.Config // TLS config of the WebSocket
+	reqAttrs     []Attribute // attributes added to binding requests
+	username     string
+	key          []byte // short-term password of MESSAGE-INTEGRITY
+	strictMI     bool   // whether responses must have MESSAGE-INTEGRITY
+	store        ResultStore
+	onForeign    func([]byte, net.Addr)
+	servers      []string // servers tried in order, see SetServers
+	breaker      *Breaker
+	compat3489   bool // whether RFC 3489 responses without cookie are accepted
+	parsing      ParseMode
+	limiter      *RateLimiter
 }
 
 // NewClient returns a client without network connection. The network
@@ -37,6 +89,8 @@ func NewClient() *Client {
 	c := new(Client)
 	c.SetSoftwareName(DefaultSoftwareName)
 	c.logger = NewLogger()
+	c.dedupWindow = DefaultDedupWindow
+	c.raceDelay = DefaultRaceDelay
 	return c
 }
 
@@ -47,6 +101,8 @@ func NewClientWithConnection(conn net.PacketConn) *Client {
 	c.conn = conn
 	c.SetSoftwareName(DefaultSoftwareName)
 	c.logger = NewLogger()
+	c.dedupWindow = DefaultDedupWindow
+	c.raceDelay = DefaultRaceDelay
 	return c
 }
 
@@ -68,14 +124,112 @@ func (c *Client) SetServerHost(host string, port int) {
 }
 
 // SetServerAddr allows user to set the transport layer STUN server address.
+// If it is not set, the best of PublicServers is chosen by SelectBest.
+// STUN and TURN URIs such as "stun:stun.example.org" are accepted too; the
+// stuns and turns schemes only select the default port 5349, the secure
+// transport is to be set with SetServerDTLS, which accepts URIs as well.
 func (c *Client) SetServerAddr(address string) {
-	c.serverAddr = address
+	c.serverAddr = serverAddress(address)
 }
 
-// SetSoftwareName allows user to set the name of the software, which is used
-// for logging purpose (NOT used in the current implementation).
+// serverAddress returns the transport address of the URI, or else the
+// address itself.
+func serverAddress(address string) string {
+	if isURI(address) {
+		if u, err := ParseURI(address); err == nil {
+			return u.Addr()
+		}
+	}
+	return address
+}
+
+// SetLocalAddr allows user to set the local address the UDP listener binds to,
+// e.g. "192.168.1.2:0". It is ignored if the client was created with a
+// connection.
+func (c *Client) SetLocalAddr(address string) {
+	c.localAddr = address
+}
+
+// SetInterface allows user to pin the discovery to the network interface of
+// the given name, on which an address of the same family as the server
+// address is used as the local address. SetLocalAddr takes precedence.
+func (c *Client) SetInterface(name string) {
+	c.iface = name
+}
+
+// SetValidationPolicy allows user to set how strictly the source address of
+// responses is checked. ValidateStrict is used by default; some servers
+// answer from a different port and need ValidateSameIP or ValidateAny.
+func (c *Client) SetValidationPolicy(p ValidationPolicy) {
+	c.validation = p
+}
+
+// SetChangedAddrPolicy allows user to choose between OTHER-ADDRESS and
+// CHANGED-ADDRESS for the alternate address of the server. PreferOtherAddress
+// is used by default, since some servers send stale CHANGED-ADDRESS values.
+func (c *Client) SetChangedAddrPolicy(p ChangedAddrPolicy) {
+	c.addrPolicy = p
+}
+
+// SetKeepaliveMode allows user to choose between request based keepalive,
+// which is the default, and indication based keepalive.
+func (c *Client) SetKeepaliveMode(m KeepaliveMode) {
+	c.keepalive = m
+}
+
+// SetTimeout sets the time a discovery or ExternalIP may take in total,
+// after which it fails with context.DeadlineExceeded. The default of 0
+// imposes no limit besides the one of each request.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// SetTestTimeout sets the time each request waits for its response,
+// including retransmissions, after which the request is considered
+// unanswered like after the last retransmission. The default of 0 follows
+// the full retransmission schedule of RFC 5389, which takes 9.5 seconds, so
+// interactive applications may want to fail faster.
+func (c *Client) SetTestTimeout(d time.Duration) {
+	c.testTimeout = d
+}
+
+// withTimeout applies the total timeout of the client to ctx.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// SetCacheTTL allows user to cache successful discovery results for the
+// given duration, during which Discover and its variants return the cached
+// result without contacting the server. The cache is disabled by default.
+func (c *Client) SetCacheTTL(ttl time.Duration) {
+	c.cacheTTL = ttl
+}
+
+// Invalidate drops the cached discovery result.
+func (c *Client) Invalidate() {
+	c.cache = nil
+}
+
+// SetRecordMessages allows user to record the encoded requests and responses
+// of the tests in the Exchanges of the discovery result, e.g. to read
+// attributes this package does not interpret.
+func (c *Client) SetRecordMessages(v bool) {
+	c.record = v
+}
+
+// SetSoftware allows user to set the SOFTWARE attribute of requests, e.g.
+// "myapp/1.2", which helps server operators to track client versions. An
+// empty string omits the attribute.
+func (c *Client) SetSoftware(software string) {
+	c.softwareName = software
+}
+
+// SetSoftwareName is the same as SetSoftware.
 func (c *Client) SetSoftwareName(name string) {
-	c.softwareName = name
+	c.SetSoftware(name)
 }
 
 // Discover contacts the STUN server and gets the response of NAT type, host
@@ -92,46 +246,160 @@ func (c *Client) Discover() (NATType, *Host, error) {
 // DiscoverAll contacts the STUN server and gets the response of NAT type,
 // There may be multiple hosts observed.
 func (c *Client) DiscoverAll() (NATType, []*Host, error) {
-	if c.serverAddr == "" {
-		c.SetServerAddr(DefaultServerAddr)
+	r, err := c.DiscoverResult()
+	return r.NAT, r.Hosts, err
+}
+
+// DiscoverResult contacts the STUN server and gets the detailed result of the
+// discovery. The result is never nil, even if an error is returned.
+func (c *Client) DiscoverResult() (*DiscoveryResult, error) {
+	return c.DiscoverResultContext(context.Background())
+}
+
+// DiscoverResultContext is DiscoverResult with a context, which aborts the
+// discovery with the error of the context once it is done.
+func (c *Client) DiscoverResultContext(ctx context.Context) (*DiscoveryResult, error) {
+	return c.discover(ctx, nil)
+}
+
+// discover performs the discovery, reporting the progress to progress if it
+// is not nil.
+func (c *Client) discover(ctx context.Context, progress func(Progress)) (*DiscoveryResult, error) {
+	if len(c.servers) > 0 {
+		return c.discoverServers(ctx, progress)
+	}
+	c.defaultServer(ctx)
+	return c.discoverServer(ctx, c.serverAddr, progress)
+}
+
+// discoverServer performs the discovery with the server address.
+func (c *Client) discoverServer(ctx context.Context, server string, progress func(Progress)) (*DiscoveryResult, error) {
+	if c.cache != nil && c.cacheServer == server && time.Since(c.cacheTime) < c.cacheTTL {
+		c.logger.Debugln("Use cached result")
+		return c.cache.clone(), nil
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	r := &DiscoveryResult{NAT: NATError, progress: progress}
+	err := c.discoverResult(ctx, server, r)
+	r.progress = nil
+	if err == nil && c.cacheTTL > 0 {
+		c.cache, c.cacheServer, c.cacheTime = r.clone(), server, time.Now()
+	}
+	if err == nil {
+		c.storeResult(server, r)
+	}
+	return r, err
+}
+
+func (c *Client) discoverResult(ctx context.Context, server string, r *DiscoveryResult) error {
+	ctx, loss := withLossCounter(ctx)
+	defer func() { r.Loss = loss.snapshot() }()
+	if c.wsURL != "" {
+		var err error
+		r.NAT, r.Hosts, err = c.discoverWebSocket(ctx, r)
+		return err
 	}
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if v6, v4, ok := c.raceAddrs(ctx, server); ok {
+		return c.discoverRace(ctx, v6, v4, r)
+	}
+	serverUDPAddr, err := c.resolveUDPAddr(ctx, "udp", server)
 	if err != nil {
-		return NATError, nil, err
+		return err
 	}
-	// Use the connection passed to the client if it is not nil, otherwise
-	// create a connection and close it at the end.
-	conn := c.conn
-	if conn == nil {
-		conn, err = net.ListenUDP("udp", nil)
+	conn, done, err := c.listen(serverUDPAddr)
+	if err != nil {
+		return err
+	}
+	defer done()
+	r.LocalAddr = newHostFromStr(conn.LocalAddr().String())
+	if c.dtls != nil {
+		r.NAT, r.Hosts, err = c.discoverDTLS(ctx, conn, serverUDPAddr, r)
+		return err
+	}
+	r.NAT, r.Hosts, err = c.discoverAll(ctx, conn, serverUDPAddr, r)
+	r.detectNAT64(serverUDPAddr)
+	return err
+}
+
+// listen returns the connection passed to the client if it is not nil,
+// otherwise it creates a connection, which is kept as the connection of the
+// client if the reuse is enabled. done closes the connection unless it is the
+// connection of the client.
+func (c *Client) listen(server *net.UDPAddr) (conn net.PacketConn, done func(), err error) {
+	if c.conn != nil {
+		return c.conn, func() {}, nil
+	}
+	laddr, err := c.localUDPAddr(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	uc, err := c.listenUDP(c.socket, "udp", laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.reuse {
+		c.logger.Debugln("Keep the connection on", uc.LocalAddr())
+		c.conn, c.ownConn = uc, true
+		return uc, func() {}, nil
+	}
+	return uc, func() { uc.Close() }, nil
+}
+
+// localUDPAddr returns the address to bind the UDP listener to, which is nil
+// if neither a local address nor an interface is set.
+func (c *Client) localUDPAddr(server *net.UDPAddr) (*net.UDPAddr, error) {
+	if c.localAddr != "" {
+		return net.ResolveUDPAddr("udp", c.localAddr)
+	}
+	if c.iface != "" {
+		ifi, err := net.InterfaceByName(c.iface)
 		if err != nil {
-			return NATError, nil, err
+			return nil, err
 		}
-		defer conn.Close()
+		return interfaceUDPAddr(ifi, server)
 	}
-	return c.discoverAll(conn, serverUDPAddr)
+	return nil, nil
 }
 
 // Keepalive sends and receives a bind request, which ensures the mapping stays open
-// Only applicable when client was created with a connection.
+// Only applicable when client was created with a connection, or keeps the
+// connection of a discovery with SetReuseConn.
+// In the KeepaliveIndication mode, a binding indication is sent instead and
+// the returned host is always nil, since the server does not respond.
 func (c *Client) Keepalive() (*Host, error) {
 	if c.conn == nil {
-		return nil, errors.New("no connection available")
-	}
-	if c.serverAddr == "" {
-		c.SetServerAddr(DefaultServerAddr)
+		return nil, ErrNoConn
 	}
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	c.defaultServer(context.Background())
+	serverUDPAddr, err := c.resolveUDPAddr(context.Background(), "udp", c.serverAddr)
 	if err != nil {
 		return nil, err
 	}
-
-	resp, err := c.test1(c.conn, serverUDPAddr)
+	conn := c.conn
+	if c.dtls != nil {
+		if conn, err = c.dialDTLS(c.conn, serverUDPAddr); err != nil {
+			return nil, err
+		}
+	}
+	if c.keepalive == KeepaliveIndication {
+		return nil, c.sendBindingInd(conn, serverUDPAddr)
+	}
+	resp, err := c.test1(context.Background(), conn, serverUDPAddr)
 	if err != nil {
 		return nil, err
 	}
-	if resp == nil || resp.packet == nil {
-		return nil, errors.New("failed to contact")
+	if resp == nil {
+		return nil, &TimeoutError{Addr: serverUDPAddr}
+	}
+	if err = responseError(resp, serverUDPAddr); err != nil {
+		return nil, err
+	}
+	// The cached result is stale once the mapping changes.
+	if c.cache != nil && len(c.cache.Hosts) > 0 && resp.mappedAddr != nil &&
+		c.cache.Hosts[0].TransportAddr() != resp.mappedAddr.TransportAddr() {
+		c.logger.Debugln("Mapping changed, invalidate cached result")
+		c.Invalidate()
 	}
 	return resp.mappedAddr, nil
 }
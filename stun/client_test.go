@@ -0,0 +1,275 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveIndication(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer server.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(server.LocalAddr().String())
+	c.SetKeepaliveMode(KeepaliveIndication)
+	// Nobody answers, the keepalive must not wait for a response.
+	start := time.Now()
+	host, err := c.Keepalive()
+	if err != nil || host != nil {
+		t.Fatalf("Keepalive error: expected nil, nil, get %v, %v", host, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Keepalive error: waited %v for a response", elapsed)
+	}
+	buf := make([]byte, 1500)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom error: %v", err)
+	}
+	if from.String() != conn.LocalAddr().String() {
+		t.Errorf("ReadFrom error: expected %v, get %v", conn.LocalAddr(), from)
+	}
+	pkt, err := newPacketFromBytes(buf[:n])
+	if err != nil {
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	if pkt.types != typeBindingIndication {
+		t.Errorf("types error: expected %#x, get %#x", typeBindingIndication, pkt.types)
+	}
+	// An indication is never retransmitted.
+	server.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err = server.ReadFrom(buf); err == nil {
+		t.Errorf("ReadFrom error: the indication was retransmitted")
+	}
+}
+
+// duplicateConn sends every packet twice.
+type duplicateConn struct {
+	net.PacketConn
+}
+
+func (c duplicateConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.PacketConn.WriteTo(b, addr)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestClientStaleResponse(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(duplicateConn{sconn})
+	go s.Serve()
+	defer s.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(sconn.LocalAddr().String())
+	var stale int
+	c.OnEvent(func(e Event) {
+		if e.Type == EventStaleResponse {
+			stale++
+		}
+	})
+	for i := 0; i < 2; i++ {
+		if _, err = c.Keepalive(); err != nil {
+			t.Fatalf("Keepalive error: %v", err)
+		}
+	}
+	// The duplicate of the first response is read by the second request.
+	if stale != 1 || c.Stats().Stale != 1 {
+		t.Errorf("stale responses error: expected 1, get %d, %+v", stale, c.Stats())
+	}
+}
+
+// spoofConn sends a garbage packet and a response with another transaction
+// ID before every packet.
+type spoofConn struct {
+	net.PacketConn
+}
+
+func (c spoofConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.PacketConn.WriteTo([]byte("garbage"), addr)
+	spoofed := append([]byte(nil), b...)
+	spoofed[19] ^= 0xff
+	c.PacketConn.WriteTo(spoofed, addr)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestClientRejectedResponse(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(spoofConn{sconn})
+	go s.Serve()
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(sconn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	r, err := c.DiscoverResult()
+	if err != nil || len(r.Hosts) == 0 {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	// One of each per transaction.
+	if stats := c.Stats(); stats.Rejected != stats.Transactions || stats.Malformed != stats.Transactions || stats.Stale != 0 {
+		t.Errorf("Stats error: %+v", stats)
+	}
+	id := make([]byte, 16)
+	if matchTransID(id, id[:12]) || !matchTransID(id, make([]byte, 16)) {
+		t.Errorf("matchTransID error")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// A socket which never answers.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer silent.Close()
+	c := NewClient()
+	c.SetServerAddr(silent.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetTestTimeout(50 * time.Millisecond)
+	start := time.Now()
+	r, err := c.DiscoverResult()
+	if err != nil || r.NAT != NATBlocked {
+		t.Errorf("DiscoverResult with test timeout error: expected %v, get %v, %v", NATBlocked, r.NAT, err)
+	}
+	c.SetTestTimeout(0)
+	c.SetTimeout(50 * time.Millisecond)
+	_, err = c.DiscoverResult()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DiscoverResult with timeout error: expected %v, get %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timeouts error: took %v", d)
+	}
+}
+
+func TestRecordMessages(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetRecordMessages(true)
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if len(r.Exchanges) != 2 || r.Exchanges[0].Test != TestI || r.Exchanges[1].Test != TestII {
+		t.Fatalf("Exchanges error: %+v", r.Exchanges)
+	}
+	e := r.Exchanges[0]
+	req, err := ParseMessage(e.Request)
+	if err != nil || req.Type != typeBindingRequest {
+		t.Errorf("Exchanges error: request %v, %v", req, err)
+	}
+	if _, ok := e.Message.Get(attributeXorMappedAddress); !ok || !bytes.Equal(e.Response[4:20], req.TransactionID) {
+		t.Errorf("Exchanges error: response %x", e.Response)
+	}
+}
+
+func TestRecordMessagesCached(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetRecordMessages(true)
+	c.SetCacheTTL(time.Minute)
+	r, err := c.DiscoverResult()
+	if err != nil || len(r.Exchanges) == 0 {
+		t.Fatalf("DiscoverResult error: %+v, %v", r, err)
+	}
+	expected := append([]byte(nil), r.Exchanges[0].Response...)
+	// Modifying a result leaves the cached one alone.
+	e := r.Exchanges[0]
+	e.Request[0] ^= 0xff
+	e.Response[0] ^= 0xff
+	e.Message.TransactionID[0] ^= 0xff
+	e.Message.Attributes[0].Value[0] ^= 0xff
+	cached, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	got := cached.Exchanges[0]
+	if !bytes.Equal(got.Response, expected) || got.Request[0] == e.Request[0] {
+		t.Errorf("cache error: the recorded messages were modified")
+	}
+	m, err := ParseMessage(expected)
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Message, m) {
+		t.Errorf("cache error: expected message %+v, get %+v", m, got.Message)
+	}
+}
+
+func TestSoftware(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(conn)
+	s.SetSoftwareName("test server")
+	go s.Serve()
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(conn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetRecordMessages(true)
+	for _, software := range []string{"test client", ""} {
+		c.SetSoftware(software)
+		r, err := c.DiscoverResult()
+		if err != nil || len(r.Exchanges) == 0 {
+			t.Fatalf("DiscoverResult error: %v %+v", err, r)
+		}
+		req, err := ParseMessage(r.Exchanges[0].Request)
+		if err != nil {
+			t.Fatalf("ParseMessage error: %v", err)
+		}
+		// The empty name leaves the attribute out.
+		v, ok := req.Get(attributeSoftware)
+		if ok != (software != "") || string(v) != software {
+			t.Errorf("SOFTWARE error: expected %q, get %q %v", software, v, ok)
+		}
+		if r.ServerSoftware != "test server" {
+			t.Errorf("ServerSoftware error: expected %q, get %q", "test server", r.ServerSoftware)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Errors of the conformance checks.
+var (
+	ErrConformanceEncode    = errors.New("encoded message differs from the test vector")
+	ErrConformanceIntegrity = errors.New("MESSAGE-INTEGRITY mismatch")
+	ErrConformanceCRC       = errors.New("FINGERPRINT mismatch")
+	ErrConformanceAttribute = errors.New("attribute differs from the test vector")
+)
+
+// testVector is a test vector of RFC 5769.
+type testVector struct {
+	name     string
+	message  string       // hex dump of the message
+	key      []byte       // key of MESSAGE-INTEGRITY
+	mapped   *net.UDPAddr // XOR-MAPPED-ADDRESS, nil if absent
+	software string       // SOFTWARE, empty if absent
+	username string       // USERNAME, empty if absent
+}
+
+// testVectors are the test vectors of RFC 5769 Section 2. The padding of the
+// attributes is not zero in some of them, which receivers must ignore.
+var testVectors = []testVector{
+	{
+		name: "request",
+		message: `
+			00 01 00 58 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+			80 22 00 10 53 54 55 4e 20 74 65 73 74 20 63 6c 69 65 6e 74
+			00 24 00 04 6e 00 01 ff
+			80 29 00 08 93 2f f9 b1 51 26 3b 36
+			00 06 00 09 65 76 74 6a 3a 68 36 76 59 20 20 20
+			00 08 00 14 9a ea a7 0c bf d8 cb 56 78 1e f2 b5 b2 d3 f2 49 c1 b5 71 a2
+			80 28 00 04 e5 7a 3b cf`,
+		key:      []byte("VOkJxbRl1RmTxUk/WvJxBt"),
+		software: "STUN test client",
+		username: "evtj:h6vY",
+	},
+	{
+		name: "IPv4 response",
+		message: `
+			01 01 00 3c 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+			80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+			00 20 00 08 00 01 a1 47 e1 12 a6 43
+			00 08 00 14 2b 91 f5 99 fd 9e 90 c3 8c 74 89 f9 2a f9 ba 53 f0 6b e7 d7
+			80 28 00 04 c0 7d 4c 96`,
+		key:      []byte("VOkJxbRl1RmTxUk/WvJxBt"),
+		mapped:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853},
+		software: "test vector",
+	},
+	{
+		name: "IPv6 response",
+		message: `
+			01 01 00 48 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+			80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+			00 20 00 14 00 02 a1 47 01 13 a9 fa a5 d3 f1 79 bc 25 f4 b5 be d2 b9 d9
+			00 08 00 14 a3 82 95 4e 4b e6 7b f1 17 84 c9 7c 82 92 c2 75 bf e3 ed 41
+			80 28 00 04 c8 fb 0b 4c`,
+		key:      []byte("VOkJxbRl1RmTxUk/WvJxBt"),
+		mapped:   &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853},
+		software: "test vector",
+	},
+	{
+		name: "long-term request",
+		message: `
+			00 01 00 60 21 12 a4 42 78 ad 34 33 c6 ad 72 c0 29 da 41 2e
+			00 06 00 12 e3 83 9e e3 83 88 e3 83 aa e3 83 83 e3 82 af e3 82 b9 00 00
+			00 15 00 1c 66 2f 2f 34 39 39 6b 39 35 34 64 36 4f 4c 33 34 6f 4c 39 46 53 54 76 79 36 34 73 41
+			00 14 00 0b 65 78 61 6d 70 6c 65 2e 6f 72 67 00
+			00 08 00 14 f6 70 24 65 6d d6 4a 3e 02 b8 e0 71 2e 85 c9 a2 8c a8 96 66`,
+		key:      longTermKey("\u30de\u30c8\u30ea\u30c3\u30af\u30b9", "example.org", "TheMatrIX"),
+		username: "\u30de\u30c8\u30ea\u30c3\u30af\u30b9",
+	},
+}
+
+// ConformanceCheck is a check of Conformance, which passed if Err is nil.
+type ConformanceCheck struct {
+	Name string
+	Err  error
+}
+
+// ConformanceReport is the report of Conformance.
+type ConformanceReport struct {
+	Checks []ConformanceCheck
+}
+
+// OK reports whether every check passed.
+func (r *ConformanceReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a line per check.
+func (r *ConformanceReport) String() string {
+	var sb strings.Builder
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			fmt.Fprintf(&sb, "FAIL %s: %v\n", c.Name, c.Err)
+		} else {
+			fmt.Fprintf(&sb, "ok   %s\n", c.Name)
+		}
+	}
+	return sb.String()
+}
+
+// Conformance checks the decoder, the encoder, MESSAGE-INTEGRITY and
+// FINGERPRINT of this package against the test vectors of RFC 5769 at run
+// time, e.g. as a sanity check on unusual architectures. It only computes,
+// and sends nothing.
+func Conformance() *ConformanceReport {
+	r := new(ConformanceReport)
+	for i := range testVectors {
+		v := &testVectors[i]
+		check := func(name string, err error) {
+			r.Checks = append(r.Checks, ConformanceCheck{v.name + ": " + name, err})
+		}
+		b, err := hex.DecodeString(strings.Join(strings.Fields(v.message), ""))
+		if err != nil {
+			check("decode", err)
+			continue
+		}
+		pkt, err := newPacketFromBytes(b)
+		check("decode", err)
+		if err != nil {
+			continue
+		}
+		check("attributes", v.checkAttributes(pkt))
+		var encodeErr error
+		if !bytes.Equal(pkt.bytes(), b) {
+			encodeErr = ErrConformanceEncode
+		}
+		check("encode", encodeErr)
+		check("message integrity", v.checkIntegrity(pkt, b))
+		if pkt.getAttribute(attributeFingerprint) != nil {
+			check("fingerprint", v.checkFingerprint(pkt, b))
+		}
+	}
+	return r
+}
+
+// checkAttributes checks the decoded attributes of the vector.
+func (v *testVector) checkAttributes(pkt *packet) error {
+	if v.mapped != nil {
+		mapped := pkt.getXorMappedAddr()
+		if mapped == nil || mapped.IP() != v.mapped.IP.String() || int(mapped.Port()) != v.mapped.Port {
+			return fmt.Errorf("%w: XOR-MAPPED-ADDRESS %v, expected %v", ErrConformanceAttribute, mapped, v.mapped)
+		}
+		// Encoding the address gives the bytes of the vector.
+		a := pkt.getAttribute(attributeXorMappedAddress)
+		if !bytes.Equal(newXorAddrAttribute(attributeXorMappedAddress, v.mapped, pkt.transID).value, a.value[:a.length]) {
+			return fmt.Errorf("%w: XOR-MAPPED-ADDRESS encoding", ErrConformanceAttribute)
+		}
+	}
+	for _, s := range []struct {
+		types uint16
+		value string
+	}{{attributeSoftware, v.software}, {attributeUsername, v.username}} {
+		if s.value == "" {
+			continue
+		}
+		a := pkt.getAttribute(s.types)
+		if a == nil || string(a.value[:a.length]) != s.value {
+			return fmt.Errorf("%w: %s", ErrConformanceAttribute, attributeString(s.types))
+		}
+	}
+	return nil
+}
+
+// checkIntegrity checks that MESSAGE-INTEGRITY of the vector verifies, and
+// that it is computed again from the attributes preceding it.
+func (v *testVector) checkIntegrity(pkt *packet, b []byte) error {
+	if !verifyMessageIntegrity(b, v.key) {
+		return ErrConformanceIntegrity
+	}
+	rebuilt, mi := v.rebuild(pkt, attributeMessageIntegrity)
+	if mi == nil || !bytes.Equal(newMessageIntegrityAttribute(rebuilt, v.key).value, mi.value) {
+		return ErrConformanceIntegrity
+	}
+	return nil
+}
+
+// checkFingerprint checks that FINGERPRINT of the vector verifies, and that
+// it is computed again from the attributes preceding it.
+func (v *testVector) checkFingerprint(pkt *packet, b []byte) error {
+	if !verifyFingerprint(b) {
+		return ErrConformanceCRC
+	}
+	rebuilt, fp := v.rebuild(pkt, attributeFingerprint)
+	if fp == nil {
+		return ErrConformanceCRC
+	}
+	rebuilt.addFingerprint()
+	if !bytes.Equal(rebuilt.attributes[len(rebuilt.attributes)-1].value, fp.value) {
+		return ErrConformanceCRC
+	}
+	return nil
+}
+
+// rebuild returns a packet with the attributes of pkt preceding the first
+// one of the type, and that attribute, nil if it is absent. The values keep
+// their padding, which the HMAC and the CRC cover.
+func (v *testVector) rebuild(pkt *packet, types uint16) (*packet, *attribute) {
+	p := &packet{types: pkt.types, transID: pkt.transID}
+	for i := range pkt.attributes {
+		a := &pkt.attributes[i]
+		if a.types == types {
+			return p, a
+		}
+		p.addAttribute(*a)
+	}
+	return p, nil
+}
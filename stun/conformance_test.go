@@ -0,0 +1,32 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	r := Conformance()
+	if !r.OK() {
+		t.Errorf("Conformance error:\n%s", r)
+	}
+	// 4 vectors with 4 checks each, and 3 fingerprints.
+	if len(r.Checks) != 19 {
+		t.Errorf("Conformance error: expected 19 checks, get %d:\n%s", len(r.Checks), r)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default timers of the consent freshness (RFC 7675 Section 5.1).
+const (
+	DefaultConsentInterval = 5 * time.Second
+	DefaultConsentTimeout  = 30 * time.Second
+)
+
+// ConsentChecker implements the consent freshness of RFC 7675. It
+// periodically sends binding requests authenticated with the short-term
+// credential on an established flow, and calls the expire callback once no
+// authenticated response was received within the consent timeout.
+//
+// The checker only writes to the connection: as the application keeps
+// reading from it, received packets have to be passed to HandlePacket.
+type ConsentChecker struct {
+	conn     net.PacketConn
+	addr     net.Addr
+	username string
+	key      []byte
+	onExpire func()
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]time.Time // transaction id -> time sent
+	last    time.Time            // time consent was last granted
+	expired bool
+	done    chan struct{}
+}
+
+// NewConsentChecker returns a consent checker for the flow to addr on conn.
+// username and password are the short-term credential of the peer, i.e.
+// "remote-ufrag:local-ufrag" and the remote ICE password. onExpire is called
+// once when the consent expires.
+func NewConsentChecker(conn net.PacketConn, addr net.Addr, username, password string, onExpire func()) *ConsentChecker {
+	return &ConsentChecker{
+		conn:     conn,
+		addr:     addr,
+		username: username,
+		key:      []byte(password),
+		onExpire: onExpire,
+		interval: DefaultConsentInterval,
+		timeout:  DefaultConsentTimeout,
+		pending:  make(map[string]time.Time),
+	}
+}
+
+// SetInterval sets the average interval between consent checks. Each
+// interval is randomized over [0.8, 1.2] of it. It must be called before
+// Start.
+func (cc *ConsentChecker) SetInterval(d time.Duration) {
+	cc.interval = d
+}
+
+// SetTimeout sets the time after which the consent expires if no
+// authenticated response is received. It must be called before Start.
+func (cc *ConsentChecker) SetTimeout(d time.Duration) {
+	cc.timeout = d
+}
+
+// Start starts sending consent checks. The consent is considered granted at
+// the time Start is called.
+func (cc *ConsentChecker) Start() {
+	cc.mu.Lock()
+	cc.last = time.Now()
+	cc.done = make(chan struct{})
+	done := cc.done
+	cc.mu.Unlock()
+	go cc.run(done)
+}
+
+// Stop stops sending consent checks. The expire callback is not called.
+func (cc *ConsentChecker) Stop() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.done != nil {
+		close(cc.done)
+		cc.done = nil
+	}
+}
+
+// Expired reports whether the consent has expired.
+func (cc *ConsentChecker) Expired() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.expired
+}
+
+// HandlePacket processes a packet received on the flow. It returns true if
+// the packet is a response to a consent check, in which case the application
+// should not process it further. The consent is refreshed only if the
+// response is a success response with a valid MESSAGE-INTEGRITY.
+func (cc *ConsentChecker) HandlePacket(b []byte) bool {
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		return false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	id := string(pkt.transID)
+	if _, ok := cc.pending[id]; !ok {
+		return false
+	}
+	if pkt.types == typeBindingResponse && verifyMessageIntegrity(b, cc.key) {
+		delete(cc.pending, id)
+		if !cc.expired {
+			cc.last = time.Now()
+		}
+	}
+	return true
+}
+
+func (cc *ConsentChecker) run(done chan struct{}) {
+	for {
+		// Randomize the interval to avoid synchronized checks.
+		wait := time.Duration(float64(cc.interval) * (0.8 + 0.4*rand.Float64()))
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		cc.mu.Lock()
+		now := time.Now()
+		if now.Sub(cc.last) >= cc.timeout {
+			cc.expired = true
+			cc.mu.Unlock()
+			if cc.onExpire != nil {
+				cc.onExpire()
+			}
+			return
+		}
+		// Forget checks which can no longer refresh the consent.
+		for id, sent := range cc.pending {
+			if now.Sub(sent) >= cc.timeout {
+				delete(cc.pending, id)
+			}
+		}
+		pkt, err := cc.newRequest()
+		if err == nil {
+			cc.pending[string(pkt.transID)] = now
+		}
+		cc.mu.Unlock()
+		if err == nil {
+			// Lost checks are covered by the following ones, so
+			// write errors only delay the consent refresh.
+			_, _ = cc.conn.WriteTo(pkt.bytes(), cc.addr)
+		}
+	}
+}
+
+func (cc *ConsentChecker) newRequest() (*packet, error) {
+	pkt, err := newPacket()
+	if err != nil {
+		return nil, err
+	}
+	pkt.types = typeBindingRequest
+	pkt.addAttribute(*newUsernameAttribute(cc.username))
+	pkt.addAttribute(*newMessageIntegrityAttribute(pkt, cc.key))
+	pkt.addFingerprint()
+	return pkt, nil
+}
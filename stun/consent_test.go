@@ -0,0 +1,175 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testConsentUsername = "remote:local"
+	testConsentPassword = "remote-password"
+)
+
+// newConsentPeer returns a connection to run the checker on, and the address
+// of a server validating the consent checks with the test credential.
+func newConsentPeer(t *testing.T) (*Server, net.PacketConn, net.Addr) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(server)
+	s.SetCredential(testConsentUsername, testConsentPassword)
+	go s.Serve()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	return s, conn, server.LocalAddr()
+}
+
+// readConsent passes the packets received on conn to the checker until conn
+// is closed.
+func readConsent(conn net.PacketConn, cc *ConsentChecker) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		cc.HandlePacket(buf[:n])
+	}
+}
+
+func TestConsentChecker(t *testing.T) {
+	s, conn, addr := newConsentPeer(t)
+	defer conn.Close()
+	expired := make(chan struct{})
+	cc := NewConsentChecker(conn, addr, testConsentUsername, testConsentPassword, func() { close(expired) })
+	cc.SetInterval(10 * time.Millisecond)
+	cc.SetTimeout(100 * time.Millisecond)
+	go readConsent(conn, cc)
+	cc.Start()
+	defer cc.Stop()
+	// The peer answers, the consent is kept for several timeouts.
+	select {
+	case <-expired:
+		t.Fatalf("ConsentChecker error: consent expired while the peer answers")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if cc.Expired() {
+		t.Errorf("Expired error: expected false, get true")
+	}
+	// Once the peer is gone, the consent expires.
+	s.Close()
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ConsentChecker error: consent did not expire")
+	}
+	if !cc.Expired() {
+		t.Errorf("Expired error: expected true, get false")
+	}
+}
+
+func TestConsentCheckerWrongPassword(t *testing.T) {
+	s, conn, addr := newConsentPeer(t)
+	defer s.Close()
+	defer conn.Close()
+	expired := make(chan struct{})
+	// The peer drops the checks, which are not authenticated with its
+	// password.
+	cc := NewConsentChecker(conn, addr, testConsentUsername, "wrong", func() { close(expired) })
+	cc.SetInterval(10 * time.Millisecond)
+	cc.SetTimeout(100 * time.Millisecond)
+	go readConsent(conn, cc)
+	cc.Start()
+	defer cc.Stop()
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ConsentChecker error: consent did not expire")
+	}
+}
+
+func TestConsentCheckerStop(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer peer.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	var expired int32
+	cc := NewConsentChecker(conn, peer.LocalAddr(), testConsentUsername, testConsentPassword, func() { atomic.StoreInt32(&expired, 1) })
+	cc.SetInterval(10 * time.Millisecond)
+	cc.SetTimeout(50 * time.Millisecond)
+	cc.Start()
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = peer.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom error: no consent check sent: %v", err)
+	}
+	cc.Stop()
+	// Drain the check which may have been in flight.
+	peer.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	peer.ReadFrom(buf)
+	peer.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+	if _, _, err = peer.ReadFrom(buf); err == nil {
+		t.Errorf("Stop error: consent checks are still sent")
+	}
+	if atomic.LoadInt32(&expired) != 0 || cc.Expired() {
+		t.Errorf("Stop error: the expire callback was called")
+	}
+}
+
+func TestConsentHandlePacket(t *testing.T) {
+	cc := NewConsentChecker(nil, nil, testConsentUsername, testConsentPassword, nil)
+	req, err := cc.newRequest()
+	if err != nil {
+		t.Fatalf("newRequest error: %v", err)
+	}
+	cc.pending[string(req.transID)] = time.Now()
+	response := func(transID []byte, key string) []byte {
+		pkt := &packet{types: typeBindingResponse, transID: transID}
+		pkt.addAttribute(*newMessageIntegrityAttribute(pkt, []byte(key)))
+		pkt.addFingerprint()
+		return pkt.bytes()
+	}
+	other, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error: %v", err)
+	}
+	if cc.HandlePacket(response(other.transID, testConsentPassword)) {
+		t.Errorf("HandlePacket error: expected false for an unknown transaction")
+	}
+	if !cc.HandlePacket(response(req.transID, "wrong")) || !cc.last.IsZero() {
+		t.Errorf("HandlePacket error: a response with a wrong MESSAGE-INTEGRITY refreshed the consent")
+	}
+	if !cc.HandlePacket(response(req.transID, testConsentPassword)) || cc.last.IsZero() {
+		t.Errorf("HandlePacket error: an authenticated response did not refresh the consent")
+	}
+	if _, ok := cc.pending[string(req.transID)]; ok {
+		t.Errorf("HandlePacket error: the answered check is still pending")
+	}
+}
@@ -16,7 +16,8 @@
 
 package stun
 
-// Default server address and client name.
+// Default server address and client name. DefaultServerAddr is used if
+// none of PublicServers answers.
 const (
 	DefaultServerAddr   = "stun.ekiga.net:3478"
 	DefaultSoftwareName = "StunClient"
@@ -41,6 +42,7 @@ const (
 	NATRestricted
 	NATPortRestricted
 	NATSymmetricUDPFirewall
+	NATUnknownFiltering
 
 	// Deprecated spellings of these constants
 	NATSymetric            = NATSymmetric
@@ -60,6 +62,7 @@ func init() {
 		NATPortRestricted:       "Port restricted NAT",
 		NATNone:                 "Not behind a NAT",
 		NATSymmetricUDPFirewall: "Symmetric UDP firewall",
+		NATUnknownFiltering:     "NAT of unknown filtering behavior",
 	}
 }
 
@@ -70,12 +73,26 @@ func (nat NATType) String() string {
 	return "Unknown"
 }
 
+// KeepaliveMode is the kind of message sent by Keepalive.
+type KeepaliveMode int
+
+// Keepalive modes.
+const (
+	// KeepaliveRequest sends binding requests and waits for responses,
+	// which report the mapped address.
+	KeepaliveRequest KeepaliveMode = iota
+	// KeepaliveIndication sends binding indications, which elicit no
+	// response and thus use less bandwidth (RFC 5389 Section 10).
+	KeepaliveIndication
+)
+
 const (
 	errorTryAlternate                 = 300
 	errorBadRequest                   = 400
 	errorUnauthorized                 = 401
 	errorUnassigned402                = 402
 	errorForbidden                    = 403
+	errorMobilityForbidden            = 405
 	errorUnknownAttribute             = 420
 	errorAllocationMismatch           = 437
 	errorStaleNonce                   = 438
@@ -138,11 +155,13 @@ const (
 	attributeResponseOrigin         = 0x802b
 	attributeOtherAddress           = 0x802c
 	attributeEcnCheckStun           = 0x802d
+	attributeMobilityTicket         = 0x8030
 	attributeCiscoFlowdata          = 0xc000
 )
 
 const (
 	typeBindingRequest                 = 0x0001
+	typeBindingIndication              = 0x0011
 	typeBindingResponse                = 0x0101
 	typeBindingErrorResponse           = 0x0111
 	typeSharedSecretRequest            = 0x0002
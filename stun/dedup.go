@@ -0,0 +1,100 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDedupWindow is the default time a transaction is remembered after
+// its request is sent, which covers the 39.5 seconds a transaction lasts at
+// most with the default RTO (RFC 5389 Section 7.2.1).
+const DefaultDedupWindow = 40 * time.Second
+
+// transactionLog remembers the transaction IDs of recent requests, so that
+// late and duplicated responses to them are recognized as stale. The IDs are
+// keyed on the 12 bytes following the magic cookie, and expire in the order
+// they were sent.
+type transactionLog struct {
+	mu    sync.Mutex
+	sent  map[[12]byte]time.Time
+	order []sentID // by time sent, from head on
+	head  int
+}
+
+// sentID is a transaction ID with the time it was sent.
+type sentID struct {
+	id   [12]byte
+	time time.Time
+}
+
+// transIDKey returns the key of the transaction ID.
+func transIDKey(transID []byte) (key [12]byte) {
+	copy(key[:], transID[len(transID)-12:])
+	return key
+}
+
+// add records the transaction ID and forgets IDs older than window.
+func (l *transactionLog) add(transID []byte, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if window <= 0 {
+		l.sent, l.order, l.head = nil, nil, 0
+		return
+	}
+	now := time.Now()
+	for ; l.head < len(l.order) && now.Sub(l.order[l.head].time) > window; l.head++ {
+		e := l.order[l.head]
+		// The ID may have been sent again since.
+		if l.sent[e.id].Equal(e.time) {
+			delete(l.sent, e.id)
+		}
+	}
+	// Reuse the front of the slice once most of it expired.
+	if l.head > len(l.order)/2 {
+		l.order = l.order[:copy(l.order, l.order[l.head:])]
+		l.head = 0
+	}
+	if l.sent == nil {
+		l.sent = make(map[[12]byte]time.Time)
+	}
+	key := transIDKey(transID)
+	l.sent[key] = now
+	l.order = append(l.order, sentID{key, now})
+}
+
+// contains reports whether the transaction ID was sent within window.
+func (l *transactionLog) contains(transID []byte, window time.Duration) bool {
+	if len(transID) < 12 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.sent[transIDKey(transID)]
+	return ok && time.Since(t) <= window
+}
+
+// SetDedupWindow sets how long the transaction IDs of requests are
+// remembered. Responses to these transactions arriving while another request
+// is pending, e.g. a delayed Test II answer during Test III, are discarded as
+// stale and reported by EventStaleResponse. Responses to transactions
+// unknown to the client are discarded as well. A window of 0 turns off the
+// tracking.
+func (c *Client) SetDedupWindow(d time.Duration) {
+	c.dedupWindow = d
+}
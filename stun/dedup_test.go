@@ -0,0 +1,51 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactionLog(t *testing.T) {
+	var l transactionLog
+	id := func(b byte) []byte {
+		transID := make([]byte, 16)
+		transID[15] = b
+		return transID
+	}
+	window := 50 * time.Millisecond
+	l.add(id(1), window)
+	l.add(id(2), window)
+	if !l.contains(id(1), window) || !l.contains(id(2), window) || l.contains(id(3), window) {
+		t.Errorf("contains error: %v", l.sent)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// Sending 1 again keeps it while 2 expires.
+	l.add(id(1), window)
+	l.add(id(3), window)
+	if !l.contains(id(1), window) || l.contains(id(2), window) || !l.contains(id(3), window) {
+		t.Errorf("expiry error: %v", l.sent)
+	}
+	if len(l.sent) != 2 || len(l.order)-l.head != 2 {
+		t.Errorf("expiry error: %d IDs, %d in order", len(l.sent), len(l.order)-l.head)
+	}
+	l.add(id(1), 0)
+	if l.contains(id(1), window) {
+		t.Errorf("contains error: expected nothing without window")
+	}
+}
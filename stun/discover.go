@@ -17,15 +17,97 @@
 package stun
 
 import (
+	"context"
 	"errors"
 	"net"
 )
 
 var (
-	ErrAddrNotMatch = errors.New("Server error: response IP/port")
-	ErrNoOtherAddr  = errors.New("Server error: no changed address.")
+	ErrAddrNotMatch = errors.New("response IP/port does not match")
+	ErrNoOtherAddr  = errors.New("no changed address")
 )
 
+// ValidationPolicy defines how strictly the source address of a response is
+// checked against the address the request was sent to.
+type ValidationPolicy int
+
+// Validation policies.
+const (
+	// ValidateStrict requires the response to come from the expected IP
+	// and port.
+	ValidateStrict ValidationPolicy = iota
+	// ValidateSameIP requires the response to come from the expected IP,
+	// but accepts any port.
+	ValidateSameIP
+	// ValidateAny accepts responses from any address.
+	ValidateAny
+)
+
+// ChangedAddrPolicy defines which attribute of the test1 response gives the
+// alternate address of the server used by the later tests: OTHER-ADDRESS of
+// RFC 5780 or CHANGED-ADDRESS of RFC 3489.
+type ChangedAddrPolicy int
+
+// Changed address policies.
+const (
+	// PreferOtherAddress uses OTHER-ADDRESS, and CHANGED-ADDRESS only if
+	// the response has no OTHER-ADDRESS.
+	PreferOtherAddress ChangedAddrPolicy = iota
+	// PreferChangedAddress uses CHANGED-ADDRESS, and OTHER-ADDRESS only
+	// if the response has no CHANGED-ADDRESS.
+	PreferChangedAddress
+	// OtherAddressOnly ignores CHANGED-ADDRESS.
+	OtherAddressOnly
+	// ChangedAddressOnly ignores OTHER-ADDRESS.
+	ChangedAddressOnly
+)
+
+// changedAddr returns the alternate address of the server in the response
+// according to the policy, and records both attributes in the result.
+func (c *Client) changedAddr(resp *response, r *DiscoveryResult) *Host {
+	r.ChangedAddr, r.OtherAddr = resp.changedAddr, resp.otherAddr
+	if r.AddrDiscrepancy() {
+		c.logger.Debugln("CHANGED-ADDRESS", resp.changedAddr, "disagrees with OTHER-ADDRESS", resp.otherAddr)
+	}
+	switch c.addrPolicy {
+	case PreferChangedAddress:
+		if resp.changedAddr != nil {
+			return resp.changedAddr
+		}
+		return resp.otherAddr
+	case OtherAddressOnly:
+		return resp.otherAddr
+	case ChangedAddressOnly:
+		return resp.changedAddr
+	}
+	if resp.otherAddr != nil {
+		return resp.otherAddr
+	}
+	return resp.changedAddr
+}
+
+// validAddr reports whether the response source addr is acceptable for a
+// request sent to target. changeIP and changePort are the flags of the
+// CHANGE-REQUEST attribute carried by the request: the server is expected to
+// answer from a different IP and/or port when they are set.
+func (c *Client) validAddr(addr *Host, target *net.UDPAddr, changeIP, changePort bool) bool {
+	if c.validation == ValidateAny {
+		return true
+	}
+	if addr == nil {
+		return false
+	}
+	sameIP := addr.IP() == target.IP.String()
+	samePort := addr.Port() == uint16(target.Port)
+	if sameIP == changeIP {
+		return false
+	}
+	if c.validation == ValidateSameIP {
+		return true
+	}
+	return samePort != changePort
+}
+
 // Follow RFC 3489 and RFC 5389.
 // Figure 2: Flow for type discovery process (from RFC 3489).
 //                        +--------+
@@ -70,54 +152,69 @@ var (
 //                                  |N
 //                                  |       Port
 //                                  +------>Restricted
-func (c *Client) discoverAll(conn net.PacketConn, addr *net.UDPAddr) (NATType, []*Host, error) {
+func (c *Client) discoverAll(ctx context.Context, conn net.PacketConn, addr *net.UDPAddr, r *DiscoveryResult) (NATType, []*Host, error) {
 	// Perform test1 to check if it is under NAT.
 	hs := make([]*Host, 0, 3)
 	c.logger.Debugln("Do Test1")
 	c.logger.Debugln("Send To:", addr)
-	resp, err := c.test1(conn, addr)
+	r.started(TestI)
+	resp, err := c.test1(withPhase(ctx, TestI), conn, addr)
 	if err != nil {
-		return NATError, hs, err
+		return NATError, hs, withTest(err, TestI)
 	}
 	c.logger.Debugln("Received:", resp)
+	r.addResponse(TestI, resp)
 	if resp == nil {
 		return NATBlocked, hs, nil
 	}
+	if err = responseError(resp, addr); err != nil {
+		return NATError, hs, withTest(err, TestI)
+	}
+	r.mapped(TestI, resp.mappedAddr)
 	// identical used to check if it is open Internet or not.
 	identical := resp.identical
 	// changedAddr is used to perform second time test1 and test3.
-	changedAddr := resp.changedAddr
+	changedAddr := c.changedAddr(resp, r)
 	// mappedAddr is used as the return value, its IP is used for tests
 	mappedAddr := resp.mappedAddr
 	hs = append(hs, mappedAddr)
 	// Make sure IP and port are not changed.
-	if resp.serverAddr.IP() != addr.IP.String() ||
-		resp.serverAddr.Port() != uint16(addr.Port) {
-		return NATError, hs, ErrAddrNotMatch
-	}
-	// if changedAddr is not available, use otherAddr as changedAddr,
-	// which is updated in RFC 5780
-	if changedAddr == nil {
-		changedAddr = resp.otherAddr
+	if !c.validAddr(resp.serverAddr, addr, false, false) {
+		return NATError, hs, &ProtocolError{TestI, addr, ErrAddrNotMatch}
 	}
-	// changedAddr shall not be nil
+	// Most servers have a single IP and provide no changed address, in
+	// which case only the presence of a NAT is known.
 	if changedAddr == nil {
-		return NATError, hs, ErrNoOtherAddr
+		c.logger.Debugln("No changed address, skip the rest tests")
+		r.Skipped = TestII | TestIChanged | TestIII
+		if !identical {
+			return NATUnknownFiltering, hs, nil
+		}
+		return c.discoverNoChangedAddr(ctx, conn, addr, r, hs)
 	}
 	// Perform test2 to see if the client can receive packet sent from
 	// another IP and port.
 	c.logger.Debugln("Do Test2")
 	c.logger.Debugln("Send To:", addr)
-	resp, err = c.test2(conn, addr)
+	r.started(TestII)
+	resp, err = c.test2(withPhase(ctx, TestII), conn, addr)
 	if err != nil {
-		return NATError, hs, err
+		return NATError, hs, withTest(err, TestII)
 	}
 	c.logger.Debugln("Received:", resp)
-	// Make sure IP and port are changed.
-	if resp != nil &&
-		(resp.serverAddr.IP() == addr.IP.String() ||
-			resp.serverAddr.Port() == uint16(addr.Port)) {
-		return NATError, hs, ErrAddrNotMatch
+	r.addResponse(TestII, resp)
+	if resp != nil {
+		if err = responseError(resp, addr); err != nil {
+			return NATError, hs, withTest(err, TestII)
+		}
+		r.mapped(TestII, resp.mappedAddr)
+		// Make sure IP and port are changed.
+		if !c.validAddr(resp.serverAddr, addr, true, true) {
+			return NATError, hs, &ProtocolError{TestII, addr, ErrAddrNotMatch}
+		}
+	}
+	if resp != nil {
+		r.Filtering = FilteringEndpointIndependent
 	}
 	if identical {
 		if resp == nil {
@@ -132,45 +229,94 @@ func (c *Client) discoverAll(conn net.PacketConn, addr *net.UDPAddr) (NATType, [
 	// external IP.
 	c.logger.Debugln("Do Test1")
 	c.logger.Debugln("Send To:", changedAddr)
-	caddr, err := net.ResolveUDPAddr("udp", changedAddr.String())
+	// The changed address is an IP, which is never resolved.
+	caddr, err := changedAddr.udpAddr()
 	if err != nil {
-		c.logger.Debugf("ResolveUDPAddr error: %v", err)
+		c.logger.Debugf("Changed address error: %v", err)
+		return NATError, hs, &ProtocolError{TestIChanged, addr, err}
 	}
-	resp, err = c.test1(conn, caddr)
+	r.started(TestIChanged)
+	resp, err = c.test1(withPhase(ctx, TestIChanged), conn, caddr)
 	if err != nil {
-		return NATError, hs, err
+		return NATError, hs, withTest(err, TestIChanged)
 	}
 	c.logger.Debugln("Received:", resp)
+	r.addResponse(TestIChanged, resp)
 	if resp == nil {
 		// It should be NAT_BLOCKED, but will be detected in the first
 		// step. So this will never happen.
 		return NATUnknown, hs, nil
 	}
+	if err = responseError(resp, caddr); err != nil {
+		return NATError, hs, withTest(err, TestIChanged)
+	}
+	r.mapped(TestIChanged, resp.mappedAddr)
 	// Make sure IP/port is not changed.
-	if resp.serverAddr.IP() != caddr.IP.String() ||
-		resp.serverAddr.Port() != uint16(caddr.Port) {
-		return NATError, hs, ErrAddrNotMatch
+	if !c.validAddr(resp.serverAddr, caddr, false, false) {
+		return NATError, hs, &ProtocolError{TestIChanged, caddr, ErrAddrNotMatch}
 	}
 	if mappedAddr.IP() == resp.mappedAddr.IP() && mappedAddr.Port() == resp.mappedAddr.Port() {
 		// Perform test3 to see if the client can receive packet sent
 		// from another port.
 		c.logger.Debugln("Do Test3")
 		c.logger.Debugln("Send To:", caddr)
-		resp, err = c.test3(conn, caddr)
+		r.started(TestIII)
+		resp, err = c.test3(withPhase(ctx, TestIII), conn, caddr)
 		if err != nil {
-			return NATError, hs, err
+			return NATError, hs, withTest(err, TestIII)
 		}
 		c.logger.Debugln("Received:", resp)
+		r.addResponse(TestIII, resp)
 		if resp == nil {
+			r.Filtering = FilteringAddressPortDependent
 			return NATPortRestricted, hs, nil
 		}
+		if err = responseError(resp, caddr); err != nil {
+			return NATError, hs, withTest(err, TestIII)
+		}
+		r.mapped(TestIII, resp.mappedAddr)
 		// Make sure IP is not changed, and port is changed.
-		if resp.serverAddr.IP() != caddr.IP.String() ||
-			resp.serverAddr.Port() == uint16(caddr.Port) {
-			return NATError, hs, ErrAddrNotMatch
+		if !c.validAddr(resp.serverAddr, caddr, false, true) {
+			return NATError, hs, &ProtocolError{TestIII, caddr, ErrAddrNotMatch}
 		}
+		r.Filtering = FilteringAddressDependent
 		return NATRestricted, hs, nil
 	}
 	hs = append(hs, resp.mappedAddr)
 	return NATSymmetric, hs, nil
 }
+
+// discoverNoChangedAddr performs test2 without NAT when the server provides
+// no changed address: a server which answers the CHANGE-REQUEST from another
+// address nonetheless tells an open host from a symmetric UDP firewall. The
+// other outcomes cannot tell them apart, so the result stays partial.
+func (c *Client) discoverNoChangedAddr(ctx context.Context, conn net.PacketConn, addr *net.UDPAddr, r *DiscoveryResult, hs []*Host) (NATType, []*Host, error) {
+	c.logger.Debugln("Do Test2")
+	c.logger.Debugln("Send To:", addr)
+	r.started(TestII)
+	resp, err := c.test2(withPhase(ctx, TestII), conn, addr)
+	if err != nil {
+		return NATError, hs, withTest(err, TestII)
+	}
+	c.logger.Debugln("Received:", resp)
+	r.addResponse(TestII, resp)
+	// No response, which may be a server ignoring the CHANGE-REQUEST
+	// silently, an error response, typically 420 for the unknown
+	// CHANGE-REQUEST, or a response from the same address means that the
+	// server may not change its address, whatever the validation policy.
+	if resp == nil {
+		c.logger.Debugln("No response to test2")
+		return NATNone, hs, nil
+	}
+	from := resp.serverAddr
+	if responseError(resp, addr) != nil || from == nil ||
+		from.IP() == addr.IP.String() && from.Port() == uint16(addr.Port) ||
+		!c.validAddr(from, addr, true, true) {
+		c.logger.Debugln("Server cannot change its address")
+		return NATNone, hs, nil
+	}
+	r.mapped(TestII, resp.mappedAddr)
+	r.Skipped = 0
+	r.Filtering = FilteringEndpointIndependent
+	return NATNone, hs, nil
+}
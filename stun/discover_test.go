@@ -0,0 +1,167 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidAddr(t *testing.T) {
+	target := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+	same := &Host{attributeFamilyIPv4, "1.2.3.4", 3478}
+	port := &Host{attributeFamilyIPv4, "1.2.3.4", 3479}
+	both := &Host{attributeFamilyIPv4, "1.2.3.5", 3479}
+	tests := []struct {
+		policy     ValidationPolicy
+		addr       *Host
+		changeIP   bool
+		changePort bool
+		expected   bool
+	}{
+		{ValidateStrict, same, false, false, true},
+		{ValidateStrict, port, false, false, false},
+		{ValidateStrict, both, true, true, true},
+		{ValidateStrict, port, true, true, false},
+		{ValidateStrict, port, false, true, true},
+		{ValidateStrict, same, false, true, false},
+		{ValidateStrict, nil, false, false, false},
+		{ValidateSameIP, port, false, false, true},
+		{ValidateSameIP, both, false, false, false},
+		{ValidateSameIP, same, false, true, true},
+		{ValidateSameIP, port, true, true, false},
+		{ValidateAny, both, false, false, true},
+		{ValidateAny, nil, false, false, true},
+	}
+	c := NewClient()
+	for i, test := range tests {
+		c.SetValidationPolicy(test.policy)
+		if c.validAddr(test.addr, target, test.changeIP, test.changePort) != test.expected {
+			t.Errorf("validAddr error in case %d", i)
+		}
+	}
+}
+
+func TestChangedAddrPolicy(t *testing.T) {
+	changed := &Host{attributeFamilyIPv4, "1.2.3.5", 3479}
+	other := &Host{attributeFamilyIPv4, "1.2.3.6", 3479}
+	tests := []struct {
+		policy   ChangedAddrPolicy
+		changed  *Host
+		other    *Host
+		expected *Host
+	}{
+		{PreferOtherAddress, changed, other, other},
+		{PreferOtherAddress, changed, nil, changed},
+		{PreferChangedAddress, changed, other, changed},
+		{PreferChangedAddress, nil, other, other},
+		{OtherAddressOnly, changed, nil, nil},
+		{ChangedAddressOnly, nil, other, nil},
+	}
+	c := NewClient()
+	for i, test := range tests {
+		c.SetChangedAddrPolicy(test.policy)
+		r := new(DiscoveryResult)
+		resp := &response{changedAddr: test.changed, otherAddr: test.other}
+		if c.changedAddr(resp, r) != test.expected {
+			t.Errorf("changedAddr error in case %d", i)
+		}
+		if r.AddrDiscrepancy() != (test.changed != nil && test.other != nil) {
+			t.Errorf("AddrDiscrepancy error in case %d", i)
+		}
+	}
+}
+
+func TestDiscoverSingleAddressServer(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if r.NAT != NATNone || !r.Partial() || r.Skipped&TestII == 0 || len(r.Hosts) != 1 {
+		t.Errorf("DiscoverResult error: %+v", r)
+	}
+}
+
+// serveNoChangedAddr answers binding requests without providing a changed
+// address. Requests with a CHANGE-REQUEST are answered from other, or
+// dropped if other is nil.
+func serveNoChangedAddr(conn, other *net.UDPConn) {
+	b := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(b[:n])
+		if err != nil {
+			continue
+		}
+		from := conn
+		if req.getAttribute(attributeChangeRequest) != nil {
+			if other == nil {
+				continue
+			}
+			from = other
+		}
+		resp := &packet{transID: req.transID, types: typeBindingResponse}
+		resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, req.transID))
+		resp.addFingerprint()
+		from.WriteTo(resp.bytes(), addr)
+	}
+}
+
+func TestDiscoverNoChangedAddr(t *testing.T) {
+	for _, silent := range []bool{false, true} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP error: %v", err)
+		}
+		defer conn.Close()
+		other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP error: %v", err)
+		}
+		defer other.Close()
+		if silent {
+			go serveNoChangedAddr(conn, nil)
+		} else {
+			go serveNoChangedAddr(conn, other)
+		}
+		c := NewClient()
+		c.SetServerAddr(conn.LocalAddr().String())
+		c.SetLocalAddr("127.0.0.1:0")
+		c.SetValidationPolicy(ValidateAny)
+		c.SetTestTimeout(100 * time.Millisecond)
+		r, err := c.DiscoverResult()
+		if err != nil {
+			t.Fatalf("DiscoverResult error: %v", err)
+		}
+		if silent {
+			if r.NAT != NATNone || r.Skipped != TestII|TestIChanged|TestIII || r.Filtering != FilteringUnknown {
+				t.Errorf("DiscoverResult without test2 response error: %+v", r)
+			}
+		} else if r.NAT != NATNone || r.Partial() || r.Filtering != FilteringEndpointIndependent {
+			t.Errorf("DiscoverResult with test2 response error: %+v", r)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DefaultTLSPort is the default port of STUN over TLS and DTLS (RFC 7350).
+const DefaultTLSPort = 5349
+
+// ErrNoDTLSDialer is returned when STUN over DTLS is used without a dialer.
+var ErrNoDTLSDialer = errors.New("no DTLS dialer configured")
+
+// DTLSDialer establishes a DTLS association with the server over conn. The
+// standard library has no DTLS implementation, so this package does not ship
+// one: implementations such as github.com/pion/dtls are plugged in through
+// this interface. Closing the returned connection must not close conn.
+type DTLSDialer interface {
+	DialDTLS(conn net.PacketConn, server net.Addr, config *DTLSConfig) (net.Conn, error)
+}
+
+// DTLSSessionStore stores DTLS sessions for resumption, keyed by the server
+// address. Dialers supporting resumption should look sessions up before the
+// handshake and store them after it.
+type DTLSSessionStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, session []byte)
+}
+
+// DTLSConfig configures STUN over DTLS. The fields are passed to the
+// dialer, which is responsible for honoring them.
+type DTLSConfig struct {
+	Dialer DTLSDialer
+
+	// Certificate based authentication.
+	Certificates       []tls.Certificate
+	RootCAs            *x509.CertPool
+	ServerName         string
+	InsecureSkipVerify bool
+
+	// Pre-shared key based authentication, used if PSK is not nil.
+	PSK             func(hint []byte) ([]byte, error)
+	PSKIdentityHint []byte
+
+	// SessionStore enables session resumption if it is not nil.
+	SessionStore DTLSSessionStore
+}
+
+// SetServerDTLS allows user to use STUN over DTLS (RFC 7350) with the server,
+// whose port defaults to 5349. Over DTLS, all responses come from the server
+// address, so the discovery only performs test1: it returns the mapped
+// address with NATNone if it is local and NATUnknown otherwise. If the client
+// was created with a connection, the DTLS association is kept for later
+// calls of Discover and Keepalive.
+func (c *Client) SetServerDTLS(address string, config *DTLSConfig) {
+	if _, _, err := net.SplitHostPort(address); err != nil && !isURI(address) {
+		address = net.JoinHostPort(address, strconv.Itoa(DefaultTLSPort))
+	}
+	c.SetServerAddr(address)
+	c.dtls = config
+	c.closeDTLS()
+}
+
+// dialDTLS returns the DTLS association with the server over conn, which is
+// reused if conn is the connection of the client.
+func (c *Client) dialDTLS(conn net.PacketConn, server *net.UDPAddr) (net.PacketConn, error) {
+	if c.dtls.Dialer == nil {
+		return nil, ErrNoDTLSDialer
+	}
+	if conn == c.conn && c.dtlsConn != nil {
+		return c.dtlsConn, nil
+	}
+	dconn, err := c.dtls.Dialer.DialDTLS(conn, server, c.dtls)
+	if err != nil {
+		return nil, err
+	}
+	pc := &datagramConn{dconn}
+	if conn == c.conn {
+		c.dtlsConn = pc
+	}
+	return pc, nil
+}
+
+func (c *Client) closeDTLS() {
+	if c.dtlsConn != nil {
+		c.dtlsConn.Close()
+		c.dtlsConn = nil
+	}
+}
+
+func (c *Client) discoverDTLS(ctx context.Context, conn net.PacketConn, server *net.UDPAddr, r *DiscoveryResult) (NATType, []*Host, error) {
+	pc, err := c.dialDTLS(conn, server)
+	if err != nil {
+		return NATError, nil, err
+	}
+	if pc != c.dtlsConn {
+		defer pc.Close()
+	}
+	c.logger.Debugln("Do Test1 over DTLS")
+	r.started(TestI)
+	resp, err := c.test1(withPhase(ctx, TestI), pc, server)
+	if err != nil {
+		// The association may be broken, do not reuse it.
+		if pc == c.dtlsConn {
+			c.closeDTLS()
+		}
+		return NATError, nil, err
+	}
+	c.logger.Debugln("Received:", resp)
+	r.addResponse(TestI, resp)
+	if resp == nil {
+		return NATBlocked, nil, nil
+	}
+	if err = responseError(resp, server); err != nil {
+		return NATError, nil, withTest(err, TestI)
+	}
+	r.mapped(TestI, resp.mappedAddr)
+	hs := []*Host{resp.mappedAddr}
+	if resp.identical {
+		return NATNone, hs, nil
+	}
+	return NATUnknown, hs, nil
+}
+
+// datagramConn adapts a connected datagram connection, such as a DTLS
+// association, to net.PacketConn.
+type datagramConn struct {
+	conn net.Conn
+}
+
+func (d *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := d.conn.Read(b)
+	return n, d.conn.RemoteAddr(), err
+}
+
+func (d *datagramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return d.conn.Write(b)
+}
+
+func (d *datagramConn) Close() error {
+	return d.conn.Close()
+}
+
+func (d *datagramConn) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *datagramConn) SetDeadline(t time.Time) error {
+	return d.conn.SetDeadline(t)
+}
+
+func (d *datagramConn) SetReadDeadline(t time.Time) error {
+	return d.conn.SetReadDeadline(t)
+}
+
+func (d *datagramConn) SetWriteDeadline(t time.Time) error {
+	return d.conn.SetWriteDeadline(t)
+}
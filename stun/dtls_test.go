@@ -0,0 +1,59 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+// plainDialer stands in for a DTLS implementation with a plain UDP
+// connection to the server.
+type plainDialer struct {
+	dials int
+}
+
+func (d *plainDialer) DialDTLS(conn net.PacketConn, server net.Addr, config *DTLSConfig) (net.Conn, error) {
+	d.dials++
+	return net.DialUDP("udp", nil, server.(*net.UDPAddr))
+}
+
+func TestDiscoverDTLS(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	dialer := new(plainDialer)
+	c := NewClientWithConnection(conn)
+	c.SetServerDTLS(addr.String(), &DTLSConfig{Dialer: dialer})
+	nat, host, err := c.Discover()
+	if err != nil {
+		t.Fatalf("Discover error: %v", err)
+	}
+	if nat != NATNone || host == nil {
+		t.Errorf("Discover error: %v %v", nat, host)
+	}
+	if _, err = c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if dialer.dials != 1 {
+		t.Errorf("DTLS association not reused: %d dials", dialer.dials)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DumpFormat is the format of the packet dump.
+type DumpFormat int
+
+const (
+	// DumpHex writes every message as a header line, a line per
+	// attribute and a hex dump.
+	DumpHex DumpFormat = iota
+	// DumpPcapng writes a pcapng stream, which Wireshark decodes. The
+	// IP and UDP headers are made up from the addresses of the sockets,
+	// as the package has no access to the real ones.
+	DumpPcapng
+)
+
+var methodStr = map[uint16]string{
+	0x001: "Binding",
+	0x002: "SharedSecret",
+	0x003: "Allocate",
+	0x004: "Refresh",
+	0x006: "Send",
+	0x007: "Data",
+	0x008: "CreatePermission",
+	0x009: "ChannelBind",
+	0x00a: "Connect",
+	0x00b: "ConnectionBind",
+	0x00c: "ConnectionAttempt",
+}
+
+var classStr = map[uint16]string{
+	0x0000: "Request",
+	0x0010: "Indication",
+	0x0100: "Success Response",
+	0x0110: "Error Response",
+}
+
+var attributeStr = map[uint16]string{
+	attributeMappedAddress:      "MAPPED-ADDRESS",
+	attributeResponseAddress:    "RESPONSE-ADDRESS",
+	attributeChangeRequest:      "CHANGE-REQUEST",
+	attributeSourceAddress:      "SOURCE-ADDRESS",
+	attributeChangedAddress:     "CHANGED-ADDRESS",
+	attributeUsername:           "USERNAME",
+	attributeMessageIntegrity:   "MESSAGE-INTEGRITY",
+	attributeErrorCode:          "ERROR-CODE",
+	attributeUnknownAttributes:  "UNKNOWN-ATTRIBUTES",
+	attributeChannelNumber:      "CHANNEL-NUMBER",
+	attributeLifetime:           "LIFETIME",
+	attributeXorPeerAddress:     "XOR-PEER-ADDRESS",
+	attributeData:               "DATA",
+	attributeRealm:              "REALM",
+	attributeNonce:              "NONCE",
+	attributeXorRelayedAddress:  "XOR-RELAYED-ADDRESS",
+	attributeRequestedTransport: "REQUESTED-TRANSPORT",
+	attributeXorMappedAddress:   "XOR-MAPPED-ADDRESS",
+	attributePadding:            "PADDING",
+	attributeResponsePort:       "RESPONSE-PORT",
+	attributeSoftware:           "SOFTWARE",
+	attributeAlternateServer:    "ALTERNATE-SERVER",
+	attributeFingerprint:        "FINGERPRINT",
+	attributeResponseOrigin:     "RESPONSE-ORIGIN",
+	attributeOtherAddress:       "OTHER-ADDRESS",
+	attributeMobilityTicket:     "MOBILITY-TICKET",
+}
+
+// messageTypeString returns the method and class of the message type, e.g.
+// "Binding Request".
+func messageTypeString(types uint16) string {
+	method := types & 0x3eef
+	// Squeeze out the class bits (RFC 5389 Section 6).
+	method = method&0x000f | method>>1&0x0070 | method>>2&0x0f80
+	m, ok := methodStr[method]
+	if !ok {
+		m = fmt.Sprintf("Method(%#03x)", method)
+	}
+	return m + " " + classStr[types&0x0110]
+}
+
+func attributeString(types uint16) string {
+	if s, ok := attributeStr[types]; ok {
+		return s
+	}
+	if t, ok := LookupAttribute(types); ok && t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("%#04x", types)
+}
+
+// SetPacketDump allows user to set a writer receiving every STUN message
+// sent or received by the client in the given format, e.g. to attach a
+// capture to a bug report without running tcpdump as root. A nil writer
+// disables the dump. Write errors are logged in the verbose mode.
+func (c *Client) SetPacketDump(w io.Writer, format DumpFormat) {
+	c.dumpMu.Lock()
+	defer c.dumpMu.Unlock()
+	c.dump = w
+	c.dumpFormat = format
+	c.dumpHeader = false
+}
+
+// dumpPacket writes the message b sent from or received at local to the
+// packet dump.
+func (c *Client) dumpPacket(sent bool, local, remote net.Addr, b []byte) {
+	c.dumpMu.Lock()
+	defer c.dumpMu.Unlock()
+	if c.dump == nil {
+		return
+	}
+	var err error
+	switch c.dumpFormat {
+	case DumpPcapng:
+		if !c.dumpHeader {
+			if _, err = c.dump.Write(pcapngHeader()); err != nil {
+				break
+			}
+			c.dumpHeader = true
+		}
+		src, dst := udpAddr(local), udpAddr(remote)
+		if !sent {
+			src, dst = dst, src
+		}
+		_, err = c.dump.Write(pcapngPacket(time.Now(), ipPacket(src, dst, b)))
+	default:
+		_, err = io.WriteString(c.dump, hexDump(time.Now(), sent, local, remote, b))
+	}
+	if err != nil {
+		c.logger.Debugln("Packet dump error:", err)
+	}
+}
+
+// hexDump annotates the message with its type and attributes.
+func hexDump(t time.Time, sent bool, local, remote net.Addr, b []byte) string {
+	var sb strings.Builder
+	dir := "->"
+	if !sent {
+		dir = "<-"
+	}
+	fmt.Fprintf(&sb, "%s %v %s %v ", t.UTC().Format(time.RFC3339Nano), local, dir, remote)
+	pkt, err := parsePacket(b)
+	if err != nil {
+		fmt.Fprintf(&sb, "malformed message, %d bytes: %v\n", len(b), err)
+	} else {
+		fmt.Fprintf(&sb, "%s, %d bytes\n", messageTypeString(pkt.types), len(b))
+		for i := range pkt.attributes {
+			a := &pkt.attributes[i]
+			fmt.Fprintf(&sb, "  %s, %d bytes%s\n", attributeString(a.types), a.length, attributeValue(a, pkt.transID))
+		}
+	}
+	sb.WriteString(hex.Dump(b))
+	return sb.String()
+}
+
+// attributeValue returns the decoded value of the attributes worth it.
+func attributeValue(a *attribute, transID []byte) string {
+	switch a.types {
+	case attributeMappedAddress, attributeSourceAddress, attributeChangedAddress,
+		attributeAlternateServer, attributeResponseOrigin, attributeOtherAddress:
+		return ": " + a.rawAddr().String()
+	case attributeXorMappedAddress, attributeXorPeerAddress, attributeXorRelayedAddress:
+		return ": " + a.xorAddr(transID).String()
+	case attributeSoftware, attributeUsername, attributeRealm:
+		return fmt.Sprintf(": %q", a.value[:a.length])
+	case attributeErrorCode:
+		if e, ok := parseErrorCode(a.value[:a.length]); ok {
+			return fmt.Sprintf(": %d %q", e.Code(), e.Reason)
+		}
+	}
+	return ""
+}
+
+// udpAddr converts addr to a UDP address, the zero address if it is not one.
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a
+	}
+	if addr != nil {
+		if a, err := net.ResolveUDPAddr("udp", addr.String()); err == nil {
+			return a
+		}
+	}
+	return &net.UDPAddr{}
+}
+
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngLinkTypeRaw      = 101 // raw IPv4 or IPv6 packets
+	pcapngTimeResolutionUs = 1000000
+)
+
+// pcapngHeader returns the section header and the interface description
+// blocks starting a pcapng stream.
+func pcapngHeader() []byte {
+	b := make([]byte, 48)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], pcapngSectionHeader)
+	le.PutUint32(b[4:], 28)
+	le.PutUint32(b[8:], pcapngByteOrderMagic)
+	le.PutUint16(b[12:], 1) // major version
+	le.PutUint16(b[14:], 0) // minor version
+	le.PutUint64(b[16:], ^uint64(0))
+	le.PutUint32(b[24:], 28)
+	le.PutUint32(b[28:], pcapngInterfaceDesc)
+	le.PutUint32(b[32:], 20)
+	le.PutUint16(b[36:], pcapngLinkTypeRaw)
+	le.PutUint32(b[40:], 0) // no snap length limit
+	le.PutUint32(b[44:], 20)
+	return b
+}
+
+// pcapngPacket returns the enhanced packet block of the packet.
+func pcapngPacket(t time.Time, pkt []byte) []byte {
+	padded := (len(pkt) + 3) &^ 3
+	b := make([]byte, 32+padded)
+	le := binary.LittleEndian
+	ts := uint64(t.UnixNano() / (1e9 / pcapngTimeResolutionUs))
+	le.PutUint32(b[0:], pcapngEnhancedPacket)
+	le.PutUint32(b[4:], uint32(len(b)))
+	le.PutUint32(b[8:], 0) // interface
+	le.PutUint32(b[12:], uint32(ts>>32))
+	le.PutUint32(b[16:], uint32(ts))
+	le.PutUint32(b[20:], uint32(len(pkt)))
+	le.PutUint32(b[24:], uint32(len(pkt)))
+	copy(b[28:], pkt)
+	le.PutUint32(b[len(b)-4:], uint32(len(b)))
+	return b
+}
+
+// ipPacket wraps the payload in made up UDP and IP headers. The family is
+// the one of dst, an unspecified or mismatching src IP is replaced by the
+// zero address of the family.
+func ipPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+	if dstIP := dst.IP.To4(); dstIP != nil || dst.IP == nil {
+		if dstIP == nil {
+			dstIP = net.IPv4zero.To4()
+		}
+		srcIP := src.IP.To4()
+		if srcIP == nil {
+			srcIP = net.IPv4zero.To4()
+		}
+		pseudo := append(append(append([]byte(nil), srcIP...), dstIP...), 0, 17, udp[4], udp[5])
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		return append(ip, udp...)
+	}
+	dstIP := dst.IP.To16()
+	srcIP := src.IP.To16()
+	if srcIP == nil || srcIP.To4() != nil {
+		srcIP = net.IPv6unspecified
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(udp)))
+	pseudo := append(append(append(append([]byte(nil), srcIP...), dstIP...), length...), 0, 0, 0, 17)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17 // UDP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], srcIP)
+	copy(ip[24:], dstIP)
+	return append(ip, udp...)
+}
+
+// udpChecksum returns the UDP checksum over the pseudo header and the
+// datagram, where 0 is sent as all ones (RFC 768).
+func udpChecksum(pseudo, udp []byte) uint16 {
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
+
+// checksum adds b to the ones' complement sum (RFC 1071). b must have an
+// even length unless it is the last part.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,91 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMessageTypeString(t *testing.T) {
+	tests := map[uint16]string{
+		typeBindingRequest:         "Binding Request",
+		typeBindingIndication:      "Binding Indication",
+		typeBindingResponse:        "Binding Success Response",
+		typeBindingErrorResponse:   "Binding Error Response",
+		typeChannelBindingResponse: "ChannelBind Success Response",
+	}
+	for types, s := range tests {
+		if got := messageTypeString(types); got != s {
+			t.Errorf("messageTypeString(%#04x) error: expected %q, get %q", types, s, got)
+		}
+	}
+}
+
+func TestPacketDump(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	for _, format := range []DumpFormat{DumpHex, DumpPcapng} {
+		c := NewClient()
+		c.SetServerAddr(addr.String())
+		c.SetLocalAddr("127.0.0.1:0")
+		var buf bytes.Buffer
+		c.SetPacketDump(&buf, format)
+		if _, err := c.ExternalIP(context.Background()); err != nil {
+			t.Fatalf("ExternalIP error: %v", err)
+		}
+		b := buf.Bytes()
+		if format == DumpHex {
+			if !strings.Contains(buf.String(), "Binding Request") ||
+				!strings.Contains(buf.String(), "XOR-MAPPED-ADDRESS, 8 bytes: 127.0.0.1:") {
+				t.Errorf("hex dump error:\n%s", b)
+			}
+			continue
+		}
+		// Walk the blocks: the section header, the interface
+		// description and a packet per message.
+		var blocks []uint32
+		for len(b) >= 12 {
+			n := binary.LittleEndian.Uint32(b[4:])
+			if n < 12 || int(n) > len(b) || binary.LittleEndian.Uint32(b[n-4:]) != n {
+				t.Fatalf("pcapng block error: %x", b)
+			}
+			blocks = append(blocks, binary.LittleEndian.Uint32(b))
+			b = b[n:]
+		}
+		if len(blocks) != 4 || blocks[0] != pcapngSectionHeader || blocks[2] != pcapngEnhancedPacket {
+			t.Errorf("pcapng blocks error: %x", blocks)
+		}
+	}
+}
+
+func TestIPPacket(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	dst := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 3478}
+	p := ipPacket(src, dst, []byte("stun"))
+	if len(p) != 32 || p[0] != 0x45 || checksum(0, p[:20]) != 0xffff {
+		t.Errorf("IPv4 packet error: %x", p)
+	}
+	p = ipPacket(&net.UDPAddr{IP: net.IPv6loopback}, &net.UDPAddr{IP: net.IPv6loopback, Port: 3478}, nil)
+	if len(p) != 48 || p[0] != 0x60 {
+		t.Errorf("IPv6 packet error: %x", p)
+	}
+}
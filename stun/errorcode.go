@@ -0,0 +1,73 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"fmt"
+)
+
+// ErrorCode is the value of the ERROR-CODE attribute of error responses (RFC
+// 5389 Section 15.6), e.g. 401 Unauthorized.
+type ErrorCode struct {
+	Class  int    // hundreds digit of the code, from 3 to 6
+	Number int    // code modulo 100
+	Reason string // reason phrase
+}
+
+// Code returns the code as a number, e.g. 401.
+func (e ErrorCode) Code() int {
+	return e.Class*100 + e.Number
+}
+
+func (e ErrorCode) String() string {
+	return fmt.Sprintf("%d %s", e.Code(), e.Reason)
+}
+
+// parseErrorCode parses the unpadded value of an ERROR-CODE attribute.
+func parseErrorCode(value []byte) (ErrorCode, bool) {
+	if len(value) < 4 {
+		return ErrorCode{}, false
+	}
+	return ErrorCode{
+		Class:  int(value[2] & 0x07),
+		Number: int(value[3]),
+		Reason: string(value[4:]),
+	}, true
+}
+
+// getErrorCode returns the ERROR-CODE attribute of the packet, nil if it is
+// not present.
+func getErrorCode(pkt *packet) *ErrorCode {
+	a := pkt.getAttribute(attributeErrorCode)
+	if a == nil {
+		return nil
+	}
+	e, ok := parseErrorCode(a.value[:a.length])
+	if !ok {
+		return nil
+	}
+	return &e
+}
+
+// ErrorCode returns the ERROR-CODE attribute of the message.
+func (m *Message) ErrorCode() (ErrorCode, bool) {
+	value, ok := m.Get(attributeErrorCode)
+	if !ok {
+		return ErrorCode{}, false
+	}
+	return parseErrorCode(value)
+}
@@ -0,0 +1,179 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var testStr = []struct {
+	test Tests
+	name string
+}{
+	{TestI, "Test I"},
+	{TestII, "Test II"},
+	{TestIChanged, "Test I to the changed address"},
+	{TestIII, "Test III"},
+}
+
+func (t Tests) String() string {
+	var names []string
+	for _, s := range testStr {
+		if t&s.test != 0 {
+			names = append(names, s.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// The errors returned by the client are one of the following types, which
+// tell a server not answering (TimeoutError) from one answering with an
+// error (ServerError), a response violating the protocol (ProtocolError) and
+// a failure of the local socket (TransportError). They carry the test of the
+// discovery which failed, 0 outside of the discovery, and the server address.
+// Note a discovery concluding UDP is blocked is no error.
+
+var (
+	// ErrNoResponse is matched by a TimeoutError with errors.Is.
+	ErrNoResponse = errors.New("no response from the server")
+	// ErrNoConn is returned by the requests which need the connection
+	// of NewClientWithConnection or SetReuseConn.
+	ErrNoConn = errors.New("no connection available")
+	// ErrInvalidLocalAddr is returned when the local address of the
+	// connection cannot be parsed.
+	ErrInvalidLocalAddr = errors.New("invalid local address")
+)
+
+// TimeoutError is returned when a request is not answered after all
+// retransmissions. errors.Is(err, ErrNoResponse) holds for it.
+type TimeoutError struct {
+	Test Tests
+	Addr net.Addr
+}
+
+func (e *TimeoutError) Error() string {
+	return "no response from " + addrString(e.Addr) + testString(e.Test)
+}
+
+// Timeout reports true, as net.Error does for timeouts.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Is makes errors.Is(err, ErrNoResponse) work.
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrNoResponse
+}
+
+// ServerError is an error response of the server. The ErrorCode is zero if
+// the response lacks the ERROR-CODE attribute.
+type ServerError struct {
+	ErrorCode
+	Test Tests
+	Addr net.Addr
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %d %q from %s%s", e.Code(), e.Reason, addrString(e.Addr), testString(e.Test))
+}
+
+// ProtocolError is a response violating the protocol, e.g. coming from an
+// unexpected address or missing the mapped address. Err is the violation.
+type ProtocolError struct {
+	Test Tests
+	Addr net.Addr
+	Err  error
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error from " + addrString(e.Addr) + testString(e.Test) + ": " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is a failure of the socket, e.g. of writing to an
+// unreachable network. Op is the failed operation, "read" or "write".
+type TransportError struct {
+	Op   string
+	Test Tests
+	Addr net.Addr
+	Err  error
+}
+
+func (e *TransportError) Error() string {
+	return e.Op + " " + addrString(e.Addr) + testString(e.Test) + ": " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return "<nil>"
+	}
+	return addr.String()
+}
+
+func testString(t Tests) string {
+	if t == 0 {
+		return ""
+	}
+	return " in " + t.String()
+}
+
+// withTest records the test in which err occurred.
+func withTest(err error, t Tests) error {
+	var (
+		te *TimeoutError
+		se *ServerError
+		pe *ProtocolError
+		xe *TransportError
+	)
+	switch {
+	case errors.As(err, &te):
+		te.Test = t
+	case errors.As(err, &se):
+		se.Test = t
+	case errors.As(err, &pe):
+		pe.Test = t
+	case errors.As(err, &xe):
+		xe.Test = t
+	}
+	return err
+}
+
+// responseError returns the error the response stands for: a ServerError
+// for an error response and a ProtocolError if it lacks the mapped address.
+func responseError(resp *response, addr net.Addr) error {
+	if isErrorResponse(resp.packet.types) {
+		e := &ServerError{Addr: addr}
+		if resp.errorCode != nil {
+			e.ErrorCode = *resp.errorCode
+		}
+		return e
+	}
+	if resp.mappedAddr == nil {
+		return &ProtocolError{Addr: addr, Err: ErrNoMappedAddr}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+	var err error = &TimeoutError{Addr: &net.UDPAddr{}}
+	if !errors.Is(withTest(err, TestII), ErrNoResponse) {
+		t.Errorf("errors.Is(TimeoutError, ErrNoResponse) error")
+	}
+	if err.(*TimeoutError).Test != TestII {
+		t.Errorf("withTest error: %v", err)
+	}
+	err = &ProtocolError{Test: TestI, Err: ErrAddrNotMatch}
+	if !errors.Is(err, ErrAddrNotMatch) {
+		t.Errorf("errors.Is(ProtocolError, ErrAddrNotMatch) error")
+	}
+	if s := (TestI | TestIII).String(); s != "Test I, Test III" {
+		t.Errorf("Tests.String error: %q", s)
+	}
+}
+
+func TestServerErrorResponse(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer sconn.Close()
+	// Answer the request with a 400 error.
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		n, addr, err := sconn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(buf[:n])
+		if err != nil {
+			return
+		}
+		resp := &packet{types: typeBindingErrorResponse, transID: req.transID}
+		resp.addAttribute(*newErrorCodeAttribute(errorBadRequest, "Bad Request"))
+		sconn.WriteTo(resp.bytes(), addr)
+	}()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(sconn.LocalAddr().String())
+	_, err = c.Keepalive()
+	var se *ServerError
+	if !errors.As(err, &se) || se.Code() != errorBadRequest || se.Reason != "Bad Request" {
+		t.Errorf("Keepalive error: expected server error 400, get %v", err)
+	}
+}
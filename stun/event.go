@@ -0,0 +1,86 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"time"
+)
+
+// EventType is the type of an event in the lifecycle of a request.
+type EventType int
+
+// Event types.
+const (
+	EventRequestSent      EventType = iota // first transmission of a request
+	EventRetransmit                        // retransmission of a request
+	EventResponseReceived                  // response matching a request
+	EventServerError                       // error response, follows EventResponseReceived
+	EventTimeout                           // no response after all retransmissions
+	EventStaleResponse                     // discarded response to an earlier request
+)
+
+var eventTypeStr = map[EventType]string{
+	EventRequestSent:      "RequestSent",
+	EventRetransmit:       "Retransmit",
+	EventResponseReceived: "ResponseReceived",
+	EventServerError:      "ServerError",
+	EventTimeout:          "Timeout",
+	EventStaleResponse:    "StaleResponse",
+}
+
+func (t EventType) String() string {
+	if s, ok := eventTypeStr[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Event is an event in the lifecycle of a request.
+type Event struct {
+	Type          EventType
+	Time          time.Time
+	Addr          net.Addr // address the request is sent to or the response comes from
+	TransactionID []byte   // magic cookie followed by the 12 bytes transaction id
+	Attempt       int      // number of the transmission, starting from 1
+	Raw           []byte   // the raw message sent or received, nil for EventTimeout
+}
+
+// OnEvent allows user to set a callback which is called synchronously for
+// every event in the lifecycle of the requests of the client, e.g. to build
+// tracing or packet capture tools. The slices in the event are copies and
+// may be retained. Calls are never concurrent, even when the IP families are
+// raced. A nil callback disables the events.
+func (c *Client) OnEvent(f func(Event)) {
+	c.onEvent = f
+}
+
+func (c *Client) emit(t EventType, addr net.Addr, transID []byte, attempt int, raw []byte) {
+	if c.onEvent == nil {
+		return
+	}
+	c.eventMu.Lock()
+	defer c.eventMu.Unlock()
+	c.onEvent(Event{
+		Type:          t,
+		Time:          time.Now(),
+		Addr:          addr,
+		TransactionID: append([]byte(nil), transID...),
+		Attempt:       attempt,
+		Raw:           append([]byte(nil), raw...),
+	})
+}
@@ -0,0 +1,47 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientEvents(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr.String())
+	var events []Event
+	c.OnEvent(func(e Event) {
+		events = append(events, e)
+	})
+	if _, err = c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != EventRequestSent || events[1].Type != EventResponseReceived {
+		t.Fatalf("events error: %v", events)
+	}
+	if len(events[1].Raw) == 0 || string(events[0].TransactionID) != string(events[1].TransactionID) {
+		t.Errorf("event error: %+v", events[1])
+	}
+}
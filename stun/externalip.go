@@ -0,0 +1,137 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrNoMappedAddr = errors.New("no mapped address")
+	ErrIPMismatch   = errors.New("servers report different external IPs")
+)
+
+// SetVerifyServerAddr allows user to set a second STUN server, against which
+// ExternalIP cross-checks the external IP. An empty address disables the
+// check, which is the default.
+func (c *Client) SetVerifyServerAddr(address string) {
+	c.verifyAddr = address
+}
+
+// ExternalIP returns the external IP of the client. Unlike Discover, it only
+// performs test1, so it takes a single round trip. If a verify server is
+// set, the IP reported by it must agree, otherwise ErrIPMismatch is
+// returned. A cached discovery result is used if it is fresh.
+func (c *Client) ExternalIP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	c.defaultServer(ctx)
+	if c.cache != nil && c.cacheServer == c.serverAddr && time.Since(c.cacheTime) < c.cacheTTL &&
+		len(c.cache.Hosts) > 0 {
+		return net.ParseIP(c.cache.Hosts[0].IP()), nil
+	}
+	if c.wsURL != "" {
+		conn, err := dialWebSocket(ctx, c.wsURL, c.wsTLS)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return c.mappedIP(ctx, conn, conn.conn.RemoteAddr())
+	}
+	if v6, v4, ok := c.raceAddrs(ctx, c.serverAddr); ok && c.verifyAddr == "" {
+		return c.externalIPRace(ctx, v6, v4)
+	}
+	serverUDPAddr, err := c.resolveUDPAddr(ctx, "udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, done, err := c.listen(serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	pc := conn
+	if c.dtls != nil {
+		if pc, err = c.dialDTLS(conn, serverUDPAddr); err != nil {
+			return nil, err
+		}
+		if pc != c.dtlsConn {
+			defer pc.Close()
+		}
+	}
+	ip, err := c.mappedIP(ctx, pc, serverUDPAddr)
+	if err != nil || c.verifyAddr == "" {
+		return ip, err
+	}
+	verifyUDPAddr, err := c.resolveUDPAddr(ctx, "udp", c.verifyAddr)
+	if err != nil {
+		return nil, err
+	}
+	verifyIP, err := c.mappedIP(ctx, conn, verifyUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !ip.Equal(verifyIP) {
+		c.logger.Debugln("External IP mismatch:", ip, verifyIP)
+		return nil, ErrIPMismatch
+	}
+	return ip, nil
+}
+
+func (c *Client) externalIPRace(ctx context.Context, v6, v4 *net.UDPAddr) (net.IP, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	winner, other := c.race(ctx, v6, v4)
+	if winner.conn != nil {
+		winner.conn.Close()
+	}
+	go func() {
+		if o := <-other; o.conn != nil {
+			o.conn.Close()
+		}
+	}()
+	if winner.err != nil {
+		return nil, winner.err
+	}
+	if winner.resp == nil {
+		return nil, &TimeoutError{Test: TestI, Addr: winner.addr}
+	}
+	if err := responseError(winner.resp, winner.addr); err != nil {
+		return nil, withTest(err, TestI)
+	}
+	return net.ParseIP(winner.resp.mappedAddr.IP()), nil
+}
+
+func (c *Client) mappedIP(ctx context.Context, conn net.PacketConn, addr net.Addr) (net.IP, error) {
+	c.logger.Debugln("Do Test1")
+	c.logger.Debugln("Send To:", addr)
+	resp, err := c.test1(ctx, conn, addr)
+	if err != nil {
+		return nil, withTest(err, TestI)
+	}
+	c.logger.Debugln("Received:", resp)
+	if resp == nil {
+		return nil, &TimeoutError{Test: TestI, Addr: addr}
+	}
+	if err = responseError(resp, addr); err != nil {
+		return nil, withTest(err, TestI)
+	}
+	return net.ParseIP(resp.mappedAddr.IP()), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestExternalIP(t *testing.T) {
+	s1, addr1 := newTestServer(t)
+	defer s1.Close()
+	s2, addr2 := newTestServer(t)
+	defer s2.Close()
+	c := NewClient()
+	c.SetServerAddr(addr1.String())
+	c.SetVerifyServerAddr(addr2.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	ip, err := c.ExternalIP(context.Background())
+	if err != nil {
+		t.Fatalf("ExternalIP error: %v", err)
+	}
+	if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("ExternalIP error: %v", ip)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = c.ExternalIP(ctx); err != context.Canceled {
+		t.Errorf("ExternalIP error: expected context.Canceled, get %v", err)
+	}
+}
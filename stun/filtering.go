@@ -0,0 +1,183 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+)
+
+// FilteringBehavior is the filtering behavior of a NAT (RFC 4787 Section 5),
+// i.e. which remote endpoints may send packets to a mapping once the
+// internal endpoint has sent to one.
+type FilteringBehavior int
+
+// Filtering behaviors.
+const (
+	// FilteringUnknown is the behavior when the tests could not tell it.
+	FilteringUnknown FilteringBehavior = iota
+	// FilteringEndpointIndependent accepts packets from any endpoint.
+	FilteringEndpointIndependent
+	// FilteringAddressDependent accepts packets from the IP addresses
+	// sent to, from any port.
+	FilteringAddressDependent
+	// FilteringAddressPortDependent accepts packets from the IP address
+	// and port pairs sent to only.
+	FilteringAddressPortDependent
+	// FilteringPortDependent accepts packets from the ports sent to,
+	// from any IP address. RFC 4787 does not define it, but firewalls
+	// filtering on ports behave so, which only the change-IP-only test
+	// reveals.
+	FilteringPortDependent
+)
+
+var filteringStr map[FilteringBehavior]string
+
+func init() {
+	filteringStr = map[FilteringBehavior]string{
+		FilteringUnknown:              "Unknown filtering",
+		FilteringEndpointIndependent:  "Endpoint-independent filtering",
+		FilteringAddressDependent:     "Address-dependent filtering",
+		FilteringAddressPortDependent: "Address and port-dependent filtering",
+		FilteringPortDependent:        "Port-dependent filtering",
+	}
+}
+
+func (f FilteringBehavior) String() string {
+	if s, ok := filteringStr[f]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// classifyFiltering returns the filtering behavior from whether the
+// responses of the change-IP-only, change-port-only and change-both tests
+// were received.
+func classifyFiltering(ip, port, both bool) FilteringBehavior {
+	switch {
+	case both:
+		return FilteringEndpointIndependent
+	case port && !ip:
+		return FilteringAddressDependent
+	case ip && !port:
+		return FilteringPortDependent
+	case !ip && !port:
+		return FilteringAddressPortDependent
+	}
+	// Both changes alone pass, but not together.
+	return FilteringUnknown
+}
+
+// BindingTest performs test1 on conn: a binding request to the server
+// without CHANGE-REQUEST. It returns the mapped address, or nil if the
+// request is unanswered. It opens the filter of the mapping of conn for the
+// server address, which the CHANGE-REQUEST tests on conn rely on.
+func (c *Client) BindingTest(ctx context.Context, conn net.PacketConn) (*Host, error) {
+	return c.ChangeRequestTest(ctx, conn, false, false)
+}
+
+// ChangeRequestTest sends a binding request with the CHANGE-REQUEST flags on
+// conn to the server, which answers from its other IP address if changeIP is
+// set and from its other port if changePort is set (RFC 5780 Section 7.2).
+// It returns the mapped address, or nil if the response is unanswered, which
+// means the NAT filtered it once the mapping has been opened by BindingTest.
+// The server must have an alternate address.
+func (c *Client) ChangeRequestTest(ctx context.Context, conn net.PacketConn, changeIP, changePort bool) (*Host, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	c.defaultServer(ctx)
+	serverUDPAddr, err := c.resolveUDPAddr(ctx, "udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	return c.changeRequestTest(ctx, conn, serverUDPAddr, changeIP, changePort)
+}
+
+// ChangeIPTest is ChangeRequestTest with the change-IP flag only: the
+// response comes from the other IP address of the server, but the same port.
+func (c *Client) ChangeIPTest(ctx context.Context, conn net.PacketConn) (*Host, error) {
+	return c.ChangeRequestTest(ctx, conn, true, false)
+}
+
+// ChangePortTest is ChangeRequestTest with the change-port flag only, test3:
+// the response comes from the other port of the server, but the same IP
+// address.
+func (c *Client) ChangePortTest(ctx context.Context, conn net.PacketConn) (*Host, error) {
+	return c.ChangeRequestTest(ctx, conn, false, true)
+}
+
+func (c *Client) changeRequestTest(ctx context.Context, conn net.PacketConn, addr *net.UDPAddr, changeIP, changePort bool) (*Host, error) {
+	c.logger.Debugln("Do CHANGE-REQUEST test, change IP:", changeIP, "change port:", changePort)
+	resp, err := c.sendBindingReq(ctx, conn, addr, changeIP, changePort)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debugln("Received:", resp)
+	if resp == nil {
+		return nil, nil
+	}
+	if err = responseError(resp, addr); err != nil {
+		return nil, err
+	}
+	if !c.validAddr(resp.serverAddr, addr, changeIP, changePort) {
+		return nil, &ProtocolError{Addr: addr, Err: ErrAddrNotMatch}
+	}
+	return resp.mappedAddr, nil
+}
+
+// DiscoverFiltering determines the filtering behavior of the NAT as RFC 5780
+// Section 4.4 does, but with the change-IP-only test besides the change-both
+// and change-port-only ones, all sent to the primary address of the server
+// on one socket after test1. This tells port-dependent filtering apart from
+// address and port-dependent filtering. The server must have an alternate
+// address, otherwise ErrNoOtherAddr is returned.
+func (c *Client) DiscoverFiltering(ctx context.Context) (FilteringBehavior, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	c.defaultServer(ctx)
+	serverUDPAddr, err := c.resolveUDPAddr(ctx, "udp", c.serverAddr)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	conn, done, err := c.listen(serverUDPAddr)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	defer done()
+	resp, err := c.test1(ctx, conn, serverUDPAddr)
+	if err != nil {
+		return FilteringUnknown, withTest(err, TestI)
+	}
+	if resp == nil {
+		return FilteringUnknown, &TimeoutError{Test: TestI, Addr: serverUDPAddr}
+	}
+	if err = responseError(resp, serverUDPAddr); err != nil {
+		return FilteringUnknown, withTest(err, TestI)
+	}
+	if c.changedAddr(resp, &DiscoveryResult{}) == nil {
+		return FilteringUnknown, ErrNoOtherAddr
+	}
+	var got [3]bool
+	for i, f := range []struct{ ip, port bool }{{true, false}, {false, true}, {true, true}} {
+		host, err := c.changeRequestTest(ctx, conn, serverUDPAddr, f.ip, f.port)
+		if err != nil {
+			return FilteringUnknown, err
+		}
+		got[i] = host != nil
+	}
+	return classifyFiltering(got[0], got[1], got[2]), nil
+}
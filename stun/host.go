@@ -68,3 +68,13 @@ func (h *Host) TransportAddr() string {
 func (h *Host) String() string {
 	return h.TransportAddr()
 }
+
+// udpAddr returns the UDP address of the host, parsing the IP without
+// resolving names.
+func (h *Host) udpAddr() (*net.UDPAddr, error) {
+	ip := net.ParseIP(h.ip)
+	if ip == nil {
+		return nil, &net.AddrError{Err: "invalid IP address", Addr: h.ip}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(h.port)}, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// readICMPError drains the error queue of the socket, which IP_RECVERR fills
+// with the ICMP errors. It returns whether the queue has any, i.e. whether
+// the failed read was caused by the queued errors, and the error of the last
+// one about each of addrs.
+func readICMPError(conn net.PacketConn, addrs []net.Addr) (bool, []error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false, nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	found := make([]error, len(addrs))
+	queued := false
+	buf := make([]byte, 0)
+	oob := make([]byte, 512)
+	rc.Read(func(fd uintptr) bool {
+		for {
+			_, oobn, _, from, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err != nil {
+				// The queue is empty, do not wait for it.
+				return true
+			}
+			queued = true
+			errno, ok := extendedErr(oob[:oobn])
+			if !ok {
+				continue
+			}
+			for i, addr := range addrs {
+				if target, ok := addr.(*net.UDPAddr); ok && sockaddrEqual(from, target) {
+					found[i] = errno
+				}
+			}
+		}
+	})
+	return queued, found
+}
+
+// extendedErr returns the error number of the sock_extended_err in the
+// control messages.
+func extendedErr(oob []byte) (syscall.Errno, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if (m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR) ||
+			(m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) {
+			if len(m.Data) >= 4 {
+				return syscall.Errno(binary.NativeEndian.Uint32(m.Data)), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func sockaddrEqual(sa syscall.Sockaddr, addr *net.UDPAddr) bool {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Port == addr.Port && net.IP(sa.Addr[:]).Equal(addr.IP)
+	case *syscall.SockaddrInet6:
+		return sa.Port == addr.Port && net.IP(sa.Addr[:]).Equal(addr.IP)
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrNoInterfaceAddr is returned when the interface has no address of the
+// same family as the server address.
+var ErrNoInterfaceAddr = errors.New("no usable address on interface")
+
+// InterfaceResult is the result of the discovery performed on one network
+// interface.
+type InterfaceResult struct {
+	Interface string       // name of the interface
+	LocalAddr *net.UDPAddr // local address the discovery was bound to
+	NAT       NATType      // NAT type observed via this interface
+	Hosts     []*Host      // mapped addresses observed via this interface
+	Err       error        // error of the discovery, if any
+}
+
+// DiscoverAllInterfaces performs the discovery on every interface which is up
+// and not a loopback, and returns the NAT type observed via each of them.
+// The connection passed to NewClientWithConnection, the local address and the
+// interface set to the client are not used. Interfaces without an address of
+// the same family as the server address are skipped. The timeout of
+// SetTimeout covers all the interfaces.
+func (c *Client) DiscoverAllInterfaces() ([]*InterfaceResult, error) {
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	c.defaultServer(ctx)
+	serverUDPAddr, err := c.resolveUDPAddr(ctx, "udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	ifNames, ips, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	// The first address of the family of the server on each interface.
+	v4 := serverUDPAddr.IP.To4() != nil
+	var names []string
+	var laddrs []*net.UDPAddr
+	for i, ip := range ips {
+		if (ip.To4() != nil) != v4 || len(names) > 0 && names[len(names)-1] == ifNames[i] {
+			continue
+		}
+		names = append(names, ifNames[i])
+		laddrs = append(laddrs, &net.UDPAddr{IP: ip})
+	}
+	return c.discoverInterfaces(ctx, names, laddrs, serverUDPAddr), nil
+}
+
+// discoverInterfaces performs the discovery on the local addresses of the
+// interfaces with the names one after another.
+func (c *Client) discoverInterfaces(ctx context.Context, names []string, laddrs []*net.UDPAddr, serverUDPAddr *net.UDPAddr) []*InterfaceResult {
+	results := make([]*InterfaceResult, 0, len(laddrs))
+	for i, laddr := range laddrs {
+		c.logger.Debugln("Discover on interface:", names[i], laddr)
+		result := &InterfaceResult{Interface: names[i], LocalAddr: laddr}
+		conn, err := c.listenUDP(c.socket, "udp", laddr)
+		if err != nil {
+			result.NAT, result.Err = NATError, err
+		} else {
+			result.NAT, result.Hosts, result.Err = c.discoverAll(ctx, conn, serverUDPAddr, new(DiscoveryResult))
+			conn.Close()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// interfaceUDPAddr returns the first global unicast address on the interface
+// which has the same family as the server address.
+func interfaceUDPAddr(ifi *net.Interface, server *net.UDPAddr) (*net.UDPAddr, error) {
+	ips, err := globalUnicastIPs(ifi)
+	if err != nil {
+		return nil, err
+	}
+	v4 := server.IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			return &net.UDPAddr{IP: ip}, nil
+		}
+	}
+	return nil, ErrNoInterfaceAddr
+}
+
+// interfaceAddrs returns the global unicast addresses of the interfaces
+// which are up and not loopbacks, in the order of the interfaces, with the
+// names of their interfaces. The interfaces whose addresses cannot be read
+// are skipped.
+func interfaceAddrs() (names []string, ips []net.IP, err error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ifis {
+		ifi := &ifis[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := globalUnicastIPs(ifi)
+		if err != nil {
+			continue
+		}
+		for _, ip := range addrs {
+			names = append(names, ifi.Name)
+			ips = append(ips, ip)
+		}
+	}
+	return names, ips, nil
+}
+
+// globalUnicastIPs returns the global unicast addresses of the interface.
+func globalUnicastIPs(ifi *net.Interface) ([]net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
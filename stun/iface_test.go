@@ -0,0 +1,118 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetLocalAddr(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	// Find a free port to bind to.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if r.LocalAddr == nil || r.LocalAddr.IP() != "127.0.0.1" || int(r.LocalAddr.Port()) != port {
+		t.Errorf("LocalAddr error: expected 127.0.0.1:%d, get %v", port, r.LocalAddr)
+	}
+	if len(r.Hosts) != 1 || r.Hosts[0].IP() != "127.0.0.1" || int(r.Hosts[0].Port()) != port {
+		t.Errorf("Hosts error: expected 127.0.0.1:%d, get %v", port, r.Hosts)
+	}
+}
+
+func TestDiscoverInterfaces(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	// The second address is not local, binding to it fails.
+	unusable := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	results := c.discoverInterfaces(context.Background(), []string{"lo", "test0"}, []*net.UDPAddr{loopback, unusable}, addr)
+	if len(results) != 2 {
+		t.Fatalf("discoverInterfaces error: expected 2 results, get %d", len(results))
+	}
+	if r := results[0]; r.Interface != "lo" || r.Err != nil || r.NAT != NATNone || len(r.Hosts) != 1 {
+		t.Errorf("discoverInterfaces error: get %+v", r)
+	}
+	if r := results[1]; r.Interface != "test0" || r.Err == nil || r.NAT != NATError {
+		t.Errorf("discoverInterfaces error: expected a bind error, get %+v", r)
+	}
+}
+
+func TestInterfaceUDPAddr(t *testing.T) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Interfaces error: %v", err)
+	}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	for i := range ifis {
+		laddr, err := interfaceUDPAddr(&ifis[i], server)
+		if err == ErrNoInterfaceAddr {
+			continue
+		}
+		if err != nil {
+			t.Errorf("interfaceUDPAddr error: %v", err)
+			continue
+		}
+		if laddr.IP.To4() == nil || !laddr.IP.IsGlobalUnicast() || laddr.Port != 0 {
+			t.Errorf("interfaceUDPAddr error: get %v on %s", laddr, ifis[i].Name)
+		}
+	}
+}
+
+func TestDiscoverInterfacesTimeout(t *testing.T) {
+	// A socket which never answers.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer silent.Close()
+	c := NewClient()
+	c.SetServerAddr(silent.LocalAddr().String())
+	c.SetTimeout(100 * time.Millisecond)
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	start := time.Now()
+	results := c.discoverInterfaces(ctx, []string{"lo", "lo", "lo"}, []*net.UDPAddr{loopback, loopback, loopback}, silent.LocalAddr().(*net.UDPAddr))
+	// The interfaces share the timeout rather than having one each.
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("discoverInterfaces error: took %v", d)
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("discoverInterfaces error: expected %v, get %v", context.DeadlineExceeded, r.Err)
+		}
+	}
+}
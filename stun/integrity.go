@@ -0,0 +1,99 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+)
+
+const messageIntegritySize = 20
+
+// newMessageIntegrityAttribute computes the HMAC-SHA1 of the packet with the
+// key (RFC 5389 Section 15.4). It must be added after all other attributes
+// except FINGERPRINT.
+func newMessageIntegrityAttribute(pkt *packet, key []byte) *attribute {
+	// The length field used in the HMAC covers the MESSAGE-INTEGRITY
+	// attribute itself, but not the attributes after it.
+	pkt.length += messageIntegritySize + 4
+	mac := hmac.New(sha1.New, key)
+	b := getBuffer()
+	mac.Write(pkt.appendTo(*b))
+	putBuffer(b)
+	pkt.length -= messageIntegritySize + 4
+	return newAttribute(attributeMessageIntegrity, mac.Sum(nil))
+}
+
+// verifyMessageIntegrity checks the MESSAGE-INTEGRITY attribute of the raw
+// packet with the key. It returns false if the attribute is not present.
+func verifyMessageIntegrity(packetBytes []byte, key []byte) bool {
+	if len(packetBytes) < 20 {
+		return false
+	}
+	for pos := 20; pos+4 <= len(packetBytes); {
+		types := binary.BigEndian.Uint16(packetBytes[pos : pos+2])
+		length := int(binary.BigEndian.Uint16(packetBytes[pos+2 : pos+4]))
+		if pos+4+length > len(packetBytes) {
+			return false
+		}
+		if types != attributeMessageIntegrity {
+			pos += int(align(uint16(length))) + 4
+			continue
+		}
+		if length != messageIntegritySize {
+			return false
+		}
+		// Compute the HMAC over the header and the attributes prior
+		// to MESSAGE-INTEGRITY, with the length adjusted to end
+		// right after it.
+		var header [4]byte
+		copy(header[:2], packetBytes[:2])
+		binary.BigEndian.PutUint16(header[2:4], uint16(pos+4+length-20))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(header[:])
+		mac.Write(packetBytes[4:pos])
+		var sum [sha1.Size]byte
+		return hmac.Equal(mac.Sum(sum[:0]), packetBytes[pos+4:pos+4+length])
+	}
+	return false
+}
+
+// SetCredential sets the short-term credential (RFC 5389 Section 10.1) the
+// requests of the client are authenticated with: they carry the USERNAME and
+// a MESSAGE-INTEGRITY computed with the password. An empty password disables
+// the authentication.
+func (c *Client) SetCredential(username, password string) {
+	c.username = username
+	c.key = []byte(password)
+}
+
+// SetStrictIntegrity sets whether responses without a valid
+// MESSAGE-INTEGRITY for the credential of SetCredential are discarded, and
+// counted in ClientStats.Unauthenticated, as if they were never received.
+// This keeps off-path attackers, who can spoof responses but do not know the
+// password, from injecting fake mapped addresses into the results. Without a
+// credential, every response is discarded.
+func (c *Client) SetStrictIntegrity(strict bool) {
+	c.strictMI = strict
+}
+
+// authenticated reports whether the raw response is acceptable, i.e. strict
+// integrity is disabled, or the response has a valid MESSAGE-INTEGRITY.
+func (c *Client) authenticated(b []byte) bool {
+	return !c.strictMI || len(c.key) > 0 && verifyMessageIntegrity(b, c.key)
+}
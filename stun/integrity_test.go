@@ -0,0 +1,58 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStrictIntegrity(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(sconn)
+	s.SetCredential("user", "secret")
+	go s.Serve()
+	defer s.Close()
+	addr := sconn.LocalAddr()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr.String())
+	c.SetCredential("user", "secret")
+	c.SetStrictIntegrity(true)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	// The responses of a server without the credential are discarded.
+	s2, addr2 := newTestServer(t)
+	defer s2.Close()
+	c.SetServerAddr(addr2.String())
+	c.SetTestTimeout(300 * time.Millisecond)
+	if _, err := c.Keepalive(); err == nil {
+		t.Errorf("Keepalive error: expected a timeout")
+	}
+	if n := c.Stats().Unauthenticated; n == 0 {
+		t.Errorf("Unauthenticated error: expected some, get %d", n)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// LatencyStats is the statistics of round-trip times.
+type LatencyStats struct {
+	Sent     int // requests sent, or tests measured
+	Received int // round-trip times measured
+	RTTs     []time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Mean     time.Duration
+
+	// Jitter is the mean difference between consecutive round-trip
+	// times, as the interarrival jitter of RFC 3550 without smoothing.
+	Jitter time.Duration
+}
+
+// Loss returns the fraction of the requests which got no RTT measured.
+func (s LatencyStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+func newLatencyStats(sent int, rtts []time.Duration) LatencyStats {
+	s := LatencyStats{Sent: sent, Received: len(rtts), RTTs: rtts}
+	if len(rtts) == 0 {
+		return s
+	}
+	var sum, diffs time.Duration
+	s.Min, s.Max = rtts[0], rtts[0]
+	for i, rtt := range rtts {
+		sum += rtt
+		s.Min = min(s.Min, rtt)
+		s.Max = max(s.Max, rtt)
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			diffs += d
+		}
+	}
+	s.Mean = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		s.Jitter = diffs / time.Duration(len(rtts)-1)
+	}
+	return s
+}
+
+// Latency returns the statistics of the round-trip times of the tests.
+func (r *DiscoveryResult) Latency() LatencyStats {
+	rtts := make([]time.Duration, len(r.RTTs))
+	for i, t := range r.RTTs {
+		rtts[i] = t.RTT
+	}
+	return newLatencyStats(len(r.RTTs), rtts)
+}
+
+// Ping sends n binding requests to the server one after another and returns
+// the statistics of their round-trip times, e.g. to select the nearest of
+// several servers. Requests which time out or are answered only after a
+// retransmission count as lost. After other errors, Ping stops and returns
+// the statistics so far with the error.
+func (c *Client) Ping(ctx context.Context, n int) (LatencyStats, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	c.defaultServer(ctx)
+	var rtts []time.Duration
+	sent := 0
+	conn, server, done, err := c.pingConn(ctx)
+	if err != nil {
+		return newLatencyStats(sent, rtts), err
+	}
+	defer done()
+	for ; sent < n; sent++ {
+		resp, err := c.test1(ctx, conn, server)
+		if err == nil && resp != nil {
+			err = responseError(resp, server)
+		}
+		if err != nil {
+			return newLatencyStats(sent+1, rtts), err
+		}
+		if resp != nil && resp.rtt > 0 {
+			rtts = append(rtts, resp.rtt)
+		}
+	}
+	return newLatencyStats(sent, rtts), nil
+}
+
+// pingConn returns the connection to the server of Ping and a function
+// releasing it.
+func (c *Client) pingConn(ctx context.Context) (net.PacketConn, net.Addr, func(), error) {
+	if c.wsURL != "" {
+		ws, err := dialWebSocket(ctx, c.wsURL, c.wsTLS)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return ws, ws.conn.RemoteAddr(), func() { ws.Close() }, nil
+	}
+	server, err := c.resolveUDPAddr(ctx, "udp", c.serverAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn, done, err := c.listen(server)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if c.dtls == nil {
+		return conn, server, done, nil
+	}
+	pc, err := c.dialDTLS(conn, server)
+	if err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	if pc == c.dtlsConn {
+		return pc, server, done, nil
+	}
+	return pc, server, func() { pc.Close(); done() }, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	ms := time.Millisecond
+	s := newLatencyStats(5, []time.Duration{10 * ms, 30 * ms, 20 * ms, 40 * ms})
+	if s.Min != 10*ms || s.Max != 40*ms || s.Mean != 25*ms || s.Jitter != 50*ms/3 || s.Loss() != 0.2 {
+		t.Errorf("stats error: %+v, loss %v", s, s.Loss())
+	}
+	s = newLatencyStats(0, nil)
+	if s.Mean != 0 || s.Loss() != 0 {
+		t.Errorf("empty stats error: %+v", s)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	stats, err := c.Ping(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+	if stats.Sent != 5 || stats.Received != 5 || stats.Loss() != 0 || stats.Min <= 0 || stats.Max < stats.Mean {
+		t.Errorf("Ping stats error: %+v", stats)
+	}
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if len(r.RTTs) != 2 || r.RTTs[0].Test != TestI || r.RTTs[1].Test != TestII || r.Latency().Received != 2 {
+		t.Errorf("result RTTs error: %+v", r.RTTs)
+	}
+}
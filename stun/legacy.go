@@ -0,0 +1,94 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+// Dialect is the protocol a server speaks, as told by its responses.
+type Dialect int
+
+// Dialects of servers.
+const (
+	// DialectUnknown is the dialect without any mapped address seen.
+	DialectUnknown Dialect = iota
+	// DialectRFC3489 is the classic STUN of RFC 3489: the responses have
+	// MAPPED-ADDRESS only, or lack the magic cookie.
+	DialectRFC3489
+	// DialectRFC5389 is the STUN of RFC 5389: the responses have the
+	// magic cookie and XOR-MAPPED-ADDRESS.
+	DialectRFC5389
+)
+
+var dialectStr map[Dialect]string
+
+func init() {
+	dialectStr = map[Dialect]string{
+		DialectUnknown: "Unknown dialect",
+		DialectRFC3489: "RFC 3489",
+		DialectRFC5389: "RFC 5389",
+	}
+}
+
+func (d Dialect) String() string {
+	if s, ok := dialectStr[d]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// SetLegacyCompat sets the client to accept RFC 3489 servers which do not
+// echo the magic cookie in the transaction ID of their responses, whose
+// transactions are then matched on the remaining 12 bytes. For the
+// responses of RFC 3489 servers, the MAPPED-ADDRESS is the mapped address.
+// The responses are always validated against the source of the packet; the
+// SOURCE-ADDRESS, which anyone on the path may forge, is only informational
+// and exposed in Response.SourceAddr. The mode is disabled by default; the
+// responses with MAPPED-ADDRESS only are always accepted.
+func (c *Client) SetLegacyCompat(v bool) {
+	c.compat3489 = v
+}
+
+// hasMagicCookie reports whether the transaction ID starts with the magic
+// cookie.
+func hasMagicCookie(transID []byte) bool {
+	return len(transID) == 16 && binary.BigEndian.Uint32(transID[:4]) == magicCookie
+}
+
+// matchLegacyTransID reports whether the response lacking the magic cookie
+// matches the request on the rest of the transaction ID.
+func matchLegacyTransID(req, resp []byte) bool {
+	return len(resp) == 16 && len(req) == 16 && !hasMagicCookie(resp) &&
+		subtle.ConstantTimeCompare(req[4:], resp[4:]) == 1
+}
+
+// responseDialect returns the dialect of the server telling the mapped
+// address of the packet. XOR-MAPPED-ADDRESS cannot be decoded without the
+// magic cookie.
+func responseDialect(pkt *packet) (Dialect, *Host) {
+	if hasMagicCookie(pkt.transID) {
+		if mapped := pkt.getXorMappedAddr(); mapped != nil {
+			return DialectRFC5389, mapped
+		}
+	}
+	if mapped := pkt.getMappedAddr(); mapped != nil {
+		return DialectRFC3489, mapped
+	}
+	return DialectUnknown, nil
+}
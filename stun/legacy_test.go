@@ -0,0 +1,86 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// serveLegacy answers binding requests like an RFC 3489 server which zeroes
+// the magic cookie, with MAPPED-ADDRESS and SOURCE-ADDRESS only, the latter
+// being source.
+func serveLegacy(conn *net.UDPConn, source *net.UDPAddr) {
+	b := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(b[:n])
+		if err != nil {
+			continue
+		}
+		transID := append([]byte{0, 0, 0, 0}, req.transID[4:]...)
+		resp := &packet{transID: transID, types: typeBindingResponse}
+		resp.addAttribute(*newAddrAttribute(attributeMappedAddress, addr))
+		resp.addAttribute(*newAddrAttribute(attributeSourceAddress, source))
+		conn.WriteTo(resp.bytes(), addr)
+	}
+}
+
+func TestLegacyCompat(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	// The forged SOURCE-ADDRESS is not used to validate the responses.
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	go serveLegacy(conn, source)
+	c := NewClient()
+	c.SetServerAddr(conn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetTestTimeout(300 * time.Millisecond)
+	// Responses without the magic cookie are rejected by default.
+	if r, err := c.DiscoverResult(); err != nil || r.NAT != NATBlocked {
+		t.Errorf("DiscoverResult error: expected %v, get %v %v", NATBlocked, r.NAT, err)
+	}
+	c.SetLegacyCompat(true)
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if r.Dialect != DialectRFC3489 {
+		t.Errorf("Dialect error: expected %v, get %v", DialectRFC3489, r.Dialect)
+	}
+	if len(r.Hosts) == 0 || r.Hosts[0].IP() != "127.0.0.1" {
+		t.Errorf("Hosts error: get %v", r.Hosts)
+	}
+	if len(r.Responses) == 0 || r.Responses[0].SourceAddr.String() != source.String() ||
+		r.Responses[0].From.String() != conn.LocalAddr().String() {
+		t.Errorf("Responses error: get %+v", r.Responses)
+	}
+
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c.SetServerAddr(addr.String())
+	if r, err := c.DiscoverResult(); err != nil || r.Dialect != DialectRFC5389 {
+		t.Errorf("Dialect error: expected %v, get %v %v", DialectRFC5389, r.Dialect, err)
+	}
+}
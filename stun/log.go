@@ -17,8 +17,10 @@
 package stun
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 // Logger is a simple logger specified for this STUN client.
@@ -26,11 +28,18 @@ type Logger struct {
 	log.Logger
 	debug bool
 	info  bool
+	trace bool
+}
+
+// Field is a structured field of a log line, printed as key=value.
+type Field struct {
+	Key   string
+	Value interface{}
 }
 
 // NewLogger creates a default logger.
 func NewLogger() *Logger {
-	logger := &Logger{*log.New(os.Stdout, "", log.LstdFlags), false, false}
+	logger := &Logger{*log.New(os.Stdout, "", log.LstdFlags), false, false, false}
 	return logger
 }
 
@@ -44,6 +53,11 @@ func (l *Logger) SetInfo(v bool) {
 	l.info = v
 }
 
+// SetTrace sets the logger running in trace mode or not.
+func (l *Logger) SetTrace(v bool) {
+	l.trace = v
+}
+
 // Debug outputs the log in the format of log.Print.
 func (l *Logger) Debug(v ...interface{}) {
 	if l.debug {
@@ -85,3 +99,53 @@ func (l *Logger) Infoln(v ...interface{}) {
 		l.Println(v...)
 	}
 }
+
+// Trace outputs the log in the format of log.Print.
+func (l *Logger) Trace(v ...interface{}) {
+	if l.trace {
+		l.Print(v...)
+	}
+}
+
+// Tracef outputs the log in the format of log.Printf.
+func (l *Logger) Tracef(format string, v ...interface{}) {
+	if l.trace {
+		l.Printf(format, v...)
+	}
+}
+
+// Traceln outputs the log in the format of log.Println.
+func (l *Logger) Traceln(v ...interface{}) {
+	if l.trace {
+		l.Println(v...)
+	}
+}
+
+// DebugFields outputs the message followed by the fields in debug mode.
+func (l *Logger) DebugFields(msg string, fields ...Field) {
+	if l.debug {
+		l.Print(formatFields(msg, fields))
+	}
+}
+
+// TraceFields outputs the message followed by the fields in trace mode.
+func (l *Logger) TraceFields(msg string, fields ...Field) {
+	if l.trace {
+		l.Print(formatFields(msg, fields))
+	}
+}
+
+// formatFields formats the message and the fields in the logfmt style, with
+// the values quoted if they have spaces.
+func formatFields(msg string, fields []Field) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&sb, " %s=%s", f.Key, v)
+	}
+	return sb.String()
+}
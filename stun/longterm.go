@@ -0,0 +1,178 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// DefaultNonceLifetime is the time a nonce of the server is valid for.
+const DefaultNonceLifetime = 10 * time.Minute
+
+// nonceMACSize is the size of the truncated HMAC of the nonces.
+const nonceMACSize = 12
+
+// longTermAuth is the long-term credential mechanism of the server (RFC
+// 5389 Section 10.2). The nonces are stateless: the time they were issued
+// and a MAC of it and of the client IP under a secret of the server, so they
+// expire and cannot be used from other IPs. The replay cache remembers the
+// transactions authenticated within the nonce lifetime.
+type longTermAuth struct {
+	realm    string
+	password func(username string) (string, bool)
+	secret   []byte
+	lifetime time.Duration
+	now      func() time.Time
+
+	// replays maps the transaction IDs to the source address of their
+	// first request, guarded by the mutex of the server.
+	replays map[string]replayEntry
+	pruned  time.Time
+}
+
+type replayEntry struct {
+	addr    string
+	expires time.Time
+}
+
+// SetLongTermCredential enables the long-term credential mechanism (RFC 5389
+// Section 10.2) with the realm, where password returns the password of a
+// username. Requests without MESSAGE-INTEGRITY are challenged with a 401
+// error carrying the REALM and a NONCE, which expires after the lifetime,
+// DefaultNonceLifetime if zero; requests with an expired nonce get a 438
+// error with a fresh one. Nonces are bound to the IP of the client, and the
+// transactions are remembered until their nonce expires, so captured
+// requests replayed from other addresses are dropped, while retransmissions
+// are answered. It replaces the short-term credential of SetCredential, and
+// must be called before Serve.
+func (s *Server) SetLongTermCredential(realm string, password func(username string) (string, bool), lifetime time.Duration) error {
+	if lifetime <= 0 {
+		lifetime = DefaultNonceLifetime
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	s.longTerm = &longTermAuth{
+		realm:    realm,
+		password: password,
+		secret:   secret,
+		lifetime: lifetime,
+		now:      time.Now,
+		replays:  make(map[string]replayEntry),
+	}
+	s.key = nil
+	return nil
+}
+
+// nonce returns a new nonce for the client IP.
+func (a *longTermAuth) nonce(ip net.IP) string {
+	var b [8 + nonceMACSize]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(a.now().UnixNano()))
+	copy(b[8:], a.nonceMAC(b[:8], ip))
+	return hex.EncodeToString(b[:])
+}
+
+func (a *longTermAuth) nonceMAC(issued []byte, ip net.IP) []byte {
+	mac := hmac.New(sha1.New, a.secret)
+	mac.Write(issued)
+	mac.Write(ip.To16())
+	return mac.Sum(nil)[:nonceMACSize]
+}
+
+// validNonce reports whether the nonce was issued for the IP and has not
+// expired yet.
+func (a *longTermAuth) validNonce(nonce string, ip net.IP) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+nonceMACSize || !hmac.Equal(b[8:], a.nonceMAC(b[:8], ip)) {
+		return false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	return a.now().Sub(issued) < a.lifetime
+}
+
+// authenticateLongTerm checks the request with the long-term credential. It
+// returns the key of the response if the request is authenticated, or the
+// error response challenging the client. Both are nil if the request is a
+// replay, which is dropped.
+func (s *Server) authenticateLongTerm(req *packet, b []byte, addr *net.UDPAddr) ([]byte, *packet) {
+	a := s.longTerm
+	challenge := func(code int, reason string) ([]byte, *packet) {
+		pkt := &packet{transID: req.transID, types: typeBindingErrorResponse, attributes: make([]attribute, 0, 4)}
+		pkt.addAttribute(*newErrorCodeAttribute(code, reason))
+		if code != errorBadRequest {
+			pkt.addAttribute(*newAttribute(attributeRealm, []byte(a.realm)))
+			pkt.addAttribute(*newAttribute(attributeNonce, []byte(a.nonce(addr.IP))))
+		}
+		return nil, pkt
+	}
+	if req.getAttribute(attributeMessageIntegrity) == nil {
+		return challenge(errorUnauthorized, "Unauthorized")
+	}
+	username := req.getAttribute(attributeUsername)
+	realm := req.getAttribute(attributeRealm)
+	nonce := req.getAttribute(attributeNonce)
+	if username == nil || realm == nil || nonce == nil {
+		return challenge(errorBadRequest, "Bad Request")
+	}
+	if !a.validNonce(string(nonce.value[:nonce.length]), addr.IP) {
+		s.count(&s.stats.StaleNonce)
+		return challenge(errorStaleNonce, "Stale Nonce")
+	}
+	user := string(username.value[:username.length])
+	password, ok := a.password(user)
+	if !ok || string(realm.value[:realm.length]) != a.realm {
+		return challenge(errorUnauthorized, "Unauthorized")
+	}
+	key := longTermKey(user, a.realm, password)
+	if !verifyMessageIntegrity(b, key) {
+		return challenge(errorUnauthorized, "Unauthorized")
+	}
+	if !s.firstSeen(req.transID, addr) {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// firstSeen records the transaction of an authenticated request, and
+// reports whether it is new or a retransmission from the same address.
+func (s *Server) firstSeen(transID []byte, addr *net.UDPAddr) bool {
+	a := s.longTerm
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := a.now()
+	if now.Sub(a.pruned) > a.lifetime {
+		for k, e := range a.replays {
+			if now.After(e.expires) {
+				delete(a.replays, k)
+			}
+		}
+		a.pruned = now
+	}
+	k := string(transID)
+	if e, ok := a.replays[k]; ok && now.Before(e.expires) {
+		return e.addr == addr.String()
+	}
+	a.replays[k] = replayEntry{addr.String(), now.Add(a.lifetime)}
+	return true
+}
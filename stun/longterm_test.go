@@ -0,0 +1,181 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// exchange sends the request on conn and returns the response of the server.
+func exchange(t *testing.T, conn *net.UDPConn, addr net.Addr, req *packet) (*packet, []byte) {
+	if _, err := conn.WriteTo(req.bytes(), addr); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom error: %v", err)
+	}
+	resp, err := newPacketFromBytes(b[:n])
+	if err != nil {
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	return resp, b[:n]
+}
+
+func errorCode(pkt *packet) int {
+	a := pkt.getAttribute(attributeErrorCode)
+	if a == nil {
+		return 0
+	}
+	return int(a.value[2])*100 + int(a.value[3])
+}
+
+func TestLongTermCredential(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(sconn)
+	err = s.SetLongTermCredential("example.org", func(username string) (string, bool) {
+		return "secret", username == "user"
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("SetLongTermCredential error: %v", err)
+	}
+	now := time.Now()
+	s.longTerm.now = func() time.Time { return now }
+	go s.Serve()
+	defer s.Close()
+	addr := sconn.LocalAddr()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+
+	request := func(username, nonce string) *packet {
+		pkt, err := newPacket()
+		if err != nil {
+			t.Fatalf("newPacket error: %v", err)
+		}
+		pkt.types = typeBindingRequest
+		if nonce != "" {
+			pkt.addAttribute(*newUsernameAttribute(username))
+			pkt.addAttribute(*newAttribute(attributeRealm, []byte("example.org")))
+			pkt.addAttribute(*newAttribute(attributeNonce, []byte(nonce)))
+			pkt.addAttribute(*newMessageIntegrityAttribute(pkt, longTermKey(username, "example.org", "secret")))
+		}
+		pkt.addFingerprint()
+		return pkt
+	}
+	// The request without MESSAGE-INTEGRITY is challenged.
+	resp, _ := exchange(t, conn, addr, request("", ""))
+	if code := errorCode(resp); code != errorUnauthorized {
+		t.Fatalf("error code error: expected %d, get %d", errorUnauthorized, code)
+	}
+	nonce := resp.getAttribute(attributeNonce)
+	if nonce == nil || resp.getAttribute(attributeRealm) == nil {
+		t.Fatalf("challenge error: expected REALM and NONCE")
+	}
+	n := string(nonce.value[:nonce.length])
+
+	// The authenticated request is answered with MESSAGE-INTEGRITY, and so
+	// are its retransmissions.
+	req := request("user", n)
+	resp, b := exchange(t, conn, addr, req)
+	if resp.types != typeBindingResponse {
+		t.Fatalf("response type error: expected %#x, get %#x (%d)", typeBindingResponse, resp.types, errorCode(resp))
+	}
+	if !verifyMessageIntegrity(b, longTermKey("user", "example.org", "secret")) {
+		t.Errorf("MESSAGE-INTEGRITY error: invalid")
+	}
+	if resp, _ := exchange(t, conn, addr, req); resp.types != typeBindingResponse {
+		t.Errorf("retransmission error: expected a response, get %#x", resp.types)
+	}
+
+	// Unknown users are rejected.
+	if resp, _ := exchange(t, conn, addr, request("mallory", n)); errorCode(resp) != errorUnauthorized {
+		t.Errorf("unknown user error: expected %d, get %d", errorUnauthorized, errorCode(resp))
+	}
+
+	// The captured request replayed from another address is dropped.
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer other.Close()
+	if _, err := other.WriteTo(req.bytes(), addr); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := other.ReadFrom(make([]byte, 1024)); err == nil {
+		t.Errorf("replay error: expected no response")
+	}
+	if got := s.Stats().Replayed; got != 1 {
+		t.Errorf("Replayed error: expected 1, get %d", got)
+	}
+}
+
+func TestStaleNonce(t *testing.T) {
+	s := NewServer(nil)
+	if err := s.SetLongTermCredential("example.org", func(string) (string, bool) { return "secret", true }, time.Minute); err != nil {
+		t.Fatalf("SetLongTermCredential error: %v", err)
+	}
+	now := time.Now()
+	s.longTerm.now = func() time.Time { return now }
+	ip := net.IPv4(1, 2, 3, 4)
+	nonce := s.longTerm.nonce(ip)
+	if !s.longTerm.validNonce(nonce, ip) {
+		t.Errorf("validNonce error: fresh nonce rejected")
+	}
+	if s.longTerm.validNonce(nonce, net.IPv4(1, 2, 3, 5)) {
+		t.Errorf("validNonce error: nonce of another IP accepted")
+	}
+	if s.longTerm.validNonce(nonce[:len(nonce)-2]+"00", ip) {
+		t.Errorf("validNonce error: forged nonce accepted")
+	}
+	now = now.Add(time.Minute)
+	if s.longTerm.validNonce(nonce, ip) {
+		t.Errorf("validNonce error: expired nonce accepted")
+	}
+
+	pkt, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error: %v", err)
+	}
+	pkt.types = typeBindingRequest
+	pkt.addAttribute(*newUsernameAttribute("user"))
+	pkt.addAttribute(*newAttribute(attributeRealm, []byte("example.org")))
+	pkt.addAttribute(*newAttribute(attributeNonce, []byte(nonce)))
+	pkt.addAttribute(*newMessageIntegrityAttribute(pkt, longTermKey("user", "example.org", "secret")))
+	b := pkt.bytes()
+	req, err := newPacketFromBytes(b)
+	if err != nil {
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	key, challenge := s.authenticateLongTerm(req, b, &net.UDPAddr{IP: ip, Port: 1234})
+	if key != nil || challenge == nil || errorCode(challenge) != errorStaleNonce {
+		t.Fatalf("authenticateLongTerm error: expected a %d challenge", errorStaleNonce)
+	}
+	if fresh := challenge.getAttribute(attributeNonce); fresh == nil || !s.longTerm.validNonce(string(fresh.value[:fresh.length]), ip) {
+		t.Errorf("challenge error: expected a fresh nonce")
+	}
+}
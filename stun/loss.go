@@ -0,0 +1,105 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"sync"
+)
+
+// LossStats counts the transactions of a discovery and their transmissions.
+// Many retransmissions tell a lossy link, in which case a NATBlocked or a
+// restricted NAT type from unanswered tests may be a loss rather than a
+// filter.
+type LossStats struct {
+	Transactions  int // transactions terminated
+	Requests      int // requests sent, including the retransmissions
+	Answered      int // transactions which got a response
+	Retransmitted int // transactions which needed retransmissions
+	TimedOut      int // transactions which got no response
+}
+
+// RetransmissionRate returns the fraction of the answered transactions which
+// needed retransmissions, 0 without any.
+func (s LossStats) RetransmissionRate() float64 {
+	if s.Answered == 0 {
+		return 0
+	}
+	return float64(s.Retransmitted) / float64(s.Answered)
+}
+
+// LossRate returns the fraction of the requests which got no response, 0
+// without any request. A transaction is answered once however many requests
+// it sent, so the rate overestimates the loss of the link.
+func (s LossStats) LossRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return 1 - float64(s.Answered)/float64(s.Requests)
+}
+
+// add accounts the terminated transaction.
+func (s *LossStats) add(tx *Transaction) {
+	s.Transactions++
+	s.Requests += tx.Requests()
+	switch tx.State() {
+	case TransactionSucceeded:
+		s.Answered++
+		if tx.Requests() > 1 {
+			s.Retransmitted++
+		}
+	case TransactionTimedOut:
+		s.TimedOut++
+	}
+}
+
+type lossKey struct{}
+
+// lossCounter collects the LossStats of the transactions of a discovery,
+// which may run at once.
+type lossCounter struct {
+	mu    sync.Mutex
+	stats LossStats
+}
+
+// withLossCounter returns a context whose transactions are accounted by the
+// counter.
+func withLossCounter(ctx context.Context) (context.Context, *lossCounter) {
+	l := new(lossCounter)
+	return context.WithValue(ctx, lossKey{}, l), l
+}
+
+// lossOf returns the counter of the context, nil if there is none.
+func lossOf(ctx context.Context) *lossCounter {
+	l, _ := ctx.Value(lossKey{}).(*lossCounter)
+	return l
+}
+
+func (l *lossCounter) add(tx *Transaction) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.stats.add(tx)
+	l.mu.Unlock()
+}
+
+func (l *lossCounter) snapshot() LossStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
@@ -0,0 +1,99 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// serveLossy answers binding requests like a server behind a link losing
+// the first request of every transaction.
+func serveLossy(conn *net.UDPConn) {
+	seen := make(map[string]bool)
+	b := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(b[:n])
+		if err != nil {
+			continue
+		}
+		if !seen[string(req.transID)] {
+			seen[string(req.transID)] = true
+			continue
+		}
+		resp := &packet{transID: req.transID, types: typeBindingResponse}
+		resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, req.transID))
+		conn.WriteTo(resp.bytes(), addr)
+	}
+}
+
+func TestLossStats(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	go serveLossy(conn)
+	c := NewClient()
+	c.SetServerAddr(conn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetTransactionConfig(TransactionConfig{RTO: 20 * time.Millisecond, Rc: 3, Rm: 2})
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	// The server provides no changed address, test2 learns that it
+	// cannot change its address.
+	expected := LossStats{Transactions: 2, Requests: 4, Answered: 2, Retransmitted: 2}
+	if r.Loss != expected {
+		t.Errorf("Loss error: expected %+v, get %+v", expected, r.Loss)
+	}
+	if rate := r.Loss.RetransmissionRate(); rate != 1 {
+		t.Errorf("RetransmissionRate error: expected 1, get %v", rate)
+	}
+	if rate := r.Loss.LossRate(); rate != 0.5 {
+		t.Errorf("LossRate error: expected 0.5, get %v", rate)
+	}
+	if stats := c.Stats(); stats.Transactions != 2 || stats.Retransmitted != 2 || stats.TimedOut != 0 {
+		t.Errorf("Stats error: %+v", stats)
+	}
+
+	// Without response at all, the verdict is NATBlocked with the
+	// timeout counted.
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer dead.Close()
+	c.SetServerAddr(dead.LocalAddr().String())
+	r, err = c.DiscoverResult()
+	if err != nil || r.NAT != NATBlocked {
+		t.Fatalf("DiscoverResult error: expected %v, get %v %v", NATBlocked, r.NAT, err)
+	}
+	if r.Loss.TimedOut != 1 || r.Loss.Requests != 3 || r.Loss.LossRate() != 1 {
+		t.Errorf("Loss error: get %+v", r.Loss)
+	}
+	// The timed out transaction is not counted as retransmitted.
+	if stats := c.Stats(); stats.Transactions != 3 || stats.Retransmitted != 2 || stats.TimedOut != 1 {
+		t.Errorf("Stats error: %+v", stats)
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natNames are the stable names of the NAT types used by MarshalText, which
+// unlike String never change.
+var natNames = []struct {
+	nat  NATType
+	name string
+}{
+	{NATError, "error"},
+	{NATUnknown, "unknown"},
+	{NATNone, "none"},
+	{NATBlocked, "blocked"},
+	{NATFull, "full-cone"},
+	{NATSymmetric, "symmetric"},
+	{NATRestricted, "restricted"},
+	{NATPortRestricted, "port-restricted"},
+	{NATSymmetricUDPFirewall, "symmetric-udp-firewall"},
+	{NATUnknownFiltering, "unknown-filtering"},
+}
+
+// MarshalText returns the stable name of the NAT type, such as "full-cone".
+func (nat NATType) MarshalText() ([]byte, error) {
+	for _, n := range natNames {
+		if n.nat == nat {
+			return []byte(n.name), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid NAT type %d", int(nat))
+}
+
+// UnmarshalText parses a name returned by MarshalText.
+func (nat *NATType) UnmarshalText(b []byte) error {
+	for _, n := range natNames {
+		if n.name == string(b) {
+			*nat = n.nat
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown NAT type %q", b)
+}
+
+// MarshalJSON encodes the NAT type as a JSON string of its stable name.
+func (nat NATType) MarshalJSON() ([]byte, error) {
+	return marshalTextJSON(nat)
+}
+
+// UnmarshalJSON decodes a JSON string of the stable name of a NAT type.
+func (nat *NATType) UnmarshalJSON(b []byte) error {
+	return unmarshalTextJSON(b, nat.UnmarshalText)
+}
+
+// filteringNames are the stable names of the filtering behaviors used by
+// MarshalText.
+var filteringNames = []struct {
+	filtering FilteringBehavior
+	name      string
+}{
+	{FilteringUnknown, "unknown"},
+	{FilteringEndpointIndependent, "endpoint-independent"},
+	{FilteringAddressDependent, "address-dependent"},
+	{FilteringAddressPortDependent, "address-port-dependent"},
+	{FilteringPortDependent, "port-dependent"},
+}
+
+// MarshalText returns the stable name of the filtering behavior, such as
+// "address-dependent".
+func (f FilteringBehavior) MarshalText() ([]byte, error) {
+	for _, n := range filteringNames {
+		if n.filtering == f {
+			return []byte(n.name), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid filtering behavior %d", int(f))
+}
+
+// UnmarshalText parses a name returned by MarshalText.
+func (f *FilteringBehavior) UnmarshalText(b []byte) error {
+	for _, n := range filteringNames {
+		if n.name == string(b) {
+			*f = n.filtering
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown filtering behavior %q", b)
+}
+
+// dialectNames are the stable names of the dialects used by MarshalText.
+var dialectNames = []struct {
+	dialect Dialect
+	name    string
+}{
+	{DialectUnknown, "unknown"},
+	{DialectRFC3489, "rfc3489"},
+	{DialectRFC5389, "rfc5389"},
+}
+
+// MarshalText returns the stable name of the dialect, such as "rfc3489".
+func (d Dialect) MarshalText() ([]byte, error) {
+	for _, n := range dialectNames {
+		if n.dialect == d {
+			return []byte(n.name), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid dialect %d", int(d))
+}
+
+// UnmarshalText parses a name returned by MarshalText.
+func (d *Dialect) UnmarshalText(b []byte) error {
+	for _, n := range dialectNames {
+		if n.name == string(b) {
+			*d = n.dialect
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown dialect %q", b)
+}
+
+// violationNames are the stable names of the kinds of violations used by
+// MarshalText.
+var violationNames = []struct {
+	kind ViolationKind
+	name string
+}{
+	{ViolationPadding, "padding"},
+	{ViolationLength, "length"},
+	{ViolationTrailingBytes, "trailing-bytes"},
+	{ViolationHeaderLength, "header-length"},
+}
+
+// MarshalText returns the stable name of the kind, such as "padding".
+func (k ViolationKind) MarshalText() ([]byte, error) {
+	for _, n := range violationNames {
+		if n.kind == k {
+			return []byte(n.name), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid violation kind %d", int(k))
+}
+
+// UnmarshalText parses a name returned by MarshalText.
+func (k *ViolationKind) UnmarshalText(b []byte) error {
+	for _, n := range violationNames {
+		if n.name == string(b) {
+			*k = n.kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown violation kind %q", b)
+}
+
+// testNames are the stable names of the tests used by MarshalText.
+var testNames = []struct {
+	test Tests
+	name string
+}{
+	{TestI, "test1"},
+	{TestII, "test2"},
+	{TestIChanged, "test1-changed"},
+	{TestIII, "test3"},
+}
+
+// MarshalText returns the stable names of the tests separated by commas,
+// such as "test2,test3", empty for no test.
+func (t Tests) MarshalText() ([]byte, error) {
+	var names []string
+	for _, n := range testNames {
+		if t&n.test != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return []byte(strings.Join(names, ",")), nil
+}
+
+// UnmarshalText parses the names returned by MarshalText.
+func (t *Tests) UnmarshalText(b []byte) error {
+	var tests Tests
+	if len(b) > 0 {
+	next:
+		for _, s := range strings.Split(string(b), ",") {
+			for _, n := range testNames {
+				if n.name == s {
+					tests |= n.test
+					continue next
+				}
+			}
+			return fmt.Errorf("unknown test %q", s)
+		}
+	}
+	*t = tests
+	return nil
+}
+
+// MarshalText returns the transport address of the host, such as
+// "192.0.2.1:3478" or "[2001:db8::1]:3478".
+func (h *Host) MarshalText() ([]byte, error) {
+	return []byte(h.TransportAddr()), nil
+}
+
+// UnmarshalText parses a transport address with an IP address, as returned
+// by MarshalText. Host names are not resolved.
+func (h *Host) UnmarshalText(b []byte) error {
+	host, port, err := net.SplitHostPort(string(b))
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	h.family = attributeFamilyIPV6
+	if ip.To4() != nil {
+		h.family = attributeFamilyIPv4
+	}
+	h.ip = ip.String()
+	h.port = uint16(p)
+	return nil
+}
+
+// MarshalJSON encodes the host as a JSON string of its transport address.
+func (h *Host) MarshalJSON() ([]byte, error) {
+	return marshalTextJSON(h)
+}
+
+// UnmarshalJSON decodes a JSON string of a transport address.
+func (h *Host) UnmarshalJSON(b []byte) error {
+	return unmarshalTextJSON(b, h.UnmarshalText)
+}
+
+// resultJSON is the JSON representation of DiscoveryResult.
+type resultJSON struct {
+	NAT               NATType           `json:"nat"`
+	Hosts             []*Host           `json:"hosts"`
+	Filtering         FilteringBehavior `json:"filtering,omitempty"`
+	Skipped           Tests             `json:"skipped,omitempty"`
+	UnknownAttributes []uint16          `json:"unknownAttributes,omitempty"`
+	LocalAddr         *Host             `json:"localAddr,omitempty"`
+	ChangedAddr       *Host             `json:"changedAddr,omitempty"`
+	OtherAddr         *Host             `json:"otherAddr,omitempty"`
+	OtherFamilyHost   *Host             `json:"otherFamilyHost,omitempty"`
+	NAT64             bool              `json:"nat64,omitempty"`
+	NAT64Prefix       string            `json:"nat64Prefix,omitempty"`
+	ServerSoftware    string            `json:"serverSoftware,omitempty"`
+	Dialect           Dialect           `json:"dialect,omitempty"`
+	Loss              *lossJSON         `json:"loss,omitempty"`
+	Violations        []violationJSON   `json:"violations,omitempty"`
+	RTTs              []rttJSON         `json:"rtts,omitempty"`
+	Responses         []responseJSON    `json:"responses,omitempty"`
+	Exchanges         []exchangeJSON    `json:"exchanges,omitempty"`
+}
+
+// rttJSON is the JSON representation of TestRTT, in nanoseconds.
+type rttJSON struct {
+	Test Tests         `json:"test"`
+	RTT  time.Duration `json:"rtt"`
+}
+
+// lossJSON is the JSON representation of LossStats.
+type lossJSON struct {
+	Transactions  int `json:"transactions"`
+	Requests      int `json:"requests"`
+	Answered      int `json:"answered"`
+	Retransmitted int `json:"retransmitted"`
+	TimedOut      int `json:"timedOut"`
+}
+
+// violationJSON is the JSON representation of Violation.
+type violationJSON struct {
+	Kind   ViolationKind `json:"kind"`
+	Type   uint16        `json:"type,omitempty"`
+	Offset int           `json:"offset"`
+	Test   Tests         `json:"test,omitempty"`
+}
+
+// responseJSON is the JSON representation of Response, with the error code
+// as a number.
+type responseJSON struct {
+	Test           Tests  `json:"test,omitempty"`
+	From           *Host  `json:"from,omitempty"`
+	MappedAddr     *Host  `json:"mappedAddr,omitempty"`
+	XorMappedAddr  *Host  `json:"xorMappedAddr,omitempty"`
+	ResponseOrigin *Host  `json:"responseOrigin,omitempty"`
+	OtherAddr      *Host  `json:"otherAddr,omitempty"`
+	ChangedAddr    *Host  `json:"changedAddr,omitempty"`
+	SourceAddr     *Host  `json:"sourceAddr,omitempty"`
+	Software       string `json:"software,omitempty"`
+	ErrorCode      int    `json:"errorCode,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// exchangeJSON is the JSON representation of Exchange. The parsed message
+// is left out, as it is parsed again from the response.
+type exchangeJSON struct {
+	Test     Tests  `json:"test"`
+	Request  []byte `json:"request"`
+	Response []byte `json:"response"`
+}
+
+// MarshalJSON encodes the result as a JSON object with the NAT type, the
+// tests and the hosts in their text forms.
+func (r *DiscoveryResult) MarshalJSON() ([]byte, error) {
+	j := resultJSON{
+		NAT:               r.NAT,
+		Hosts:             r.Hosts,
+		Filtering:         r.Filtering,
+		Skipped:           r.Skipped,
+		UnknownAttributes: r.UnknownAttributes,
+		LocalAddr:         r.LocalAddr,
+		ChangedAddr:       r.ChangedAddr,
+		OtherAddr:         r.OtherAddr,
+		OtherFamilyHost:   r.OtherFamilyHost,
+		NAT64:             r.NAT64,
+		ServerSoftware:    r.ServerSoftware,
+		Dialect:           r.Dialect,
+	}
+	if r.NAT64Prefix != nil {
+		j.NAT64Prefix = r.NAT64Prefix.String()
+	}
+	if l := r.Loss; l != (LossStats{}) {
+		j.Loss = &lossJSON{l.Transactions, l.Requests, l.Answered, l.Retransmitted, l.TimedOut}
+	}
+	for _, t := range r.RTTs {
+		j.RTTs = append(j.RTTs, rttJSON{t.Test, t.RTT})
+	}
+	for _, v := range r.Violations {
+		j.Violations = append(j.Violations, violationJSON{v.Kind, v.Type, v.Offset, v.Test})
+	}
+	for _, resp := range r.Responses {
+		rj := responseJSON{resp.Test, resp.From, resp.MappedAddr, resp.XorMappedAddr, resp.ResponseOrigin,
+			resp.OtherAddr, resp.ChangedAddr, resp.SourceAddr, resp.Software, 0, ""}
+		if e := resp.ErrorCode; e != nil {
+			rj.ErrorCode, rj.Reason = e.Code(), e.Reason
+		}
+		j.Responses = append(j.Responses, rj)
+	}
+	for _, e := range r.Exchanges {
+		j.Exchanges = append(j.Exchanges, exchangeJSON{e.Test, e.Request, e.Response})
+	}
+	return json.Marshal(&j)
+}
+
+// UnmarshalJSON decodes a result encoded by MarshalJSON.
+func (r *DiscoveryResult) UnmarshalJSON(b []byte) error {
+	var j resultJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	res := DiscoveryResult{
+		NAT:               j.NAT,
+		Hosts:             j.Hosts,
+		Filtering:         j.Filtering,
+		Skipped:           j.Skipped,
+		UnknownAttributes: j.UnknownAttributes,
+		LocalAddr:         j.LocalAddr,
+		ChangedAddr:       j.ChangedAddr,
+		OtherAddr:         j.OtherAddr,
+		OtherFamilyHost:   j.OtherFamilyHost,
+		NAT64:             j.NAT64,
+		ServerSoftware:    j.ServerSoftware,
+		Dialect:           j.Dialect,
+	}
+	if l := j.Loss; l != nil {
+		res.Loss = LossStats{l.Transactions, l.Requests, l.Answered, l.Retransmitted, l.TimedOut}
+	}
+	if j.NAT64Prefix != "" {
+		_, prefix, err := net.ParseCIDR(j.NAT64Prefix)
+		if err != nil {
+			return err
+		}
+		res.NAT64Prefix = prefix
+	}
+	for _, t := range j.RTTs {
+		res.RTTs = append(res.RTTs, TestRTT{t.Test, t.RTT})
+	}
+	for _, v := range j.Violations {
+		res.Violations = append(res.Violations, Violation{v.Kind, v.Type, v.Offset, v.Test})
+	}
+	for _, rj := range j.Responses {
+		resp := Response{rj.Test, rj.From, rj.MappedAddr, rj.XorMappedAddr, rj.ResponseOrigin,
+			rj.OtherAddr, rj.ChangedAddr, rj.SourceAddr, rj.Software, nil}
+		if rj.ErrorCode != 0 {
+			resp.ErrorCode = &ErrorCode{rj.ErrorCode / 100, rj.ErrorCode % 100, rj.Reason}
+		}
+		res.Responses = append(res.Responses, resp)
+	}
+	for _, e := range j.Exchanges {
+		// A message with unknown attributes is returned with an
+		// error, and kept as the client does.
+		m, _ := ParseMessage(e.Response)
+		res.Exchanges = append(res.Exchanges, Exchange{e.Test, e.Request, e.Response, m})
+	}
+	*r = res
+	return nil
+}
+
+func marshalTextJSON(m interface{ MarshalText() ([]byte, error) }) ([]byte, error) {
+	b, err := m.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(b))
+}
+
+func unmarshalTextJSON(b []byte, unmarshal func([]byte) error) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return unmarshal([]byte(s))
+}
@@ -0,0 +1,125 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNATTypeText(t *testing.T) {
+	seen := make(map[string]bool)
+	for nat := NATError; nat <= NATUnknownFiltering; nat++ {
+		b, err := nat.MarshalText()
+		if err != nil {
+			t.Fatalf("MarshalText(%v) error: %v", nat, err)
+		}
+		if seen[string(b)] {
+			t.Errorf("duplicate name %q", b)
+		}
+		seen[string(b)] = true
+		var got NATType
+		if err = got.UnmarshalText(b); err != nil || got != nat {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v", b, got, err, nat)
+		}
+	}
+	if b, _ := json.Marshal(NATFull); string(b) != `"full-cone"` {
+		t.Errorf("JSON of NATFull is %s", b)
+	}
+	var nat NATType
+	if err := json.Unmarshal([]byte(`"Full cone NAT"`), &nat); err == nil {
+		t.Errorf("String form accepted")
+	}
+	if _, err := NATType(100).MarshalText(); err == nil {
+		t.Errorf("invalid NAT type marshaled")
+	}
+}
+
+func TestHostText(t *testing.T) {
+	for _, s := range []string{"192.0.2.1:3478", "[2001:db8::1]:5349"} {
+		var h Host
+		if err := h.UnmarshalText([]byte(s)); err != nil {
+			t.Fatalf("UnmarshalText(%q) error: %v", s, err)
+		}
+		if want := newHostFromStr(s); !reflect.DeepEqual(&h, want) {
+			t.Errorf("UnmarshalText(%q) = %+v, want %+v", s, h, want)
+		}
+		if b, _ := h.MarshalText(); string(b) != s {
+			t.Errorf("MarshalText = %q, want %q", b, s)
+		}
+	}
+	for _, s := range []string{"192.0.2.1", "example.com:3478", "192.0.2.1:70000"} {
+		var h Host
+		if err := h.UnmarshalText([]byte(s)); err == nil {
+			t.Errorf("UnmarshalText(%q) succeeded", s)
+		}
+	}
+}
+
+func TestDiscoveryResultJSON(t *testing.T) {
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	resp, _ := newPacket()
+	resp.types = typeBindingResponse
+	resp.addFingerprint()
+	msg, err := ParseMessage(resp.bytes())
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	r := &DiscoveryResult{
+		NAT:               NATPortRestricted,
+		Hosts:             []*Host{newHostFromStr("192.0.2.1:1000"), nil},
+		Filtering:         FilteringAddressPortDependent,
+		Skipped:           TestII | TestIII,
+		UnknownAttributes: []uint16{0x7f00},
+		LocalAddr:         newHostFromStr("10.0.0.2:40000"),
+		OtherAddr:         newHostFromStr("192.0.2.2:3479"),
+		NAT64:             true,
+		NAT64Prefix:       prefix,
+		ServerSoftware:    "test",
+		Dialect:           DialectRFC5389,
+		Violations:        []Violation{{ViolationPadding, attributeSoftware, 20, TestI}},
+		Loss:              LossStats{Transactions: 2, Requests: 5, Answered: 1, Retransmitted: 1, TimedOut: 1},
+		RTTs:              []TestRTT{{TestI, 20 * time.Millisecond}},
+		Responses: []Response{
+			{Test: TestI, From: newHostFromStr("192.0.2.2:3478"), MappedAddr: newHostFromStr("192.0.2.1:1000"),
+				XorMappedAddr: newHostFromStr("192.0.2.1:1000"), ResponseOrigin: newHostFromStr("192.0.2.2:3478")},
+			{Test: TestII, ErrorCode: &ErrorCode{4, 20, "Unknown Attribute"}},
+		},
+		Exchanges: []Exchange{{TestI, req.bytes(), resp.bytes(), msg}},
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	var got DiscoveryResult
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(&got, r) {
+		t.Errorf("round trip of %s\ngot  %+v\nwant %+v", b, got, *r)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+	if m["nat"] != "port-restricted" || m["filtering"] != "address-port-dependent" || m["skipped"] != "test2,test3" || m["otherAddr"] != "192.0.2.2:3479" {
+		t.Errorf("JSON is %s", b)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by ParseMessage.
+var (
+	ErrTruncatedMessage             = errors.New("truncated message")
+	ErrInvalidHeader                = errors.New("invalid message header")
+	ErrTruncatedAttribute           = errors.New("truncated attribute")
+	ErrInvalidAttribute             = errors.New("invalid attribute length")
+	ErrUnknownComprehensionRequired = errors.New("unknown comprehension-required attribute")
+)
+
+// ParseError is the error of parsing an attribute.
+type ParseError struct {
+	Err    error  // ErrTruncatedAttribute or ErrInvalidAttribute
+	Type   uint16 // type of the attribute, 0 if it is not read yet
+	Offset int    // offset of the attribute in the message
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: type 0x%04x at offset %d", e.Err, e.Type, e.Offset)
+}
+
+// Unwrap returns the underlying error, so errors.Is works on ParseError.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownAttributesError lists the comprehension-required attributes of a
+// message which are unknown to this package.
+type UnknownAttributesError struct {
+	Types []uint16
+}
+
+func (e *UnknownAttributesError) Error() string {
+	return fmt.Sprintf("%v: %#04x", ErrUnknownComprehensionRequired, e.Types)
+}
+
+// Is makes errors.Is(err, ErrUnknownComprehensionRequired) work.
+func (e *UnknownAttributesError) Is(target error) bool {
+	return target == ErrUnknownComprehensionRequired
+}
+
+// Message is a parsed STUN message.
+type Message struct {
+	Type          uint16
+	TransactionID []byte // magic cookie followed by the 12 bytes transaction id
+	Attributes    []Attribute
+}
+
+// Attribute is an attribute of a STUN message.
+type Attribute struct {
+	Type  uint16
+	Value []byte // without padding
+}
+
+// clone returns a deep copy of the message.
+func (m *Message) clone() *Message {
+	if m == nil {
+		return nil
+	}
+	cp := &Message{
+		Type:          m.Type,
+		TransactionID: append([]byte(nil), m.TransactionID...),
+		Attributes:    make([]Attribute, len(m.Attributes)),
+	}
+	for i, a := range m.Attributes {
+		cp.Attributes[i] = Attribute{a.Type, append([]byte(nil), a.Value...)}
+	}
+	return cp
+}
+
+// Get returns the value of the first attribute of the type.
+func (m *Message) Get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ParseMessage parses a STUN message. Every length in the message is checked
+// against the bounds, and errors are returned for truncated messages and
+// attributes, and for attributes known to this package which have invalid
+// lengths. If the message is well formed but has comprehension-required
+// attributes unknown to this package, the message is returned together with
+// an *UnknownAttributesError.
+func ParseMessage(b []byte) (*Message, error) {
+	pkt, err := parsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	m := pkt.message()
+	if unknown := pkt.unknownAttributes(); len(unknown) > 0 {
+		return m, &UnknownAttributesError{unknown}
+	}
+	return m, nil
+}
+
+// Decode parses a STUN message into m like ParseMessage, but reuses the
+// attribute slice of m and does not copy: the transaction ID and the
+// attribute values share memory with b, so m is valid only as long as b is
+// not modified. It is meant for parsing many messages without allocating.
+func (m *Message) Decode(b []byte) error {
+	end, err := messageEnd(b)
+	if err != nil {
+		return err
+	}
+	m.Type = binary.BigEndian.Uint16(b[0:2])
+	m.TransactionID = b[4:20]
+	m.Attributes = m.Attributes[:0]
+	var unknown []uint16
+	for pos := 20; pos < end; {
+		types, value, next, err := nextAttribute(b, pos, end)
+		if err != nil {
+			return err
+		}
+		if !validAttribute(types, value) {
+			return &ParseError{ErrInvalidAttribute, types, pos}
+		}
+		m.Attributes = append(m.Attributes, Attribute{types, value})
+		if types < 0x8000 && !isKnownAttribute(types) {
+			unknown = append(unknown, types)
+		}
+		pos = next
+	}
+	if len(unknown) > 0 {
+		return &UnknownAttributesError{unknown}
+	}
+	return nil
+}
+
+// AppendTo appends the encoded message to b and returns the extended
+// buffer. The length in the header is computed from the attributes, which
+// are padded to multiples of 4 bytes.
+func (m *Message) AppendTo(b []byte) []byte {
+	length := 0
+	for _, a := range m.Attributes {
+		length += 4 + int(align(uint16(len(a.Value))))
+	}
+	b = binary.BigEndian.AppendUint16(b, m.Type)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	b = append(b, m.TransactionID...)
+	for _, a := range m.Attributes {
+		b = binary.BigEndian.AppendUint16(b, a.Type)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.Value)))
+		b = append(b, a.Value...)
+		for i := len(a.Value); i%4 != 0; i++ {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+// message copies the packet into a Message, which does not share memory
+// with the buffer the packet was parsed from.
+func (v *packet) message() *Message {
+	m := &Message{
+		Type:          v.types,
+		TransactionID: append([]byte(nil), v.transID...),
+		Attributes:    make([]Attribute, len(v.attributes)),
+	}
+	for i, a := range v.attributes {
+		m.Attributes[i] = Attribute{a.types, append([]byte(nil), a.value[:a.length]...)}
+	}
+	return m
+}
+
+// knownAttributes are the comprehension-required attributes defined in this
+// package.
+var knownAttributes = map[uint16]bool{
+	attributeMappedAddress:          true,
+	attributeResponseAddress:        true,
+	attributeChangeRequest:          true,
+	attributeSourceAddress:          true,
+	attributeChangedAddress:         true,
+	attributeUsername:               true,
+	attributePassword:               true,
+	attributeMessageIntegrity:       true,
+	attributeErrorCode:              true,
+	attributeUnknownAttributes:      true,
+	attributeReflectedFrom:          true,
+	attributeChannelNumber:          true,
+	attributeLifetime:               true,
+	attributeBandwidth:              true,
+	attributeXorPeerAddress:         true,
+	attributeData:                   true,
+	attributeRealm:                  true,
+	attributeNonce:                  true,
+	attributeXorRelayedAddress:      true,
+	attributeRequestedAddressFamily: true,
+	attributeEvenPort:               true,
+	attributeRequestedTransport:     true,
+	attributeDontFragment:           true,
+	attributeXorMappedAddress:       true,
+	attributeTimerVal:               true,
+	attributeReservationToken:       true,
+	attributePriority:               true,
+	attributeUseCandidate:           true,
+	attributePadding:                true,
+	attributeResponsePort:           true,
+	attributeConnectionID:           true,
+}
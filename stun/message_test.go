@@ -0,0 +1,152 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testMessage() []byte {
+	p, _ := newPacket()
+	p.types = typeBindingRequest
+	p.addAttribute(*newSoftwareAttribute("abcde"))
+	p.addAttribute(*newChangeReqAttribute(false, true))
+	return p.bytes()
+}
+
+func TestParseMessage(t *testing.T) {
+	b := testMessage()
+	m, err := ParseMessage(b)
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	if m.Type != typeBindingRequest || len(m.Attributes) != 2 {
+		t.Errorf("ParseMessage error: %+v", m)
+	}
+	if v, ok := m.Get(attributeSoftware); !ok || string(v) != "abcde" {
+		t.Errorf("ParseMessage error: software %q", v)
+	}
+	// Truncate the last attribute.
+	_, err = ParseMessage(b[:len(b)-2])
+	if !errors.Is(err, ErrTruncatedMessage) {
+		t.Errorf("ParseMessage error: expected ErrTruncatedMessage, get %v", err)
+	}
+	b[2], b[3] = 0, 14
+	_, err = ParseMessage(b[:34])
+	if !errors.Is(err, ErrTruncatedAttribute) {
+		t.Errorf("ParseMessage error: expected ErrTruncatedAttribute, get %v", err)
+	}
+	// Invalid length of a known attribute.
+	bad := append(b[:20:20], 0x80, 0x28, 0, 2, 0, 0, 0, 0)
+	bad[2], bad[3] = 0, 8
+	_, err = ParseMessage(bad)
+	if !errors.Is(err, ErrInvalidAttribute) {
+		t.Errorf("ParseMessage error: expected ErrInvalidAttribute, get %v", err)
+	}
+	// Unknown comprehension-required attribute.
+	unknown := append(bytes.Repeat([]byte{0}, 20), 0x7f, 0xff, 0, 0)
+	unknown[3] = 4
+	m, err = ParseMessage(unknown)
+	if !errors.Is(err, ErrUnknownComprehensionRequired) || m == nil {
+		t.Errorf("ParseMessage error: expected ErrUnknownComprehensionRequired, get %v", err)
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	f.Add(testMessage())
+	f.Add(make([]byte, 20))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ParseMessage(b)
+		// Decode walks the attributes like ParseMessage.
+		var d Message
+		if derr := d.Decode(b); (derr == nil) != (err == nil) {
+			t.Fatalf("Decode error: ParseMessage returned %v, Decode %v", err, derr)
+		}
+		if err != nil && m == nil {
+			return
+		}
+		// Messages which parse must survive decoding the addresses.
+		pkt, err := parsePacket(b)
+		if err != nil {
+			t.Fatalf("parsePacket error after ParseMessage succeeded: %v", err)
+		}
+		pkt.getXorMappedAddr()
+		pkt.getMappedAddr()
+		pkt.getChangedAddr()
+		pkt.getOtherAddr()
+	})
+}
+
+func TestMessageErrorCode(t *testing.T) {
+	pkt, err := newPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt.types = typeBindingErrorResponse
+	pkt.addAttribute(*newErrorCodeAttribute(errorUnauthorized, "Unauthorized"))
+	m, err := ParseMessage(pkt.bytes())
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	e, ok := m.ErrorCode()
+	if !ok || e.Class != 4 || e.Number != 1 || e.Code() != 401 || e.String() != "401 Unauthorized" {
+		t.Errorf("ErrorCode error: %+v %v", e, ok)
+	}
+}
+
+func TestMessageDecode(t *testing.T) {
+	b := testMessage()
+	var m Message
+	if err := m.Decode(b); err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	if v, ok := m.Get(attributeSoftware); !ok || string(v) != "abcde" {
+		t.Errorf("Decode error: software %q", v)
+	}
+	if out := m.AppendTo(nil); !bytes.Equal(out, b) {
+		t.Errorf("AppendTo error: expected %x, get %x", b, out)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = m.Decode(b)
+	})
+	if allocs != 0 {
+		t.Errorf("Decode error: %v allocations", allocs)
+	}
+}
+
+func BenchmarkMessageDecode(b *testing.B) {
+	msg := testMessage()
+	var m Message
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.Decode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseMessage(b *testing.B) {
+	msg := testMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseMessage(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults of the KeepalivePolicy.
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultKeepaliveFailures = 3
+	DefaultKeepaliveBackoff  = time.Second
+)
+
+// ErrNoRebind is reported when the keepalive policy asks to rebind, but the
+// connection of the client is not created by it with SetReuseConn.
+var ErrNoRebind = errors.New("connection not owned by the client, cannot rebind")
+
+// KeepaliveAction is what a KeepaliveMonitor does once keepalives failed too
+// many times in a row.
+type KeepaliveAction int
+
+// Keepalive actions.
+const (
+	// KeepaliveNotify only reports the failures.
+	KeepaliveNotify KeepaliveAction = iota
+	// KeepaliveRediscover runs the discovery again on the connection.
+	KeepaliveRediscover
+	// KeepaliveRebind replaces the connection by a new one on a new local
+	// port and runs the discovery on it, which needs a client with
+	// SetReuseConn.
+	KeepaliveRebind
+)
+
+// KeepalivePolicy controls a KeepaliveMonitor. Zero values select the
+// defaults.
+type KeepalivePolicy struct {
+	Interval    time.Duration // between successful keepalives
+	MaxFailures int           // failures in a row triggering the action
+	Action      KeepaliveAction
+
+	// After a failure, the next keepalive is sent after the backoff
+	// instead of the interval. It starts from MinBackoff and doubles on
+	// each failure up to MaxBackoff, which defaults to the interval. The
+	// action is taken again on each failure, and the backoff keeps
+	// growing, until the action recovers the mapping.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnFailure is called after each failed keepalive, and with the
+	// outcome of the action once it is taken.
+	OnFailure func(KeepaliveReport)
+}
+
+// KeepaliveReport describes a keepalive failure.
+type KeepaliveReport struct {
+	Failures int   // failures in a row
+	Err      error // error of the last keepalive
+
+	// Taken reports whether the action was taken, in which case Action,
+	// Result and ActionErr are its outcome. The failures are reset after
+	// the action.
+	Taken     bool
+	Action    KeepaliveAction
+	Result    *DiscoveryResult // result of the discovery of the action
+	ActionErr error
+	LocalAddr net.Addr // local address of the connection after the action
+}
+
+// KeepaliveMonitor sends keepalives periodically with a client, and applies
+// a KeepalivePolicy when they fail. The client must not be used by others
+// while the monitor runs.
+type KeepaliveMonitor struct {
+	client *Client
+	policy KeepalivePolicy
+
+	mu   sync.Mutex
+	host *Host // mapped address of the last successful keepalive
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewKeepaliveMonitor returns a monitor of the client, which must have a
+// connection, i.e. be created with one or keep one with SetReuseConn.
+func NewKeepaliveMonitor(c *Client, policy KeepalivePolicy) *KeepaliveMonitor {
+	if policy.Interval <= 0 {
+		policy.Interval = DefaultKeepaliveInterval
+	}
+	if policy.MaxFailures <= 0 {
+		policy.MaxFailures = DefaultKeepaliveFailures
+	}
+	if policy.MinBackoff <= 0 {
+		policy.MinBackoff = DefaultKeepaliveBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = policy.Interval
+	}
+	return &KeepaliveMonitor{client: c, policy: policy}
+}
+
+// Start starts sending keepalives, the first one after the interval.
+func (m *KeepaliveMonitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+// Stop stops the keepalives and waits for the pending one, after which the
+// client can be used again.
+func (m *KeepaliveMonitor) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Host returns the mapped address of the last successful keepalive, nil if
+// there is none yet.
+func (m *KeepaliveMonitor) Host() *Host {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.host
+}
+
+func (m *KeepaliveMonitor) run(stop, done chan struct{}) {
+	defer close(done)
+	failures := 0
+	wait := m.policy.Interval
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		host, err := m.client.Keepalive()
+		if err == nil {
+			failures = 0
+			wait = m.policy.Interval
+			if host != nil {
+				m.mu.Lock()
+				m.host = host
+				m.mu.Unlock()
+			}
+			continue
+		}
+		failures++
+		m.client.logger.Debugln("Keepalive failure", failures, err)
+		report := KeepaliveReport{Failures: failures, Err: err}
+		// The failures keep counting, and the backoff growing, until
+		// the action recovers the mapping.
+		if failures >= m.policy.MaxFailures && m.act(&report) {
+			failures = 0
+		}
+		if m.policy.OnFailure != nil {
+			m.policy.OnFailure(report)
+		}
+		wait = m.backoff(failures)
+	}
+}
+
+// backoff returns the wait after the failures, the interval if there are
+// none.
+func (m *KeepaliveMonitor) backoff(failures int) time.Duration {
+	if failures == 0 {
+		return m.policy.Interval
+	}
+	wait := m.policy.MinBackoff
+	for i := 1; i < failures && wait < m.policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > m.policy.MaxBackoff {
+		wait = m.policy.MaxBackoff
+	}
+	return wait
+}
+
+// act takes the action of the policy and records its outcome in the report.
+// It reports whether the action discovered a mapped address.
+func (m *KeepaliveMonitor) act(report *KeepaliveReport) bool {
+	c := m.client
+	report.Taken, report.Action = true, m.policy.Action
+	c.Invalidate()
+	switch m.policy.Action {
+	case KeepaliveRediscover:
+		report.Result, report.ActionErr = c.DiscoverResult()
+	case KeepaliveRebind:
+		if !c.ownConn {
+			report.ActionErr = ErrNoRebind
+			break
+		}
+		c.Close()
+		report.Result, report.ActionErr = c.DiscoverResult()
+	}
+	if c.conn != nil {
+		report.LocalAddr = c.conn.LocalAddr()
+	}
+	if report.Result == nil || report.ActionErr != nil || len(report.Result.Hosts) == 0 {
+		return false
+	}
+	m.mu.Lock()
+	m.host = report.Result.Hosts[0]
+	m.mu.Unlock()
+	return true
+}
@@ -0,0 +1,136 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dropConn drops the packets while drop is set.
+type dropConn struct {
+	net.PacketConn
+	drop *atomic.Bool
+}
+
+func (c dropConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.drop.Load() {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestKeepaliveMonitor(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	drop := new(atomic.Bool)
+	s := NewServer(dropConn{sconn, drop})
+	go s.Serve()
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(sconn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetReuseConn(true)
+	c.SetTestTimeout(20 * time.Millisecond)
+	defer c.Close()
+	if _, err = c.DiscoverResult(); err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	local := c.Conn().LocalAddr().String()
+	reports := make(chan KeepaliveReport, 10)
+	m := NewKeepaliveMonitor(c, KeepalivePolicy{
+		Interval:    10 * time.Millisecond,
+		MaxFailures: 2,
+		Action:      KeepaliveRebind,
+		OnFailure: func(r KeepaliveReport) {
+			reports <- r
+		},
+	})
+	m.Start()
+	defer m.Stop()
+	drop.Store(true)
+	if r := <-reports; r.Taken || r.Failures != 1 || !errors.Is(r.Err, ErrNoResponse) {
+		t.Errorf("first report error: %+v", r)
+	}
+	// The discovery of the action fails too, while the socket is replaced.
+	r := <-reports
+	if !r.Taken || r.Action != KeepaliveRebind || r.Result.NAT != NATBlocked || r.LocalAddr.String() == local {
+		t.Errorf("action report error: %+v", r)
+	}
+	drop.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for m.Host() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Stop()
+	if m.Host() == nil || m.Host().Port() != uint16(c.Conn().LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("Host error: %v", m.Host())
+	}
+}
+
+func TestKeepaliveMonitorBackoff(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	drop := new(atomic.Bool)
+	s := NewServer(dropConn{sconn, drop})
+	go s.Serve()
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(sconn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetReuseConn(true)
+	c.SetTestTimeout(10 * time.Millisecond)
+	defer c.Close()
+	if _, err = c.DiscoverResult(); err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	reports := make(chan KeepaliveReport, 10)
+	m := NewKeepaliveMonitor(c, KeepalivePolicy{
+		Interval:    10 * time.Millisecond,
+		MaxFailures: 1,
+		Action:      KeepaliveRediscover,
+		MinBackoff:  5 * time.Millisecond,
+		MaxBackoff:  time.Second,
+		OnFailure: func(r KeepaliveReport) {
+			select {
+			case reports <- r:
+			default:
+			}
+		},
+	})
+	drop.Store(true)
+	m.Start()
+	defer m.Stop()
+	// The rediscovery fails as well, so the failures are not reset.
+	for i := 1; i <= 3; i++ {
+		r := <-reports
+		if !r.Taken || r.Failures != i || r.Result == nil || r.Result.NAT != NATBlocked {
+			t.Errorf("report %d error: %+v", i, r)
+		}
+	}
+	m.Stop()
+	if m.backoff(3) != 20*time.Millisecond {
+		t.Errorf("backoff error: expected %v, get %v", 20*time.Millisecond, m.backoff(3))
+	}
+}
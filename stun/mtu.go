@@ -0,0 +1,142 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultProbeTimeout is the default time a probe of ProbeMTU waits
+	// for the response, including retransmissions.
+	DefaultProbeTimeout = time.Second
+	// DefaultProbeMax is the default largest size tried by ProbeMTU,
+	// the Ethernet MTU minus the IPv4 and UDP headers.
+	DefaultProbeMax = 1472
+)
+
+// SetProbeTimeout sets the time a probe of ProbeMTU waits for the response.
+func (c *Client) SetProbeTimeout(d time.Duration) {
+	c.probeTimeout = d
+}
+
+// ProbeMTU finds the size of the largest STUN message, which is the UDP
+// payload, reaching the server and being answered, by a binary search over
+// Binding requests padded with the PADDING attribute (RFC 5780 Section 7.6).
+// The IP and UDP headers, 28 bytes for IPv4 and 48 bytes for IPv6, are to be
+// added for the path MTU. Sizes up to max are tried, or DefaultProbeMax if
+// max is 0, and sizes are multiples of 4.
+//
+// On sockets created by the client, fragmentation is disabled where
+// supported (see SocketConfig.DontFragment), otherwise the probe finds the
+// largest datagram surviving fragmentation, which is still limited by
+// firewalls dropping fragments. The server may limit the size of requests
+// too, e.g. Server drops requests over its maximum packet size. DTLS is not
+// used for the probes.
+func (c *Client) ProbeMTU(ctx context.Context, max int) (int, error) {
+	if max == 0 {
+		max = DefaultProbeMax
+	}
+	c.defaultServer(ctx)
+	serverUDPAddr, err := c.resolveUDPAddr(ctx, "udp", c.serverAddr)
+	if err != nil {
+		return 0, err
+	}
+	conn := c.conn
+	if conn == nil {
+		laddr, err := c.localUDPAddr(serverUDPAddr)
+		if err != nil {
+			return 0, err
+		}
+		cfg := c.socket
+		cfg.DontFragment = true
+		uc, err := c.listenUDP(cfg, "udp", laddr)
+		if errors.Is(err, ErrSocketOption) {
+			c.logger.Debugln("Probe with fragmentation:", err)
+			uc, err = c.listenUDP(c.socket, "udp", laddr)
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer uc.Close()
+		conn = uc
+	}
+	base, err := c.newBindingPacket(typeBindingRequest, false, false)
+	if err != nil {
+		return 0, err
+	}
+	size := len(base.bytes())
+	ok, err := c.probe(ctx, conn, serverUDPAddr, size)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, &TimeoutError{Addr: serverUDPAddr}
+	}
+	// The PADDING attribute adds its 4 bytes header to the base size.
+	lo, hi := size+4, max&^3
+	for lo <= hi {
+		mid := lo + (hi-lo)/2&^3
+		ok, err := c.probe(ctx, conn, serverUDPAddr, mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			size, lo = mid, mid+4
+		} else {
+			hi = mid - 4
+		}
+	}
+	return size, nil
+}
+
+// probe reports whether a Binding request of the given size is answered.
+func (c *Client) probe(ctx context.Context, conn net.PacketConn, addr net.Addr, size int) (bool, error) {
+	var extra []*attribute
+	base, err := c.newBindingPacket(typeBindingRequest, false, false)
+	if err != nil {
+		return false, err
+	}
+	if n := size - len(base.bytes()) - 4; n >= 0 {
+		extra = append(extra, newPaddingAttribute(n))
+	}
+	pkt, err := c.newBindingPacket(typeBindingRequest, false, false, extra...)
+	if err != nil {
+		return false, err
+	}
+	timeout := c.probeTimeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c.logger.Debugln("Probe with", len(pkt.bytes()), "bytes")
+	resp, err := c.send(pctx, pkt, conn, addr)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		// A pending read being interrupted by the probe timeout or
+		// EMSGSIZE for packets over the known path MTU.
+		c.logger.Debugln("Probe error:", err)
+		return false, nil
+	}
+	return resp != nil && !isErrorResponse(resp.packet.types), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeMTU(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(sconn)
+	s.SetMaxPacketSize(600)
+	go s.Serve()
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(sconn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetProbeTimeout(50 * time.Millisecond)
+	size, err := c.ProbeMTU(context.Background(), 1400)
+	if err != nil {
+		t.Fatalf("ProbeMTU error: %v", err)
+	}
+	if size != 600 {
+		t.Errorf("ProbeMTU error: expected 600, get %d", size)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrNoNAT64 is returned by DetectNAT64 when the network synthesizes no
+// IPv6 addresses for IPv4-only names.
+var ErrNoNAT64 = errors.New("no NAT64 prefix found")
+
+// WellKnownNAT64Prefix is the NAT64 Well-Known Prefix 64:ff9b::/96 (RFC 6052
+// Section 2.1).
+var WellKnownNAT64Prefix = &net.IPNet{
+	IP:   net.ParseIP("64:ff9b::"),
+	Mask: net.CIDRMask(96, 128),
+}
+
+// ipv4OnlyName is the name which only has the A records of the well-known
+// IPv4 addresses below (RFC 7050 Section 2.2).
+const ipv4OnlyName = "ipv4only.arpa"
+
+var ipv4OnlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// nat64PrefixLens are the prefix lengths allowed by RFC 6052 Section 2.2.
+var nat64PrefixLens = []int{96, 64, 56, 48, 40, 32}
+
+// DetectNAT64 discovers the NAT64 prefix of the network with the resolver of
+// the system, see Client.DetectNAT64.
+func DetectNAT64(ctx context.Context) (*net.IPNet, error) {
+	return NewClient().DetectNAT64(ctx)
+}
+
+// DetectNAT64 discovers the NAT64 prefix of the network from the IPv6
+// addresses DNS64 synthesizes for ipv4only.arpa (RFC 7050), looked up with
+// the resolver of the client. It returns ErrNoNAT64 if the name has no IPv6
+// address, i.e. there is no DNS64.
+func (c *Client) DetectNAT64(ctx context.Context) (*net.IPNet, error) {
+	var r Resolver = net.DefaultResolver
+	if c.resolver != nil {
+		r = c.resolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, ipv4OnlyName)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, ErrNoNAT64
+		}
+		return nil, err
+	}
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			continue
+		}
+		if prefix := nat64Prefix(a.IP); prefix != nil {
+			return prefix, nil
+		}
+	}
+	return nil, ErrNoNAT64
+}
+
+// nat64Prefix returns the prefix of the synthesized IPv6 address if it
+// embeds one of the well-known IPv4 addresses of ipv4only.arpa.
+func nat64Prefix(ip net.IP) *net.IPNet {
+	for _, n := range nat64PrefixLens {
+		v4 := extractNAT64(ip, n)
+		for _, known := range ipv4OnlyAddrs {
+			if v4.Equal(known) {
+				mask := net.CIDRMask(n, 128)
+				return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+			}
+		}
+	}
+	return nil
+}
+
+// NAT64Addr returns the IPv6 address which reaches the IPv4 address through
+// the NAT64 with the prefix (RFC 6052 Section 2.2), e.g. to connect to IPv4
+// peers from an IPv6-only host. It returns nil if the prefix length is not
+// one allowed by RFC 6052 or ip is not an IPv4 address.
+func NAT64Addr(prefix *net.IPNet, ip net.IP) net.IP {
+	v4 := ip.To4()
+	n, bits := prefix.Mask.Size()
+	if v4 == nil || bits != 128 || !validNAT64PrefixLen(n) {
+		return nil
+	}
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.To16()[:n/8])
+	// Bits 64 to 71 are reserved and skipped (the "u" octet).
+	pos := n / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = b
+		pos++
+	}
+	return out
+}
+
+// extractNAT64 returns the IPv4 address embedded in ip with the prefix
+// length n.
+func extractNAT64(ip net.IP, n int) net.IP {
+	ip = ip.To16()
+	v4 := make(net.IP, 0, net.IPv4len)
+	pos := n / 8
+	for len(v4) < net.IPv4len {
+		if pos == 8 {
+			pos++
+		}
+		v4 = append(v4, ip[pos])
+		pos++
+	}
+	return v4
+}
+
+func validNAT64PrefixLen(n int) bool {
+	for _, l := range nat64PrefixLens {
+		if n == l {
+			return true
+		}
+	}
+	return false
+}
+
+// detectNAT64 records in the result whether the server was reached through
+// a NAT64, which is the case if it was sent an IPv6 address but observed an
+// IPv4 one.
+func (r *DiscoveryResult) detectNAT64(server *net.UDPAddr) {
+	if server.IP.To4() != nil || len(r.Hosts) == 0 || r.Hosts[0] == nil ||
+		r.Hosts[0].Family() != attributeFamilyIPv4 {
+		return
+	}
+	r.NAT64 = true
+	if WellKnownNAT64Prefix.Contains(server.IP) {
+		// A copy, so the result does not alias the package variable.
+		r.NAT64Prefix = &net.IPNet{
+			IP:   append(net.IP(nil), WellKnownNAT64Prefix.IP...),
+			Mask: append(net.IPMask(nil), WellKnownNAT64Prefix.Mask...),
+		}
+	}
+}
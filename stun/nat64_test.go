@@ -0,0 +1,96 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestNAT64Addr(t *testing.T) {
+	// Examples of RFC 6052 Section 2.4.
+	tests := []struct {
+		prefix string
+		addr   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+	}
+	v4 := net.IPv4(192, 0, 2, 33)
+	for _, tt := range tests {
+		_, prefix, _ := net.ParseCIDR(tt.prefix)
+		got := NAT64Addr(prefix, v4)
+		if !got.Equal(net.ParseIP(tt.addr)) {
+			t.Errorf("NAT64Addr(%v) error: expected %v, get %v", prefix, tt.addr, got)
+		}
+		n, _ := prefix.Mask.Size()
+		if e := extractNAT64(got, n); !e.Equal(v4) {
+			t.Errorf("extractNAT64(%v) error: get %v", got, e)
+		}
+	}
+}
+
+func TestNAT64Prefix(t *testing.T) {
+	prefix := nat64Prefix(net.ParseIP("64:ff9b::192.0.0.170"))
+	if prefix == nil || prefix.String() != WellKnownNAT64Prefix.String() {
+		t.Errorf("nat64Prefix error: %v", prefix)
+	}
+	if prefix = nat64Prefix(net.ParseIP("2001:db8::1")); prefix != nil {
+		t.Errorf("nat64Prefix error: expected nil, get %v", prefix)
+	}
+}
+
+func TestClientDetectNAT64(t *testing.T) {
+	c := NewClient()
+	// DNS64 synthesizes the addresses with the prefix 2001:db8:122::/48.
+	_, dns64, _ := net.ParseCIDR("2001:db8:122::/48")
+	synthesized := NAT64Addr(dns64, net.IPv4(192, 0, 0, 170))
+	c.SetResolver(stubResolver{{IP: net.IPv4(192, 0, 0, 170)}, {IP: synthesized}})
+	prefix, err := c.DetectNAT64(context.Background())
+	if err != nil || prefix.String() != "2001:db8:122::/48" {
+		t.Errorf("DetectNAT64 error: expected 2001:db8:122::/48, get %v, %v", prefix, err)
+	}
+	c.SetResolver(stubResolver{{IP: net.IPv4(192, 0, 0, 170)}})
+	if _, err = c.DetectNAT64(context.Background()); err != ErrNoNAT64 {
+		t.Errorf("DetectNAT64 error: expected %v, get %v", ErrNoNAT64, err)
+	}
+}
+
+func TestDetectNAT64Result(t *testing.T) {
+	r := &DiscoveryResult{Hosts: []*Host{newHostFromStr("198.51.100.1:5000")}}
+	r.detectNAT64(&net.UDPAddr{IP: net.ParseIP("64:ff9b::203.0.113.1"), Port: 3478})
+	if !r.NAT64 || r.NAT64Prefix == nil || r.NAT64Prefix.String() != WellKnownNAT64Prefix.String() {
+		t.Fatalf("detectNAT64 error: %v %v", r.NAT64, r.NAT64Prefix)
+	}
+	// Modifying the result leaves the well-known prefix alone.
+	r.NAT64Prefix.IP[0] = 0xff
+	r.NAT64Prefix.Mask[15] = 0xff
+	if WellKnownNAT64Prefix.String() != "64:ff9b::/96" {
+		t.Errorf("WellKnownNAT64Prefix error: modified to %v", WellKnownNAT64Prefix)
+	}
+	// So does modifying a cached copy.
+	cp := r.clone()
+	cp.NAT64Prefix.IP[1] = 0xff
+	if r.NAT64Prefix.IP[1] == 0xff {
+		t.Errorf("clone error: NAT64Prefix shared with the copy")
+	}
+}
@@ -17,9 +17,9 @@
 package stun
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
-	"errors"
+	"io"
 	"net"
 	"time"
 )
@@ -31,76 +31,451 @@ const (
 	maxPacketSize  = 1024
 )
 
-func (c *Client) sendBindingReq(conn net.PacketConn, addr net.Addr, changeIP bool, changePort bool) (*response, error) {
+func (c *Client) sendBindingReq(ctx context.Context, conn net.PacketConn, addr net.Addr, changeIP bool, changePort bool) (*response, error) {
+	pkt, err := c.newBindingPacket(typeBindingRequest, changeIP, changePort)
+	if err != nil {
+		return nil, err
+	}
+	// Send packet.
+	return c.send(ctx, pkt, conn, addr)
+}
+
+// sendBindingInd sends a binding indication, which elicits no response from
+// the server (RFC 5389 Section 10), so it is sent only once.
+func (c *Client) sendBindingInd(conn net.PacketConn, addr net.Addr) error {
+	pkt, err := c.newBindingPacket(typeBindingIndication, false, false)
+	if err != nil {
+		return err
+	}
+	if c.limiter != nil {
+		release, err := c.limit(context.Background(), addr)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	b := pkt.appendTo(*buf)
+	if c.logger.info {
+		c.logger.Info("\n" + hex.Dump(b))
+	}
+	length, err := conn.WriteTo(b, addr)
+	if err != nil {
+		return &TransportError{Op: "write", Addr: addr, Err: err}
+	}
+	c.dumpPacket(true, conn.LocalAddr(), addr, b)
+	if length != len(b) {
+		return &TransportError{Op: "write", Addr: addr, Err: io.ErrShortWrite}
+	}
+	c.emit(EventRequestSent, addr, pkt.transID, 1, b)
+	return nil
+}
+
+// newBindingPacket constructs a binding packet, with the extra attributes
+// added before MESSAGE-INTEGRITY and FINGERPRINT.
+func (c *Client) newBindingPacket(types uint16, changeIP bool, changePort bool, extra ...*attribute) (*packet, error) {
 	// Construct packet.
 	pkt, err := newPacket()
 	if err != nil {
 		return nil, err
 	}
-	pkt.types = typeBindingRequest
-	attribute := newSoftwareAttribute(c.softwareName)
-	pkt.addAttribute(*attribute)
+	pkt.types = types
+	if c.softwareName != "" {
+		pkt.addAttribute(*newSoftwareAttribute(c.softwareName))
+	}
 	if changeIP || changePort {
-		attribute = newChangeReqAttribute(changeIP, changePort)
-		pkt.addAttribute(*attribute)
-	}
-	// length of fingerprint attribute must be included into crc,
-	// so we add it before calculating crc, then subtract it after calculating crc.
-	pkt.length += 8
-	attribute = newFingerprintAttribute(pkt)
-	pkt.length -= 8
-	pkt.addAttribute(*attribute)
-	// Send packet.
-	return c.send(pkt, conn, addr)
+		pkt.addAttribute(*newChangeReqAttribute(changeIP, changePort))
+	}
+	for _, a := range c.reqAttrs {
+		pkt.addAttribute(*newAttribute(a.Type, a.Value))
+	}
+	if len(c.key) > 0 {
+		pkt.addAttribute(*newUsernameAttribute(c.username))
+	}
+	for _, a := range extra {
+		pkt.addAttribute(*a)
+	}
+	if len(c.key) > 0 {
+		pkt.addAttribute(*newMessageIntegrityAttribute(pkt, c.key))
+	}
+	pkt.addFingerprint()
+	return pkt, nil
 }
 
 // RFC 3489: Clients SHOULD retransmit the request starting with an interval
 // of 100ms, doubling every retransmit until the interval reaches 1.6s.
 // Retransmissions continue with intervals of 1.6s until a response is
-// received, or a total of 9 requests have been sent.
-func (c *Client) send(pkt *packet, conn net.PacketConn, addr net.Addr) (*response, error) {
-	c.logger.Info("\n" + hex.Dump(pkt.bytes()))
-	timeout := defaultTimeout
-	packetBytes := make([]byte, maxPacketSize)
-	for i := 0; i < numRetransmit; i++ {
-		// Send packet to the server.
-		length, err := conn.WriteTo(pkt.bytes(), addr)
+// received, or a total of 9 requests have been sent. The schedule is set by
+// SetTransactionConfig.
+// The transaction stops early with the error of ctx once it is done.
+func (c *Client) send(ctx context.Context, pkt *packet, conn net.PacketConn, addr net.Addr) (*response, error) {
+	return c.sendVia(ctx, pkt, conn, conn, addr)
+}
+
+// sendVia sends the packet on conn and reads the response on readConn, which
+// differ if the request carries a RESPONSE-PORT attribute.
+func (c *Client) sendVia(ctx context.Context, pkt *packet, conn, readConn net.PacketConn, addr net.Addr) (*response, error) {
+	reqs := []*request{{pkt: pkt, addr: addr}}
+	c.transact(ctx, conn, readConn, reqs)
+	return reqs[0].resp, reqs[0].err
+}
+
+// request is a request of a transaction and its outcome: a response, nil
+// with no error if it timed out, or an error.
+type request struct {
+	pkt   *packet
+	addr  net.Addr
+	b     []byte // encoded request
+	tx    *Transaction
+	resp  *response
+	err   error
+	phase Tests // test of the discovery, for the logs
+	loss  *lossCounter
+}
+
+// transact runs the transactions of the requests at once, sending them on
+// conn and reading the responses on readConn, until all are terminated.
+func (c *Client) transact(ctx context.Context, conn, readConn net.PacketConn, reqs []*request) {
+	// The wait for the rate limiter does not count towards the test
+	// timeout.
+	if c.limiter != nil {
+		release, err := c.limit(ctx, requestAddrs(reqs)...)
 		if err != nil {
-			return nil, err
+			// The transactions end before their first request, so the
+			// callers always find them terminated.
+			now := time.Now()
+			for _, r := range reqs {
+				r.tx = NewTransaction(r.pkt.transID, c.txConfig, isReliable(conn), now)
+				r.tx.Cancel(now, err)
+				r.err = err
+			}
+			return
 		}
-		if length != len(pkt.bytes()) {
-			return nil, errors.New("Error in sending data.")
+		defer release()
+	}
+	// The requests are encoded once, and read into a scratch packet, all
+	// in pooled buffers.
+	rbuf := getBuffer()
+	defer putBuffer(rbuf)
+	packetBytes := (*rbuf)[:maxPacketSize]
+	var p packet
+	var violations []Violation
+	reliable := isReliable(conn)
+	// The test timeout ends the retransmissions like the last one does,
+	// while ctx being done is an error.
+	tctx := ctx
+	if c.testTimeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, c.testTimeout)
+		defer cancel()
+	}
+	// Interrupt the pending read once tctx is done.
+	stop := context.AfterFunc(tctx, func() {
+		readConn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	now := time.Now()
+	phase, loss := phaseOf(ctx), lossOf(ctx)
+	for _, r := range reqs {
+		r.phase, r.loss = phase, loss
+		wbuf := getBuffer()
+		defer putBuffer(wbuf)
+		r.b = r.pkt.appendTo(*wbuf)
+		if c.logger.info {
+			c.logger.Info("\n" + hex.Dump(r.b))
 		}
-		err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
-		if err != nil {
-			return nil, err
+		c.transactions.add(r.pkt.transID, c.dedupWindow)
+		r.tx = NewTransaction(r.pkt.transID, c.txConfig, reliable, now)
+		c.write(conn, r)
+	}
+	for {
+		if expired(tctx) {
+			// Time out the rest, unless ctx is done.
+			var err error
+			if expired(ctx) {
+				if err = ctx.Err(); err == nil {
+					err = context.DeadlineExceeded
+				}
+			}
+			for _, r := range reqs {
+				c.terminate(r, func(tx *Transaction) { tx.Cancel(time.Now(), err) }, err)
+			}
+			return
+		}
+		// Read until the earliest deadline of the transactions.
+		var deadline time.Time
+		for _, r := range reqs {
+			if d := r.tx.Deadline(); !d.IsZero() && (deadline.IsZero() || d.Before(deadline)) {
+				deadline = d
+			}
 		}
-		if timeout < maxTimeout {
-			timeout *= 2
+		if deadline.IsZero() {
+			return
 		}
-		for {
-			// Read from the port.
-			length, raddr, err := conn.ReadFrom(packetBytes)
-			if err != nil {
-				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-					break
+		if d, ok := tctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := readConn.SetReadDeadline(deadline); err != nil {
+			c.failAll(reqs, "read", err)
+			return
+		}
+		// tctx may be done before the deadline is set, which would
+		// undo the interruption.
+		if expired(tctx) {
+			continue
+		}
+		// Read from the port.
+		length, raddr, err := readConn.ReadFrom(packetBytes)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				now := time.Now()
+				for _, r := range reqs {
+					if d := r.tx.Deadline(); d.IsZero() || now.Before(d) {
+						continue
+					}
+					if r.tx.Timeout(now) {
+						c.write(conn, r)
+					} else {
+						if c.logger.debug {
+							c.logger.DebugFields("Transaction timeout", r.fields(Field{"requests", r.tx.Requests()})...)
+						}
+						c.finish(r)
+						c.emit(EventTimeout, r.addr, r.pkt.transID, r.tx.Requests(), nil)
+					}
 				}
-				return nil, err
+				continue
 			}
-			p, err := newPacketFromBytes(packetBytes[0:length])
-			if err != nil {
-				return nil, err
+			// Packets longer than the buffer are discarded by the
+			// connections which cannot truncate them.
+			if err == io.ErrShortBuffer {
+				if c.logger.debug {
+					c.logger.DebugFields("Discard oversized packet", txFields(phase, nil, nil, Field{"from", raddr})...)
+				}
+				c.count(&c.stats.Malformed)
+				continue
 			}
-			// If transId mismatches, keep reading until get a
-			// matched packet or timeout.
-			if !bytes.Equal(pkt.transID, p.transID) {
+			// Errors of IP_RECVERR about other addresses, e.g. of
+			// earlier transactions, are ignored.
+			if queued, errs := readICMPError(readConn, waitingAddrs(reqs)); queued {
+				for i, r := range waiting(reqs) {
+					if errs[i] != nil {
+						if c.logger.debug {
+							c.logger.DebugFields("ICMP error", r.fields(Field{"error", errs[i]})...)
+						}
+						c.fail(r, "read", errs[i])
+					}
+				}
 				continue
 			}
+			c.failAll(reqs, "read", err)
+			return
+		}
+		c.dumpPacket(false, readConn.LocalAddr(), raddr, packetBytes[0:length])
+		if length < 24 {
+			err = ErrTruncatedMessage
+		} else {
+			violations = violations[:0]
+			err = p.parseMode(packetBytes[0:length], c.parsing, &violations)
+		}
+		if err != nil {
+			if c.logger.debug {
+				c.logger.DebugFields("Discard malformed packet", txFields(phase, nil, nil, Field{"from", raddr}, Field{"error", err})...)
+			}
+			c.count(&c.stats.Malformed)
+			c.foreign(packetBytes[0:length], raddr)
+			continue
+		}
+		// If transId mismatches, keep reading until get a matched
+		// packet or timeout.
+		var r *request
+		for _, w := range waiting(reqs) {
+			if matchTransID(w.pkt.transID, p.transID) ||
+				c.compat3489 && matchLegacyTransID(w.pkt.transID, p.transID) {
+				r = w
+				break
+			}
+		}
+		if r == nil {
+			if c.transactions.contains(p.transID, c.dedupWindow) {
+				if c.logger.debug {
+					c.logger.DebugFields("Discard stale response", txFields(phase, p.transID, nil, Field{"from", raddr})...)
+				}
+				c.count(&c.stats.Stale)
+				c.emit(EventStaleResponse, raddr, p.transID, maxRequests(reqs), packetBytes[0:length])
+			} else {
+				if c.logger.debug {
+					c.logger.DebugFields("Discard response of unknown transaction", txFields(phase, p.transID, nil, Field{"from", raddr})...)
+				}
+				c.count(&c.stats.Rejected)
+				c.foreign(packetBytes[0:length], raddr)
+			}
+			continue
+		}
+		// Unauthenticated responses may be spoofed, so the
+		// transaction keeps waiting for the genuine one.
+		if !c.authenticated(packetBytes[0:length]) {
+			if c.logger.debug {
+				c.logger.DebugFields("Discard unauthenticated response", r.fields(Field{"from", raddr})...)
+			}
+			c.count(&c.stats.Unauthenticated)
+			continue
+		}
+		r.tx.Succeed(time.Now())
+		if c.logger.debug {
+			c.logger.DebugFields("Receive response", r.fields(Field{"from", raddr}, Field{"rtt", r.tx.RTT()}, Field{"requests", r.tx.Requests()})...)
+		}
+		c.traceMessage("Received", packetBytes[0:length], r.fields())
+		if c.logger.info {
 			c.logger.Info("\n" + hex.Dump(packetBytes[0:length]))
-			resp := newResponse(p, conn)
-			resp.serverAddr = newHostFromStr(raddr.String())
-			return resp, err
 		}
+		c.emit(EventResponseReceived, raddr, r.pkt.transID, r.tx.Requests(), packetBytes[0:length])
+		if isErrorResponse(p.types) {
+			c.emit(EventServerError, raddr, r.pkt.transID, r.tx.Requests(), packetBytes[0:length])
+		}
+		// The response outlives the pooled buffer, so it gets a copy
+		// of the packet.
+		r.resp = newResponse(p.clone(), readConn)
+		if c.record {
+			r.resp.request = append([]byte(nil), r.b...)
+		}
+		r.resp.serverAddr = newHostFromStr(raddr.String())
+		if len(violations) > 0 {
+			if c.logger.debug {
+				c.logger.DebugFields("Accept response with violations", r.fields(Field{"violations", violations})...)
+			}
+			r.resp.violations = append([]Violation(nil), violations...)
+			c.countN(&c.stats.Violations, len(violations))
+		}
+		r.resp.rtt = r.tx.RTT()
+		c.finish(r)
+	}
+}
+
+// write sends the request of the waiting transaction, the first
+// transmission or a retransmission, failing it on errors other than
+// timeouts. Streams wait for the response as long as the retransmissions, so
+// the request is sent only once over them.
+func (c *Client) write(conn net.PacketConn, r *request) {
+	// The write may block until the retransmission, e.g. on a congested
+	// tunnel, in which case the request is lost like any datagram. The
+	// deadline is cleared for the other users of the connection.
+	conn.SetWriteDeadline(r.tx.Deadline())
+	length, err := conn.WriteTo(r.b, r.addr)
+	conn.SetWriteDeadline(time.Time{})
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		if c.logger.debug {
+			c.logger.DebugFields("Write timeout", r.fields()...)
+		}
+		return
+	}
+	if err != nil {
+		c.fail(r, "write", err)
+		return
+	}
+	c.dumpPacket(true, conn.LocalAddr(), r.addr, r.b)
+	if length != len(r.b) {
+		c.fail(r, "write", io.ErrShortWrite)
+		return
+	}
+	if n := r.tx.Requests(); n == 1 {
+		if c.logger.debug {
+			c.logger.DebugFields("Send request", r.fields()...)
+		}
+		c.traceMessage("Sent", r.b, r.fields())
+		c.emit(EventRequestSent, r.addr, r.pkt.transID, n, r.b)
+	} else {
+		if c.logger.debug {
+			c.logger.DebugFields("Retransmit request", r.fields(Field{"requests", n})...)
+		}
+		c.emit(EventRetransmit, r.addr, r.pkt.transID, n, r.b)
+	}
+}
+
+// fail terminates the waiting transaction with a TransportError.
+func (c *Client) fail(r *request, op string, err error) {
+	err = &TransportError{Op: op, Addr: r.addr, Err: err}
+	c.terminate(r, func(tx *Transaction) { tx.Fail(time.Now(), err) }, err)
+}
+
+func (c *Client) failAll(reqs []*request, op string, err error) {
+	for _, r := range waiting(reqs) {
+		c.fail(r, op, err)
+	}
+}
+
+// terminate terminates the transaction of the request by end if it is
+// waiting, which results in err, or in a timeout if err is nil.
+func (c *Client) terminate(r *request, end func(*Transaction), err error) {
+	if r.tx.State() != TransactionWaiting {
+		return
+	}
+	end(r.tx)
+	r.err = err
+	c.finish(r)
+	if err == nil {
+		c.emit(EventTimeout, r.addr, r.pkt.transID, r.tx.Requests(), nil)
+	}
+}
+
+// finish accounts the terminated transaction of the request.
+func (c *Client) finish(r *request) {
+	r.loss.add(r.tx)
+	c.count(&c.stats.Transactions)
+	if r.tx.State() == TransactionSucceeded && r.tx.Requests() > 1 {
+		c.count(&c.stats.Retransmitted)
+	}
+	if r.tx.State() == TransactionTimedOut {
+		c.count(&c.stats.TimedOut)
+	}
+	c.emitTransaction(r.tx)
+}
+
+// requestAddrs returns the addresses of the requests.
+func requestAddrs(reqs []*request) []net.Addr {
+	addrs := make([]net.Addr, len(reqs))
+	for i, r := range reqs {
+		addrs[i] = r.addr
+	}
+	return addrs
+}
+
+// waiting returns the requests whose transactions are waiting.
+func waiting(reqs []*request) []*request {
+	var w []*request
+	for _, r := range reqs {
+		if r.tx.State() == TransactionWaiting {
+			w = append(w, r)
+		}
+	}
+	return w
+}
+
+func waitingAddrs(reqs []*request) []net.Addr {
+	var addrs []net.Addr
+	for _, r := range waiting(reqs) {
+		addrs = append(addrs, r.addr)
+	}
+	return addrs
+}
+
+// maxRequests returns the most transmissions of the requests.
+func maxRequests(reqs []*request) int {
+	n := 0
+	for _, r := range reqs {
+		if r.tx.Requests() > n {
+			n = r.tx.Requests()
+		}
+	}
+	return n
+}
+
+// expired reports whether ctx is done or its deadline has passed, which the
+// read deadline may notice before the timer of ctx fires.
+func expired(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
 	}
-	return nil, nil
+	d, ok := ctx.Deadline()
+	return ok && !time.Now().Before(d)
 }
@@ -0,0 +1,195 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DefaultNetworkPollInterval is the interval the network is checked at on
+// platforms without change notifications.
+const DefaultNetworkPollInterval = 5 * time.Second
+
+// networkSettle is the time the network state is read after a notification,
+// as a change comes with a burst of them.
+const networkSettle = 200 * time.Millisecond
+
+// NetworkChange is a change of the default interface or of its addresses.
+type NetworkChange struct {
+	Interface string // name of the default interface, empty if none
+	IPv4      net.IP // local address used for IPv4, nil if none
+	IPv6      net.IP // local address used for IPv6, nil if none
+
+	// Result and Err are the outcome of the discovery run by
+	// Client.WatchNetwork after the change, both nil for WatchNetwork.
+	Result *DiscoveryResult
+	Err    error
+}
+
+// netState is the default interface and addresses of the host.
+type netState struct {
+	iface string
+	v4    net.IP
+	v6    net.IP
+}
+
+func (s netState) equal(o netState) bool {
+	return s.iface == o.iface && s.v4.Equal(o.v4) && s.v6.Equal(o.v6)
+}
+
+// currentNetState reads the source addresses the routing table selects for
+// the Internet, which connecting a UDP socket reveals without sending any
+// packet, and the interface owning them.
+func currentNetState() netState {
+	var s netState
+	s.v4 = routeSource("udp4", "192.0.2.1:9")
+	s.v6 = routeSource("udp6", "[2001:db8::1]:9")
+	ip := s.v4
+	if ip == nil {
+		ip = s.v6
+	}
+	if ip == nil {
+		return s
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return s
+	}
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				s.iface = ifi.Name
+				return s
+			}
+		}
+	}
+	return s
+}
+
+func routeSource(network, address string) net.IP {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// WatchNetwork returns a channel receiving a NetworkChange whenever the
+// default interface or its addresses change. The channel is closed once ctx
+// is done. It relies on the routing socket on Linux and BSD, including macOS,
+// and polls every DefaultNetworkPollInterval elsewhere: Windows, whose
+// change notifications are not implemented, only polls.
+func WatchNetwork(ctx context.Context) (<-chan NetworkChange, error) {
+	events, err := netNotifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan NetworkChange)
+	go func() {
+		defer close(ch)
+		watchNetwork(ctx, events, DefaultNetworkPollInterval, currentNetState, func(nc NetworkChange) {
+			select {
+			case ch <- nc:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch, nil
+}
+
+// watchNetwork calls changed with the new state whenever state reports a
+// change, checking it after the events, or at the poll interval if events is
+// nil or gets closed. It returns once ctx is done.
+func watchNetwork(ctx context.Context, events <-chan struct{}, poll time.Duration, state func() netState, changed func(NetworkChange)) {
+	last := state()
+	var tick <-chan time.Time
+	if events == nil {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case _, ok := <-events:
+			if !ok {
+				// The notifications failed, fall back to polling.
+				events = nil
+				ticker := time.NewTicker(poll)
+				defer ticker.Stop()
+				tick = ticker.C
+				continue
+			}
+			// Let the burst of notifications settle.
+			timer := time.NewTimer(networkSettle)
+			for settled := false; !settled; {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-events:
+				case <-timer.C:
+					settled = true
+				}
+			}
+		}
+		s := state()
+		if s.equal(last) {
+			continue
+		}
+		last = s
+		changed(NetworkChange{Interface: s.iface, IPv4: s.v4, IPv6: s.v6})
+	}
+}
+
+// WatchNetwork is WatchNetwork, but the client runs the discovery again after
+// each change and reports its outcome in the NetworkChange. The cached result
+// is invalidated, and the connection kept by SetReuseConn, which is bound to
+// the old network, is replaced. The client must not be used by others while
+// it watches the network.
+func (c *Client) WatchNetwork(ctx context.Context) (<-chan NetworkChange, error) {
+	events, err := netNotifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan NetworkChange)
+	go func() {
+		defer close(ch)
+		watchNetwork(ctx, events, DefaultNetworkPollInterval, currentNetState, func(nc NetworkChange) {
+			c.logger.Debugln("Network changed to", nc.Interface, nc.IPv4, nc.IPv6)
+			c.Invalidate()
+			if c.ownConn {
+				c.Close()
+			}
+			nc.Result, nc.Err = c.DiscoverResultContext(ctx)
+			select {
+			case ch <- nc:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch, nil
+}
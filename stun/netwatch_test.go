@@ -0,0 +1,91 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchNetwork(t *testing.T) {
+	var mu sync.Mutex
+	cur := netState{iface: "eth0", v4: net.IPv4(192, 0, 2, 1)}
+	state := func() netState {
+		mu.Lock()
+		defer mu.Unlock()
+		return cur
+	}
+	set := func(s netState) {
+		mu.Lock()
+		cur = s
+		mu.Unlock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan struct{})
+	changes := make(chan NetworkChange, 4)
+	done := make(chan struct{})
+	go func() {
+		watchNetwork(ctx, events, time.Hour, state, func(nc NetworkChange) {
+			changes <- nc
+		})
+		close(done)
+	}()
+
+	// A burst of notifications reports the change once.
+	events <- struct{}{}
+	set(netState{iface: "wlan0", v4: net.IPv4(192, 0, 2, 2)})
+	events <- struct{}{}
+	events <- struct{}{}
+	select {
+	case nc := <-changes:
+		if nc.Interface != "wlan0" || !nc.IPv4.Equal(net.IPv4(192, 0, 2, 2)) {
+			t.Errorf("change is %+v", nc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported")
+	}
+	select {
+	case nc := <-changes:
+		t.Errorf("burst reported twice: %+v", nc)
+	case <-time.After(2 * networkSettle):
+	}
+
+	cancel()
+	<-done
+
+	// Closing the notifications falls back to polling.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events = make(chan struct{})
+	close(events)
+	go watchNetwork(ctx, events, 10*time.Millisecond, state, func(nc NetworkChange) {
+		changes <- nc
+	})
+	time.Sleep(50 * time.Millisecond)
+	set(netState{iface: "eth0", v6: net.ParseIP("2001:db8::1")})
+	select {
+	case nc := <-changes:
+		if nc.IPv6 == nil || nc.IPv4 != nil {
+			t.Errorf("change is %+v", nc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change polled")
+	}
+}
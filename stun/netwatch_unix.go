@@ -0,0 +1,68 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// netNotifications returns a channel receiving a value for every message of
+// the routing socket, which reports the changes of the interfaces, addresses
+// and routes. The socket is closed once ctx is done, and the channel if
+// reading it fails otherwise.
+func netNotifications(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := routeSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// A non-blocking file uses the poller, so Close interrupts Read.
+	f := os.NewFile(uintptr(fd), "route")
+	events := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		defer f.Close()
+		buf := make([]byte, 1<<16)
+		for {
+			// ENOBUFS tells that notifications were lost, which is a
+			// change as well.
+			if _, err := f.Read(buf); err != nil && !errors.Is(err, syscall.ENOBUFS) {
+				if ctx.Err() == nil {
+					close(events)
+				}
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
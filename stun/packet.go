@@ -19,7 +19,6 @@ package stun
 import (
 	"crypto/rand"
 	"encoding/binary"
-	"errors"
 )
 
 type packet struct {
@@ -27,63 +26,195 @@ type packet struct {
 	length     uint16
 	transID    []byte // 4 bytes magic cookie + 12 bytes transaction id
 	attributes []attribute
+
+	// Inline storage of new packets, which saves allocations.
+	idBuf   [16]byte
+	attrBuf [6]attribute
 }
 
+// newPacket returns a packet with a transaction ID from crypto/rand, which
+// off-path attackers cannot guess to spoof responses.
 func newPacket() (*packet, error) {
 	v := new(packet)
-	v.transID = make([]byte, 16)
+	v.transID = v.idBuf[:]
 	binary.BigEndian.PutUint32(v.transID[:4], magicCookie)
 	_, err := rand.Read(v.transID[4:])
 	if err != nil {
 		return nil, err
 	}
-	v.attributes = make([]attribute, 0, 10)
+	v.attributes = v.attrBuf[:0]
 	v.length = 0
 	return v, nil
 }
 
 func newPacketFromBytes(packetBytes []byte) (*packet, error) {
 	if len(packetBytes) < 24 {
-		return nil, errors.New("Received data length too short.")
+		return nil, ErrTruncatedMessage
 	}
+	return parsePacket(packetBytes)
+}
+
+// parsePacket parses the packet with every length checked against the
+// bounds. Bytes beyond the length in the header are ignored.
+func parsePacket(packetBytes []byte) (*packet, error) {
 	pkt := new(packet)
-	pkt.types = binary.BigEndian.Uint16(packetBytes[0:2])
-	pkt.length = binary.BigEndian.Uint16(packetBytes[2:4])
-	pkt.transID = packetBytes[4:20]
-	pkt.attributes = make([]attribute, 0, 10)
-	for pos := uint16(20); pos < uint16(len(packetBytes)); {
-		types := binary.BigEndian.Uint16(packetBytes[pos : pos+2])
-		length := binary.BigEndian.Uint16(packetBytes[pos+2 : pos+4])
-		if pos+4+length > uint16(len(packetBytes)) {
-			return nil, errors.New("Received data format mismatch.")
-		}
-		value := packetBytes[pos+4 : pos+4+length]
-		attribute := newAttribute(types, value)
-		pkt.addAttribute(*attribute)
-		pos += align(length) + 4
+	if err := pkt.parse(packetBytes); err != nil {
+		return nil, err
 	}
 	return pkt, nil
 }
 
+// parse parses the packet into v, reusing its attribute slice. The transID
+// and the attribute values share memory with packetBytes.
+func (v *packet) parse(packetBytes []byte) error {
+	return v.parseMode(packetBytes, ParseDefault, nil)
+}
+
+// messageEnd checks the header of the message and returns the end of its
+// attributes.
+func messageEnd(packetBytes []byte) (int, error) {
+	if len(packetBytes) < 20 {
+		return 0, ErrTruncatedMessage
+	}
+	if packetBytes[0]&0xc0 != 0 {
+		return 0, ErrInvalidHeader
+	}
+	// Use int for positions, which would overflow uint16 on long attributes.
+	end := 20 + int(binary.BigEndian.Uint16(packetBytes[2:4]))
+	if end > len(packetBytes) {
+		return 0, ErrTruncatedMessage
+	}
+	return end, nil
+}
+
+// nextAttribute reads the attribute at pos, and returns its value without
+// padding and the position of the next attribute. It only checks the bounds,
+// the callers check the value with validAttribute.
+func nextAttribute(packetBytes []byte, pos, end int) (uint16, []byte, int, error) {
+	if pos+4 > end {
+		return 0, nil, 0, &ParseError{ErrTruncatedAttribute, 0, pos}
+	}
+	types := binary.BigEndian.Uint16(packetBytes[pos : pos+2])
+	length := binary.BigEndian.Uint16(packetBytes[pos+2 : pos+4])
+	if pos+4+int(length) > end {
+		return 0, nil, 0, &ParseError{ErrTruncatedAttribute, types, pos}
+	}
+	// Limit the capacity, so appending to the value copies it instead
+	// of overwriting the bytes following it.
+	value := packetBytes[pos+4 : pos+4+int(length) : pos+4+int(length)]
+	return types, value, pos + int(align(length)) + 4, nil
+}
+
+// paddedValue returns the value with its padding, which is sliced from the
+// message if the padding is there, so parsing does not copy values.
+func paddedValue(packetBytes []byte, pos, end int, value []byte) []byte {
+	padded := pos + 4 + int(align(uint16(len(value))))
+	if padded <= end {
+		return packetBytes[pos+4 : padded : padded]
+	}
+	return padding(value)
+}
+
+// validAttribute checks the length of the value of attributes this package
+// interprets, so that decoding them never reads out of bounds.
+func validAttribute(types uint16, value []byte) bool {
+	switch types {
+	case attributeMappedAddress, attributeResponseAddress,
+		attributeSourceAddress, attributeChangedAddress,
+		attributeReflectedFrom, attributeXorPeerAddress,
+		attributeXorRelayedAddress, attributeXorMappedAddress,
+		attributeXorMappedAddressExp, attributeAlternateServer,
+		attributeResponseOrigin, attributeOtherAddress:
+		if len(value) < 4 {
+			return false
+		}
+		switch value[1] {
+		case attributeFamilyIPv4:
+			return len(value) == 8
+		case attributeFamilyIPV6:
+			return len(value) == 20
+		}
+		return false
+	case attributeChangeRequest, attributeFingerprint, attributeLifetime,
+		attributeResponsePort, attributeConnectionID:
+		return len(value) == 4
+	case attributeMessageIntegrity:
+		return len(value) == messageIntegritySize
+	case attributeErrorCode:
+		return len(value) >= 4
+	case attributeUnknownAttributes:
+		return len(value)%2 == 0
+	}
+	return validCustomAttribute(types, value)
+}
+
+// unknownAttributes returns the comprehension-required attributes (RFC 5389
+// Section 15) of the packet which are unknown to this package.
+func (v *packet) unknownAttributes() []uint16 {
+	var unknown []uint16
+	for _, a := range v.attributes {
+		if a.types < 0x8000 && !isKnownAttribute(a.types) {
+			unknown = append(unknown, a.types)
+		}
+	}
+	return unknown
+}
+
+// clone returns a copy of the packet which does not share memory with the
+// buffer it was parsed from.
+func (v *packet) clone() *packet {
+	b := v.bytes()
+	pkt := &packet{types: v.types, length: v.length, transID: b[4:20]}
+	pkt.attributes = make([]attribute, len(v.attributes))
+	pos := 20
+	for i, a := range v.attributes {
+		n := len(a.value)
+		pkt.attributes[i] = attribute{a.types, a.length, b[pos+4 : pos+4+n : pos+4+n]}
+		pos += 4 + n
+	}
+	return pkt
+}
+
 func (v *packet) addAttribute(a attribute) {
 	v.attributes = append(v.attributes, a)
 	v.length += align(a.length) + 4
 }
 
+// addFingerprint adds the FINGERPRINT attribute, which must be the last one.
+func (v *packet) addFingerprint() {
+	// length of fingerprint attribute must be included into crc,
+	// so we add it before calculating crc, then subtract it after calculating crc.
+	v.length += 8
+	attribute := newFingerprintAttribute(v)
+	v.length -= 8
+	v.addAttribute(*attribute)
+}
+
 func (v *packet) bytes() []byte {
-	packetBytes := make([]byte, 4)
-	binary.BigEndian.PutUint16(packetBytes[0:2], v.types)
-	binary.BigEndian.PutUint16(packetBytes[2:4], v.length)
-	packetBytes = append(packetBytes, v.transID...)
+	return v.appendTo(make([]byte, 0, 20+int(v.length)))
+}
+
+// appendTo appends the encoded packet to b and returns the extended buffer,
+// which lets callers reuse buffers.
+func (v *packet) appendTo(b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, v.types)
+	b = binary.BigEndian.AppendUint16(b, v.length)
+	b = append(b, v.transID...)
 	for _, a := range v.attributes {
-		buf := make([]byte, 2)
-		binary.BigEndian.PutUint16(buf, a.types)
-		packetBytes = append(packetBytes, buf...)
-		binary.BigEndian.PutUint16(buf, a.length)
-		packetBytes = append(packetBytes, buf...)
-		packetBytes = append(packetBytes, a.value...)
-	}
-	return packetBytes
+		b = binary.BigEndian.AppendUint16(b, a.types)
+		b = binary.BigEndian.AppendUint16(b, a.length)
+		b = append(b, a.value...)
+	}
+	return b
+}
+
+func (v *packet) getAttribute(types uint16) *attribute {
+	for i := range v.attributes {
+		if v.attributes[i].types == types {
+			return &v.attributes[i]
+		}
+	}
+	return nil
 }
 
 func (v *packet) getSourceAddr() *Host {
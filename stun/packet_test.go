@@ -17,6 +17,7 @@
 package stun
 
 import (
+	"net"
 	"testing"
 )
 
@@ -59,3 +60,82 @@ func TestPacketAll(t *testing.T) {
 		t.Errorf("newPacketFromBytes error")
 	}
 }
+
+func TestMessageIntegrity(t *testing.T) {
+	key := []byte("password")
+	p, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error")
+	}
+	p.types = typeBindingRequest
+	p.addAttribute(*newUsernameAttribute("a:b"))
+	p.addAttribute(*newMessageIntegrityAttribute(p, key))
+	p.addFingerprint()
+	if !verifyMessageIntegrity(p.bytes(), key) {
+		t.Errorf("verifyMessageIntegrity error: valid integrity rejected")
+	}
+	if verifyMessageIntegrity(p.bytes(), []byte("wrong")) {
+		t.Errorf("verifyMessageIntegrity error: wrong key accepted")
+	}
+}
+
+func TestPacketAppendTo(t *testing.T) {
+	p, _ := newPacket()
+	p.types = typeBindingRequest
+	p.addAttribute(*newSoftwareAttribute("abcde"))
+	p.addFingerprint()
+	buf := make([]byte, 0, maxPacketSize)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = p.appendTo(buf[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("appendTo error: %v allocations", allocs)
+	}
+	var pkt packet
+	if err := pkt.parse(buf); err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		_ = pkt.parse(buf)
+	})
+	if allocs != 0 {
+		t.Errorf("parse error: %v allocations", allocs)
+	}
+	// The clone must not share memory with the buffer.
+	c := pkt.clone()
+	for i := range buf {
+		buf[i] = 0
+	}
+	if a := c.getAttribute(attributeSoftware); a == nil || string(a.value[:a.length]) != "abcde" {
+		t.Errorf("clone error: %v", c.attributes)
+	}
+}
+
+func BenchmarkBindingRequest(b *testing.B) {
+	c := NewClient()
+	buf := make([]byte, 0, maxPacketSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkt, err := c.newBindingPacket(typeBindingRequest, false, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf = pkt.appendTo(buf[:0])
+	}
+}
+
+func BenchmarkPacketParse(b *testing.B) {
+	p, _ := newPacket()
+	p.types = typeBindingResponse
+	p.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}, p.transID))
+	p.addAttribute(*newSoftwareAttribute("go-stun"))
+	p.addFingerprint()
+	msg := p.bytes()
+	var pkt packet
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := pkt.parse(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
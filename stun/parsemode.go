@@ -0,0 +1,186 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Errors returned in the strict parsing mode.
+var (
+	ErrInvalidPadding = errors.New("invalid attribute padding")
+	ErrTrailingBytes  = errors.New("trailing bytes after the message")
+)
+
+// ParseMode is how the parser treats messages violating the encoding rules
+// of RFC 5389 Section 15 which it can recover from.
+type ParseMode int
+
+// Parsing modes.
+const (
+	// ParseDefault rejects the attributes known to this package with
+	// invalid lengths, and tolerates the other violations.
+	ParseDefault ParseMode = iota
+	// ParseStrict rejects every violation: missing or nonzero padding, a
+	// message length which is not a multiple of 4, invalid attribute
+	// lengths and bytes after the message.
+	ParseStrict
+	// ParseLenient accepts every violation, and drops the attributes
+	// with invalid lengths, so their values are never decoded.
+	ParseLenient
+)
+
+// ViolationKind is the kind of a Violation.
+type ViolationKind int
+
+// Kinds of violations.
+const (
+	ViolationPadding       ViolationKind = iota // missing or nonzero padding
+	ViolationLength                             // invalid length of a known attribute
+	ViolationTrailingBytes                      // bytes after the length in the header
+	ViolationHeaderLength                       // message length not a multiple of 4
+)
+
+var violationStr map[ViolationKind]string
+
+func init() {
+	violationStr = map[ViolationKind]string{
+		ViolationPadding:       "Invalid padding",
+		ViolationLength:        "Invalid attribute length",
+		ViolationTrailingBytes: "Trailing bytes",
+		ViolationHeaderLength:  "Invalid message length",
+	}
+}
+
+func (k ViolationKind) String() string {
+	if s, ok := violationStr[k]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Violation is a violation of the encoding rules found in a message, which
+// the parser recovered from.
+type Violation struct {
+	Kind   ViolationKind
+	Type   uint16 // type of the attribute, 0 for the message
+	Offset int    // offset of the attribute or of the trailing bytes
+	Test   Tests  // test of the discovery, 0 outside of DiscoveryResult
+}
+
+func (v Violation) String() string {
+	if v.Type == 0 {
+		return fmt.Sprintf("%v at offset %d", v.Kind, v.Offset)
+	}
+	return fmt.Sprintf("%v of %s at offset %d", v.Kind, attributeString(v.Type), v.Offset)
+}
+
+// ParseMessageMode parses a STUN message like ParseMessage in the parsing
+// mode, and returns the violations the message was accepted with.
+func ParseMessageMode(b []byte, mode ParseMode) (*Message, []Violation, error) {
+	var pkt packet
+	var violations []Violation
+	if err := pkt.parseMode(b, mode, &violations); err != nil {
+		return nil, violations, err
+	}
+	m := pkt.message()
+	if unknown := pkt.unknownAttributes(); len(unknown) > 0 {
+		return m, violations, &UnknownAttributesError{unknown}
+	}
+	return m, violations, nil
+}
+
+// SetParseMode sets the parsing mode of the responses, ParseDefault by
+// default. Responses rejected by the mode are counted as malformed. The
+// violations of the accepted responses are counted in ClientStats, and
+// listed in DiscoveryResult.Violations.
+func (c *Client) SetParseMode(mode ParseMode) {
+	c.parsing = mode
+}
+
+// parseMode parses the packet into v like parse in the mode, appending the
+// violations it accepted to violations unless it is nil.
+func (v *packet) parseMode(packetBytes []byte, mode ParseMode, violations *[]Violation) error {
+	end, err := messageEnd(packetBytes)
+	if err != nil {
+		return err
+	}
+	// violation records the violation, and reports whether the message
+	// is rejected for it.
+	violation := func(kind ViolationKind, types uint16, pos int) bool {
+		switch {
+		case mode == ParseStrict:
+			return true
+		case kind == ViolationLength:
+			// Even the default mode rejects invalid lengths.
+			if mode == ParseDefault {
+				return true
+			}
+		}
+		if violations != nil {
+			*violations = append(*violations, Violation{Kind: kind, Type: types, Offset: pos})
+		}
+		return false
+	}
+	if (end-20)%4 != 0 && violation(ViolationHeaderLength, 0, 2) {
+		return ErrInvalidHeader
+	}
+	if len(packetBytes) > end && violation(ViolationTrailingBytes, 0, end) {
+		return ErrTrailingBytes
+	}
+	v.types = binary.BigEndian.Uint16(packetBytes[0:2])
+	v.length = 0
+	v.transID = packetBytes[4:20]
+	if v.attributes == nil {
+		v.attributes = v.attrBuf[:0]
+	}
+	v.attributes = v.attributes[:0]
+	for pos := 20; pos < end; {
+		types, value, next, err := nextAttribute(packetBytes, pos, end)
+		if err != nil {
+			return err
+		}
+		if !validPadding(packetBytes, pos+4+len(value), next, end) && violation(ViolationPadding, types, pos) {
+			return &ParseError{ErrInvalidPadding, types, pos}
+		}
+		if !validAttribute(types, value) {
+			if violation(ViolationLength, types, pos) {
+				return &ParseError{ErrInvalidAttribute, types, pos}
+			}
+		} else {
+			v.addAttribute(attribute{types, uint16(len(value)), paddedValue(packetBytes, pos, end, value)})
+		}
+		pos = next
+	}
+	return nil
+}
+
+// validPadding reports whether the padding from pos to next is within the
+// message and zero.
+func validPadding(packetBytes []byte, pos, next, end int) bool {
+	if next > end {
+		return false
+	}
+	for _, b := range packetBytes[pos:next] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
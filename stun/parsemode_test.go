@@ -0,0 +1,112 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// violatingMessage returns a binding response whose SOFTWARE has nonzero
+// padding, with a FINGERPRINT of invalid length, followed by trailing bytes.
+func violatingMessage(transID []byte, mapped *net.UDPAddr) []byte {
+	pkt := &packet{transID: transID, types: typeBindingResponse}
+	pkt.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, mapped, transID))
+	pkt.addAttribute(*newSoftwareAttribute("abc"))
+	pkt.addAttribute(*newAttribute(attributeFingerprint, []byte{1, 2}))
+	b := pkt.bytes()
+	// The padding of SOFTWARE follows the XOR-MAPPED-ADDRESS of 12 bytes.
+	b[20+12+4+3] = 0xff
+	return append(b, 0xde, 0xad)
+}
+
+func TestParseMode(t *testing.T) {
+	p, _ := newPacket()
+	b := violatingMessage(p.transID, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+
+	_, _, err := ParseMessageMode(b, ParseDefault)
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Err != ErrInvalidAttribute || perr.Type != attributeFingerprint {
+		t.Errorf("ParseDefault error: expected invalid FINGERPRINT, get %v", err)
+	}
+
+	if _, _, err = ParseMessageMode(b, ParseStrict); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("ParseStrict error: expected %v, get %v", ErrTrailingBytes, err)
+	}
+	if _, _, err = ParseMessageMode(b[:len(b)-2], ParseStrict); !errors.Is(err, ErrInvalidPadding) {
+		t.Errorf("ParseStrict error: expected %v, get %v", ErrInvalidPadding, err)
+	}
+
+	m, violations, err := ParseMessageMode(b, ParseLenient)
+	if err != nil {
+		t.Fatalf("ParseLenient error: %v", err)
+	}
+	expected := []Violation{
+		{Kind: ViolationTrailingBytes, Offset: len(b) - 2},
+		{Kind: ViolationPadding, Type: attributeSoftware, Offset: 32},
+		{Kind: ViolationLength, Type: attributeFingerprint, Offset: 40},
+	}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("violations error: expected %v, get %v", expected, violations)
+	}
+	if _, ok := m.Get(attributeFingerprint); ok || len(m.Attributes) != 2 {
+		t.Errorf("ParseLenient error: expected the FINGERPRINT dropped, get %v", m.Attributes)
+	}
+}
+
+func TestClientParseMode(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if req, err := newPacketFromBytes(b[:n]); err == nil {
+				conn.WriteTo(violatingMessage(req.transID, addr), addr)
+			}
+		}
+	}()
+	c := NewClient()
+	c.SetServerAddr(conn.LocalAddr().String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetTestTimeout(300 * time.Millisecond)
+	c.SetParseMode(ParseLenient)
+	r, err := c.DiscoverResult()
+	if err != nil || r.NAT == NATBlocked {
+		t.Fatalf("DiscoverResult error: get %v %v", r.NAT, err)
+	}
+	// Both the responses of test1 and test2 have the violations.
+	if len(r.Violations) != 6 || r.Violations[0].Test != TestI || r.Violations[3].Test != TestII {
+		t.Errorf("Violations error: get %v", r.Violations)
+	}
+	if n := c.Stats().Violations; n != 6 {
+		t.Errorf("Stats error: expected 6 violations, get %d", n)
+	}
+	c.SetParseMode(ParseStrict)
+	if r, err := c.DiscoverResult(); err != nil || r.NAT != NATBlocked {
+		t.Errorf("DiscoverResult error: expected %v, get %v %v", NATBlocked, r.NAT, err)
+	}
+}
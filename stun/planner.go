@@ -0,0 +1,147 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Endpoint is a local address of the host rated by PlanEndpoints for
+// establishing P2P sessions.
+type Endpoint struct {
+	Interface string           // name of the interface
+	LocalAddr *net.UDPAddr     // local address the discovery was bound to
+	Result    *DiscoveryResult // result of the discovery, never nil
+	Err       error            // error of the discovery, if any
+	Score     int              // the higher the better, 0 if unusable
+}
+
+// natScores rate the NAT types by how easily peers reach them: no NAT first,
+// then the NATs with less restrictive filtering, and symmetric NATs last.
+var natScores = map[NATType]int{
+	NATNone:                 90,
+	NATFull:                 80,
+	NATSymmetricUDPFirewall: 70,
+	NATRestricted:           60,
+	NATPortRestricted:       50,
+	NATUnknownFiltering:     40,
+	NATSymmetric:            20,
+}
+
+// endpointScore returns the score of the endpoint: the score of its NAT
+// type, with a bonus for IPv6, so a public IPv6 address is preferred over a
+// public IPv4 one, which is preferred over a full-cone IPv4 NAT.
+func endpointScore(e *Endpoint) int {
+	if e.Err != nil {
+		return 0
+	}
+	score := natScores[e.Result.NAT]
+	if score > 0 && e.LocalAddr.IP.To4() == nil {
+		score += 10
+	}
+	return score
+}
+
+// PlanEndpoints performs the discovery at once on every global unicast
+// address of every interface which is up and not a loopback, with the
+// server address resolved for the family of each address, and returns the
+// endpoints sorted best first, see BestEndpoint. The connection passed to
+// NewClientWithConnection, the local address and the interface set to the
+// client are not used. Addresses of a family the server has no address of
+// are skipped.
+func (c *Client) PlanEndpoints(ctx context.Context) ([]*Endpoint, error) {
+	c.defaultServer(ctx)
+	names, ips, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	laddrs := make([]*net.UDPAddr, len(ips))
+	for i, ip := range ips {
+		laddrs[i] = &net.UDPAddr{IP: ip}
+	}
+	return c.planEndpoints(ctx, names, laddrs)
+}
+
+// planEndpoints performs the discovery on the local addresses of the
+// interfaces with the names, and rates them.
+func (c *Client) planEndpoints(ctx context.Context, names []string, laddrs []*net.UDPAddr) ([]*Endpoint, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	// The server is resolved once per family.
+	var servers [2]*net.UDPAddr
+	var errs [2]error
+	for i, network := range []string{"udp4", "udp6"} {
+		servers[i], errs[i] = c.resolveUDPAddr(ctx, network, c.serverAddr)
+	}
+	if errs[0] != nil && errs[1] != nil {
+		return nil, errs[0]
+	}
+	var eps []*Endpoint
+	var wg sync.WaitGroup
+	for i, laddr := range laddrs {
+		family := 0
+		if laddr.IP.To4() == nil {
+			family = 1
+		}
+		server := servers[family]
+		if server == nil {
+			continue
+		}
+		e := &Endpoint{Interface: names[i], LocalAddr: laddr, Result: &DiscoveryResult{NAT: NATError}}
+		eps = append(eps, e)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.logger.Debugln("Discover on", e.Interface, e.LocalAddr)
+			c.discoverEndpoint(ctx, e, server)
+		}()
+	}
+	wg.Wait()
+	if len(eps) == 0 {
+		return nil, ErrNoInterfaceAddr
+	}
+	sort.SliceStable(eps, func(i, j int) bool { return eps[i].Score > eps[j].Score })
+	return eps, nil
+}
+
+// discoverEndpoint performs the discovery from the endpoint and rates it.
+func (c *Client) discoverEndpoint(ctx context.Context, e *Endpoint, server *net.UDPAddr) {
+	defer func() { e.Score = endpointScore(e) }()
+	conn, err := c.listenUDP(c.socket, "udp", e.LocalAddr)
+	if err != nil {
+		e.Err = err
+		return
+	}
+	defer conn.Close()
+	r := e.Result
+	ctx, loss := withLossCounter(ctx)
+	r.LocalAddr = newHostFromStr(conn.LocalAddr().String())
+	r.NAT, r.Hosts, e.Err = c.discoverAll(ctx, conn, server, r)
+	r.Loss = loss.snapshot()
+}
+
+// BestEndpoint returns the best endpoint of PlanEndpoints, nil if none is
+// usable.
+func BestEndpoint(eps []*Endpoint) *Endpoint {
+	if len(eps) == 0 || eps[0].Score == 0 {
+		return nil
+	}
+	return eps[0]
+}
@@ -0,0 +1,80 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestEndpointScore(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}
+	endpoint := func(laddr *net.UDPAddr, nat NATType) *Endpoint {
+		return &Endpoint{LocalAddr: laddr, Result: &DiscoveryResult{NAT: nat}}
+	}
+	// Best first.
+	ordered := []*Endpoint{
+		endpoint(v6, NATNone),
+		endpoint(v4, NATNone),
+		endpoint(v4, NATFull),
+		endpoint(v4, NATRestricted),
+		endpoint(v4, NATPortRestricted),
+		endpoint(v4, NATSymmetric),
+	}
+	for i := 1; i < len(ordered); i++ {
+		a, b := ordered[i-1], ordered[i]
+		if endpointScore(a) <= endpointScore(b) {
+			t.Errorf("endpointScore error: %v %v is not better than %v %v", a.LocalAddr, a.Result.NAT, b.LocalAddr, b.Result.NAT)
+		}
+	}
+	if s := endpointScore(endpoint(v6, NATBlocked)); s != 0 {
+		t.Errorf("endpointScore error: expected 0 for blocked, get %d", s)
+	}
+	failed := endpoint(v4, NATFull)
+	failed.Err = errors.New("failed")
+	if s := endpointScore(failed); s != 0 {
+		t.Errorf("endpointScore error: expected 0 for errors, get %d", s)
+	}
+	if BestEndpoint([]*Endpoint{failed}) != nil {
+		t.Errorf("BestEndpoint error: expected nil")
+	}
+}
+
+func TestPlanEndpoints(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	eps, err := c.planEndpoints(context.Background(), []string{"lo", "lo"}, []*net.UDPAddr{loopback, loopback})
+	if err != nil {
+		t.Fatalf("planEndpoints error: %v", err)
+	}
+	if len(eps) != 2 {
+		t.Fatalf("planEndpoints error: expected 2 endpoints, get %d", len(eps))
+	}
+	best := BestEndpoint(eps)
+	if best == nil || best.Err != nil || best.Result.NAT != NATNone {
+		t.Fatalf("BestEndpoint error: get %+v", best)
+	}
+	if best.Score != natScores[NATNone] {
+		t.Errorf("Score error: expected %d, get %d", natScores[NATNone], best.Score)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+)
+
+// Errors of the port range set by SetPortRange.
+var (
+	ErrInvalidPortRange = errors.New("invalid port range")
+	ErrNoPortAvailable  = errors.New("no port available in the range")
+)
+
+// SetPortRange sets the range of the local ports, from min to max
+// inclusive, of the UDP sockets the client creates, e.g. the ports allowed
+// by a strict egress firewall. A port is picked at random, trying the
+// others of the range while it is in use. A port set by SetLocalAddr takes
+// precedence. SetPortRange(0, 0) lets the system choose the port again.
+func (c *Client) SetPortRange(min, max int) {
+	c.portMin, c.portMax = min, max
+}
+
+// listenUDP creates a UDP socket with the socket options of cfg, on a port
+// of the range if set and the port of laddr is not.
+func (c *Client) listenUDP(cfg SocketConfig, network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	if c.portMin == 0 && c.portMax == 0 || laddr != nil && laddr.Port != 0 {
+		return cfg.listenUDP(network, laddr)
+	}
+	if c.portMin <= 0 || c.portMax > 65535 || c.portMin > c.portMax {
+		return nil, ErrInvalidPortRange
+	}
+	addr := net.UDPAddr{}
+	if laddr != nil {
+		addr = *laddr
+	}
+	n := c.portMax - c.portMin + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		addr.Port = c.portMin + (start+i)%n
+		conn, err := cfg.listenUDP(network, &addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, ErrNoPortAvailable
+}
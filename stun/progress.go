@@ -0,0 +1,87 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+)
+
+// ProgressType is the type of a progress update of DiscoverAsync.
+type ProgressType int
+
+// Progress types.
+const (
+	ProgressTestStarted ProgressType = iota // a test is started
+	ProgressMappedAddr                      // a test found the mapped address
+	ProgressDone                            // the discovery is done
+)
+
+var progressTypeStr = map[ProgressType]string{
+	ProgressTestStarted: "TestStarted",
+	ProgressMappedAddr:  "MappedAddr",
+	ProgressDone:        "Done",
+}
+
+func (t ProgressType) String() string {
+	if s, ok := progressTypeStr[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Progress is a progress update of DiscoverAsync.
+type Progress struct {
+	Type   ProgressType
+	Test   Tests            // the test, for ProgressTestStarted and ProgressMappedAddr
+	Host   *Host            // the mapped address, for ProgressMappedAddr
+	Result *DiscoveryResult // the result, for ProgressDone
+	Err    error            // the error of the discovery, for ProgressDone
+}
+
+// progressBuffer holds all updates of a discovery, which are at most a
+// start and a mapped address per test and the final one, so the discovery
+// never waits for the receiver.
+const progressBuffer = 9
+
+// DiscoverAsync starts the discovery in the background and returns a channel
+// of its progress, e.g. for GUIs to show live progress. The last update is
+// of type ProgressDone, carrying the result and error of DiscoverResult,
+// after which the channel is closed. Canceling ctx aborts the discovery. The
+// client must not be used otherwise until the channel is closed.
+func (c *Client) DiscoverAsync(ctx context.Context) <-chan Progress {
+	ch := make(chan Progress, progressBuffer)
+	go func() {
+		defer close(ch)
+		r, err := c.discover(ctx, func(p Progress) { ch <- p })
+		ch <- Progress{Type: ProgressDone, Result: r, Err: err}
+	}()
+	return ch
+}
+
+// started reports that the test is started.
+func (r *DiscoveryResult) started(t Tests) {
+	if r.progress != nil {
+		r.progress(Progress{Type: ProgressTestStarted, Test: t})
+	}
+}
+
+// mapped reports that the test found the mapped address.
+func (r *DiscoveryResult) mapped(t Tests, host *Host) {
+	if r.progress != nil && host != nil {
+		r.progress(Progress{Type: ProgressMappedAddr, Test: t, Host: host})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiscoverAsync(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	var types []ProgressType
+	var last Progress
+	for p := range c.DiscoverAsync(context.Background()) {
+		types = append(types, p.Type)
+		last = p
+	}
+	if len(types) != 4 || types[0] != ProgressTestStarted || types[1] != ProgressMappedAddr || types[2] != ProgressTestStarted {
+		t.Fatalf("progress error: %v", types)
+	}
+	if last.Type != ProgressDone || last.Err != nil || last.Result.NAT != NATNone {
+		t.Errorf("progress done error: %+v", last)
+	}
+}
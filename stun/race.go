@@ -0,0 +1,150 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DefaultRaceDelay is the default delay of the IPv4 attempt after the IPv6
+// one, the Connection Attempt Delay recommended by RFC 8305 Section 8.
+const DefaultRaceDelay = 250 * time.Millisecond
+
+// SetRaceDelay sets the delay of the IPv4 attempt when the server resolves
+// to both IPv4 and IPv6 addresses. Test1 is then sent over IPv6 first and
+// over IPv4 after the delay, or as soon as IPv6 fails, and the family which
+// answers first is used, so that a broken IPv6 path costs at most the delay
+// (RFC 8305). The racing only applies if the client creates the connections
+// itself, i.e. neither a connection, a local address, an interface nor DTLS
+// is set, and to ExternalIP only without a verify server. A delay of 0
+// disables the racing and the first address resolved is used.
+func (c *Client) SetRaceDelay(d time.Duration) {
+	c.raceDelay = d
+}
+
+// raceResult is the outcome of test1 over one IP family.
+type raceResult struct {
+	conn net.PacketConn
+	addr *net.UDPAddr
+	resp *response
+	err  error
+}
+
+// raceAddrs returns the IPv6 and IPv4 addresses of the server if it should
+// be raced.
+func (c *Client) raceAddrs(ctx context.Context, server string) (v6, v4 *net.UDPAddr, ok bool) {
+	if c.raceDelay <= 0 || c.conn != nil || c.reuse || c.localAddr != "" || c.iface != "" || c.dtls != nil {
+		return nil, nil, false
+	}
+	v6, err := c.resolveUDPAddr(ctx, "udp6", server)
+	if err != nil {
+		return nil, nil, false
+	}
+	v4, err = c.resolveUDPAddr(ctx, "udp4", server)
+	if err != nil {
+		return nil, nil, false
+	}
+	return v6, v4, true
+}
+
+// race sends test1 to v6 and, after the race delay, to v4. It returns the
+// first attempt with a response, or the last failed one if both fail, and a
+// channel delivering the other attempt. Canceling ctx stops the other
+// attempt. The caller must close the connections of both attempts.
+func (c *Client) race(ctx context.Context, v6, v4 *net.UDPAddr) (raceResult, <-chan raceResult) {
+	results := make(chan raceResult, 2)
+	failed := make(chan struct{})
+	attempt := func(network string, addr *net.UDPAddr) raceResult {
+		r := raceResult{addr: addr}
+		conn, err := c.listenUDP(c.socket, network, nil)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		r.conn = conn
+		c.logger.Debugln("Do Test1 over", network)
+		c.logger.Debugln("Send To:", addr)
+		r.resp, r.err = c.test1(ctx, conn, addr)
+		return r
+	}
+	go func() {
+		r := attempt("udp6", v6)
+		if r.resp == nil {
+			close(failed)
+		}
+		results <- r
+	}()
+	go func() {
+		select {
+		case <-time.After(c.raceDelay):
+		case <-failed:
+		case <-ctx.Done():
+			results <- raceResult{addr: v4, err: ctx.Err()}
+			return
+		}
+		results <- attempt("udp4", v4)
+	}()
+	first := <-results
+	if first.resp != nil {
+		return first, results
+	}
+	second := <-results
+	if second.resp == nil && second.err != nil && first.err == nil {
+		// A timeout tells more than an error of the other family,
+		// e.g. an unreachable IPv6 network, UDP is blocked.
+		first, second = second, first
+	}
+	// Both attempts are done, deliver the other one back.
+	results <- first
+	return second, results
+}
+
+// discoverRace is discoverResult for a server with both IPv4 and IPv6
+// addresses. The discovery is performed over the family which answers test1
+// first. The mapped address seen over the other family is reported as
+// OtherFamilyHost if its test1 is answered meanwhile.
+func (c *Client) discoverRace(ctx context.Context, v6, v4 *net.UDPAddr, r *DiscoveryResult) error {
+	ctx, cancel := context.WithCancel(ctx)
+	winner, other := c.race(ctx, v6, v4)
+	defer func() {
+		if winner.conn != nil {
+			winner.conn.Close()
+		}
+	}()
+	var err error
+	if winner.resp == nil {
+		if winner.err == nil {
+			r.NAT = NATBlocked
+		}
+		err = winner.err
+	} else {
+		c.logger.Debugln("Use", winner.addr, "answering first")
+		r.LocalAddr = newHostFromStr(winner.conn.LocalAddr().String())
+		r.NAT, r.Hosts, err = c.discoverAll(ctx, winner.conn, winner.addr, r)
+		r.detectNAT64(winner.addr)
+	}
+	cancel()
+	if o := <-other; o.conn != nil {
+		o.conn.Close()
+		if o.resp != nil {
+			r.OtherFamilyHost = o.resp.mappedAddr
+		}
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRace(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetRaceDelay(20 * time.Millisecond)
+	// Nothing answers on IPv6, so IPv4 must win after the delay.
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: addr.Port}
+	ctx, cancel := context.WithCancel(context.Background())
+	winner, other := c.race(ctx, v6, addr)
+	cancel()
+	if winner.conn != nil {
+		winner.conn.Close()
+	}
+	if o := <-other; o.conn != nil {
+		o.conn.Close()
+	}
+	if winner.err != nil || winner.resp == nil {
+		t.Fatalf("race error: %v", winner.err)
+	}
+	if winner.addr != addr {
+		t.Errorf("race winner error: expected %v, get %v", addr, winner.addr)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the requests of the clients it is set to, so software
+// deployed widely does not overload the volunteer-run public servers: the
+// transactions are started at most at the rate per server address with
+// bursts of up to burst, and at most maxConcurrent of them run at once. A
+// limiter may be shared by many clients, and is safe for concurrent use.
+// Retransmissions are not limited, as the schedule spaces them already.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	sem   chan struct{} // nil without a concurrency cap
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// NewRateLimiter returns a limiter of rate transactions per second per server
+// address with bursts of up to burst, and of maxConcurrent transactions at
+// once. A rate or maxConcurrent of 0 disables the respective limit.
+func NewRateLimiter(rate float64, burst, maxConcurrent int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if maxConcurrent > 0 {
+		l.sem = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// SetRateLimiter sets the limiter of the transactions of the client, of
+// Discover, Keepalive, Ping and the others alike. The binding indications of
+// the keepalives are limited as well. A nil limiter disables the limits.
+func (c *Client) SetRateLimiter(l *RateLimiter) {
+	c.limiter = l
+}
+
+// reserve takes a token from the bucket of the server, and returns how long
+// to wait until it is available.
+func (l *RateLimiter) reserve(server string) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.pruned) > bucketExpiry {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketExpiry && b.tokens >= 0 {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[server]
+	if !ok {
+		b = &tokenBucket{l.burst, now}
+		l.buckets[server] = b
+	}
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	// The tokens go negative for the waiting transactions, which are
+	// thus served in order.
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.rate * float64(time.Second))
+}
+
+// refund returns the token of a canceled wait.
+func (l *RateLimiter) refund(server string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[server]; ok {
+		b.tokens++
+	}
+}
+
+// wait waits until a token of the server is available or ctx is done.
+func (l *RateLimiter) wait(ctx context.Context, server net.Addr) error {
+	key := server.String()
+	d := l.reserve(key)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.refund(key)
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// acquire waits until fewer than maxConcurrent transactions run, or ctx is
+// done. release must be called once the transaction is over.
+func (l *RateLimiter) acquire(ctx context.Context) error {
+	if l.sem == nil {
+		return nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *RateLimiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// limit waits for the limiter of the client, which must be set, to allow the
+// requests to the addresses. The returned function releases the concurrency
+// slot.
+func (c *Client) limit(ctx context.Context, addrs ...net.Addr) (func(), error) {
+	l := c.limiter
+	start := time.Now()
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if err := l.wait(ctx, addr); err != nil {
+			l.release()
+			return nil, err
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		c.logger.Debugln("Rate limited for", waited)
+		c.count(&c.stats.Throttled)
+	}
+	return l.release, nil
+}
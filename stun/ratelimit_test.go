@@ -0,0 +1,115 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(10, 2, 0)
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	if d := l.reserve(server.String()); d != 0 {
+		t.Errorf("reserve error: burst delayed by %v", d)
+	}
+	if d := l.reserve(server.String()); d != 0 {
+		t.Errorf("reserve error: burst delayed by %v", d)
+	}
+	if d := l.reserve(server.String()); d <= 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("reserve error: expected a delay of 100ms, get %v", d)
+	}
+	// Other servers have their own buckets.
+	if d := l.reserve("192.0.2.2:3478"); d != 0 {
+		t.Errorf("reserve error: other server delayed by %v", d)
+	}
+	// A canceled wait gives its token back.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, server); err != context.Canceled {
+		t.Errorf("wait error: expected %v, get %v", context.Canceled, err)
+	}
+	if tokens := l.buckets[server.String()].tokens; tokens > -0.9 {
+		t.Errorf("refund error: expected one waiting token, get %v", tokens)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	l := NewRateLimiter(20, 1, 1)
+	var wg sync.WaitGroup
+	start := time.Now()
+	// The limiter is shared by the clients.
+	clients := make([]*Client, 3)
+	for i := range clients {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP error: %v", err)
+		}
+		defer conn.Close()
+		c := NewClientWithConnection(conn)
+		c.SetServerAddr(addr.String())
+		c.SetRateLimiter(l)
+		clients[i] = c
+	}
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Ping(context.Background(), 2); err != nil {
+				t.Errorf("Ping error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// 6 transactions at 20 per second after the first one.
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("rate limit error: 6 transactions in %v", d)
+	}
+	var throttled uint64
+	for _, c := range clients {
+		throttled += c.Stats().Throttled
+	}
+	if throttled == 0 {
+		t.Errorf("Throttled error: expected some")
+	}
+}
+
+func TestHealthCheckRateLimit(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetLocalAddr("127.0.0.1:0")
+	// The health check is throttled by the limiter of the client, which
+	// the first check drains.
+	c.SetRateLimiter(NewRateLimiter(0.1, 1, 0))
+	servers := []string{addr.String()}
+	if health := c.HealthCheck(context.Background(), servers); health[0].Err != nil {
+		t.Fatalf("HealthCheck error: %v", health[0].Err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	health := c.HealthCheck(ctx, servers)
+	if !errors.Is(health[0].Err, context.DeadlineExceeded) || health[0].RTT != 0 {
+		t.Errorf("HealthCheck error: expected %v, get %v after %v", context.DeadlineExceeded, health[0].Err, health[0].RTT)
+	}
+}
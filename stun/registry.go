@@ -0,0 +1,140 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"sync"
+)
+
+// Errors of the attribute registry.
+var (
+	ErrAttributeRegistered = errors.New("attribute type already registered")
+	ErrAttributeCodec      = errors.New("no codec for the attribute type")
+)
+
+// AttributeType is a custom attribute type, e.g. of a private protocol
+// extension, defined by its code, name and codec.
+type AttributeType struct {
+	Code uint16
+	Name string
+
+	// Decode parses the value of the attribute, without padding. Values
+	// it returns an error for make the messages invalid, as for the
+	// attributes of this package with invalid lengths.
+	Decode func(value []byte) (interface{}, error)
+
+	// Encode returns the value of the attribute for v, as decoded by
+	// Decode.
+	Encode func(v interface{}) ([]byte, error)
+}
+
+var registry = struct {
+	sync.RWMutex
+	types map[uint16]AttributeType
+}{types: make(map[uint16]AttributeType)}
+
+// RegisterAttribute registers a custom attribute type. The messages with
+// attributes of the type are checked by its Decode when they are parsed by
+// ParseMessage, the client and the server, comprehension-required ones are
+// no longer unknown, and the packet dump shows the name. Attribute.Decode
+// and NewAttribute use the codec. The types defined in this package and the
+// registered ones cannot be registered again.
+func RegisterAttribute(t AttributeType) error {
+	if _, ok := attributeStr[t.Code]; ok || knownAttributes[t.Code] {
+		return ErrAttributeRegistered
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.types[t.Code]; ok {
+		return ErrAttributeRegistered
+	}
+	registry.types[t.Code] = t
+	return nil
+}
+
+// UnregisterAttribute removes the custom attribute type of the code.
+func UnregisterAttribute(code uint16) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.types, code)
+}
+
+// LookupAttribute returns the custom attribute type of the code.
+func LookupAttribute(code uint16) (AttributeType, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	t, ok := registry.types[code]
+	return t, ok
+}
+
+// isKnownAttribute reports whether the attribute type is defined in this
+// package or registered.
+func isKnownAttribute(code uint16) bool {
+	if knownAttributes[code] {
+		return true
+	}
+	_, ok := LookupAttribute(code)
+	return ok
+}
+
+// validCustomAttribute checks the value of a registered attribute by its
+// Decode, accepting the values of other attributes.
+func validCustomAttribute(code uint16, value []byte) bool {
+	t, ok := LookupAttribute(code)
+	if !ok || t.Decode == nil {
+		return true
+	}
+	_, err := t.Decode(value)
+	return err == nil
+}
+
+// NewAttribute returns the attribute of a registered type with the value v
+// encoded by its codec.
+func NewAttribute(code uint16, v interface{}) (Attribute, error) {
+	t, ok := LookupAttribute(code)
+	if !ok || t.Encode == nil {
+		return Attribute{}, ErrAttributeCodec
+	}
+	value, err := t.Encode(v)
+	if err != nil {
+		return Attribute{}, err
+	}
+	return Attribute{code, value}, nil
+}
+
+// Decode decodes the value of an attribute of a registered type by its
+// codec.
+func (a Attribute) Decode() (interface{}, error) {
+	t, ok := LookupAttribute(a.Type)
+	if !ok || t.Decode == nil {
+		return nil, ErrAttributeCodec
+	}
+	return t.Decode(a.Value)
+}
+
+// Name returns the name of the attribute type, such as "XOR-MAPPED-ADDRESS"
+// or the name of a registered type, or the code in hex if it is unknown.
+func (a Attribute) Name() string {
+	return attributeString(a.Type)
+}
+
+// SetRequestAttributes sets attributes added to the binding requests of the
+// client, e.g. of registered types, before FINGERPRINT.
+func (c *Client) SetRequestAttributes(attrs ...Attribute) {
+	c.reqAttrs = append([]Attribute(nil), attrs...)
+}
@@ -0,0 +1,123 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+const testVendorAttribute = 0x7f01
+
+var errTestVendorValue = errors.New("invalid vendor value")
+
+func registerTestAttribute(t *testing.T) {
+	err := RegisterAttribute(AttributeType{
+		Code: testVendorAttribute,
+		Name: "VENDOR-COUNTER",
+		Decode: func(b []byte) (interface{}, error) {
+			if len(b) != 4 {
+				return nil, errTestVendorValue
+			}
+			return binary.BigEndian.Uint32(b), nil
+		},
+		Encode: func(v interface{}) ([]byte, error) {
+			n, ok := v.(uint32)
+			if !ok {
+				return nil, errTestVendorValue
+			}
+			return binary.BigEndian.AppendUint32(nil, n), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterAttribute error: %v", err)
+	}
+}
+
+func TestRegisterAttribute(t *testing.T) {
+	registerTestAttribute(t)
+	defer UnregisterAttribute(testVendorAttribute)
+	if err := RegisterAttribute(AttributeType{Code: testVendorAttribute}); err != ErrAttributeRegistered {
+		t.Errorf("RegisterAttribute error: expected ErrAttributeRegistered, get %v", err)
+	}
+	if err := RegisterAttribute(AttributeType{Code: attributeXorMappedAddress}); err != ErrAttributeRegistered {
+		t.Errorf("RegisterAttribute error: expected ErrAttributeRegistered, get %v", err)
+	}
+	if _, err := NewAttribute(testVendorAttribute, "42"); err != errTestVendorValue {
+		t.Errorf("NewAttribute error: expected the codec error, get %v", err)
+	}
+	if _, err := NewAttribute(0x7f02, uint32(42)); err != ErrAttributeCodec {
+		t.Errorf("NewAttribute error: expected ErrAttributeCodec, get %v", err)
+	}
+
+	a, err := NewAttribute(testVendorAttribute, uint32(42))
+	if err != nil {
+		t.Fatalf("NewAttribute error: %v", err)
+	}
+	m := Message{Type: typeBindingRequest, TransactionID: make([]byte, 16), Attributes: []Attribute{a}}
+	b := m.AppendTo(nil)
+	parsed, err := ParseMessage(b)
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	if len(parsed.Attributes) != 1 || parsed.Attributes[0].Name() != "VENDOR-COUNTER" {
+		t.Fatalf("ParseMessage error: %+v", parsed)
+	}
+	if v, err := parsed.Attributes[0].Decode(); err != nil || v != uint32(42) {
+		t.Errorf("Decode error: %v %v", v, err)
+	}
+	// Invalid values of registered attributes make the message invalid.
+	bad := Message{Type: typeBindingRequest, TransactionID: make([]byte, 16),
+		Attributes: []Attribute{{testVendorAttribute, []byte{1, 2}}}}
+	if _, err := ParseMessage(bad.AppendTo(nil)); !errors.Is(err, ErrInvalidAttribute) {
+		t.Errorf("ParseMessage error: expected ErrInvalidAttribute, get %v", err)
+	}
+
+	UnregisterAttribute(testVendorAttribute)
+	if _, err := ParseMessage(b); !errors.Is(err, ErrUnknownComprehensionRequired) {
+		t.Errorf("ParseMessage error: expected ErrUnknownComprehensionRequired, get %v", err)
+	}
+	if _, err := parsed.Attributes[0].Decode(); err != ErrAttributeCodec {
+		t.Errorf("Decode error: expected ErrAttributeCodec, get %v", err)
+	}
+}
+
+func TestRequestAttributes(t *testing.T) {
+	registerTestAttribute(t)
+	defer UnregisterAttribute(testVendorAttribute)
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	a, err := NewAttribute(testVendorAttribute, uint32(7))
+	if err != nil {
+		t.Fatalf("NewAttribute error: %v", err)
+	}
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr.String())
+	c.SetRequestAttributes(a)
+	// The server knows the registered attribute, so it does not reject the
+	// requests with UNKNOWN-ATTRIBUTES.
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+}
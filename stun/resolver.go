@@ -0,0 +1,77 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// Resolver resolves host names to IP addresses, which *net.Resolver
+// implements. A custom one may resolve over DoH or DoT, or stub DNS in tests.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// SetResolver allows user to resolve the host name of the server with r
+// instead of the resolver of the system. Passing nil restores the default.
+func (c *Client) SetResolver(r Resolver) {
+	c.resolver = r
+}
+
+// resolveUDPAddr resolves the address like net.ResolveUDPAddr, with the
+// resolver of the client if it is set. network is "udp", "udp4" or "udp6",
+// and IPv4 addresses are preferred for "udp".
+func (c *Client) resolveUDPAddr(ctx context.Context, network, address string) (*net.UDPAddr, error) {
+	if c.resolver == nil {
+		return net.ResolveUDPAddr(network, address)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		if port, err = net.LookupPort(network, portStr); err != nil {
+			return nil, err
+		}
+	}
+	// IP literals need no lookup.
+	if ip := net.ParseIP(host); ip != nil {
+		return net.ResolveUDPAddr(network, address)
+	}
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v6 *net.IPAddr
+	for i := range addrs {
+		a := &addrs[i]
+		if a.IP.To4() != nil {
+			if network != "udp6" {
+				return &net.UDPAddr{IP: a.IP, Port: port}, nil
+			}
+		} else if v6 == nil {
+			v6 = a
+		}
+	}
+	if v6 != nil && network != "udp4" {
+		return &net.UDPAddr{IP: v6.IP, Port: port, Zone: v6.Zone}, nil
+	}
+	return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+}
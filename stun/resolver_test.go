@@ -0,0 +1,50 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// stubResolver resolves every host name to its addresses.
+type stubResolver []net.IPAddr
+
+func (r stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r, nil
+}
+
+func TestResolver(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetResolver(stubResolver{{IP: net.ParseIP("::1")}, {IP: net.IPv4(127, 0, 0, 1)}})
+	c.SetServerHost("stun.invalid", addr.Port)
+	c.SetLocalAddr("127.0.0.1:0")
+	if _, err := c.DiscoverResult(); err != nil {
+		t.Errorf("DiscoverResult error: %v", err)
+	}
+	v6, err := c.resolveUDPAddr(context.Background(), "udp6", "stun.invalid:3478")
+	if err != nil || !v6.IP.Equal(net.ParseIP("::1")) || v6.Port != 3478 {
+		t.Errorf("resolveUDPAddr error: %v, %v", v6, err)
+	}
+	c.SetResolver(stubResolver{{IP: net.ParseIP("::1")}})
+	if _, err = c.resolveUDPAddr(context.Background(), "udp4", "stun.invalid:3478"); err == nil {
+		t.Errorf("resolveUDPAddr error: expected no suitable address")
+	}
+}
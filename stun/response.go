@@ -19,27 +19,40 @@ package stun
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 type response struct {
-	packet      *packet // the original packet from the server
-	serverAddr  *Host   // the address received packet
-	changedAddr *Host   // parsed from packet
-	mappedAddr  *Host   // parsed from packet, external addr of client NAT
-	otherAddr   *Host   // parsed from packet, to replace changedAddr in RFC 5780
-	identical   bool    // if mappedAddr is in local addr list
+	packet      *packet     // the original packet from the server
+	serverAddr  *Host       // the address received packet
+	changedAddr *Host       // parsed from packet
+	mappedAddr  *Host       // parsed from packet, external addr of client NAT
+	otherAddr   *Host       // parsed from packet, to replace changedAddr in RFC 5780
+	identical   bool        // if mappedAddr is in local addr list
+	unknown     []uint16    // unknown comprehension-required attributes
+	software    string      // parsed from packet, software of the server
+	dialect     Dialect     // dialect of the server, told by the mapped address
+	errorCode   *ErrorCode  // parsed from packet, nil if not present
+	request     []byte      // encoded request, if the messages are recorded
+	violations  []Violation // violations the packet was parsed with
+
+	// rtt is the round-trip time, 0 if the request was retransmitted.
+	rtt time.Duration
 }
 
 func newResponse(pkt *packet, conn net.PacketConn) *response {
-	resp := &response{pkt, nil, nil, nil, nil, false}
+	resp := &response{packet: pkt, dialect: DialectUnknown}
 	if pkt == nil {
 		return resp
 	}
-	// RFC 3489 doesn't require the server return XOR mapped address.
-	mappedAddr := pkt.getXorMappedAddr()
-	if mappedAddr == nil {
-		mappedAddr = pkt.getMappedAddr()
+	resp.errorCode = getErrorCode(pkt)
+	resp.unknown = pkt.unknownAttributes()
+	if software := pkt.getAttribute(attributeSoftware); software != nil {
+		resp.software = string(software.value[:software.length])
 	}
+	// RFC 3489 doesn't require the server return XOR mapped address.
+	dialect, mappedAddr := responseDialect(pkt)
+	resp.dialect = dialect
 	resp.mappedAddr = mappedAddr
 	// compute identical
 	localAddrStr := conn.LocalAddr().String()
@@ -68,11 +81,13 @@ func (r *response) String() string {
 	if r == nil {
 		return "Nil"
 	}
-	return fmt.Sprintf("{packet nil: %v, local: %v, remote: %v, changed: %v, other: %v, identical: %v}",
+	return fmt.Sprintf("{packet nil: %v, local: %v, remote: %v, changed: %v, other: %v, identical: %v, software: %q, error: %v}",
 		r.packet == nil,
 		r.mappedAddr,
 		r.serverAddr,
 		r.changedAddr,
 		r.otherAddr,
-		r.identical)
+		r.identical,
+		r.software,
+		r.errorCode)
 }
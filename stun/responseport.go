@@ -0,0 +1,74 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+)
+
+// ResponsePortTest performs a filtering test with the RESPONSE-PORT attribute
+// (RFC 5780 Section 7.4) on a pair of sockets. It first sends a binding
+// request on respConn to learn and open its mapping, then sends a binding
+// request on conn, asking the server to answer to the mapped port of
+// respConn from the address selected by changeIP and changePort. The
+// response is read on respConn, so the filtering behavior of the mapping of
+// respConn is tested without the mapping of conn being touched.
+//
+// It returns the mapped address of conn if the response is received, and nil
+// if the NAT filtered it. The server must support RESPONSE-PORT.
+func (c *Client) ResponsePortTest(conn, respConn net.PacketConn, changeIP, changePort bool) (*Host, error) {
+	c.defaultServer(context.Background())
+	serverUDPAddr, err := c.resolveUDPAddr(context.Background(), "udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	c.logger.Debugln("Do Test1 on the response socket")
+	resp, err := c.test1(ctx, respConn, serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debugln("Received:", resp)
+	if resp == nil {
+		return nil, &TimeoutError{Test: TestI, Addr: serverUDPAddr}
+	}
+	if err = responseError(resp, serverUDPAddr); err != nil {
+		return nil, withTest(err, TestI)
+	}
+	pkt, err := c.newBindingPacket(typeBindingRequest, changeIP, changePort,
+		newResponsePortAttribute(resp.mappedAddr.Port()))
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debugln("Do RESPONSE-PORT test to", resp.mappedAddr.Port())
+	resp, err = c.sendVia(ctx, pkt, conn, respConn, serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debugln("Received:", resp)
+	if resp == nil {
+		return nil, nil
+	}
+	if err = responseError(resp, serverUDPAddr); err != nil {
+		return nil, err
+	}
+	if !c.validAddr(resp.serverAddr, serverUDPAddr, changeIP, changePort) {
+		return nil, &ProtocolError{Addr: serverUDPAddr, Err: ErrAddrNotMatch}
+	}
+	return resp.mappedAddr, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+// Response is a response of the server with the addresses it reports, so
+// applications can classify the NAT their own way, or detect the middleboxes
+// rewriting the messages, without parsing the attributes themselves. The
+// addresses are nil if the attributes are absent.
+type Response struct {
+	Test Tests // test of the discovery, 0 if parsed by ParseResponse
+	From *Host // address the response came from, nil if parsed by ParseResponse
+
+	MappedAddr     *Host // MAPPED-ADDRESS
+	XorMappedAddr  *Host // XOR-MAPPED-ADDRESS, or its pre-RFC 5389 type
+	ResponseOrigin *Host // RESPONSE-ORIGIN of RFC 5780
+	OtherAddr      *Host // OTHER-ADDRESS of RFC 5780
+	ChangedAddr    *Host // CHANGED-ADDRESS of RFC 3489
+	SourceAddr     *Host // SOURCE-ADDRESS of RFC 3489
+
+	Software  string     // SOFTWARE, empty if absent
+	ErrorCode *ErrorCode // ERROR-CODE, nil if absent
+}
+
+// ParseResponse parses a STUN message into a Response. Errors are returned
+// as by ParseMessage, including the *UnknownAttributesError returned together
+// with the response.
+func ParseResponse(b []byte) (*Response, error) {
+	pkt, err := parsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	resp := pkt.typedResponse()
+	if unknown := pkt.unknownAttributes(); len(unknown) > 0 {
+		return resp, &UnknownAttributesError{unknown}
+	}
+	return resp, nil
+}
+
+// typedResponse parses the addresses of the packet into a Response.
+func (v *packet) typedResponse() *Response {
+	resp := &Response{
+		MappedAddr:     v.getMappedAddr(),
+		ResponseOrigin: v.getRawAddr(attributeResponseOrigin),
+		OtherAddr:      v.getOtherAddr(),
+		ChangedAddr:    v.getChangedAddr(),
+		SourceAddr:     v.getSourceAddr(),
+		ErrorCode:      getErrorCode(v),
+	}
+	// Without the magic cookie, as from RFC 3489 servers, the address
+	// cannot be decoded.
+	if hasMagicCookie(v.transID) {
+		resp.XorMappedAddr = v.getXorMappedAddr()
+	}
+	if software := v.getAttribute(attributeSoftware); software != nil {
+		resp.Software = string(software.value[:software.length])
+	}
+	return resp
+}
+
+// Mapped returns the mapped address the client uses: XOR-MAPPED-ADDRESS, or
+// MAPPED-ADDRESS from the servers which do not send it.
+func (r *Response) Mapped() *Host {
+	if r.XorMappedAddr != nil {
+		return r.XorMappedAddr
+	}
+	return r.MappedAddr
+}
+
+// Origin returns the address the server sent the response from as it tells:
+// RESPONSE-ORIGIN, or SOURCE-ADDRESS from RFC 3489 servers.
+func (r *Response) Origin() *Host {
+	if r.ResponseOrigin != nil {
+		return r.ResponseOrigin
+	}
+	return r.SourceAddr
+}
+
+// MappedRewritten reports whether MAPPED-ADDRESS and XOR-MAPPED-ADDRESS
+// disagree, which tells a middlebox, e.g. an ALG, rewrote the address found
+// in the plain one: the reason XOR-MAPPED-ADDRESS exists.
+func (r *Response) MappedRewritten() bool {
+	return r.MappedAddr != nil && r.XorMappedAddr != nil &&
+		r.MappedAddr.String() != r.XorMappedAddr.String()
+}
+
+// OriginRewritten reports whether the response came from another address
+// than the origin the server tells, which tells the address of the server
+// was translated on the path, e.g. by a NAT64 or a load balancer.
+func (r *Response) OriginRewritten() bool {
+	origin := r.Origin()
+	return r.From != nil && origin != nil && r.From.String() != origin.String()
+}
+
+// FamilyTranslated reports whether the address family changed on the path:
+// the mapped address or the origin is of another family than the address
+// the response came from, as through a NAT64.
+func (r *Response) FamilyTranslated() bool {
+	if r.From == nil {
+		return false
+	}
+	if mapped := r.Mapped(); mapped != nil && mapped.Family() != r.From.Family() {
+		return true
+	}
+	origin := r.Origin()
+	return origin != nil && origin.Family() != r.From.Family()
+}
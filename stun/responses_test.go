@@ -0,0 +1,97 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseResponse(t *testing.T) {
+	pkt, _ := newPacket()
+	pkt.types = typeBindingResponse
+	// An ALG rewrote MAPPED-ADDRESS, but not XOR-MAPPED-ADDRESS.
+	mapped := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	pkt.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, mapped, pkt.transID))
+	pkt.addAttribute(*newAddrAttribute(attributeMappedAddress, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}))
+	pkt.addAttribute(*newAddrAttribute(attributeResponseOrigin, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 3478}))
+	pkt.addAttribute(*newAddrAttribute(attributeOtherAddress, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 3479}))
+	pkt.addAttribute(*newSoftwareAttribute("test"))
+	pkt.addFingerprint()
+	resp, err := ParseResponse(pkt.bytes())
+	if err != nil {
+		t.Fatalf("ParseResponse error: %v", err)
+	}
+	if resp.Mapped().String() != mapped.String() {
+		t.Errorf("Mapped error: expected %v, get %v", mapped, resp.Mapped())
+	}
+	if resp.OtherAddr.String() != "192.0.2.3:3479" || resp.Origin().String() != "192.0.2.2:3478" {
+		t.Errorf("address error: other %v, origin %v", resp.OtherAddr, resp.Origin())
+	}
+	if resp.Software != "test" || resp.ChangedAddr != nil || resp.ErrorCode != nil {
+		t.Errorf("ParseResponse error: get %+v", resp)
+	}
+	if !resp.MappedRewritten() {
+		t.Errorf("MappedRewritten error: expected true, get false")
+	}
+	// Without the address the response came from, there is nothing to
+	// compare the origin with.
+	if resp.OriginRewritten() || resp.FamilyTranslated() {
+		t.Errorf("OriginRewritten error: expected false without From")
+	}
+	resp.From = newHostFromStr("[64:ff9b::c000:202]:3478")
+	if !resp.OriginRewritten() || !resp.FamilyTranslated() {
+		t.Errorf("FamilyTranslated error: expected true through a NAT64")
+	}
+	resp.From = newHostFromStr("192.0.2.2:3478")
+	if resp.OriginRewritten() || resp.FamilyTranslated() {
+		t.Errorf("OriginRewritten error: expected false from the origin")
+	}
+
+	// Without the magic cookie, XOR-MAPPED-ADDRESS is not decoded.
+	pkt.transID[0] = 0
+	if resp, err = ParseResponse(pkt.bytes()); err != nil || resp.XorMappedAddr != nil || resp.Mapped() == nil {
+		t.Errorf("ParseResponse error: %+v %v", resp, err)
+	}
+
+	if _, err := ParseResponse(pkt.bytes()[:10]); !errors.Is(err, ErrTruncatedMessage) {
+		t.Errorf("ParseResponse error: expected %v, get %v", ErrTruncatedMessage, err)
+	}
+}
+
+func TestDiscoveryResponses(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	result, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if len(result.Responses) == 0 {
+		t.Fatalf("Responses error: expected the response of test1")
+	}
+	resp := result.Responses[0]
+	if resp.Test != TestI || resp.From.String() != addr.String() {
+		t.Errorf("Responses error: get %+v", resp)
+	}
+	if resp.Mapped().String() != result.Hosts[0].String() || resp.MappedRewritten() {
+		t.Errorf("Mapped error: expected %v, get %v and %v", result.Hosts[0], resp.XorMappedAddr, resp.MappedAddr)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"time"
+)
+
+// Tests is a set of the tests of the discovery process.
+type Tests uint8
+
+// Tests of the discovery process, see the flow in discover.go.
+const (
+	TestI        Tests = 1 << iota // binding request to the server
+	TestII                         // request to change IP and port
+	TestIChanged                   // binding request to the changed address
+	TestIII                        // request to change port to the changed address
+)
+
+// DiscoveryResult is the detailed result of the discovery.
+type DiscoveryResult struct {
+	NAT   NATType // type of the NAT
+	Hosts []*Host // mapped addresses observed, the first one is from test1
+
+	// Filtering is the filtering behavior of the NAT or firewall as far
+	// as the tests tell it: FilteringUnknown without changed address or
+	// with a symmetric NAT, whose mappings differ per server address. See
+	// DiscoverFiltering for the complete classification.
+	Filtering FilteringBehavior
+
+	// Skipped is the set of tests which could not be performed because
+	// the server provides no changed address. The NAT type is then
+	// NATNone or NATUnknownFiltering, telling only whether there is a
+	// NAT: without NAT, test2 is still sent, but only a response from
+	// another address tells an open host, as a symmetric UDP firewall
+	// and a server unable to change its address both leave it
+	// unanswered.
+	Skipped Tests
+
+	// UnknownAttributes lists the comprehension-required attributes of
+	// the responses which are unknown to this package. The responses are
+	// used regardless, but the result may be inaccurate if the
+	// attributes change the meaning of them.
+	UnknownAttributes []uint16
+
+	// LocalAddr is the local address of the socket of the discovery,
+	// whose port is the one the NAT mapped.
+	LocalAddr *Host
+
+	// ChangedAddr and OtherAddr are the CHANGED-ADDRESS and OTHER-ADDRESS
+	// of the test1 response, nil if absent. The one used for the later
+	// tests is chosen by the ChangedAddrPolicy of the client.
+	ChangedAddr *Host
+	OtherAddr   *Host
+
+	// OtherFamilyHost is the mapped address observed over the IP family
+	// not used for the discovery when the server has both IPv4 and IPv6
+	// addresses, nil if it did not answer in time.
+	OtherFamilyHost *Host
+
+	// NAT64 reports whether the server was reached through a NAT64
+	// (RFC 6146): the request was sent to an IPv6 address, yet the
+	// server observed an IPv4 address. NAT64Prefix is the prefix if the
+	// server address is in the Well-Known Prefix, nil otherwise, in which
+	// case DetectNAT64 finds it.
+	NAT64       bool
+	NAT64Prefix *net.IPNet
+
+	// ServerSoftware is the SOFTWARE attribute of the first response
+	// which has it, empty if the server does not send it.
+	ServerSoftware string
+
+	// Violations lists the violations of the encoding rules the responses
+	// were accepted with, see SetParseMode.
+	Violations []Violation
+
+	// Loss counts the transactions of the discovery and their
+	// retransmissions, which tell a lossy link from a filtering one.
+	Loss LossStats
+
+	// Dialect is the protocol of the server as told by the first response
+	// with a mapped address, see SetLegacyCompat.
+	Dialect Dialect
+
+	// RTTs are the round-trip times of the tests answered without
+	// retransmission, in the order of the tests, see Latency for the
+	// aggregates.
+	RTTs []TestRTT
+
+	// Responses are the responses of the tests with the addresses they
+	// report, in the order of the tests.
+	Responses []Response
+
+	// Exchanges are the messages of the tests which got a response, if
+	// SetRecordMessages is enabled.
+	Exchanges []Exchange
+
+	progress func(Progress) // receives the progress of the discovery
+}
+
+// Exchange is a request of the discovery and its response.
+type Exchange struct {
+	Test     Tests
+	Request  []byte   // encoded request
+	Response []byte   // encoded response
+	Message  *Message // parsed response, with every attribute
+}
+
+// TestRTT is the round-trip time of a test.
+type TestRTT struct {
+	Test Tests
+	RTT  time.Duration
+}
+
+// Partial reports whether some tests could not be performed.
+func (r *DiscoveryResult) Partial() bool {
+	return r.Skipped != 0
+}
+
+// AddrDiscrepancy reports whether the server sent both CHANGED-ADDRESS and
+// OTHER-ADDRESS, but with different addresses, which suggests a
+// misconfigured server: the result depends on the ChangedAddrPolicy.
+func (r *DiscoveryResult) AddrDiscrepancy() bool {
+	return r.ChangedAddr != nil && r.OtherAddr != nil &&
+		r.ChangedAddr.String() != r.OtherAddr.String()
+}
+
+// clone returns a copy of the result which shares no slices with it.
+func (r *DiscoveryResult) clone() *DiscoveryResult {
+	cp := *r
+	cp.Hosts = append([]*Host(nil), r.Hosts...)
+	cp.UnknownAttributes = append([]uint16(nil), r.UnknownAttributes...)
+	cp.RTTs = append([]TestRTT(nil), r.RTTs...)
+	cp.Responses = append([]Response(nil), r.Responses...)
+	cp.Exchanges = append([]Exchange(nil), r.Exchanges...)
+	// The cached result must not share the messages with the copies.
+	for i := range cp.Exchanges {
+		e := &cp.Exchanges[i]
+		e.Request = append([]byte(nil), e.Request...)
+		e.Response = append([]byte(nil), e.Response...)
+		e.Message = e.Message.clone()
+	}
+	cp.Violations = append([]Violation(nil), r.Violations...)
+	if r.NAT64Prefix != nil {
+		cp.NAT64Prefix = &net.IPNet{
+			IP:   append(net.IP(nil), r.NAT64Prefix.IP...),
+			Mask: append(net.IPMask(nil), r.NAT64Prefix.Mask...),
+		}
+	}
+	cp.progress = nil
+	return &cp
+}
+
+// addResponse records the information of the response to the test into the
+// result.
+func (r *DiscoveryResult) addResponse(t Tests, resp *response) {
+	if resp == nil {
+		return
+	}
+	typed := resp.packet.typedResponse()
+	typed.Test, typed.From = t, resp.serverAddr
+	r.Responses = append(r.Responses, *typed)
+	if resp.request != nil {
+		r.Exchanges = append(r.Exchanges, Exchange{
+			Test:     t,
+			Request:  resp.request,
+			Response: resp.packet.bytes(),
+			Message:  resp.packet.message(),
+		})
+	}
+	if resp.rtt > 0 {
+		r.RTTs = append(r.RTTs, TestRTT{t, resp.rtt})
+	}
+	if r.ServerSoftware == "" {
+		r.ServerSoftware = resp.software
+	}
+	if r.Dialect == DialectUnknown {
+		r.Dialect = resp.dialect
+	}
+	for _, v := range resp.violations {
+		v.Test = t
+		r.Violations = append(r.Violations, v)
+	}
+	for _, t := range resp.unknown {
+		if !r.hasUnknown(t) {
+			r.UnknownAttributes = append(r.UnknownAttributes, t)
+		}
+	}
+}
+
+func (r *DiscoveryResult) hasUnknown(t uint16) bool {
+	for _, u := range r.UnknownAttributes {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
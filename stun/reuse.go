@@ -0,0 +1,50 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+)
+
+// SetReuseConn allows user to keep the UDP connection created by the first
+// discovery open, and use it for the later discoveries, ExternalIP and
+// keepalives, so the mapped address stays stable and can be used for data
+// through Conn. The connection is closed by Close. Racing IPv6 and IPv4 is
+// disabled with the reuse, since it needs a connection for each family.
+func (c *Client) SetReuseConn(v bool) {
+	c.reuse = v
+}
+
+// Conn returns the connection of the client, which is the one passed to
+// NewClientWithConnection or the one kept by SetReuseConn, or nil if there
+// is none yet.
+func (c *Client) Conn() net.PacketConn {
+	return c.conn
+}
+
+// Close closes the connection kept by SetReuseConn and the DTLS association.
+// A connection passed to NewClientWithConnection is left open, it is owned by
+// the caller.
+func (c *Client) Close() error {
+	c.closeDTLS()
+	if !c.ownConn {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.ownConn = nil, false
+	return err
+}
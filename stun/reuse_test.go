@@ -0,0 +1,52 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReuseConn(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetReuseConn(true)
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	conn := c.Conn()
+	if conn == nil {
+		t.Fatalf("Conn error: connection not kept")
+	}
+	if r.Hosts[0].Port() != uint16(conn.LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("DiscoverResult error: mapped %v, local %v", r.Hosts[0], conn.LocalAddr())
+	}
+	host, err := c.Keepalive()
+	if err != nil || host.TransportAddr() != r.Hosts[0].TransportAddr() {
+		t.Errorf("Keepalive error: %v, %v", host, err)
+	}
+	if _, err = c.DiscoverResult(); err != nil || c.Conn() != conn {
+		t.Errorf("DiscoverResult error: connection not reused, %v", err)
+	}
+	if err = c.Close(); err != nil || c.Conn() != nil {
+		t.Errorf("Close error: %v", err)
+	}
+}
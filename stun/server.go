@@ -0,0 +1,397 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default rate limit of the server per source IP.
+const (
+	DefaultServerRate  = 10 // requests per second
+	DefaultServerBurst = 20
+)
+
+// bucketExpiry is how long the token bucket of an idle source IP is kept.
+const bucketExpiry = time.Minute
+
+// ServerStats contains the counters of a server.
+type ServerStats struct {
+	Received        uint64 // packets received
+	Responded       uint64 // responses sent
+	Oversized       uint64 // packets dropped for exceeding the size limit
+	Malformed       uint64 // packets dropped for being malformed
+	Unauthenticated uint64 // requests dropped for failing authentication
+	RateLimited     uint64 // packets dropped by the rate limit
+
+	// Challenged counts the requests answered with 400, 401 or 438 errors
+	// by the long-term credential mechanism, of which StaleNonce counts
+	// those with expired nonces, and Replayed the valid requests dropped
+	// as replays from other addresses.
+	Challenged uint64
+	StaleNonce uint64
+	Replayed   uint64
+}
+
+// Server is a STUN server answering binding requests. Requests with
+// comprehension-required attributes unknown to this package are answered
+// with a 420 error listing them in UNKNOWN-ATTRIBUTES. Unless alternate
+// addresses are set with SetAlternate, so are requests asking to change the
+// IP or port.
+//
+// To be run on the public Internet, the server limits the rate of requests
+// per source IP with a token bucket and silently drops oversized, malformed
+// and unauthenticated packets.
+type Server struct {
+	conn          net.PacketConn
+	alternate     []net.PacketConn // alternate port, IP, both
+	softwareName  string
+	logger        *Logger
+	maxPacketSize int
+	rate          float64
+	burst         float64
+	username      string
+	key           []byte
+	longTerm      *longTermAuth
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+	stats   ServerStats
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewServer returns a server which serves on the given connection.
+func NewServer(conn net.PacketConn) *Server {
+	return &Server{
+		conn:          conn,
+		softwareName:  DefaultSoftwareName,
+		logger:        NewLogger(),
+		maxPacketSize: maxPacketSize,
+		rate:          DefaultServerRate,
+		burst:         DefaultServerBurst,
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+// SetVerbose sets the server to be in the verbose mode, which prints
+// information of dropped packets.
+func (s *Server) SetVerbose(v bool) {
+	s.logger.SetDebug(v)
+}
+
+// SetVVerbose sets the server to be in the double verbose mode, which also
+// prints the packets.
+func (s *Server) SetVVerbose(v bool) {
+	s.logger.SetInfo(v)
+}
+
+// SetSoftwareName sets the SOFTWARE attribute of responses. An empty string
+// omits the attribute.
+func (s *Server) SetSoftwareName(name string) {
+	s.softwareName = name
+}
+
+// SetMaxPacketSize sets the size over which packets are dropped.
+func (s *Server) SetMaxPacketSize(n int) {
+	s.maxPacketSize = n
+}
+
+// SetRateLimit sets the number of requests per second and the burst size
+// allowed per source IP. A rate of 0 disables the rate limit.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = rate
+	s.burst = float64(burst)
+}
+
+// SetAlternate sets the connections on the alternate port, the alternate IP
+// and both of the server, which are used to answer CHANGE-REQUEST and
+// advertised in OTHER-ADDRESS and CHANGED-ADDRESS (RFC 5780 Section 7.3).
+// Serve also answers requests received on them. It must be called before
+// Serve.
+func (s *Server) SetAlternate(altPort, altIP, altBoth net.PacketConn) {
+	s.alternate = []net.PacketConn{altPort, altIP, altBoth}
+}
+
+// SetCredential sets the short-term credential requests must be
+// authenticated with. Requests without a valid MESSAGE-INTEGRITY are then
+// dropped. An empty password disables the authentication. It must be called
+// before Serve. See SetLongTermCredential for the long-term credential.
+func (s *Server) SetCredential(username, password string) {
+	s.username = username
+	s.key = []byte(password)
+}
+
+// Stats returns a snapshot of the counters of the server.
+func (s *Server) Stats() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Serve reads packets from the connections and answers them until reading
+// fails, e.g. because the connections are closed.
+func (s *Server) Serve() error {
+	errs := make(chan error, len(s.alternate))
+	for i := range s.alternate {
+		go func(i int) { errs <- s.serve(i + 1) }(i)
+	}
+	err := s.serve(0)
+	for range s.alternate {
+		<-errs
+	}
+	return err
+}
+
+// serve reads packets from the connection with the given index, where 0 is
+// the primary connection and 1 to 3 are the alternate ones.
+func (s *Server) serve(i int) error {
+	conn := s.connAt(i)
+	// Read one more byte than allowed to detect oversized packets.
+	buf := make([]byte, s.maxPacketSize+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		s.handle(buf[:n], addr, i)
+	}
+}
+
+// connAt returns the connection with the given index. Bit 0 of the index
+// selects the alternate port and bit 1 the alternate IP.
+func (s *Server) connAt(i int) net.PacketConn {
+	if i == 0 {
+		return s.conn
+	}
+	return s.alternate[i-1]
+}
+
+// Close closes the connections, which makes Serve return.
+func (s *Server) Close() error {
+	err := s.conn.Close()
+	for _, conn := range s.alternate {
+		if e := conn.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) handle(b []byte, addr net.Addr, i int) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	s.count(&s.stats.Received)
+	if len(b) > s.maxPacketSize {
+		s.logger.Debugln("Drop oversized packet from", addr)
+		s.count(&s.stats.Oversized)
+		return
+	}
+	if !s.allow(udpAddr.IP) {
+		s.logger.Debugln("Drop rate limited packet from", addr)
+		s.count(&s.stats.RateLimited)
+		return
+	}
+	if !validHeader(b) {
+		s.logger.Debugln("Drop malformed packet from", addr)
+		s.count(&s.stats.Malformed)
+		return
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		s.logger.Debugln("Drop malformed packet from", addr, err)
+		s.count(&s.stats.Malformed)
+		return
+	}
+	// Only binding requests are answered, binding indications are
+	// keepalives and need no response.
+	if pkt.types != typeBindingRequest {
+		return
+	}
+	if s.logger.info {
+		s.logger.Info("\n" + hex.Dump(b))
+	}
+	key := s.key
+	if s.longTerm != nil {
+		var challenge *packet
+		key, challenge = s.authenticateLongTerm(pkt, b, udpAddr)
+		if challenge != nil {
+			s.logger.Debugln("Challenge request from", addr)
+			s.count(&s.stats.Challenged)
+			challenge.addFingerprint()
+			s.reply(challenge, s.connAt(i), addr)
+			return
+		}
+		if key == nil {
+			s.logger.Debugln("Drop replayed request from", addr)
+			s.count(&s.stats.Replayed)
+			return
+		}
+	} else if len(s.key) > 0 && !s.authenticated(pkt, b) {
+		s.logger.Debugln("Drop unauthenticated request from", addr)
+		s.count(&s.stats.Unauthenticated)
+		return
+	}
+	resp, conn := s.newResponse(pkt, udpAddr, i, key)
+	// Success responses are sent to the port in RESPONSE-PORT if present
+	// (RFC 5780 Section 7.4).
+	if port := pkt.getAttribute(attributeResponsePort); port != nil && !isErrorResponse(resp.types) {
+		addr = &net.UDPAddr{IP: udpAddr.IP, Port: int(binary.BigEndian.Uint16(port.value)), Zone: udpAddr.Zone}
+	}
+	s.reply(resp, conn, addr)
+}
+
+// reply sends the response on the connection.
+func (s *Server) reply(resp *packet, conn net.PacketConn, addr net.Addr) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	out := resp.appendTo(*buf)
+	if s.logger.info {
+		s.logger.Info("\n" + hex.Dump(out))
+	}
+	if _, err := conn.WriteTo(out, addr); err != nil {
+		s.logger.Debugln("Send error:", err)
+		return
+	}
+	s.count(&s.stats.Responded)
+}
+
+func (s *Server) authenticated(pkt *packet, b []byte) bool {
+	username := pkt.getAttribute(attributeUsername)
+	if username == nil || string(username.value[:username.length]) != s.username {
+		return false
+	}
+	return verifyMessageIntegrity(b, s.key)
+}
+
+// newResponse returns the response to a request received on the connection
+// with index i, and the connection to send it on. The response has a
+// MESSAGE-INTEGRITY with the key unless it is nil.
+func (s *Server) newResponse(req *packet, addr *net.UDPAddr, i int, key []byte) (*packet, net.PacketConn) {
+	pkt := &packet{transID: req.transID, attributes: make([]attribute, 0, 10)}
+	unknown := req.unknownAttributes()
+	from := i
+	if changeReq := req.getAttribute(attributeChangeRequest); changeReq != nil &&
+		changeReq.value[3]&0x06 != 0 {
+		if s.alternate == nil {
+			// There is no alternate address to answer from, so
+			// the CHANGE-REQUEST is not understood either (RFC
+			// 5780 Section 7.2).
+			unknown = append(unknown, attributeChangeRequest)
+		}
+		if changeReq.value[3]&0x04 != 0 {
+			from ^= 2
+		}
+		if changeReq.value[3]&0x02 != 0 {
+			from ^= 1
+		}
+	}
+	if len(unknown) > 0 {
+		pkt.types = typeBindingErrorResponse
+		pkt.addAttribute(*newErrorCodeAttribute(errorUnknownAttribute, "Unknown Attribute"))
+		pkt.addAttribute(*newUnknownAttributesAttribute(unknown))
+	} else {
+		pkt.types = typeBindingResponse
+		pkt.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, pkt.transID))
+		// RFC 3489 clients only understand MAPPED-ADDRESS.
+		pkt.addAttribute(*newAddrAttribute(attributeMappedAddress, addr))
+		if s.alternate != nil {
+			if other, ok := s.connAt(i ^ 3).LocalAddr().(*net.UDPAddr); ok {
+				pkt.addAttribute(*newAddrAttribute(attributeOtherAddress, other))
+				pkt.addAttribute(*newAddrAttribute(attributeChangedAddress, other))
+			}
+			if origin, ok := s.connAt(from).LocalAddr().(*net.UDPAddr); ok {
+				pkt.addAttribute(*newAddrAttribute(attributeResponseOrigin, origin))
+			}
+		}
+	}
+	if s.softwareName != "" {
+		pkt.addAttribute(*newSoftwareAttribute(s.softwareName))
+	}
+	if len(key) > 0 {
+		pkt.addAttribute(*newMessageIntegrityAttribute(pkt, key))
+	}
+	pkt.addFingerprint()
+	if len(unknown) > 0 {
+		return pkt, s.connAt(i)
+	}
+	return pkt, s.connAt(from)
+}
+
+// allow takes a token from the bucket of the IP.
+func (s *Server) allow(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(s.pruned) > bucketExpiry {
+		// Buckets idle for long are full again, so dropping them
+		// changes nothing but bounds the memory usage.
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > bucketExpiry {
+				delete(s.buckets, k)
+			}
+		}
+		s.pruned = now
+	}
+	key := ip.String()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{s.burst, now}
+		s.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.rate
+	if b.tokens > s.burst {
+		b.tokens = s.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *Server) count(counter *uint64) {
+	s.mu.Lock()
+	*counter++
+	s.mu.Unlock()
+}
+
+// validHeader checks the STUN header (RFC 5389 Section 6): the two most
+// significant bits are zero and the length matches the packet size.
+func validHeader(b []byte) bool {
+	if len(b) < 20 || b[0]&0xc0 != 0 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	return length%4 == 0 && length+20 == len(b)
+}
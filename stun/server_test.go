@@ -0,0 +1,101 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*Server, *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	s := NewServer(conn)
+	go s.Serve()
+	return s, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestServerBinding(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr.String())
+	host, err := c.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if host.String() != conn.LocalAddr().String() {
+		t.Errorf("mapped address error: expected %v, get %v", conn.LocalAddr(), host)
+	}
+	if stats := s.Stats(); stats.Received != 1 {
+		t.Errorf("stats error: %+v", stats)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := NewServer(nil)
+	s.SetRateLimit(1, 2)
+	ip := net.IPv4(1, 2, 3, 4)
+	if !s.allow(ip) || !s.allow(ip) {
+		t.Errorf("allow error: burst rejected")
+	}
+	if s.allow(ip) {
+		t.Errorf("allow error: exceeded burst accepted")
+	}
+	if !s.allow(net.IPv4(1, 2, 3, 5)) {
+		t.Errorf("allow error: other IP rejected")
+	}
+}
+
+func TestServerUnknownAttribute(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatalf("DialUDP error: %v", err)
+	}
+	defer conn.Close()
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	req.addAttribute(*newAttribute(0x7fff, []byte{1, 2, 3, 4}))
+	if _, err = conn.Write(req.bytes()); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	buf := make([]byte, maxPacketSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	resp, err := newPacketFromBytes(buf[:n])
+	if err != nil {
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	if resp.types != typeBindingErrorResponse {
+		t.Errorf("response type error: %#04x", resp.types)
+	}
+	unknown := resp.getAttribute(attributeUnknownAttributes)
+	if unknown == nil || unknown.length != 2 || unknown.value[0] != 0x7f || unknown.value[1] != 0xff {
+		t.Errorf("UNKNOWN-ATTRIBUTES error: %v", unknown)
+	}
+}
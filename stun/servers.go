@@ -0,0 +1,202 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrNoHealthyServer is returned by SelectBest when none of the servers
+// answers.
+var ErrNoHealthyServer = errors.New("no healthy server")
+
+// DefaultHealthTimeout is the time HealthCheck waits for the response of a
+// server.
+const DefaultHealthTimeout = 2 * time.Second
+
+// PublicServers is a list of public STUN servers, from which SelectBest
+// chooses the server of clients which have none set. Only some of them have
+// an alternate address, the others support the first test of the discovery
+// only.
+var PublicServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun2.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+	"global.stun.twilio.com:3478",
+	"stun.nextcloud.com:443",
+	"stun.stunprotocol.org:3478",
+	DefaultServerAddr,
+}
+
+// ServerHealth is the result of the health check of a server.
+type ServerHealth struct {
+	Addr      string
+	RTT       time.Duration // round trip time of the binding request
+	OtherAddr *Host         // alternate address of the server, nil if none
+	Err       error         // nil if the server answers
+}
+
+// HealthCheck checks the health of the servers with a client of the default
+// settings, see Client.HealthCheck.
+func HealthCheck(ctx context.Context, servers []string) []ServerHealth {
+	return NewClient().HealthCheck(ctx, servers)
+}
+
+// SelectBest selects the best of the servers with a client of the default
+// settings, see Client.SelectBest.
+func SelectBest(ctx context.Context, servers []string) (string, error) {
+	return NewClient().SelectBest(ctx, servers)
+}
+
+// HealthCheck sends a binding request to each server concurrently, as
+// concurrent transactions on a single socket, and returns their health in
+// the order of servers. A server is healthy if it answers with a success
+// response within DefaultHealthTimeout. The servers are resolved with the
+// resolver of the client, and the requests are sent on its connection or
+// from a socket with its local address, interface, port range and socket
+// options, subject to its rate limiter.
+func (c *Client) HealthCheck(ctx context.Context, servers []string) []ServerHealth {
+	p := c.prober()
+	health := make([]ServerHealth, len(servers))
+	addrs := make([]*net.UDPAddr, len(servers))
+	var wg sync.WaitGroup
+	for i, addr := range servers {
+		health[i].Addr = addr
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			addrs[i], health[i].Err = p.resolveUDPAddr(ctx, "udp", addr)
+		}(i, addr)
+	}
+	wg.Wait()
+	var first *net.UDPAddr
+	for i, addr := range addrs {
+		if health[i].Err == nil {
+			first = addr
+			break
+		}
+	}
+	if first == nil {
+		return health
+	}
+	conn, done, err := p.listen(first)
+	if err != nil {
+		for i := range health {
+			if health[i].Err == nil {
+				health[i].Err = err
+			}
+		}
+		return health
+	}
+	defer done()
+	var reqs []*request
+	var index []int
+	for i, addr := range addrs {
+		if health[i].Err != nil {
+			continue
+		}
+		pkt, err := p.newBindingPacket(typeBindingRequest, false, false)
+		if err != nil {
+			health[i].Err = err
+			continue
+		}
+		reqs = append(reqs, &request{pkt: pkt, addr: addr})
+		index = append(index, i)
+	}
+	p.transact(ctx, conn, conn, reqs)
+	for j, r := range reqs {
+		h := &health[index[j]]
+		h.RTT = r.tx.Duration()
+		err := r.err
+		if err == nil && r.resp == nil {
+			err = &TimeoutError{Addr: r.addr}
+		}
+		if err == nil {
+			err = responseError(r.resp, r.addr)
+		}
+		h.Err = err
+		if err == nil {
+			h.OtherAddr = r.resp.otherAddr
+			if h.OtherAddr == nil {
+				h.OtherAddr = r.resp.changedAddr
+			}
+		}
+	}
+	return health
+}
+
+// SelectBest checks the health of the servers and returns the healthy one
+// with the lowest RTT among those with an alternate address, which support
+// the complete discovery, or among all the healthy ones if none has.
+func (c *Client) SelectBest(ctx context.Context, servers []string) (string, error) {
+	best := -1
+	health := c.HealthCheck(ctx, servers)
+	for i := range health {
+		if health[i].Err == nil && (best < 0 || health[i].better(&health[best])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", ErrNoHealthyServer
+	}
+	return health[best].Addr, nil
+}
+
+// better reports whether the healthy server is preferred to the other.
+func (h *ServerHealth) better(other *ServerHealth) bool {
+	if (h.OtherAddr != nil) != (other.OtherAddr != nil) {
+		return h.OtherAddr != nil
+	}
+	return h.RTT < other.RTT
+}
+
+// prober returns a client for the health checks which reaches the servers
+// like the client: with its resolver, rate limiter, connection, local
+// address, interface, port range and socket options.
+func (c *Client) prober() *Client {
+	p := NewClient()
+	p.softwareName = c.softwareName
+	p.logger = c.logger
+	p.resolver = c.resolver
+	p.limiter = c.limiter
+	p.conn = c.conn
+	p.localAddr, p.iface = c.localAddr, c.iface
+	p.portMin, p.portMax = c.portMin, c.portMax
+	p.socket = c.socket
+	p.SetTestTimeout(DefaultHealthTimeout)
+	return p
+}
+
+// defaultServer sets the server address to the best of PublicServers if it
+// is not set, or to DefaultServerAddr if none of them answers.
+func (c *Client) defaultServer(ctx context.Context) {
+	if c.serverAddr != "" {
+		return
+	}
+	addr, err := c.SelectBest(ctx, PublicServers)
+	if err != nil {
+		c.logger.Debugln("Select server error:", err)
+		addr = DefaultServerAddr
+	}
+	c.logger.Debugln("Use server", addr)
+	c.SetServerAddr(addr)
+}
@@ -0,0 +1,114 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSelectBest(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	servers := []string{silent.LocalAddr().String(), addr.String()}
+	health := HealthCheck(ctx, servers)
+	if len(health) != 2 || health[0].Err == nil || health[1].Err != nil || health[1].RTT <= 0 {
+		t.Errorf("HealthCheck error: %+v", health)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	best, err := SelectBest(ctx, servers)
+	if err != nil || best != addr.String() {
+		t.Errorf("SelectBest error: expected %v, get %v, %v", addr, best, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = SelectBest(ctx, servers[:1]); err != ErrNoHealthyServer {
+		t.Errorf("SelectBest error: expected %v, get %v", ErrNoHealthyServer, err)
+	}
+}
+
+// newAlternateTestServer returns a server with an alternate address, on
+// loopback ports only.
+func newAlternateTestServer(t *testing.T) (*Server, *net.UDPAddr) {
+	var conns [4]net.PacketConn
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP error: %v", err)
+		}
+		conns[i] = conn
+	}
+	s := NewServer(conns[0])
+	s.SetAlternate(conns[1], conns[2], conns[3])
+	go s.Serve()
+	return s, conns[0].LocalAddr().(*net.UDPAddr)
+}
+
+func TestSelectBestAlternate(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	alt, altAddr := newAlternateTestServer(t)
+	defer alt.Close()
+	c := NewClient()
+	c.SetLocalAddr("127.0.0.1:0")
+	servers := []string{addr.String(), altAddr.String()}
+	health := c.HealthCheck(context.Background(), servers)
+	if len(health) != 2 || health[0].Err != nil || health[1].Err != nil {
+		t.Fatalf("HealthCheck error: %+v", health)
+	}
+	if health[0].OtherAddr != nil || health[1].OtherAddr == nil {
+		t.Errorf("OtherAddr error: expected nil and an address, get %v and %v", health[0].OtherAddr, health[1].OtherAddr)
+	}
+	// The server with an alternate address wins regardless of the RTT.
+	best, err := c.SelectBest(context.Background(), servers)
+	if err != nil || best != altAddr.String() {
+		t.Errorf("SelectBest error: expected %v, get %v, %v", altAddr, best, err)
+	}
+}
+
+func TestClientHealthCheck(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetLocalAddr("127.0.0.1:0")
+	// The servers are resolved with the resolver of the client.
+	c.SetResolver(stubResolver{{IP: net.IPv4(127, 0, 0, 1)}})
+	server := net.JoinHostPort("stun.invalid", strconv.Itoa(addr.Port))
+	health := c.HealthCheck(context.Background(), []string{server})
+	if len(health) != 1 || health[0].Err != nil || health[0].Addr != server {
+		t.Fatalf("HealthCheck error: %+v", health)
+	}
+	// The default server is selected by the client as well.
+	saved := PublicServers
+	defer func() { PublicServers = saved }()
+	PublicServers = []string{server}
+	c.defaultServer(context.Background())
+	if c.serverAddr != server {
+		t.Errorf("defaultServer error: expected %v, get %v", server, c.serverAddr)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var (
+	// ErrSocketOption is returned when a socket option of the SocketConfig
+	// is not supported on the platform.
+	ErrSocketOption = errors.New("socket option not supported on this platform")
+	// ErrInvalidSocketConfig is returned when an option of the
+	// SocketConfig is out of range.
+	ErrInvalidSocketConfig = errors.New("invalid socket config")
+)
+
+// SocketConfig is the options of the sockets created by the client. Zero
+// values keep the defaults of the system.
+type SocketConfig struct {
+	TTL         int  // IP TTL or IPv6 hop limit
+	DSCP        int  // DSCP marking (RFC 2474), from 0 to 63
+	ReuseAddr   bool // set SO_REUSEADDR
+	ReusePort   bool // set SO_REUSEPORT
+	ReadBuffer  int  // size of the receive buffer
+	WriteBuffer int  // size of the send buffer
+
+	// DontFragment sets the DF bit and disables the fragmentation of
+	// the sent packets, which is only supported on Linux.
+	DontFragment bool
+
+	// ICMPErrors enables IP_RECVERR, so ICMP errors such as port
+	// unreachable end the transaction at once with a TransportError
+	// instead of waiting for the retransmissions to time out. It is only
+	// supported on Linux.
+	ICMPErrors bool
+}
+
+// SetSocketConfig sets the options of the sockets the client creates, which
+// excludes a connection passed to NewClientWithConnection.
+func (c *Client) SetSocketConfig(cfg SocketConfig) {
+	c.socket = cfg
+}
+
+// listenUDP creates a UDP socket with the socket options.
+func (cfg SocketConfig) listenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	if cfg.DSCP < 0 || cfg.DSCP > 63 || cfg.TTL < 0 || cfg.TTL > 255 {
+		return nil, ErrInvalidSocketConfig
+	}
+	address := ""
+	if laddr != nil {
+		address = laddr.String()
+	}
+	lc := net.ListenConfig{Control: cfg.control}
+	pc, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if cfg.ReadBuffer > 0 {
+		if err = conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cfg.WriteBuffer > 0 {
+		if err = conn.SetWriteBuffer(cfg.WriteBuffer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// getsockopt returns the value of the socket option of the connection.
+func getsockopt(t *testing.T, conn *net.UDPConn, level, opt int) int {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn error: %v", err)
+	}
+	var value int
+	cerr := rc.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if cerr != nil || err != nil {
+		t.Fatalf("getsockopt error: %v, %v", cerr, err)
+	}
+	return value
+}
+
+func TestSocketOptions(t *testing.T) {
+	c := NewClient()
+	c.SetSocketConfig(SocketConfig{TTL: 32, DSCP: 46, ReuseAddr: true, ReadBuffer: 1 << 16, WriteBuffer: 1 << 15})
+	conn, err := c.socket.listenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listenUDP error: %v", err)
+	}
+	defer conn.Close()
+	if v := getsockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TTL); v != 32 {
+		t.Errorf("IP_TTL error: expected 32, get %d", v)
+	}
+	if v := getsockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS); v != 46<<2 {
+		t.Errorf("IP_TOS error: expected %d, get %d", 46<<2, v)
+	}
+	if v := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_REUSEADDR); v != 1 {
+		t.Errorf("SO_REUSEADDR error: expected 1, get %d", v)
+	}
+	// Linux doubles the buffer sizes for its bookkeeping, the requested
+	// ones are below the default net.core.rmem_max and wmem_max.
+	if v := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < 1<<16 {
+		t.Errorf("SO_RCVBUF error: expected at least %d, get %d", 1<<16, v)
+	}
+	if v := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < 1<<15 {
+		t.Errorf("SO_SNDBUF error: expected at least %d, get %d", 1<<15, v)
+	}
+	conn6, err := c.socket.listenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("listenUDP on IPv6 error: %v", err)
+	}
+	defer conn6.Close()
+	if v := getsockopt(t, conn6, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS); v != 32 {
+		t.Errorf("IPV6_UNICAST_HOPS error: expected 32, get %d", v)
+	}
+	if v := getsockopt(t, conn6, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS); v != 46<<2 {
+		t.Errorf("IPV6_TCLASS error: expected %d, get %d", 46<<2, v)
+	}
+}
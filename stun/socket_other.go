@@ -0,0 +1,33 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package stun
+
+import (
+	"syscall"
+)
+
+// control fails if any socket option is set, as setting them is only
+// implemented on Unix.
+func (cfg SocketConfig) control(network, address string, rc syscall.RawConn) error {
+	if cfg.TTL > 0 || cfg.DSCP > 0 || cfg.ReuseAddr || cfg.ReusePort || cfg.DontFragment || cfg.ICMPErrors {
+		return ErrSocketOption
+	}
+	return nil
+}
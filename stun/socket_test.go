@@ -0,0 +1,104 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocketConfig(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("socket options are tested on Linux only")
+	}
+	c := NewClient()
+	c.SetSocketConfig(SocketConfig{TTL: 32, DSCP: 46, ReusePort: true, ReadBuffer: 1 << 16})
+	a, err := c.socket.listenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listenUDP error: %v", err)
+	}
+	defer a.Close()
+	// SO_REUSEPORT allows a second socket on the same port.
+	b, err := c.socket.listenUDP("udp4", a.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("listenUDP with SO_REUSEPORT error: %v", err)
+	}
+	b.Close()
+	c.SetSocketConfig(SocketConfig{DSCP: 64})
+	if _, err = c.socket.listenUDP("udp4", nil); err != ErrInvalidSocketConfig {
+		t.Errorf("listenUDP with invalid DSCP error: expected %v, get %v", ErrInvalidSocketConfig, err)
+	}
+}
+
+func TestICMPErrors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("IP_RECVERR is only supported on Linux")
+	}
+	// A port nobody listens on, which answers with port unreachable.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	addr := closed.LocalAddr().String()
+	closed.Close()
+	c := NewClient()
+	c.SetServerAddr(addr)
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetSocketConfig(SocketConfig{ICMPErrors: true})
+	start := time.Now()
+	_, err = c.DiscoverResult()
+	var te *TransportError
+	if !errors.As(err, &te) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("DiscoverResult error: expected ECONNREFUSED, get %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("DiscoverResult error: took %v", d)
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	port := busy.LocalAddr().(*net.UDPAddr).Port
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetPortRange(port, port)
+	if _, err = c.DiscoverResult(); err != ErrNoPortAvailable {
+		t.Errorf("DiscoverResult error: expected %v, get %v", ErrNoPortAvailable, err)
+	}
+	busy.Close()
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if r.LocalAddr == nil || int(r.LocalAddr.Port()) != port {
+		t.Errorf("local address error: expected port %d, get %v", port, r.LocalAddr)
+	}
+	c.SetPortRange(port, port-1)
+	if _, err = c.DiscoverResult(); err != ErrInvalidPortRange {
+		t.Errorf("DiscoverResult error: expected %v, get %v", ErrInvalidPortRange, err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package stun
+
+import (
+	"syscall"
+)
+
+// control sets the socket options before the socket is bound.
+func (cfg SocketConfig) control(network, address string, rc syscall.RawConn) error {
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		set := func(level, opt, value int) {
+			if err == nil {
+				err = syscall.SetsockoptInt(int(fd), level, opt, value)
+			}
+		}
+		if cfg.ReuseAddr {
+			set(syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+		if cfg.ReusePort {
+			set(syscall.SOL_SOCKET, soReusePort, 1)
+		}
+		if cfg.DontFragment && err == nil {
+			err = dontFragment(int(fd), network == "udp6")
+		}
+		if cfg.ICMPErrors && err == nil {
+			err = recvErr(int(fd), network == "udp6")
+		}
+		if network == "udp6" {
+			if cfg.TTL > 0 {
+				set(syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, cfg.TTL)
+			}
+			if cfg.DSCP > 0 {
+				set(syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, cfg.DSCP<<2)
+			}
+			// Dual-stack sockets also send IPv4 packets, the
+			// IPv4 options may be refused on IPv6-only ones.
+			if cfg.TTL > 0 {
+				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, cfg.TTL)
+			}
+			if cfg.DSCP > 0 {
+				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, cfg.DSCP<<2)
+			}
+			return
+		}
+		if cfg.TTL > 0 {
+			set(syscall.IPPROTO_IP, syscall.IP_TTL, cfg.TTL)
+		}
+		if cfg.DSCP > 0 {
+			set(syscall.IPPROTO_IP, syscall.IP_TOS, cfg.DSCP<<2)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/subtle"
+)
+
+// ClientStats contains the counters of the packets a client drops while
+// waiting for responses, and of its transactions.
+type ClientStats struct {
+	Malformed uint64 // packets which are not STUN messages
+	Stale     uint64 // responses of earlier transactions
+	Rejected  uint64 // responses of no transaction sent, e.g. spoofed ones
+
+	// Unauthenticated counts the responses without a valid
+	// MESSAGE-INTEGRITY discarded by SetStrictIntegrity.
+	Unauthenticated uint64
+
+	// Transactions counts the terminated transactions, of which
+	// Retransmitted counts the answered ones which sent more than one
+	// request, and TimedOut those which got no response, as in
+	// DiscoveryResult.Loss for the counts of a discovery.
+	Transactions  uint64
+	Retransmitted uint64
+	TimedOut      uint64
+
+	// Violations counts the violations of the encoding rules the
+	// responses were accepted with, see SetParseMode.
+	Violations uint64
+
+	// Throttled counts the transactions delayed by SetRateLimiter.
+	Throttled uint64
+}
+
+// Stats returns a snapshot of the counters of the client.
+func (c *Client) Stats() ClientStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
+}
+
+func (c *Client) count(counter *uint64) {
+	c.countN(counter, 1)
+}
+
+func (c *Client) countN(counter *uint64, n int) {
+	c.statsMu.Lock()
+	*counter += uint64(n)
+	c.statsMu.Unlock()
+}
+
+// matchTransID reports whether the transaction ID of the response, which
+// includes the magic cookie, is the one of the request. The comparison is in
+// constant time, so off-path attackers learn nothing about the transaction
+// ID from the time their spoofed responses take to be dropped.
+func matchTransID(req, resp []byte) bool {
+	return len(resp) == len(req) && subtle.ConstantTimeCompare(req, resp) == 1
+}
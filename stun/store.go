@@ -0,0 +1,240 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is a discovery result recorded by a ResultStore.
+type Record struct {
+	Time   time.Time        `json:"time"`
+	Server string           `json:"server"`
+	Result *DiscoveryResult `json:"result"`
+
+	// BindingLifetime is the time the NAT keeps a mapping without
+	// traffic, if the application measured it, e.g. with keepalives of
+	// growing intervals, zero if unknown.
+	BindingLifetime time.Duration `json:"bindingLifetime,omitempty"`
+}
+
+// ResultStore stores records of discovery results over time, see
+// SetResultStore.
+type ResultStore interface {
+	// Append adds the record after the others.
+	Append(r Record) error
+	// Records returns the records, oldest first.
+	Records() ([]Record, error)
+}
+
+// MemoryStore is a ResultStore in memory keeping the last Max records, all
+// of them if Max is zero.
+type MemoryStore struct {
+	Max int
+
+	mu      sync.Mutex
+	records []Record
+}
+
+// Append implements ResultStore.
+func (s *MemoryStore) Append(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	if s.Max > 0 && len(s.records) > s.Max {
+		s.records = append([]Record(nil), s.records[len(s.records)-s.Max:]...)
+	}
+	return nil
+}
+
+// Records implements ResultStore.
+func (s *MemoryStore) Records() ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Record(nil), s.records...), nil
+}
+
+// FileStore is a ResultStore appending the records to a file as JSON, one
+// record per line, so the file survives restarts of long-running agents and
+// can be processed by other tools.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore returns a store in the file at path, which is created by the
+// first Append if it does not exist.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Append implements ResultStore.
+func (s *FileStore) Append(r Record) error {
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Records implements ResultStore. A missing file has no records.
+func (s *FileStore) Records() ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// SetResultStore sets the store each discovery result of the client is
+// recorded in, except the cached ones. Failures to record are logged, but do
+// not fail the discovery. A nil store disables the recording.
+func (c *Client) SetResultStore(s ResultStore) {
+	c.store = s
+}
+
+func (c *Client) storeResult(server string, r *DiscoveryResult) {
+	if c.store == nil {
+		return
+	}
+	err := c.store.Append(Record{Time: time.Now(), Server: server, Result: r.clone()})
+	if err != nil {
+		c.logger.Debugln("Record result error:", err)
+	}
+}
+
+// ChangeKind is what changed between two records.
+type ChangeKind int
+
+// Kinds of changes.
+const (
+	ChangeNAT ChangeKind = iota
+	ChangeExternalIP
+	ChangeBindingLifetime
+)
+
+var changeStr map[ChangeKind]string
+
+func init() {
+	changeStr = map[ChangeKind]string{
+		ChangeNAT:             "NAT type",
+		ChangeExternalIP:      "external IP",
+		ChangeBindingLifetime: "binding lifetime",
+	}
+}
+
+func (k ChangeKind) String() string {
+	if s, ok := changeStr[k]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Change is a difference between a record and the previous one. Old and New
+// are the values in text form: the stable name of the NAT type, the IP
+// address, or the duration.
+type Change struct {
+	Kind ChangeKind
+	Time time.Time // time of the new record
+	Old  string
+	New  string
+}
+
+func (c Change) String() string {
+	return c.Time.Format(time.RFC3339) + " " + c.Kind.String() + " changed from " + c.Old + " to " + c.New
+}
+
+// Diff returns the changes of the NAT type, the external IP and the binding
+// lifetime from prev to next. The external IP is compared only if both
+// results have one, and the binding lifetime only if both records have one,
+// so unanswered discoveries report a NAT type change only.
+func Diff(prev, next Record) []Change {
+	var changes []Change
+	add := func(k ChangeKind, o, n string) {
+		changes = append(changes, Change{k, next.Time, o, n})
+	}
+	if o, n := recordNAT(prev), recordNAT(next); o != n {
+		ob, _ := o.MarshalText()
+		nb, _ := n.MarshalText()
+		add(ChangeNAT, string(ob), string(nb))
+	}
+	if o, n := recordIP(prev), recordIP(next); o != "" && n != "" && o != n {
+		add(ChangeExternalIP, o, n)
+	}
+	if o, n := prev.BindingLifetime, next.BindingLifetime; o > 0 && n > 0 && o != n {
+		add(ChangeBindingLifetime, o.String(), n.String())
+	}
+	return changes
+}
+
+// Changes returns the changes between the consecutive records, oldest first.
+func Changes(records []Record) []Change {
+	var changes []Change
+	for i := 1; i < len(records); i++ {
+		changes = append(changes, Diff(records[i-1], records[i])...)
+	}
+	return changes
+}
+
+func recordNAT(r Record) NATType {
+	if r.Result == nil {
+		return NATError
+	}
+	return r.Result.NAT
+}
+
+func recordIP(r Record) string {
+	if r.Result == nil || len(r.Result.Hosts) == 0 || r.Result.Hosts[0] == nil {
+		return ""
+	}
+	return r.Result.Hosts[0].IP()
+}
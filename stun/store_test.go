@@ -0,0 +1,86 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	s := NewFileStore(filepath.Join(t.TempDir(), "results.json"))
+	if records, err := s.Records(); err != nil || len(records) != 0 {
+		t.Fatalf("Records error: %v %v", records, err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	in := []Record{
+		{Time: t0, Server: "s", Result: &DiscoveryResult{NAT: NATFull, Hosts: []*Host{newHostFromStr("192.0.2.1:1000")}}},
+		{Time: t0.Add(time.Hour), Server: "s", Result: &DiscoveryResult{NAT: NATFull, Hosts: []*Host{newHostFromStr("192.0.2.1:2000")}}, BindingLifetime: time.Minute},
+		{Time: t0.Add(2 * time.Hour), Server: "s", Result: &DiscoveryResult{NAT: NATSymmetric, Hosts: []*Host{newHostFromStr("100.64.0.1:3000")}}, BindingLifetime: 30 * time.Second},
+		{Time: t0.Add(3 * time.Hour), Server: "s", Result: &DiscoveryResult{NAT: NATBlocked}},
+	}
+	for _, r := range in {
+		if err := s.Append(r); err != nil {
+			t.Fatalf("Append error: %v", err)
+		}
+	}
+	records, err := s.Records()
+	if err != nil || len(records) != len(in) {
+		t.Fatalf("Records error: %d %v", len(records), err)
+	}
+	if !records[1].Time.Equal(in[1].Time) || records[1].BindingLifetime != time.Minute || records[2].Result.Hosts[0].IP() != "100.64.0.1" {
+		t.Errorf("Records error: %+v", records)
+	}
+	changes := Changes(records)
+	want := []Change{
+		{ChangeNAT, in[2].Time, "full-cone", "symmetric"},
+		{ChangeExternalIP, in[2].Time, "192.0.2.1", "100.64.0.1"},
+		{ChangeBindingLifetime, in[2].Time, "1m0s", "30s"},
+		{ChangeNAT, in[3].Time, "symmetric", "blocked"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Changes error: %v", changes)
+	}
+	for i, c := range changes {
+		if c.Kind != want[i].Kind || !c.Time.Equal(want[i].Time) || c.Old != want[i].Old || c.New != want[i].New {
+			t.Errorf("change %d error: expected %v, get %v", i, want[i], c)
+		}
+	}
+}
+
+func TestResultStore(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	store := &MemoryStore{Max: 2}
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetResultStore(store)
+	for i := 0; i < 3; i++ {
+		if _, err := c.DiscoverResult(); err != nil {
+			t.Fatalf("DiscoverResult error: %v", err)
+		}
+	}
+	records, _ := store.Records()
+	if len(records) != 2 || records[1].Server != addr.String() || records[1].Result.NAT != NATNone {
+		t.Errorf("Records error: %+v", records)
+	}
+	if changes := Changes(records); len(changes) != 0 {
+		t.Errorf("Changes error: %v", changes)
+	}
+}
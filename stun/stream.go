@@ -0,0 +1,124 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// streamConn frames the STUN messages and ChannelData messages on a TCP or
+// TLS connection (RFC 5389 Section 7.2.2 and RFC 5766 Section 11.5), so the
+// transactions can use it like a net.PacketConn. Requests over it are not
+// retransmitted, the transport is reliable.
+type streamConn struct {
+	conn    net.Conn
+	pending []byte // bytes read but not returned yet
+	buf     []byte
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{conn: conn, buf: make([]byte, maxPacketSize)}
+}
+
+// frameLen returns the length of the frame at the start of b, or 0 if the
+// header is not complete yet.
+func frameLen(b []byte) int {
+	if len(b) < 4 {
+		return 0
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if b[0]&0xc0 == 0 {
+		return 20 + length
+	}
+	// ChannelData messages are padded to multiples of 4 bytes over
+	// streams.
+	return 4 + int(align(uint16(length)))
+}
+
+// ReadFrom reads the next frame, which is discarded with io.ErrShortBuffer if
+// it is longer than b. A timeout leaves the partial frame to the next read.
+func (s *streamConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		if n := frameLen(s.pending); n > 0 && len(s.pending) >= n {
+			frame := s.pending[:n]
+			s.pending = s.pending[n:]
+			if n > len(b) {
+				return 0, s.conn.RemoteAddr(), io.ErrShortBuffer
+			}
+			return copy(b, frame), s.conn.RemoteAddr(), nil
+		}
+		n, err := s.conn.Read(s.buf)
+		s.pending = append(s.pending, s.buf[:n]...)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// WriteTo writes the message to the stream, addr is ignored.
+func (s *streamConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.conn.Write(b)
+}
+
+func (s *streamConn) Close() error {
+	return s.conn.Close()
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *streamConn) SetDeadline(t time.Time) error {
+	return s.conn.SetDeadline(t)
+}
+
+func (s *streamConn) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *streamConn) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+// isReliable reports whether the connection is a stream, on which requests
+// are not retransmitted.
+func isReliable(conn net.PacketConn) bool {
+	switch conn.(type) {
+	case *streamConn, *wsConn:
+		return true
+	}
+	return false
+}
+
+// prefixConn is a connection which returns the prefix before reading from
+// the underlying connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
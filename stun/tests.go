@@ -17,17 +17,18 @@
 package stun
 
 import (
+	"context"
 	"net"
 )
 
-func (c *Client) test1(conn net.PacketConn, addr net.Addr) (*response, error) {
-	return c.sendBindingReq(conn, addr, false, false)
+func (c *Client) test1(ctx context.Context, conn net.PacketConn, addr net.Addr) (*response, error) {
+	return c.sendBindingReq(ctx, conn, addr, false, false)
 }
 
-func (c *Client) test2(conn net.PacketConn, addr net.Addr) (*response, error) {
-	return c.sendBindingReq(conn, addr, true, true)
+func (c *Client) test2(ctx context.Context, conn net.PacketConn, addr net.Addr) (*response, error) {
+	return c.sendBindingReq(ctx, conn, addr, true, true)
 }
 
-func (c *Client) test3(conn net.PacketConn, addr net.Addr) (*response, error) {
-	return c.sendBindingReq(conn, addr, false, true)
+func (c *Client) test3(ctx context.Context, conn net.PacketConn, addr net.Addr) (*response, error) {
+	return c.sendBindingReq(ctx, conn, addr, false, true)
 }
@@ -0,0 +1,87 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// SetTrace sets the client to be in the trace mode, which prints every
+// attribute of the messages sent and received, in addition to the verbose
+// mode output. Every line of a transaction carries its transaction ID, the
+// test of the discovery and the server address as fields, so interleaved
+// transactions can be told apart.
+func (c *Client) SetTrace(v bool) {
+	c.logger.SetTrace(v)
+}
+
+type phaseKey struct{}
+
+// withPhase returns a context for the transactions of the test.
+func withPhase(ctx context.Context, t Tests) context.Context {
+	return context.WithValue(ctx, phaseKey{}, t)
+}
+
+// phaseOf returns the test of the context, 0 if there is none.
+func phaseOf(ctx context.Context) Tests {
+	t, _ := ctx.Value(phaseKey{}).(Tests)
+	return t
+}
+
+// txFields returns the fields of the log lines of a transaction.
+func txFields(phase Tests, transID []byte, addr net.Addr, extra ...Field) []Field {
+	fields := make([]Field, 0, 3+len(extra))
+	if len(transID) == 16 {
+		fields = append(fields, Field{"tx", hex.EncodeToString(transID[4:])})
+	}
+	if phase != 0 {
+		fields = append(fields, Field{"phase", phase})
+	}
+	if addr != nil {
+		fields = append(fields, Field{"server", addr})
+	}
+	return append(fields, extra...)
+}
+
+// fields returns the fields of the log lines of the request.
+func (r *request) fields(extra ...Field) []Field {
+	return txFields(r.phase, r.pkt.transID, r.addr, extra...)
+}
+
+// traceMessage logs the type and the attributes of the message in the trace
+// mode.
+func (c *Client) traceMessage(msg string, b []byte, fields []Field) {
+	if !c.logger.trace {
+		return
+	}
+	pkt, err := parsePacket(b)
+	if err != nil {
+		return
+	}
+	c.logger.TraceFields(msg, append(fields[:len(fields):len(fields)], Field{"type", messageTypeString(pkt.types)}, Field{"length", len(b)})...)
+	for i := range pkt.attributes {
+		a := &pkt.attributes[i]
+		attr := append(fields[:len(fields):len(fields)], Field{"attribute", attributeString(a.types)}, Field{"length", a.length})
+		if v := strings.TrimPrefix(attributeValue(a, pkt.transID), ": "); v != "" {
+			attr = append(attr, Field{"value", v})
+		}
+		c.logger.TraceFields(msg, attr...)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFormatFields(t *testing.T) {
+	got := formatFields("Send request", []Field{{"tx", "00ff"}, {"phase", TestI}, {"error", ""}})
+	expected := `Send request tx=00ff phase="Test I" error=""`
+	if got != expected {
+		t.Errorf("formatFields error: expected %s, get %s", expected, got)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(addr.String())
+	c.SetLocalAddr("127.0.0.1:0")
+	c.SetVerbose(true)
+	c.SetTrace(true)
+	var buf bytes.Buffer
+	c.logger.SetOutput(&buf)
+	var transID []byte
+	c.OnEvent(func(e Event) {
+		// The first request is the one of test1.
+		if e.Type == EventRequestSent && transID == nil {
+			transID = e.TransactionID
+		}
+	})
+	if _, err := c.DiscoverResult(); err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	tx := "tx=" + hex.EncodeToString(transID[4:])
+	var sent, received, attribute bool
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.Contains(line, tx) {
+			continue
+		}
+		if !strings.Contains(line, `phase="Test I"`) || !strings.Contains(line, "server="+addr.String()) {
+			t.Errorf("log error: missing fields in %q", line)
+		}
+		sent = sent || strings.Contains(line, "Send request")
+		received = received || strings.Contains(line, "Receive response")
+		attribute = attribute || strings.Contains(line, "attribute=XOR-MAPPED-ADDRESS")
+	}
+	if !sent || !received || !attribute {
+		t.Errorf("log error: sent %v, received %v, attribute %v in\n%s", sent, received, attribute, buf.String())
+	}
+}
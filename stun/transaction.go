@@ -0,0 +1,284 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"time"
+)
+
+// TransactionConfig is the retransmission schedule of the transactions over
+// unreliable transports (RFC 5389 Section 7.2.1). A request is sent at most
+// Rc times, the timeout starts at RTO and doubles after each transmission up
+// to MaxRTO, and the transaction times out Rm times RTO after the last one.
+// Over reliable transports, the request is sent once and the transaction
+// times out after as long as the whole schedule.
+type TransactionConfig struct {
+	RTO    time.Duration // initial retransmission timeout
+	MaxRTO time.Duration // cap of the retransmission timeout, 0 for none
+	Rc     int           // number of transmissions
+	Rm     int           // final timeout in multiples of RTO
+}
+
+// DefaultTransactionConfig is the schedule of RFC 3489: 9 requests starting
+// with an interval of 100ms, doubling until it reaches 1.6s, which is 9.5
+// seconds in total.
+var DefaultTransactionConfig = TransactionConfig{
+	RTO:    defaultTimeout * time.Millisecond,
+	MaxRTO: maxTimeout * time.Millisecond,
+	Rc:     numRetransmit,
+	Rm:     16,
+}
+
+// RFC5389TransactionConfig is the default schedule of RFC 5389: 7 requests
+// starting with an interval of 500ms, doubling without a cap, and a final
+// wait of 8s, which is 39.5 seconds in total.
+var RFC5389TransactionConfig = TransactionConfig{
+	RTO: 500 * time.Millisecond,
+	Rc:  7,
+	Rm:  16,
+}
+
+// withDefaults returns DefaultTransactionConfig for the zero config, or the
+// config with the zero values but MaxRTO replaced by the ones of it.
+func (cfg TransactionConfig) withDefaults() TransactionConfig {
+	if cfg == (TransactionConfig{}) {
+		return DefaultTransactionConfig
+	}
+	if cfg.RTO <= 0 {
+		cfg.RTO = DefaultTransactionConfig.RTO
+	}
+	if cfg.Rc <= 0 {
+		cfg.Rc = DefaultTransactionConfig.Rc
+	}
+	if cfg.Rm <= 0 {
+		cfg.Rm = DefaultTransactionConfig.Rm
+	}
+	return cfg
+}
+
+// timeout returns the timeout after the nth transmission, starting from 1.
+func (cfg TransactionConfig) timeout(n int) time.Duration {
+	if n >= cfg.Rc {
+		return time.Duration(cfg.Rm) * cfg.RTO
+	}
+	rto := cfg.RTO
+	for i := 1; i < n && (cfg.MaxRTO <= 0 || rto < cfg.MaxRTO); i++ {
+		rto *= 2
+	}
+	if cfg.MaxRTO > 0 && rto > cfg.MaxRTO {
+		rto = cfg.MaxRTO
+	}
+	return rto
+}
+
+// Total returns the time a transaction lasts at most, which is Ti of RFC
+// 5389 for reliable transports.
+func (cfg TransactionConfig) Total() time.Duration {
+	cfg = cfg.withDefaults()
+	var total time.Duration
+	for n := 1; n <= cfg.Rc; n++ {
+		total += cfg.timeout(n)
+	}
+	return total
+}
+
+// SetTransactionConfig sets the retransmission schedule of the requests. The
+// zero config is DefaultTransactionConfig, and other zero fields but MaxRTO
+// take the ones of it. SetTestTimeout still ends each test early.
+func (c *Client) SetTransactionConfig(cfg TransactionConfig) {
+	c.txConfig = cfg
+}
+
+// TransactionState is the state of a transaction.
+type TransactionState int
+
+// Transaction states. Every state but TransactionWaiting is terminal.
+const (
+	TransactionWaiting   TransactionState = iota // waiting for the response
+	TransactionSucceeded                         // response received
+	TransactionTimedOut                          // no response after all transmissions
+	TransactionFailed                            // the transport failed
+	TransactionCanceled                          // the context is done
+)
+
+var transactionStateStr = map[TransactionState]string{
+	TransactionWaiting:   "Waiting",
+	TransactionSucceeded: "Succeeded",
+	TransactionTimedOut:  "TimedOut",
+	TransactionFailed:    "Failed",
+	TransactionCanceled:  "Canceled",
+}
+
+func (s TransactionState) String() string {
+	if str, ok := transactionStateStr[s]; ok {
+		return str
+	}
+	return "Unknown"
+}
+
+// Transaction is the state machine of a client transaction (RFC 5389
+// Section 7.2). It does no I/O, so it can drive transactions over any
+// transport: the owner sends the request when the transaction starts and
+// whenever Timeout asks for a retransmission, and calls Timeout at the
+// Deadline. Many transactions can be pending on a connection at once, their
+// responses told apart by the transaction ID.
+type Transaction struct {
+	id       []byte
+	cfg      TransactionConfig
+	reliable bool
+	state    TransactionState
+	requests int
+	start    time.Time
+	sent     time.Time // time of the last transmission
+	deadline time.Time
+	end      time.Time
+	err      error
+}
+
+// NewTransaction returns a transaction whose first request is sent at now,
+// retransmitted by cfg unless the transport is reliable.
+func NewTransaction(id []byte, cfg TransactionConfig, reliable bool, now time.Time) *Transaction {
+	t := &Transaction{
+		id:       append([]byte(nil), id...),
+		cfg:      cfg.withDefaults(),
+		reliable: reliable,
+		requests: 1,
+		start:    now,
+		sent:     now,
+	}
+	if reliable {
+		t.deadline = now.Add(t.cfg.Total())
+	} else {
+		t.deadline = now.Add(t.cfg.timeout(1))
+	}
+	return t
+}
+
+// ID returns the transaction ID, the magic cookie followed by the 12 bytes
+// transaction id.
+func (t *Transaction) ID() []byte {
+	return t.id
+}
+
+// State returns the state of the transaction.
+func (t *Transaction) State() TransactionState {
+	return t.state
+}
+
+// Requests returns the number of transmissions of the request so far.
+func (t *Transaction) Requests() int {
+	return t.requests
+}
+
+// Deadline returns the time Timeout is due, which is zero once the
+// transaction is terminated.
+func (t *Transaction) Deadline() time.Time {
+	if t.state != TransactionWaiting {
+		return time.Time{}
+	}
+	return t.deadline
+}
+
+// Duration returns the time from the first request to the termination of
+// the transaction, the round-trip time of the last transmission included if
+// it succeeded, or zero while it is waiting.
+func (t *Transaction) Duration() time.Duration {
+	if t.state == TransactionWaiting {
+		return 0
+	}
+	return t.end.Sub(t.start)
+}
+
+// RTT returns the round-trip time of a transaction which succeeded without
+// retransmission, and zero otherwise, as the response to a retransmitted
+// request may answer any of its transmissions (Karn's algorithm).
+func (t *Transaction) RTT() time.Duration {
+	if t.state != TransactionSucceeded || t.requests != 1 {
+		return 0
+	}
+	return t.end.Sub(t.sent)
+}
+
+// Err returns the error of a failed or canceled transaction.
+func (t *Transaction) Err() error {
+	return t.err
+}
+
+// Timeout advances the waiting transaction at now, which should not be
+// before the Deadline. It returns true if the request is to be sent again,
+// otherwise the transaction is timed out after the last transmission.
+func (t *Transaction) Timeout(now time.Time) bool {
+	if t.state != TransactionWaiting || now.Before(t.deadline) {
+		return false
+	}
+	if t.reliable || t.requests >= t.cfg.Rc {
+		t.terminate(TransactionTimedOut, now, nil)
+		return false
+	}
+	t.requests++
+	t.sent = now
+	t.deadline = now.Add(t.cfg.timeout(t.requests))
+	return true
+}
+
+// Succeed terminates the waiting transaction with its response received at
+// now.
+func (t *Transaction) Succeed(now time.Time) {
+	t.terminate(TransactionSucceeded, now, nil)
+}
+
+// Fail terminates the waiting transaction with an error of the transport.
+func (t *Transaction) Fail(now time.Time, err error) {
+	t.terminate(TransactionFailed, now, err)
+}
+
+// Cancel terminates the waiting transaction with the error of its context.
+// A nil error times the transaction out instead, e.g. when a time limit
+// shorter than the schedule expires.
+func (t *Transaction) Cancel(now time.Time, err error) {
+	if err == nil {
+		t.terminate(TransactionTimedOut, now, nil)
+		return
+	}
+	t.terminate(TransactionCanceled, now, err)
+}
+
+func (t *Transaction) terminate(s TransactionState, now time.Time, err error) {
+	if t.state != TransactionWaiting {
+		return
+	}
+	t.state = s
+	t.end = now
+	t.err = err
+}
+
+// OnTransaction allows user to set a callback which is called synchronously
+// with every transaction of the client once it is terminated, e.g. to
+// collect the numbers of transmissions and the durations. Like OnEvent,
+// calls are never concurrent. A nil callback disables it.
+func (c *Client) OnTransaction(f func(*Transaction)) {
+	c.onTx = f
+}
+
+func (c *Client) emitTransaction(t *Transaction) {
+	if c.onTx == nil {
+		return
+	}
+	c.eventMu.Lock()
+	defer c.eventMu.Unlock()
+	c.onTx(t)
+}
@@ -0,0 +1,139 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransactionConfigTotal(t *testing.T) {
+	if d := DefaultTransactionConfig.Total(); d != 9500*time.Millisecond {
+		t.Errorf("default total error: %v", d)
+	}
+	if d := RFC5389TransactionConfig.Total(); d != 39500*time.Millisecond {
+		t.Errorf("RFC 5389 total error: %v", d)
+	}
+	if d := (TransactionConfig{}).Total(); d != DefaultTransactionConfig.Total() {
+		t.Errorf("zero config total error: %v", d)
+	}
+}
+
+func TestTransactionSchedule(t *testing.T) {
+	start := time.Now()
+	tx := NewTransaction(make([]byte, 16), RFC5389TransactionConfig, false, start)
+	now := start
+	var waits []time.Duration
+	for tx.State() == TransactionWaiting {
+		d := tx.Deadline()
+		waits = append(waits, d.Sub(now))
+		if tx.Timeout(d.Add(-time.Nanosecond)) || tx.State() != TransactionWaiting {
+			t.Fatalf("early timeout at request %d", tx.Requests())
+		}
+		now = d
+		tx.Timeout(now)
+	}
+	want := []time.Duration{500, 1000, 2000, 4000, 8000, 16000, 8000}
+	if len(waits) != len(want) || tx.Requests() != 7 {
+		t.Fatalf("schedule error: %v with %d requests", waits, tx.Requests())
+	}
+	for i := range want {
+		if waits[i] != want[i]*time.Millisecond {
+			t.Errorf("schedule error: %v", waits)
+		}
+	}
+	if tx.State() != TransactionTimedOut || tx.Duration() != 39500*time.Millisecond {
+		t.Errorf("terminal error: %v after %v", tx.State(), tx.Duration())
+	}
+	if !tx.Deadline().IsZero() || tx.Timeout(now.Add(time.Hour)) {
+		t.Errorf("terminated transaction advanced")
+	}
+}
+
+func TestTransactionTerminal(t *testing.T) {
+	start := time.Now()
+	tx := NewTransaction(make([]byte, 16), DefaultTransactionConfig, true, start)
+	if d := tx.Deadline().Sub(start); d != DefaultTransactionConfig.Total() {
+		t.Errorf("reliable deadline error: %v", d)
+	}
+	tx.Succeed(start.Add(time.Second))
+	tx.Fail(start.Add(2*time.Second), errors.New("late"))
+	if tx.State() != TransactionSucceeded || tx.Duration() != time.Second || tx.Err() != nil {
+		t.Errorf("succeeded error: %v %v %v", tx.State(), tx.Duration(), tx.Err())
+	}
+	tx = NewTransaction(make([]byte, 16), DefaultTransactionConfig, true, start)
+	if tx.Timeout(tx.Deadline()) || tx.State() != TransactionTimedOut || tx.Requests() != 1 {
+		t.Errorf("reliable timeout error: %v after %d requests", tx.State(), tx.Requests())
+	}
+	err := errors.New("canceled")
+	tx = NewTransaction(make([]byte, 16), DefaultTransactionConfig, false, start)
+	tx.Cancel(start, err)
+	if tx.State() != TransactionCanceled || tx.Err() != err {
+		t.Errorf("canceled error: %v %v", tx.State(), tx.Err())
+	}
+}
+
+func TestTransactConcurrent(t *testing.T) {
+	s1, addr1 := newTestServer(t)
+	defer s1.Close()
+	s2, addr2 := newTestServer(t)
+	defer s2.Close()
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer silent.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetTransactionConfig(TransactionConfig{RTO: 10 * time.Millisecond, Rc: 3, Rm: 2})
+	var txs []*Transaction
+	c.OnTransaction(func(tx *Transaction) {
+		txs = append(txs, tx)
+	})
+	var reqs []*request
+	for _, addr := range []net.Addr{silent.LocalAddr(), addr1, addr2} {
+		pkt, err := c.newBindingPacket(typeBindingRequest, false, false)
+		if err != nil {
+			t.Fatalf("newBindingPacket error: %v", err)
+		}
+		reqs = append(reqs, &request{pkt: pkt, addr: addr})
+	}
+	c.transact(context.Background(), conn, conn, reqs)
+	if r := reqs[0]; r.resp != nil || r.err != nil || r.tx.State() != TransactionTimedOut || r.tx.Requests() != 3 {
+		t.Errorf("silent server error: %v %v %v after %d requests", r.resp, r.err, r.tx.State(), r.tx.Requests())
+	}
+	for i, r := range reqs[1:] {
+		if r.err != nil || r.resp == nil || r.tx.State() != TransactionSucceeded {
+			t.Fatalf("server %d error: %v %v", i+1, r.err, r.tx.State())
+		}
+		if r.resp.serverAddr.String() != r.addr.String() || r.resp.mappedAddr.String() != conn.LocalAddr().String() {
+			t.Errorf("server %d response error: from %v mapped %v", i+1, r.resp.serverAddr, r.resp.mappedAddr)
+		}
+	}
+	// The responses arrive while the silent server is still retransmitted
+	// to.
+	if len(txs) != 3 || txs[2] != reqs[0].tx {
+		t.Errorf("transaction order error: %d transactions", len(txs))
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultTURNLifetime is the lifetime requested for allocations (RFC 5766
+// Section 2.2).
+const DefaultTURNLifetime = 10 * time.Minute
+
+var (
+	ErrNoAllocation = errors.New("no TURN allocation")
+	ErrNoMobility   = errors.New("TURN allocation without mobility")
+
+	ErrNoRelayedAddr = errors.New("no relayed address")
+)
+
+// TURNClient is a TURN (RFC 5766) client managing one allocation on a UDP,
+// TCP or TLS connection, authenticated with the long-term credential. Over
+// TCP and TLS, the allocation may relay TCP (RFC 6062).
+type TURNClient struct {
+	client   *Client
+	conn     net.PacketConn
+	server   *net.UDPAddr
+	username string
+	password string
+	realm    string
+	nonce    string
+	key      []byte
+	relayed  *Host
+	mapped   *Host
+	lifetime time.Duration
+	mobility bool
+	ticket   []byte
+	tcp      bool                     // whether the allocation relays TCP
+	dial     func() (net.Conn, error) // dials data connections of RFC 6062
+	ownConn  bool                     // whether Close closes conn
+}
+
+// NewTURNClient returns a TURN client which talks to the server on the given
+// connection.
+func NewTURNClient(conn net.PacketConn, server *net.UDPAddr, username, password string) *TURNClient {
+	return &TURNClient{
+		client:   NewClientWithConnection(conn),
+		conn:     conn,
+		server:   server,
+		username: username,
+		password: password,
+	}
+}
+
+// SetVerbose sets the client to be in the verbose mode.
+func (t *TURNClient) SetVerbose(v bool) {
+	t.client.SetVerbose(v)
+}
+
+// SetVVerbose sets the client to be in the double verbose mode.
+func (t *TURNClient) SetVVerbose(v bool) {
+	t.client.SetVVerbose(v)
+}
+
+// SetMobility sets whether Allocate requests mobility (RFC 8016), which lets
+// the allocation survive changes of the client address with Migrate.
+func (t *TURNClient) SetMobility(enable bool) {
+	t.mobility = enable
+}
+
+// Mobile reports whether the server granted mobility to the allocation.
+func (t *TURNClient) Mobile() bool {
+	return t.ticket != nil
+}
+
+// RelayedAddr returns the relayed transport address of the allocation.
+func (t *TURNClient) RelayedAddr() *Host {
+	return t.relayed
+}
+
+// MappedAddr returns the server reflexive address reported by the server
+// when the allocation was created.
+func (t *TURNClient) MappedAddr() *Host {
+	return t.mapped
+}
+
+// Lifetime returns the lifetime granted by the server in the last allocate
+// or refresh transaction.
+func (t *TURNClient) Lifetime() time.Duration {
+	return t.lifetime
+}
+
+// Allocate creates an allocation for UDP relaying and returns the relayed
+// transport address.
+func (t *TURNClient) Allocate() (*Host, error) {
+	resp, err := t.do(typeAllocate, func(pkt *packet) {
+		pkt.addAttribute(*newAttribute(attributeRequestedTransport, []byte{17, 0, 0, 0}))
+		pkt.addAttribute(*newLifetimeAttribute(DefaultTURNLifetime))
+		if t.mobility {
+			pkt.addAttribute(*newAttribute(attributeMobilityTicket, nil))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.ticket = getMobilityTicket(resp.packet)
+	return t.allocated(resp)
+}
+
+// allocated records the allocation of the response.
+func (t *TURNClient) allocated(resp *response) (*Host, error) {
+	relayed := resp.packet.getXorAddr(attributeXorRelayedAddress)
+	if relayed == nil {
+		return nil, &ProtocolError{Addr: t.server, Err: ErrNoRelayedAddr}
+	}
+	t.relayed = relayed
+	t.mapped = resp.mappedAddr
+	t.lifetime = getLifetime(resp.packet)
+	return relayed, nil
+}
+
+// Refresh refreshes the allocation with the requested lifetime. A lifetime
+// of 0 deletes the allocation.
+func (t *TURNClient) Refresh(lifetime time.Duration) error {
+	if t.relayed == nil {
+		return ErrNoAllocation
+	}
+	resp, err := t.do(typeRefresh, func(pkt *packet) {
+		pkt.addAttribute(*newLifetimeAttribute(lifetime))
+	})
+	if err != nil {
+		return err
+	}
+	t.lifetime = getLifetime(resp.packet)
+	return nil
+}
+
+// Migrate moves the allocation to a new connection, e.g. after a handover
+// from Wi-Fi to LTE changed the client address, by refreshing it with the
+// mobility ticket from the new address (RFC 8016 Section 3.3). The
+// permissions and channels of the allocation are kept. If it fails, the
+// client keeps using the old connection and the allocation has to be
+// recreated once the old address is gone. ErrNoMobility is returned once the
+// server forbids the mobility of the allocation.
+func (t *TURNClient) Migrate(conn net.PacketConn) error {
+	if t.relayed == nil {
+		return ErrNoAllocation
+	}
+	if t.ticket == nil {
+		return ErrNoMobility
+	}
+	old := t.conn
+	t.conn = conn
+	lifetime := t.lifetime
+	if lifetime == 0 {
+		lifetime = DefaultTURNLifetime
+	}
+	resp, err := t.do(typeRefresh, func(pkt *packet) {
+		pkt.addAttribute(*newLifetimeAttribute(lifetime))
+		pkt.addAttribute(*newAttribute(attributeMobilityTicket, t.ticket))
+	})
+	if err != nil {
+		t.conn = old
+		// The server withdrew the mobility of the allocation (RFC 8016
+		// Section 3.3), the ticket is of no use anymore.
+		var se *ServerError
+		if errors.As(err, &se) && se.Code() == errorMobilityForbidden {
+			t.ticket = nil
+			return ErrNoMobility
+		}
+		return err
+	}
+	// The ticket is only valid once, the server hands out a new one.
+	t.ticket = getMobilityTicket(resp.packet)
+	t.lifetime = getLifetime(resp.packet)
+	if resp.mappedAddr != nil {
+		t.mapped = resp.mappedAddr
+	}
+	return nil
+}
+
+// CreatePermission installs or refreshes the permission for the IP of the
+// peer, which lasts 5 minutes (RFC 5766 Section 8).
+func (t *TURNClient) CreatePermission(peer *net.UDPAddr) error {
+	if t.relayed == nil {
+		return ErrNoAllocation
+	}
+	_, err := t.do(typeCreatePermisiion, func(pkt *packet) {
+		pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, pkt.transID))
+	})
+	return err
+}
+
+// ChannelBind binds the channel number, which must be in the range
+// 0x4000-0x7ffe, to the peer, which lasts 10 minutes (RFC 5766 Section 11).
+func (t *TURNClient) ChannelBind(peer *net.UDPAddr, channel uint16) error {
+	if t.relayed == nil {
+		return ErrNoAllocation
+	}
+	if channel < 0x4000 || channel > 0x7ffe {
+		return fmt.Errorf("invalid channel number %#04x", channel)
+	}
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint16(value, channel)
+	_, err := t.do(typeChannelBinding, func(pkt *packet) {
+		pkt.addAttribute(*newAttribute(attributeChannelNumber, value))
+		pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, pkt.transID))
+	})
+	return err
+}
+
+// Close deletes the allocation, and closes the connection if the client is
+// from DialTURN.
+func (t *TURNClient) Close() error {
+	var err error
+	if t.relayed != nil {
+		err = t.Refresh(0)
+		t.relayed = nil
+		t.ticket = nil
+		t.tcp = false
+	}
+	if t.ownConn {
+		if e := t.conn.Close(); err == nil {
+			err = e
+		}
+		t.ownConn = false
+	}
+	return err
+}
+
+// do performs a transaction with the server, where build adds the attributes
+// of the request. If the server challenges the request or reports a stale
+// nonce, it is retried once with the new nonce.
+func (t *TURNClient) do(types uint16, build func(pkt *packet)) (*response, error) {
+	return t.doVia(t.conn, types, build)
+}
+
+// doVia performs the transaction of do on conn.
+func (t *TURNClient) doVia(conn net.PacketConn, types uint16, build func(pkt *packet)) (*response, error) {
+	for retry := 0; ; retry++ {
+		pkt, err := newPacket()
+		if err != nil {
+			return nil, err
+		}
+		pkt.types = types
+		build(pkt)
+		if t.key != nil {
+			pkt.addAttribute(*newUsernameAttribute(t.username))
+			pkt.addAttribute(*newAttribute(attributeRealm, []byte(t.realm)))
+			pkt.addAttribute(*newAttribute(attributeNonce, []byte(t.nonce)))
+			pkt.addAttribute(*newMessageIntegrityAttribute(pkt, t.key))
+		}
+		pkt.addFingerprint()
+		resp, err := t.client.send(context.Background(), pkt, conn, t.server)
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			return nil, &TimeoutError{Addr: t.server}
+		}
+		if !isErrorResponse(resp.packet.types) {
+			return resp, nil
+		}
+		var code ErrorCode
+		if resp.errorCode != nil {
+			code = *resp.errorCode
+		}
+		if retry == 0 && (code.Code() == errorUnauthorized || code.Code() == errorStaleNonce) {
+			if realm := resp.packet.getAttribute(attributeRealm); realm != nil {
+				t.realm = string(realm.value[:realm.length])
+			}
+			if nonce := resp.packet.getAttribute(attributeNonce); nonce != nil {
+				t.nonce = string(nonce.value[:nonce.length])
+			}
+			t.key = longTermKey(t.username, t.realm, t.password)
+			continue
+		}
+		return nil, &ServerError{ErrorCode: code, Addr: t.server}
+	}
+}
+
+// longTermKey returns the key of the long-term credential (RFC 5389 Section
+// 15.4).
+func longTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+func newLifetimeAttribute(lifetime time.Duration) *attribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	return newAttribute(attributeLifetime, value)
+}
+
+// getMobilityTicket returns the value of the MOBILITY-TICKET attribute, or
+// nil if it is not present.
+func getMobilityTicket(pkt *packet) []byte {
+	a := pkt.getAttribute(attributeMobilityTicket)
+	if a == nil || a.length == 0 {
+		return nil
+	}
+	return append([]byte(nil), a.value[:a.length]...)
+}
+
+func getLifetime(pkt *packet) time.Duration {
+	a := pkt.getAttribute(attributeLifetime)
+	if a == nil {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(a.value)) * time.Second
+}
+
+// isErrorResponse reports whether the message type is of the error response
+// class (RFC 5389 Section 6).
+func isErrorResponse(types uint16) bool {
+	return types&0x0110 == 0x0110
+}
@@ -0,0 +1,406 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default timers of TURNRefresher.
+const (
+	DefaultRefreshMargin = time.Minute
+	DefaultRefreshJitter = 10 * time.Second
+	DefaultRefreshRetry  = 5 * time.Second
+)
+
+// Lifetimes of permissions and channel bindings (RFC 5766 Sections 8 and
+// 11).
+const (
+	permissionLifetime = 5 * time.Minute
+	channelLifetime    = 10 * time.Minute
+)
+
+// RefreshKind is what a TURNRefresher refreshes.
+type RefreshKind int
+
+// Kinds of refreshes.
+const (
+	RefreshAllocation RefreshKind = iota
+	RefreshPermission
+	RefreshChannel
+)
+
+var refreshStr map[RefreshKind]string
+
+func init() {
+	refreshStr = map[RefreshKind]string{
+		RefreshAllocation: "Allocation",
+		RefreshPermission: "Permission",
+		RefreshChannel:    "Channel binding",
+	}
+}
+
+func (k RefreshKind) String() string {
+	if s, ok := refreshStr[k]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// TURNRefresher renews the allocation of a TURN client, and the permissions
+// and channel bindings added to it, ahead of their expiry: each is refreshed
+// the margin before it expires, minus a random delay of up to the jitter,
+// which keeps the refreshes of many clients from synchronizing. A failed
+// refresh is reported to the failure callback and retried after the retry
+// interval until it succeeds, is removed, or the refresher is stopped. An
+// allocation mismatch (437) tells the allocation is gone: it is reported,
+// the permissions and channel bindings are dropped and the refresher stops.
+//
+// Once started, the TURN client must only be used through the refresher
+// until it is stopped, as the client is not safe for concurrent use. Stop
+// must be called before Close of the TURN client.
+type TURNRefresher struct {
+	turn      *TURNClient
+	onFailure func(kind RefreshKind, peer *net.UDPAddr, err error)
+	margin    time.Duration
+	jitter    time.Duration
+	retry     time.Duration
+
+	// Lifetimes of the permissions and channel bindings.
+	permLifetime time.Duration
+	chanLifetime time.Duration
+
+	opMu sync.Mutex // serializes the transactions of the TURN client
+
+	mu       sync.Mutex
+	alloc    time.Time                // time of the next allocation refresh
+	perms    map[string]*refreshEntry // by the IP of the peer
+	channels map[uint16]*refreshEntry
+	wake     chan struct{}
+	stop     chan struct{} // closed to stop the loop
+	done     chan struct{} // closed by the loop once it returns
+}
+
+// refreshEntry is a permission or channel binding to refresh.
+type refreshEntry struct {
+	peer *net.UDPAddr
+	next time.Time
+}
+
+// NewTURNRefresher returns a refresher of the allocation of the TURN client.
+// onFailure, which may be nil, is called with the errors of the refreshes,
+// with the peer of the permission or channel binding, nil for the
+// allocation.
+func NewTURNRefresher(t *TURNClient, onFailure func(kind RefreshKind, peer *net.UDPAddr, err error)) *TURNRefresher {
+	return &TURNRefresher{
+		turn:         t,
+		onFailure:    onFailure,
+		margin:       DefaultRefreshMargin,
+		jitter:       DefaultRefreshJitter,
+		retry:        DefaultRefreshRetry,
+		permLifetime: permissionLifetime,
+		chanLifetime: channelLifetime,
+		perms:        make(map[string]*refreshEntry),
+		channels:     make(map[uint16]*refreshEntry),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// SetMargin sets how long before the expiry the refreshes are due. It must
+// be called before Start.
+func (r *TURNRefresher) SetMargin(d time.Duration) {
+	r.margin = d
+}
+
+// SetJitter sets the maximum random delay the refreshes are advanced by. It
+// must be called before Start.
+func (r *TURNRefresher) SetJitter(d time.Duration) {
+	r.jitter = d
+}
+
+// SetRetryInterval sets the interval between the retries of a failed
+// refresh. It must be called before Start.
+func (r *TURNRefresher) SetRetryInterval(d time.Duration) {
+	r.retry = d
+}
+
+// Start starts refreshing the allocation, which must be created.
+func (r *TURNRefresher) Start() error {
+	r.opMu.Lock()
+	relayed, lifetime := r.turn.RelayedAddr(), r.allocLifetime()
+	r.opMu.Unlock()
+	if relayed == nil {
+		return ErrNoAllocation
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return nil
+	}
+	r.alloc = r.due(time.Now(), lifetime)
+	r.stop, r.done = make(chan struct{}), make(chan struct{})
+	go r.run(r.stop, r.done)
+	return nil
+}
+
+// Stop stops refreshing, and waits for the refresh in flight, if any. The
+// allocation is not deleted, which is up to Close of the TURN client, to be
+// called once the refresher is stopped.
+func (r *TURNRefresher) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Migrate moves the allocation to the connection, see TURNClient.Migrate.
+func (r *TURNRefresher) Migrate(conn net.PacketConn) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	return r.turn.Migrate(conn)
+}
+
+// AddPermission creates the permission for the IP of the peer, and keeps it
+// refreshed.
+func (r *TURNRefresher) AddPermission(peer *net.UDPAddr) error {
+	r.opMu.Lock()
+	err := r.turn.CreatePermission(peer)
+	r.opMu.Unlock()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.perms[peer.IP.String()] = &refreshEntry{peer, r.due(time.Now(), r.permLifetime)}
+	r.mu.Unlock()
+	r.notify()
+	return nil
+}
+
+// RemovePermission stops refreshing the permission for the IP of the peer,
+// which then expires.
+func (r *TURNRefresher) RemovePermission(peer *net.UDPAddr) {
+	r.mu.Lock()
+	delete(r.perms, peer.IP.String())
+	r.mu.Unlock()
+}
+
+// AddChannel binds the channel to the peer, and keeps it refreshed.
+func (r *TURNRefresher) AddChannel(peer *net.UDPAddr, channel uint16) error {
+	r.opMu.Lock()
+	err := r.turn.ChannelBind(peer, channel)
+	r.opMu.Unlock()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.channels[channel] = &refreshEntry{peer, r.due(time.Now(), r.chanLifetime)}
+	r.mu.Unlock()
+	r.notify()
+	return nil
+}
+
+// RemoveChannel stops refreshing the channel binding, which then expires.
+func (r *TURNRefresher) RemoveChannel(channel uint16) {
+	r.mu.Lock()
+	delete(r.channels, channel)
+	r.mu.Unlock()
+}
+
+// notify wakes the loop up to reconsider the earliest refresh.
+func (r *TURNRefresher) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns the time of the refresh of something refreshed at now with
+// the lifetime. If the lifetime is shorter than the margin and the jitter,
+// the refresh is due halfway.
+func (r *TURNRefresher) due(now time.Time, lifetime time.Duration) time.Time {
+	ahead := r.margin
+	if r.jitter > 0 {
+		ahead += time.Duration(rand.Int63n(int64(r.jitter)))
+	}
+	if ahead >= lifetime {
+		ahead = lifetime / 2
+	}
+	return now.Add(lifetime - ahead)
+}
+
+// allocLifetime returns the lifetime of the allocation. It must be called
+// with opMu held, as the TURN client updates the lifetime.
+func (r *TURNRefresher) allocLifetime() time.Duration {
+	if l := r.turn.Lifetime(); l > 0 {
+		return l
+	}
+	return DefaultTURNLifetime
+}
+
+func (r *TURNRefresher) run(stop, done chan struct{}) {
+	defer close(done)
+	for {
+		r.mu.Lock()
+		next := r.alloc
+		for _, e := range r.perms {
+			if e.next.Before(next) {
+				next = e.next
+			}
+		}
+		for _, e := range r.channels {
+			if e.next.Before(next) {
+				next = e.next
+			}
+		}
+		r.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-r.wake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		if !r.refreshDue(time.Now(), stop) {
+			return
+		}
+	}
+}
+
+// refreshDue refreshes everything due at now, unless stop is closed
+// meanwhile. It returns false once the loop of stop is to return, as it is
+// stopped or the allocation is gone.
+func (r *TURNRefresher) refreshDue(now time.Time, stop chan struct{}) bool {
+	r.mu.Lock()
+	alloc := !now.Before(r.alloc)
+	var perms []*refreshEntry
+	for _, e := range r.perms {
+		if !now.Before(e.next) {
+			perms = append(perms, e)
+		}
+	}
+	channels := make(map[uint16]*refreshEntry)
+	for c, e := range r.channels {
+		if !now.Before(e.next) {
+			channels[c] = e
+		}
+	}
+	r.mu.Unlock()
+
+	if alloc {
+		r.opMu.Lock()
+		err := r.turn.Refresh(r.allocLifetime())
+		lifetime := r.allocLifetime()
+		r.opMu.Unlock()
+		r.mu.Lock()
+		r.alloc = r.next(now, lifetime, err)
+		r.mu.Unlock()
+		r.failed(RefreshAllocation, nil, err)
+		if r.mismatch(err, stop) {
+			return false
+		}
+	}
+	for _, e := range perms {
+		if stopped(stop) {
+			return false
+		}
+		r.opMu.Lock()
+		err := r.turn.CreatePermission(e.peer)
+		r.opMu.Unlock()
+		r.mu.Lock()
+		e.next = r.next(now, r.permLifetime, err)
+		r.mu.Unlock()
+		r.failed(RefreshPermission, e.peer, err)
+		if r.mismatch(err, stop) {
+			return false
+		}
+	}
+	for c, e := range channels {
+		if stopped(stop) {
+			return false
+		}
+		r.opMu.Lock()
+		err := r.turn.ChannelBind(e.peer, c)
+		r.opMu.Unlock()
+		r.mu.Lock()
+		e.next = r.next(now, r.chanLifetime, err)
+		r.mu.Unlock()
+		r.failed(RefreshChannel, e.peer, err)
+		if r.mismatch(err, stop) {
+			return false
+		}
+	}
+	return true
+}
+
+// mismatch reports whether the error is an allocation mismatch (RFC 5766
+// Section 7.2), in which case it drops the permissions and channel bindings
+// of the gone allocation and stops the loop of stop, unless it is already
+// stopped.
+func (r *TURNRefresher) mismatch(err error, stop chan struct{}) bool {
+	var se *ServerError
+	if !errors.As(err, &se) || se.Code() != errorAllocationMismatch {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.perms = make(map[string]*refreshEntry)
+	r.channels = make(map[uint16]*refreshEntry)
+	if r.stop == stop {
+		r.stop, r.done = nil, nil
+	}
+	return true
+}
+
+// stopped reports whether stop is closed.
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// next returns the time of the next refresh after the one at now, which is
+// retried after the retry interval if it failed.
+func (r *TURNRefresher) next(now time.Time, lifetime time.Duration, err error) time.Time {
+	if err != nil {
+		return now.Add(r.retry)
+	}
+	return r.due(now, lifetime)
+}
+
+func (r *TURNRefresher) failed(kind RefreshKind, peer *net.UDPAddr, err error) {
+	if err == nil {
+		return
+	}
+	r.turn.client.logger.Debugln(kind, "refresh error:", err)
+	if r.onFailure != nil {
+		r.onFailure(kind, peer, err)
+	}
+}
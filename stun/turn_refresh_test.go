@@ -0,0 +1,264 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTURN answers the TURN requests on the connection with success
+// responses, granting allocations of a second, unless fail returns true
+// for the method of the request.
+type fakeTURN struct {
+	mu     sync.Mutex
+	counts map[uint16]int // requests by method
+	fail   func(method uint16, count int) bool
+	code   int           // of the failures, 400 if zero
+	delay  time.Duration // before each response
+}
+
+func (f *fakeTURN) serve(conn *net.UDPConn) {
+	b := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(b[:n])
+		if err != nil {
+			continue
+		}
+		f.mu.Lock()
+		f.counts[req.types]++
+		failed := f.fail != nil && f.fail(req.types, f.counts[req.types])
+		delay := f.delay
+		f.mu.Unlock()
+		time.Sleep(delay)
+		resp := &packet{transID: req.transID, types: req.types | 0x0100}
+		if failed {
+			resp.types = req.types | 0x0110
+			if f.code != 0 {
+				resp.addAttribute(*newErrorCodeAttribute(f.code, "Error"))
+			} else {
+				resp.addAttribute(*newErrorCodeAttribute(errorBadRequest, "Bad Request"))
+			}
+		} else if req.types == typeAllocate || req.types == typeRefresh {
+			resp.addAttribute(*newXorAddrAttribute(attributeXorRelayedAddress, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, req.transID))
+			lifetime := make([]byte, 4)
+			binary.BigEndian.PutUint32(lifetime, 1)
+			resp.addAttribute(*newAttribute(attributeLifetime, lifetime))
+		}
+		resp.addFingerprint()
+		conn.WriteTo(resp.bytes(), addr)
+	}
+}
+
+func (f *fakeTURN) total() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.counts {
+		n += c
+	}
+	return n
+}
+
+func (f *fakeTURN) count(method uint16) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[method]
+}
+
+func TestTURNRefresher(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer sconn.Close()
+	// Channel bindings fail once refreshed.
+	f := &fakeTURN{counts: make(map[uint16]int), fail: func(method uint16, count int) bool {
+		return method == typeChannelBinding && count > 1
+	}}
+	go f.serve(sconn)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	turn := NewTURNClient(conn, sconn.LocalAddr().(*net.UDPAddr), "user", "secret")
+	r := NewTURNRefresher(turn, nil)
+	if err := r.Start(); err != ErrNoAllocation {
+		t.Errorf("Start error: expected %v, get %v", ErrNoAllocation, err)
+	}
+	if _, err := turn.Allocate(); err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	failures := make(chan RefreshKind, 10)
+	r = NewTURNRefresher(turn, func(kind RefreshKind, peer *net.UDPAddr, err error) {
+		select {
+		case failures <- kind:
+		default:
+		}
+	})
+	r.SetMargin(400 * time.Millisecond)
+	r.SetJitter(100 * time.Millisecond)
+	r.SetRetryInterval(100 * time.Millisecond)
+	r.permLifetime = 600 * time.Millisecond
+	r.chanLifetime = 600 * time.Millisecond
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer r.Stop()
+	peer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 4000}
+	if err := r.AddPermission(peer); err != nil {
+		t.Fatalf("AddPermission error: %v", err)
+	}
+	if err := r.AddChannel(peer, 0x4000); err != nil {
+		t.Fatalf("AddChannel error: %v", err)
+	}
+	select {
+	case kind := <-failures:
+		if kind != RefreshChannel {
+			t.Errorf("failure error: expected %v, get %v", RefreshChannel, kind)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("failure error: no failed refresh reported")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for f.count(typeRefresh) < 2 || f.count(typeCreatePermisiion) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("refresh error: %d allocation and %d permission refreshes", f.count(typeRefresh), f.count(typeCreatePermisiion)-1)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// The allocation has no mobility ticket.
+	if err := r.Migrate(conn); err != ErrNoMobility {
+		t.Errorf("Migrate error: expected %v, get %v", ErrNoMobility, err)
+	}
+	// A removed permission is no longer refreshed, once the refresh in
+	// flight, if any, is done.
+	r.RemovePermission(peer)
+	r.RemoveChannel(0x4000)
+	time.Sleep(100 * time.Millisecond)
+	n := f.count(typeCreatePermisiion)
+	time.Sleep(400 * time.Millisecond)
+	if got := f.count(typeCreatePermisiion); got != n {
+		t.Errorf("RemovePermission error: %d refreshes after removal", got-n)
+	}
+}
+
+func TestTURNRefresherMismatch(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer sconn.Close()
+	// The server lost the allocation.
+	f := &fakeTURN{counts: make(map[uint16]int), code: errorAllocationMismatch, fail: func(method uint16, count int) bool {
+		return method == typeRefresh
+	}}
+	go f.serve(sconn)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	turn := NewTURNClient(conn, sconn.LocalAddr().(*net.UDPAddr), "user", "secret")
+	if _, err := turn.Allocate(); err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	failures := make(chan RefreshKind, 10)
+	r := NewTURNRefresher(turn, func(kind RefreshKind, peer *net.UDPAddr, err error) {
+		failures <- kind
+	})
+	r.SetMargin(800 * time.Millisecond)
+	r.SetJitter(0)
+	r.SetRetryInterval(50 * time.Millisecond)
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer r.Stop()
+	if err := r.AddPermission(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 4000}); err != nil {
+		t.Fatalf("AddPermission error: %v", err)
+	}
+	select {
+	case kind := <-failures:
+		if kind != RefreshAllocation {
+			t.Errorf("failure error: expected %v, get %v", RefreshAllocation, kind)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("failure error: no failed refresh reported")
+	}
+	// The refresher stopped instead of retrying.
+	time.Sleep(200 * time.Millisecond)
+	if n := f.count(typeRefresh); n != 1 {
+		t.Errorf("refresh error: expected 1 refresh, get %d", n)
+	}
+	r.mu.Lock()
+	stopped, perms := r.stop == nil, len(r.perms)
+	r.mu.Unlock()
+	if !stopped || perms != 0 {
+		t.Errorf("mismatch error: stopped %v with %d permissions", stopped, perms)
+	}
+}
+
+func TestTURNRefresherStop(t *testing.T) {
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer sconn.Close()
+	f := &fakeTURN{counts: make(map[uint16]int)}
+	go f.serve(sconn)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	turn := NewTURNClient(conn, sconn.LocalAddr().(*net.UDPAddr), "user", "secret")
+	if _, err := turn.Allocate(); err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	r := NewTURNRefresher(turn, nil)
+	r.SetJitter(0)
+	r.permLifetime = 200 * time.Millisecond
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := r.AddPermission(&net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 4000}); err != nil {
+			t.Fatalf("AddPermission error: %v", err)
+		}
+	}
+	// The permissions are refreshed halfway, one after the other, while
+	// the responses are slow.
+	f.mu.Lock()
+	f.delay = 50 * time.Millisecond
+	f.mu.Unlock()
+	time.Sleep(130 * time.Millisecond)
+	r.Stop()
+	// No refresh is sent once Stop returns.
+	n := f.total()
+	time.Sleep(200 * time.Millisecond)
+	if got := f.total(); got != n {
+		t.Errorf("Stop error: %d requests after Stop", got-n)
+	}
+}
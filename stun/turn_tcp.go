@@ -0,0 +1,187 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Errors of TCP relaying (RFC 6062).
+var (
+	ErrNotStream      = errors.New("TCP relaying needs a TCP or TLS connection to the server")
+	ErrNotTCPRelay    = errors.New("TURN allocation does not relay TCP")
+	ErrNoDialer       = errors.New("no dialer for TURN data connections")
+	ErrNoConnectionID = errors.New("no connection id")
+)
+
+// DialTURN connects to the TURN server at address over the network, which is
+// "udp", "tcp" or "tls", and returns a client for it. config is used for
+// "tls" only, a nil one verifies the certificate against the host of the
+// address. Clients over TCP and TLS dial the data connections of RFC 6062 the
+// same way. Close closes the connection of the returned client.
+func DialTURN(network, address string, config *tls.Config, username, password string) (*TURNClient, error) {
+	if network == "udp" {
+		server, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		t := NewTURNClient(conn, server, username, password)
+		t.ownConn = true
+		return t, nil
+	}
+	var dial func() (net.Conn, error)
+	switch network {
+	case "tcp":
+		dial = func() (net.Conn, error) {
+			return net.Dial("tcp", address)
+		}
+	case "tls":
+		if config == nil {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			config = &tls.Config{ServerName: host}
+		}
+		dial = func() (net.Conn, error) {
+			return tls.Dial("tcp", address, config)
+		}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	t := NewTURNClientConn(conn, username, password)
+	t.dial, t.ownConn = dial, true
+	return t, nil
+}
+
+// NewTURNClientConn returns a TURN client which talks to the server on the
+// TCP or TLS connection. ConnectionBind is only available on clients from
+// DialTURN, which know how to dial the data connections.
+func NewTURNClientConn(conn net.Conn, username, password string) *TURNClient {
+	return NewTURNClient(newStreamConn(conn), streamAddr(conn.RemoteAddr()), username, password)
+}
+
+// streamAddr converts the remote address of a stream to the UDP address the
+// transactions report in errors.
+func streamAddr(addr net.Addr) *net.UDPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	if a, err := net.ResolveUDPAddr("udp", addr.String()); err == nil {
+		return a
+	}
+	return &net.UDPAddr{}
+}
+
+// AllocateTCP creates an allocation for TCP relaying (RFC 6062 Section 4.1)
+// and returns the relayed transport address. The client must talk to the
+// server over TCP or TLS.
+func (t *TURNClient) AllocateTCP() (*Host, error) {
+	if !isReliable(t.conn) {
+		return nil, ErrNotStream
+	}
+	resp, err := t.do(typeAllocate, func(pkt *packet) {
+		pkt.addAttribute(*newAttribute(attributeRequestedTransport, []byte{6, 0, 0, 0}))
+		pkt.addAttribute(*newLifetimeAttribute(DefaultTURNLifetime))
+	})
+	if err != nil {
+		return nil, err
+	}
+	relayed, err := t.allocated(resp)
+	if err != nil {
+		return nil, err
+	}
+	t.tcp = true
+	return relayed, nil
+}
+
+// Connect asks the server to open a TCP connection from the relayed address
+// to the peer (RFC 6062 Section 4.3), and returns the connection id to be
+// bound with ConnectionBind.
+func (t *TURNClient) Connect(peer *net.TCPAddr) (uint32, error) {
+	if t.relayed == nil {
+		return 0, ErrNoAllocation
+	}
+	if !t.tcp {
+		return 0, ErrNotTCPRelay
+	}
+	udpPeer := &net.UDPAddr{IP: peer.IP, Port: peer.Port, Zone: peer.Zone}
+	resp, err := t.do(typeConnect, func(pkt *packet) {
+		pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, udpPeer, pkt.transID))
+	})
+	if err != nil {
+		return 0, err
+	}
+	a := resp.packet.getAttribute(attributeConnectionID)
+	if a == nil {
+		return 0, &ProtocolError{Addr: t.server, Err: ErrNoConnectionID}
+	}
+	return binary.BigEndian.Uint32(a.value), nil
+}
+
+// ConnectionBind opens a data connection to the server and binds it to the
+// peer connection with the id (RFC 6062 Section 4.4). The returned
+// connection carries the data of the peer as is.
+func (t *TURNClient) ConnectionBind(id uint32) (net.Conn, error) {
+	if t.dial == nil {
+		return nil, ErrNoDialer
+	}
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	sc := newStreamConn(conn)
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, id)
+	_, err = t.doVia(sc, typeConnectionBind, func(pkt *packet) {
+		pkt.addAttribute(*newAttribute(attributeConnectionID, value))
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The deadline of the transaction must not end the reads of the
+	// application.
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The peer may have sent data right after the response.
+	return &prefixConn{conn, sc.pending}, nil
+}
+
+// DialTCP connects to the peer through the TCP allocation with Connect and
+// ConnectionBind.
+func (t *TURNClient) DialTCP(peer *net.TCPAddr) (net.Conn, error) {
+	id, err := t.Connect(peer)
+	if err != nil {
+		return nil, err
+	}
+	return t.ConnectionBind(id)
+}
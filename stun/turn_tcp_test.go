@@ -0,0 +1,166 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	sc := newStreamConn(b)
+	defer sc.Close()
+	msg := testMessage()
+	channelData := []byte{0x40, 0x00, 0x00, 0x03, 1, 2, 3, 0}
+	go func() {
+		// Split the frames across writes.
+		all := append(append([]byte(nil), msg...), channelData...)
+		a.Write(all[:3])
+		a.Write(all[3 : len(msg)+2])
+		a.Write(all[len(msg)+2:])
+	}()
+	buf := make([]byte, maxPacketSize)
+	n, _, err := sc.ReadFrom(buf)
+	if err != nil || n != len(msg) {
+		t.Fatalf("ReadFrom error: %d, %v", n, err)
+	}
+	n, _, err = sc.ReadFrom(buf)
+	if err != nil || n != len(channelData) {
+		t.Fatalf("ReadFrom error: %d, %v", n, err)
+	}
+	// A timeout keeps the stream in sync.
+	sc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	go a.Write(msg[:10])
+	if _, _, err = sc.ReadFrom(buf); err == nil {
+		t.Fatalf("ReadFrom error: expected timeout")
+	}
+	sc.SetReadDeadline(time.Time{})
+	go a.Write(msg[10:])
+	if n, _, err = sc.ReadFrom(buf); err != nil || n != len(msg) {
+		t.Errorf("ReadFrom after timeout error: %d, %v", n, err)
+	}
+}
+
+// serveTURNTCP answers the requests on the stream with handle, which returns
+// the response and the data to send after it.
+func serveTURNTCP(t *testing.T, conn net.Conn, handle func(req *packet) (*packet, []byte)) {
+	sc := newStreamConn(conn)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := sc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(buf[:n])
+		if err != nil {
+			t.Errorf("server error: %v", err)
+			return
+		}
+		resp, data := handle(req)
+		resp.addFingerprint()
+		conn.Write(append(resp.bytes(), data...))
+	}
+}
+
+func turnResponse(req *packet, types uint16) *packet {
+	resp, _ := newPacket()
+	resp.types = types
+	resp.transID = append([]byte(nil), req.transID...)
+	return resp
+}
+
+func TestTURNTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer ln.Close()
+	relayed := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	var allocations atomic.Int32
+	go func() {
+		// The control connection, then the data connection.
+		control, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer control.Close()
+		go serveTURNTCP(t, control, func(req *packet) (*packet, []byte) {
+			switch req.types {
+			case typeAllocate:
+				allocations.Add(1)
+				resp := turnResponse(req, typeAllocateResponse)
+				resp.addAttribute(*newXorAddrAttribute(attributeXorRelayedAddress, relayed, resp.transID))
+				return resp, nil
+			case typeConnect:
+				resp := turnResponse(req, typeConnectResponse)
+				value := make([]byte, 4)
+				binary.BigEndian.PutUint32(value, 42)
+				resp.addAttribute(*newAttribute(attributeConnectionID, value))
+				return resp, nil
+			}
+			return turnResponse(req, req.types|0x0110), nil
+		})
+		data, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer data.Close()
+		// More data after the deadline of the transaction.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			data.Write([]byte("world"))
+		}()
+		serveTURNTCP(t, data, func(req *packet) (*packet, []byte) {
+			a := req.getAttribute(attributeConnectionID)
+			if req.types != typeConnectionBind || a == nil || binary.BigEndian.Uint32(a.value) != 42 {
+				return turnResponse(req, typeConnectionBindErrorResponse), nil
+			}
+			return turnResponse(req, typeConnectionBindResponse), []byte("hello")
+		})
+	}()
+	tc, err := DialTURN("tcp", ln.Addr().String(), nil, "user", "pass")
+	if err != nil {
+		t.Fatalf("DialTURN error: %v", err)
+	}
+	defer tc.Close()
+	tc.client.SetTestTimeout(50 * time.Millisecond)
+	if _, err = tc.Connect(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80}); err != ErrNoAllocation {
+		t.Errorf("Connect error: expected %v, get %v", ErrNoAllocation, err)
+	}
+	host, err := tc.AllocateTCP()
+	if err != nil || host.TransportAddr() != relayed.String() {
+		t.Fatalf("AllocateTCP error: %v, %v", host, err)
+	}
+	conn, err := tc.DialTCP(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80})
+	if err != nil {
+		t.Fatalf("DialTCP error: %v", err)
+	}
+	defer conn.Close()
+	b := make([]byte, 10)
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "helloworld" {
+		t.Errorf("data connection error: %q, %v", b, err)
+	}
+	if n := allocations.Load(); n != 1 {
+		t.Errorf("AllocateTCP error: %d requests, expected no retransmission", n)
+	}
+}
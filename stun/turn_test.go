@@ -0,0 +1,266 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testTURNUsername = "user"
+	testTURNPassword = "pass"
+	testTURNRealm    = "example.org"
+)
+
+// authTURN answers the TURN requests on the connection as a server using the
+// long-term credential: requests are challenged with a 401 until they carry
+// a valid MESSAGE-INTEGRITY, and with a 438 while their NONCE is not the
+// current one.
+type authTURN struct {
+	mu         sync.Mutex
+	nonce      string
+	relayed    *net.UDPAddr
+	challenged int // 401 responses sent
+	stale      int // 438 responses sent
+	tickets    int // mobility tickets handed out
+	forbidden  bool
+}
+
+func newAuthTURN(t *testing.T) (*authTURN, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	f := &authTURN{nonce: "nonce1", relayed: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}}
+	go f.serve(conn)
+	return f, conn
+}
+
+func (f *authTURN) setNonce(nonce string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nonce = nonce
+}
+
+func (f *authTURN) forbidMobility() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forbidden = true
+}
+
+func (f *authTURN) counts() (challenged, stale int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.challenged, f.stale
+}
+
+func (f *authTURN) serve(conn *net.UDPConn) {
+	b := make([]byte, 1500)
+	key := longTermKey(testTURNUsername, testTURNRealm, testTURNPassword)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		req, err := newPacketFromBytes(b[:n])
+		if err != nil {
+			continue
+		}
+		f.mu.Lock()
+		nonce := req.getAttribute(attributeNonce)
+		var resp *packet
+		switch {
+		case !verifyMessageIntegrity(b[:n], key):
+			f.challenged++
+			resp = f.errorResponse(req, errorUnauthorized, "Unauthorized")
+		case nonce == nil || string(nonce.value[:nonce.length]) != f.nonce:
+			f.stale++
+			resp = f.errorResponse(req, errorStaleNonce, "Stale Nonce")
+		case req.getAttribute(attributeMobilityTicket) != nil && f.forbidden:
+			resp = f.errorResponse(req, errorMobilityForbidden, "Mobility Forbidden")
+		default:
+			resp = turnResponse(req, req.types|0x0100)
+			lifetime := uint32(600)
+			if req.types == typeAllocate {
+				resp.addAttribute(*newXorAddrAttribute(attributeXorRelayedAddress, f.relayed, resp.transID))
+				resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, resp.transID))
+			} else if a := req.getAttribute(attributeLifetime); a != nil {
+				lifetime = binary.BigEndian.Uint32(a.value)
+			}
+			if req.getAttribute(attributeMobilityTicket) != nil {
+				f.tickets++
+				resp.addAttribute(*newAttribute(attributeMobilityTicket, []byte{byte(f.tickets)}))
+				if req.types == typeRefresh {
+					resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, resp.transID))
+				}
+			}
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, lifetime)
+			resp.addAttribute(*newAttribute(attributeLifetime, value))
+		}
+		f.mu.Unlock()
+		resp.addFingerprint()
+		conn.WriteTo(resp.bytes(), addr)
+	}
+}
+
+func (f *authTURN) errorResponse(req *packet, code int, reason string) *packet {
+	resp := turnResponse(req, req.types|0x0110)
+	resp.addAttribute(*newErrorCodeAttribute(code, reason))
+	resp.addAttribute(*newAttribute(attributeRealm, []byte(testTURNRealm)))
+	resp.addAttribute(*newAttribute(attributeNonce, []byte(f.nonce)))
+	return resp
+}
+
+func newTestTURNClient(t *testing.T, server net.PacketConn, password string) *TURNClient {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	return NewTURNClient(conn, server.LocalAddr().(*net.UDPAddr), testTURNUsername, password)
+}
+
+func TestTURNAllocate(t *testing.T) {
+	f, sconn := newAuthTURN(t)
+	defer sconn.Close()
+	tc := newTestTURNClient(t, sconn, testTURNPassword)
+	defer tc.conn.Close()
+	if err := tc.Refresh(time.Minute); err != ErrNoAllocation {
+		t.Errorf("Refresh error: expected %v, get %v", ErrNoAllocation, err)
+	}
+	relayed, err := tc.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	if relayed.TransportAddr() != f.relayed.String() || tc.RelayedAddr() != relayed {
+		t.Errorf("Allocate error: expected %v, get %v", f.relayed, relayed)
+	}
+	local := tc.conn.LocalAddr().String()
+	if tc.MappedAddr() == nil || tc.MappedAddr().TransportAddr() != local {
+		t.Errorf("MappedAddr error: expected %v, get %v", local, tc.MappedAddr())
+	}
+	if tc.Lifetime() != 10*time.Minute {
+		t.Errorf("Lifetime error: expected %v, get %v", 10*time.Minute, tc.Lifetime())
+	}
+	// The first request is challenged, the retry is authenticated.
+	if challenged, stale := f.counts(); challenged != 1 || stale != 0 {
+		t.Errorf("Allocate error: %d challenges and %d stale nonces", challenged, stale)
+	}
+	if err = tc.Refresh(5 * time.Minute); err != nil {
+		t.Fatalf("Refresh error: %v", err)
+	}
+	if tc.Lifetime() != 5*time.Minute {
+		t.Errorf("Lifetime error: expected %v, get %v", 5*time.Minute, tc.Lifetime())
+	}
+	if challenged, _ := f.counts(); challenged != 1 {
+		t.Errorf("Refresh error: the known credential was challenged")
+	}
+}
+
+func TestTURNStaleNonce(t *testing.T) {
+	f, sconn := newAuthTURN(t)
+	defer sconn.Close()
+	tc := newTestTURNClient(t, sconn, testTURNPassword)
+	defer tc.conn.Close()
+	if _, err := tc.Allocate(); err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	// The request with the expired nonce is retried with the new one.
+	f.setNonce("nonce2")
+	if err := tc.Refresh(time.Minute); err != nil {
+		t.Fatalf("Refresh error: %v", err)
+	}
+	if _, stale := f.counts(); stale != 1 {
+		t.Errorf("Refresh error: expected 1 stale nonce, get %d", stale)
+	}
+	if tc.nonce != "nonce2" {
+		t.Errorf("nonce error: expected nonce2, get %s", tc.nonce)
+	}
+}
+
+func TestTURNUnauthorized(t *testing.T) {
+	f, sconn := newAuthTURN(t)
+	defer sconn.Close()
+	tc := newTestTURNClient(t, sconn, "wrong")
+	defer tc.conn.Close()
+	_, err := tc.Allocate()
+	var se *ServerError
+	if !errors.As(err, &se) || se.Code() != errorUnauthorized {
+		t.Fatalf("Allocate error: expected a 401 ServerError, get %v", err)
+	}
+	// A wrong password is retried only once.
+	if challenged, _ := f.counts(); challenged != 2 {
+		t.Errorf("Allocate error: expected 2 challenges, get %d", challenged)
+	}
+	if tc.RelayedAddr() != nil {
+		t.Errorf("RelayedAddr error: expected nil, get %v", tc.RelayedAddr())
+	}
+}
+
+func TestTURNMigrate(t *testing.T) {
+	f, sconn := newAuthTURN(t)
+	defer sconn.Close()
+	tc := newTestTURNClient(t, sconn, testTURNPassword)
+	defer tc.conn.Close()
+	tc.SetMobility(true)
+	if _, err := tc.Allocate(); err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	if !tc.Mobile() {
+		t.Fatalf("Mobile error: expected the mobility granted")
+	}
+	old := tc.conn
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer conn.Close()
+	if err = tc.Migrate(conn); err != nil {
+		t.Fatalf("Migrate error: %v", err)
+	}
+	if tc.conn != conn || tc.MappedAddr().TransportAddr() != conn.LocalAddr().String() || string(tc.ticket) != "\x02" {
+		t.Errorf("Migrate error: conn %v, mapped %v, ticket %x", tc.conn.LocalAddr(), tc.MappedAddr(), tc.ticket)
+	}
+	// A failed migration keeps the current connection.
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	closed.Close()
+	if err = tc.Migrate(closed); err == nil {
+		t.Fatalf("Migrate error: expected an error on a closed connection")
+	}
+	if tc.conn != conn || !tc.Mobile() {
+		t.Errorf("Migrate error: the failed migration was not rolled back")
+	}
+	// Once the server forbids the mobility, the ticket is dropped.
+	f.forbidMobility()
+	if err = tc.Migrate(old); err != ErrNoMobility {
+		t.Errorf("Migrate error: expected %v, get %v", ErrNoMobility, err)
+	}
+	if tc.conn != conn || tc.Mobile() {
+		t.Errorf("Migrate error: conn %v, mobile %v", tc.conn.LocalAddr(), tc.Mobile())
+	}
+	if err = tc.Migrate(old); err != ErrNoMobility {
+		t.Errorf("Migrate error: expected %v, get %v", ErrNoMobility, err)
+	}
+}
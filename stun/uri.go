@@ -0,0 +1,148 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the default port of STUN and TURN over UDP and TCP.
+const DefaultPort = 3478
+
+// ErrInvalidURI is returned by ParseURI for malformed URIs.
+var ErrInvalidURI = errors.New("invalid STUN URI")
+
+// URI is a STUN URI (RFC 7064) or TURN URI (RFC 7065), e.g.
+// "stun:stun.example.org:3478" or "turns:turn.example.org?transport=tcp".
+type URI struct {
+	Scheme    string // "stun", "stuns", "turn" or "turns"
+	Host      string // host name or IP address, without brackets
+	Port      int    // port, the default port of the scheme if absent
+	Transport string // "udp" or "tcp" of TURN URIs, empty if absent
+}
+
+// ParseURI parses a STUN or TURN URI. The scheme and transport are case
+// insensitive and returned in lower case.
+func ParseURI(s string) (*URI, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, ErrInvalidURI
+	}
+	u := &URI{Scheme: strings.ToLower(s[:i])}
+	rest := s[i+1:]
+	switch u.Scheme {
+	case "stun", "turn":
+		u.Port = DefaultPort
+	case "stuns", "turns":
+		u.Port = DefaultTLSPort
+	default:
+		return nil, ErrInvalidURI
+	}
+	// Only TURN URIs have the transport parameter.
+	if j := strings.IndexByte(rest, '?'); j >= 0 {
+		if u.Scheme != "turn" && u.Scheme != "turns" {
+			return nil, ErrInvalidURI
+		}
+		query := rest[j+1:]
+		rest = rest[:j]
+		if !strings.HasPrefix(strings.ToLower(query), "transport=") {
+			return nil, ErrInvalidURI
+		}
+		u.Transport = strings.ToLower(query[len("transport="):])
+		if u.Transport != "udp" && u.Transport != "tcp" {
+			return nil, ErrInvalidURI
+		}
+	}
+	host, port := rest, ""
+	if strings.HasPrefix(rest, "[") {
+		// IPv6 address.
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			return nil, ErrInvalidURI
+		}
+		host = rest[1:end]
+		if net.ParseIP(host) == nil {
+			return nil, ErrInvalidURI
+		}
+		rest = rest[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return nil, ErrInvalidURI
+			}
+			port = rest[1:]
+		}
+	} else {
+		if j := strings.LastIndexByte(rest, ':'); j >= 0 {
+			host, port = rest[:j], rest[j+1:]
+		}
+		if host == "" || strings.ContainsAny(host, "/@:") {
+			return nil, ErrInvalidURI
+		}
+	}
+	u.Host = host
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, ErrInvalidURI
+		}
+		u.Port = p
+	}
+	return u, nil
+}
+
+// Secure reports whether the scheme is stuns or turns, which use TLS or
+// DTLS.
+func (u *URI) Secure() bool {
+	return u.Scheme == "stuns" || u.Scheme == "turns"
+}
+
+// Addr returns the transport address of the URI, e.g. "[::1]:3478".
+func (u *URI) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+func (u *URI) String() string {
+	s := u.Scheme + ":" + u.Addr()
+	if u.Transport != "" {
+		s += "?transport=" + u.Transport
+	}
+	return s
+}
+
+// isURI reports whether the address is a STUN or TURN URI rather than a
+// transport address.
+func isURI(address string) bool {
+	i := strings.IndexByte(address, ':')
+	if i < 0 {
+		return false
+	}
+	// A host named like a scheme with a port, e.g. "stun:3478", is a
+	// transport address.
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		if _, err = strconv.ParseUint(port, 10, 16); err == nil {
+			return false
+		}
+	}
+	switch strings.ToLower(address[:i]) {
+	case "stun", "stuns", "turn", "turns":
+		return true
+	}
+	return false
+}
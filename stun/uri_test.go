@@ -0,0 +1,93 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		uri      string
+		expected URI
+	}{
+		{"stun:stun.example.org", URI{"stun", "stun.example.org", 3478, ""}},
+		{"STUN:stun.example.org:1234", URI{"stun", "stun.example.org", 1234, ""}},
+		{"stuns:stun.example.org", URI{"stuns", "stun.example.org", 5349, ""}},
+		{"stun:[2001:db8::1]:3479", URI{"stun", "2001:db8::1", 3479, ""}},
+		{"stun:[2001:db8::1]", URI{"stun", "2001:db8::1", 3478, ""}},
+		{"turn:192.0.2.1?transport=TCP", URI{"turn", "192.0.2.1", 3478, "tcp"}},
+		{"turns:turn.example.org:443?transport=udp", URI{"turns", "turn.example.org", 443, "udp"}},
+	}
+	for _, test := range tests {
+		u, err := ParseURI(test.uri)
+		if err != nil || *u != test.expected {
+			t.Errorf("ParseURI(%q) error: %+v, %v", test.uri, u, err)
+		}
+	}
+	for _, uri := range []string{
+		"stun.example.org:3478",
+		"http://stun.example.org",
+		"stun:",
+		"stun://stun.example.org",
+		"stun:stun.example.org?transport=udp",
+		"turn:turn.example.org?transport=sctp",
+		"stun:stun.example.org:0",
+		"stun:2001:db8::1",
+		"stun:[2001:db8::1",
+		"stun:user@stun.example.org",
+	} {
+		if _, err := ParseURI(uri); err != ErrInvalidURI {
+			t.Errorf("ParseURI(%q) error: expected ErrInvalidURI, get %v", uri, err)
+		}
+	}
+}
+
+func TestSetServerAddrURI(t *testing.T) {
+	c := NewClient()
+	c.SetServerAddr("stun:[::1]")
+	if c.serverAddr != "[::1]:3478" {
+		t.Errorf("SetServerAddr error: %v", c.serverAddr)
+	}
+	// A host named stun is not mistaken for the scheme.
+	c.SetServerAddr("stun:3478")
+	if c.serverAddr != "stun:3478" {
+		t.Errorf("SetServerAddr error: %v", c.serverAddr)
+	}
+	c.SetServerDTLS("stuns:stun.example.org", &DTLSConfig{})
+	if c.serverAddr != "stun.example.org:5349" {
+		t.Errorf("SetServerDTLS error: %v", c.serverAddr)
+	}
+}
+
+func TestIsURI(t *testing.T) {
+	for address, expected := range map[string]bool{
+		"stun:stun.example.org":      true,
+		"stun:stun.example.org:3478": true,
+		"turns:192.0.2.1":            true,
+		"stun:[2001:db8::1]:3478":    true,
+		"stun:3478":                  false,
+		"turn:443":                   false,
+		"stun.example.org:3478":      false,
+		"[2001:db8::1]:3478":         false,
+		"192.0.2.1":                  false,
+	} {
+		if got := isURI(address); got != expected {
+			t.Errorf("isURI(%q) error: expected %v, get %v", address, expected, got)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of the WebSocket transport.
+var (
+	ErrWebSocketURL       = errors.New("invalid WebSocket URL")
+	ErrWebSocketHandshake = errors.New("WebSocket handshake failed")
+	ErrWebSocketFrame     = errors.New("invalid WebSocket frame")
+)
+
+const (
+	webSocketGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketProtocol = "stun"
+
+	// The frame opcodes (RFC 6455 Section 5.2).
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	// wsMaxMessage is the longest message accepted, far more than a STUN
+	// message needs.
+	wsMaxMessage = 1 << 16
+)
+
+// SetServerWebSocket allows user to use STUN over a WebSocket (RFC 6455) to
+// a gateway at the ws or wss URL, such as WebSocketGateway, which relays the
+// messages to the STUN server, e.g. to traverse HTTP-only proxies. config is
+// the TLS config of wss, nil for the default one. The transport is
+// experimental. Each STUN message is a binary message of the WebSocket, and
+// like over DTLS, all responses come through the gateway, so Discover only
+// performs test1 and ExternalIP does not cross-check with the verify server.
+// The mapped address is the one the STUN server sees from the gateway.
+func (c *Client) SetServerWebSocket(url string, config *tls.Config) {
+	c.SetServerAddr(url)
+	c.wsURL, c.wsTLS = url, config
+}
+
+func (c *Client) discoverWebSocket(ctx context.Context, r *DiscoveryResult) (NATType, []*Host, error) {
+	conn, err := dialWebSocket(ctx, c.wsURL, c.wsTLS)
+	if err != nil {
+		return NATError, nil, err
+	}
+	defer conn.Close()
+	r.LocalAddr = newHostFromStr(conn.LocalAddr().String())
+	server := conn.conn.RemoteAddr()
+	c.logger.Debugln("Do Test1 over WebSocket")
+	r.started(TestI)
+	resp, err := c.test1(withPhase(ctx, TestI), conn, server)
+	if err != nil {
+		return NATError, nil, withTest(err, TestI)
+	}
+	c.logger.Debugln("Received:", resp)
+	r.addResponse(TestI, resp)
+	if resp == nil {
+		return NATBlocked, nil, nil
+	}
+	if err = responseError(resp, server); err != nil {
+		return NATError, nil, withTest(err, TestI)
+	}
+	r.mapped(TestI, resp.mappedAddr)
+	// The mapped address is the one of the gateway, which tells nothing
+	// about the NAT of the client.
+	return NATUnknown, []*Host{resp.mappedAddr}, nil
+}
+
+// dialWebSocket opens a WebSocket to the URL.
+func dialWebSocket(ctx context.Context, rawURL string, config *tls.Config) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "ws" && u.Scheme != "wss") {
+		return nil, ErrWebSocketURL
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		cfg := &tls.Config{}
+		if config != nil {
+			cfg = config.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	ws, err := webSocketHandshake(ctx, conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// webSocketHandshake performs the opening handshake of the client on conn.
+func webSocketHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*wsConn, error) {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+		defer conn.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {webSocketProtocol},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, ErrWebSocketHandshake
+	}
+	return newWSConn(conn, br, true), nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept of the key.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn carries a STUN message per binary message of a WebSocket, so the
+// transactions can use it like a net.PacketConn. Like streamConn, a timeout
+// leaves the partial frame to the next read, and requests over it are not
+// retransmitted.
+type wsConn struct {
+	conn    net.Conn
+	client  bool   // whether the sent frames are masked
+	pending []byte // bytes read but not parsed yet
+	msg     []byte // payload of the fragments of the message
+	buf     []byte
+	wmu     sync.Mutex
+}
+
+// newWSConn returns the WebSocket on conn, with the bytes buffered by br
+// during the handshake.
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	w := &wsConn{conn: conn, client: client, buf: make([]byte, maxPacketSize)}
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		w.pending = append(w.pending, b...)
+	}
+	return w
+}
+
+// parseWSFrame parses the frame at the start of b, unmasking its payload in
+// place. It returns the length of the frame, 0 if it is not complete yet.
+func parseWSFrame(b []byte, masked bool) (n int, fin bool, op byte, payload []byte, err error) {
+	if len(b) < 2 {
+		return 0, false, 0, nil, nil
+	}
+	if b[0]&0x70 != 0 || (b[1]&0x80 != 0) != masked {
+		return 0, false, 0, nil, ErrWebSocketFrame
+	}
+	fin, op = b[0]&0x80 != 0, b[0]&0x0f
+	length, pos := uint64(b[1]&0x7f), 2
+	switch length {
+	case 126:
+		if len(b) < 4 {
+			return 0, false, 0, nil, nil
+		}
+		length, pos = uint64(binary.BigEndian.Uint16(b[2:4])), 4
+	case 127:
+		if len(b) < 10 {
+			return 0, false, 0, nil, nil
+		}
+		length, pos = binary.BigEndian.Uint64(b[2:10]), 10
+	}
+	if length > wsMaxMessage {
+		return 0, false, 0, nil, ErrWebSocketFrame
+	}
+	var key []byte
+	if masked {
+		if len(b) < pos+4 {
+			return 0, false, 0, nil, nil
+		}
+		key, pos = b[pos:pos+4], pos+4
+	}
+	n = pos + int(length)
+	if len(b) < n {
+		return 0, false, 0, nil, nil
+	}
+	payload = b[pos:n]
+	for i := range key {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= key[i]
+		}
+	}
+	return n, fin, op, payload, nil
+}
+
+// ReadFrom reads the next message, which is discarded with io.ErrShortBuffer
+// if it is longer than b. Pings are answered, and a close frame ends the
+// reads with io.EOF.
+func (w *wsConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		// Frames from the client are masked, from the server not.
+		n, fin, op, payload, err := parseWSFrame(w.pending, !w.client)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n == 0 {
+			m, err := w.conn.Read(w.buf)
+			w.pending = append(w.pending, w.buf[:m]...)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		switch op {
+		case wsPing:
+			err = w.writeFrame(wsPong, payload)
+		case wsClose:
+			w.writeFrame(wsClose, nil)
+			err = io.EOF
+		case wsContinuation, wsText, wsBinary:
+			w.msg = append(w.msg, payload...)
+			if len(w.msg) > wsMaxMessage {
+				err = ErrWebSocketFrame
+			}
+		}
+		w.pending = w.pending[n:]
+		if err != nil {
+			return 0, nil, err
+		}
+		if fin && op <= wsBinary {
+			msg := w.msg
+			w.msg = w.msg[:0]
+			if len(msg) > len(b) {
+				return 0, nil, io.ErrShortBuffer
+			}
+			return copy(b, msg), w.conn.RemoteAddr(), nil
+		}
+	}
+}
+
+// WriteTo sends b as a binary message, addr is ignored.
+func (w *wsConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := w.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !w.client {
+		frame = append(frame, payload...)
+	} else {
+		frame[1] |= 0x80
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		for i, c := range payload {
+			frame = append(frame, c^key[i%4])
+		}
+	}
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	_, err := w.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame and closes the connection.
+func (w *wsConn) Close() error {
+	w.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	w.writeFrame(wsClose, nil)
+	return w.conn.Close()
+}
+
+func (w *wsConn) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *wsConn) SetDeadline(t time.Time) error {
+	return w.conn.SetDeadline(t)
+}
+
+func (w *wsConn) SetReadDeadline(t time.Time) error {
+	return w.conn.SetReadDeadline(t)
+}
+
+func (w *wsConn) SetWriteDeadline(t time.Time) error {
+	return w.conn.SetWriteDeadline(t)
+}
+
+// WebSocketGateway is an http.Handler relaying the STUN messages of
+// WebSocket clients, such as the ones set by SetServerWebSocket, to a STUN
+// server over UDP, from a UDP socket per client. The datagrams received on
+// the socket from the IPs and ports of the server, and of the alternate
+// address told by its responses, are relayed back to the client; the others
+// are dropped.
+type WebSocketGateway struct {
+	server string
+}
+
+// NewWebSocketGateway returns a gateway to the STUN server at the address.
+func NewWebSocketGateway(server string) *WebSocketGateway {
+	return &WebSocketGateway{server: server}
+}
+
+// ServeHTTP performs the opening handshake of the server and relays the
+// messages until either side closes.
+func (g *WebSocketGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "WebSocket required", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	server, err := net.ResolveUDPAddr("udp", g.server)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer udp.Close()
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n")
+	if offersProtocol(r, webSocketProtocol) {
+		rw.WriteString("Sec-WebSocket-Protocol: " + webSocketProtocol + "\r\n")
+	}
+	rw.WriteString("\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	ws := newWSConn(conn, rw.Reader, false)
+	defer ws.Close()
+	go func() {
+		peers := &wsPeers{}
+		peers.add(server)
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !peers.has(addr) {
+				continue
+			}
+			if addr.IP.Equal(server.IP) && addr.Port == server.Port {
+				peers.learn(buf[:n])
+			}
+			if _, err = ws.WriteTo(buf[:n], nil); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := ws.ReadFrom(buf)
+		if err == io.ErrShortBuffer {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		udp.WriteTo(buf[:n], server)
+	}
+}
+
+// offersProtocol reports whether the client offered the subprotocol in the
+// Sec-WebSocket-Protocol headers of the request.
+func offersProtocol(r *http.Request, protocol string) bool {
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == protocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsPeers is the set of addresses the gateway relays datagrams from: any of
+// the IPs combined with any of the ports, as the server answers the change
+// requests from its alternate IP, port or both.
+type wsPeers struct {
+	ips   []net.IP
+	ports []int
+}
+
+// add adds the IP and port of the address to the set.
+func (p *wsPeers) add(addr *net.UDPAddr) {
+	hasIP := false
+	for _, ip := range p.ips {
+		hasIP = hasIP || ip.Equal(addr.IP)
+	}
+	if !hasIP {
+		p.ips = append(p.ips, addr.IP)
+	}
+	hasPort := false
+	for _, port := range p.ports {
+		hasPort = hasPort || port == addr.Port
+	}
+	if !hasPort {
+		p.ports = append(p.ports, addr.Port)
+	}
+}
+
+// has reports whether the datagrams from the address are relayed.
+func (p *wsPeers) has(addr *net.UDPAddr) bool {
+	hasIP := false
+	for _, ip := range p.ips {
+		hasIP = hasIP || ip.Equal(addr.IP)
+	}
+	for _, port := range p.ports {
+		if hasIP && port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// learn adds the alternate address told by the OTHER-ADDRESS, or else the
+// CHANGED-ADDRESS, of the response of the server to the set.
+func (p *wsPeers) learn(b []byte) {
+	pkt, err := parsePacket(b)
+	if err != nil {
+		return
+	}
+	alternate := pkt.getOtherAddr()
+	if alternate == nil {
+		alternate = pkt.getChangedAddr()
+	}
+	if alternate == nil {
+		return
+	}
+	if addr, err := alternate.udpAddr(); err == nil {
+		p.add(addr)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	s, addr := newTestServer(t)
+	defer s.Close()
+	gw := httptest.NewServer(NewWebSocketGateway(addr.String()))
+	defer gw.Close()
+	c := NewClient()
+	c.SetServerWebSocket("ws"+strings.TrimPrefix(gw.URL, "http")+"/stun", nil)
+	r, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if r.NAT != NATUnknown || len(r.Hosts) != 1 || r.Hosts[0].IP() != "127.0.0.1" {
+		t.Errorf("result error: %v %v", r.NAT, r.Hosts)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ip, err := c.ExternalIP(ctx)
+	if err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("ExternalIP error: %v %v", ip, err)
+	}
+	if stats := s.Stats(); stats.Received != 2 {
+		t.Errorf("stats error: %+v", stats)
+	}
+	c.SetServerWebSocket(gw.URL, nil)
+	if _, err = c.DiscoverResult(); err != ErrWebSocketURL {
+		t.Errorf("DiscoverResult error: expected %v, get %v", ErrWebSocketURL, err)
+	}
+}
+
+func TestWebSocketGatewayPeers(t *testing.T) {
+	s, addr := newAlternateTestServer(t)
+	defer s.Close()
+	gw := httptest.NewServer(NewWebSocketGateway(addr.String()))
+	defer gw.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ws, err := dialWebSocket(ctx, "ws"+strings.TrimPrefix(gw.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dialWebSocket error: %v", err)
+	}
+	defer ws.Close()
+	c := NewClient()
+	resp, err := c.test1(ctx, ws, ws.conn.RemoteAddr())
+	if err != nil || resp == nil || resp.otherAddr == nil {
+		t.Fatalf("test1 error: %v %v", resp, err)
+	}
+	// The alternate address is learned from the response to Test I.
+	resp, err = c.test2(ctx, ws, ws.conn.RemoteAddr())
+	if err != nil || resp == nil {
+		t.Fatalf("test2 error: %v %v", resp, err)
+	}
+	// The datagrams from others than the server are dropped.
+	mapped, err := resp.mappedAddr.udpAddr()
+	if err != nil {
+		t.Fatalf("udpAddr error: %v", err)
+	}
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	defer stranger.Close()
+	if _, err = stranger.WriteTo([]byte("hello"), mapped); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, maxPacketSize)
+	if n, _, err := ws.ReadFrom(buf); err == nil {
+		t.Errorf("ReadFrom error: relayed %q", buf[:n])
+	}
+}
+
+func TestWebSocketGatewayProtocol(t *testing.T) {
+	gw := httptest.NewServer(NewWebSocketGateway("127.0.0.1:3478"))
+	defer gw.Close()
+	for _, offer := range []string{"", "chat, stun"} {
+		conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial error: %v", err)
+		}
+		defer conn.Close()
+		req := "GET / HTTP/1.1\r\nHost: stun\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+		if offer != "" {
+			req += "Sec-WebSocket-Protocol: " + offer + "\r\n"
+		}
+		if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse error: %v", err)
+		}
+		expected := ""
+		if offer != "" {
+			expected = webSocketProtocol
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Protocol"); resp.StatusCode != http.StatusSwitchingProtocols || got != expected {
+			t.Errorf("protocol error: expected %q, get %d %q", expected, resp.StatusCode, got)
+		}
+	}
+}
+
+// maskedFrame returns a frame as sent by clients.
+func maskedFrame(fin bool, op byte, payload []byte) []byte {
+	b := []byte{op, 0x80 | byte(len(payload))}
+	if fin {
+		b[0] |= 0x80
+	}
+	if len(payload) >= 126 {
+		b = append(b[:1], 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	key := []byte{1, 2, 3, 4}
+	b = append(b, key...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+	return b
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	server := &wsConn{conn: b, buf: make([]byte, maxPacketSize)}
+	msg := make([]byte, 300)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	var stream []byte
+	stream = append(stream, maskedFrame(true, wsPing, []byte("hi"))...)
+	stream = append(stream, maskedFrame(false, wsBinary, msg[:100])...)
+	stream = append(stream, maskedFrame(true, wsContinuation, msg[100:])...)
+	// An unmasked frame from the client violates the protocol.
+	stream = append(stream, 0x82, 0x01, 0x00)
+	pong := make(chan []byte, 1)
+	go func() {
+		// The pong is read as net.Pipe is synchronous.
+		buf := make([]byte, 16)
+		n, _ := a.Read(buf)
+		pong <- buf[:n]
+	}()
+	go func() {
+		// The frames arrive a few bytes at a time.
+		for i := 0; i < len(stream); i += 7 {
+			a.Write(stream[i:min(i+7, len(stream))])
+		}
+	}()
+	buf := make([]byte, maxPacketSize)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("ReadFrom error: %d bytes, %v", n, err)
+	}
+	if p := <-pong; !bytes.Equal(p, []byte{0x80 | wsPong, 2, 'h', 'i'}) {
+		t.Errorf("pong error: %x", p)
+	}
+	if _, _, err = server.ReadFrom(buf); err != ErrWebSocketFrame {
+		t.Errorf("ReadFrom error: expected %v, get %v", ErrWebSocketFrame, err)
+	}
+}
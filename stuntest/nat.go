@@ -0,0 +1,155 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Behavior is the mapping or filtering behavior of a NAT (RFC 4787).
+type Behavior int
+
+const (
+	// EndpointIndependent reuses the mapping for, and accepts packets
+	// from, any remote endpoint.
+	EndpointIndependent Behavior = iota
+	// AddressDependent uses a mapping per, and accepts packets from,
+	// remote IP addresses the internal endpoint has sent to.
+	AddressDependent
+	// AddressAndPortDependent uses a mapping per, and accepts packets
+	// from, remote IP address and port pairs the internal endpoint has
+	// sent to.
+	AddressAndPortDependent
+	// PortDependent accepts packets from the remote ports the internal
+	// endpoint has sent to, from any IP address. It is a filtering
+	// behavior of some firewalls, outside RFC 4787, and must not be used
+	// for mappings.
+	PortDependent
+)
+
+// NAT translates the addresses of connections listening behind it to its
+// public IP. In RFC 3489 terms, endpoint independent mapping and filtering is
+// a full cone NAT, address dependent filtering a restricted cone NAT,
+// address and port dependent filtering a port restricted cone NAT and any
+// other mapping a symmetric NAT.
+type NAT struct {
+	network   *Network
+	publicIP  net.IP
+	mapping   Behavior
+	filtering Behavior
+
+	mu       sync.Mutex
+	blocked  bool
+	mappings map[string]*natMapping // by internal endpoint and remote key
+	ports    map[int]*natMapping    // by public port
+	port     int
+}
+
+type natMapping struct {
+	conn    *Conn
+	port    int
+	allowed map[string]bool // remote keys by the filtering behavior
+}
+
+// NewNAT returns a NAT on the network with the given public IP, which must
+// not be in use by other connections.
+func (n *Network) NewNAT(publicIP string, mapping, filtering Behavior) *NAT {
+	nat := &NAT{
+		network:   n,
+		publicIP:  net.ParseIP(publicIP),
+		mapping:   mapping,
+		filtering: filtering,
+		mappings:  make(map[string]*natMapping),
+		ports:     make(map[int]*natMapping),
+		port:      firstEphemeralPort,
+	}
+	n.mu.Lock()
+	n.nats[nat.publicIP.String()] = nat
+	n.mu.Unlock()
+	return nat
+}
+
+// Listen returns a connection behind the NAT listening on the given private
+// address.
+func (nat *NAT) Listen(address string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return nat.network.listen(addr, nat)
+}
+
+// SetBlocked sets whether the NAT drops all UDP traffic.
+func (nat *NAT) SetBlocked(blocked bool) {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	nat.blocked = blocked
+}
+
+// Reset drops all mappings, as a NAT rebooting or timing out idle mappings
+// does. New mappings get new public ports.
+func (nat *NAT) Reset() {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	nat.mappings = make(map[string]*natMapping)
+	nat.ports = make(map[int]*natMapping)
+}
+
+// remoteKey returns the key of the remote endpoint under the behavior.
+func remoteKey(b Behavior, addr *net.UDPAddr) string {
+	switch b {
+	case AddressDependent:
+		return addr.IP.String()
+	case AddressAndPortDependent:
+		return addr.String()
+	case PortDependent:
+		return strconv.Itoa(addr.Port)
+	}
+	return ""
+}
+
+func (nat *NAT) outbound(b []byte, c *Conn, dst *net.UDPAddr) {
+	nat.mu.Lock()
+	if nat.blocked {
+		nat.mu.Unlock()
+		return
+	}
+	k := c.addr.String() + "|" + remoteKey(nat.mapping, dst)
+	m := nat.mappings[k]
+	if m == nil {
+		m = &natMapping{conn: c, port: nat.port, allowed: make(map[string]bool)}
+		nat.port++
+		nat.mappings[k] = m
+		nat.ports[m.port] = m
+	}
+	m.allowed[remoteKey(nat.filtering, dst)] = true
+	public := &net.UDPAddr{IP: nat.publicIP, Port: m.port}
+	nat.mu.Unlock()
+	nat.network.deliver(b, public, dst)
+}
+
+func (nat *NAT) inbound(b []byte, src, dst *net.UDPAddr) {
+	nat.mu.Lock()
+	m := nat.ports[dst.Port]
+	ok := m != nil && !nat.blocked && m.allowed[remoteKey(nat.filtering, src)]
+	nat.mu.Unlock()
+	if ok {
+		m.conn.receive(b, src)
+	}
+}
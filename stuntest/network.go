@@ -0,0 +1,267 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package stuntest provides an in-memory network with NAT emulation and a
+// scriptable STUN server, so that code handling NATs can be unit tested
+// without real network access.
+//
+//	n := stuntest.NewNetwork()
+//	srv, _ := stuntest.NewServer(n, "203.0.113.1", "203.0.113.2", 3478, 3479)
+//	defer srv.Close()
+//	nat := n.NewNAT("198.51.100.1", stuntest.EndpointIndependent, stuntest.AddressDependent)
+//	conn, _ := nat.Listen("10.0.0.2:5000")
+//	client := stun.NewClientWithConnection(conn)
+//	client.SetServerAddr(srv.Addr().String())
+//	typ, host, err := client.Discover() // stun.NATRestricted
+package stuntest
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// queueSize is the number of datagrams a connection buffers before dropping
+// further ones, like a full socket buffer.
+const queueSize = 64
+
+// firstEphemeralPort is the first port assigned to listeners asking for
+// port 0.
+const firstEphemeralPort = 49152
+
+// ErrAddrInUse is returned when listening on an address already in use.
+var ErrAddrInUse = errors.New("address already in use")
+
+// Network is an in-memory network routing datagrams between the connections
+// listening on it. Delivery is immediate and never reorders, but datagrams
+// are dropped when the receiver's queue is full.
+type Network struct {
+	mu    sync.Mutex
+	conns map[string]*Conn
+	nats  map[string]*NAT
+	port  int
+}
+
+// NewNetwork returns an empty network.
+func NewNetwork() *Network {
+	return &Network{
+		conns: make(map[string]*Conn),
+		nats:  make(map[string]*NAT),
+		port:  firstEphemeralPort,
+	}
+}
+
+// Pipe returns a pair of connections on a new network, which can only reach
+// each other.
+func Pipe() (net.PacketConn, net.PacketConn) {
+	n := NewNetwork()
+	a, _ := n.Listen("192.0.2.1:1000")
+	b, _ := n.Listen("192.0.2.2:2000")
+	return a, b
+}
+
+// Listen returns a connection on the network listening on the given address,
+// which must have an IP literal. Port 0 picks a free port.
+func (n *Network) Listen(address string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return n.listen(addr, nil)
+}
+
+func (n *Network) listen(addr *net.UDPAddr, nat *NAT) (*Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if addr.Port == 0 {
+		for n.conns[key(addr.IP, n.port)] != nil {
+			n.port++
+		}
+		addr = &net.UDPAddr{IP: addr.IP, Port: n.port}
+		n.port++
+	}
+	k := addr.String()
+	if n.conns[k] != nil {
+		return nil, ErrAddrInUse
+	}
+	c := &Conn{
+		network:  n,
+		addr:     addr,
+		nat:      nat,
+		inbox:    make(chan datagram, queueSize),
+		deadline: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	n.conns[k] = c
+	return c, nil
+}
+
+// deliver routes a datagram from src to dst, through the NAT owning dst if
+// any.
+func (n *Network) deliver(b []byte, src, dst *net.UDPAddr) {
+	n.mu.Lock()
+	nat := n.nats[dst.IP.String()]
+	c := n.conns[dst.String()]
+	n.mu.Unlock()
+	if nat != nil {
+		nat.inbound(b, src, dst)
+		return
+	}
+	// Connections behind a NAT are only reachable through it.
+	if c != nil && c.nat == nil {
+		c.receive(b, src)
+	}
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+}
+
+func key(ip net.IP, port int) string {
+	return (&net.UDPAddr{IP: ip, Port: port}).String()
+}
+
+type datagram struct {
+	b   []byte
+	src *net.UDPAddr
+}
+
+// Conn is a connection on a Network. It implements net.PacketConn.
+type Conn struct {
+	network *Network
+	addr    *net.UDPAddr
+	nat     *NAT // the NAT the connection is behind, if any
+	inbox   chan datagram
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	deadline     chan struct{} // closed when readDeadline changes
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, again, err := c.read(b)
+		if !again {
+			return n, addr, err
+		}
+	}
+}
+
+// read waits for a datagram until the read deadline. It reports again if the
+// deadline changed meanwhile.
+func (c *Conn) read(b []byte) (n int, addr net.Addr, again bool, err error) {
+	c.mu.Lock()
+	t, changed := c.readDeadline, c.deadline
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !t.IsZero() {
+		d := time.Until(t)
+		if d <= 0 {
+			return 0, nil, false, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p := <-c.inbox:
+		return copy(b, p.b), p.src, false, nil
+	case <-expired:
+		return 0, nil, false, c.opError("read", os.ErrDeadlineExceeded)
+	case <-c.closed:
+		return 0, nil, false, c.opError("read", net.ErrClosed)
+	case <-changed:
+		return 0, nil, true, nil
+	}
+}
+
+// WriteTo implements net.PacketConn.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if dst, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, c.opError("write", err)
+		}
+	}
+	b = append([]byte(nil), b...)
+	if c.nat != nil {
+		c.nat.outbound(b, c, dst)
+	} else {
+		c.network.deliver(b, c.addr, dst)
+	}
+	return len(b), nil
+}
+
+// Close implements net.PacketConn.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements net.PacketConn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadline)
+	c.deadline = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn. Writes never block, so the
+// deadline is ignored.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *Conn) receive(b []byte, src *net.UDPAddr) {
+	select {
+	case c.inbox <- datagram{b, src}:
+	default:
+	}
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
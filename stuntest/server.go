@@ -0,0 +1,149 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// Server is a STUN server on a Network whose responses can be dropped,
+// delayed and duplicated. It is serving as soon as it is created.
+type Server struct {
+	server *stun.Server
+	addr   net.Addr
+
+	mu        sync.Mutex
+	drop      func(n int) bool
+	delay     time.Duration
+	duplicate int
+	sent      int
+}
+
+// NewServer returns a server listening on ip and port. Unless altIP is
+// empty, it also listens on the alternate IP and port combinations to answer
+// CHANGE-REQUEST as RFC 3489 and RFC 5780 servers do. The rate limit of the
+// underlying stun.Server is disabled.
+func NewServer(n *Network, ip, altIP string, port, altPort int) (*Server, error) {
+	s := &Server{}
+	listen := func(ip string, port int) (net.PacketConn, error) {
+		c, err := n.Listen(net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		return &faultConn{c, s}, nil
+	}
+	primary, err := listen(ip, port)
+	if err != nil {
+		return nil, err
+	}
+	s.addr = primary.LocalAddr()
+	s.server = stun.NewServer(primary)
+	s.server.SetRateLimit(0, 0)
+	if altIP != "" {
+		var conns []net.PacketConn
+		for _, a := range []struct {
+			ip   string
+			port int
+		}{{ip, altPort}, {altIP, port}, {altIP, altPort}} {
+			c, err := listen(a.ip, a.port)
+			if err != nil {
+				primary.Close()
+				for _, c := range conns {
+					c.Close()
+				}
+				return nil, err
+			}
+			conns = append(conns, c)
+		}
+		s.server.SetAlternate(conns[0], conns[1], conns[2])
+	}
+	go s.server.Serve()
+	return s, nil
+}
+
+// Addr returns the primary address of the server.
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+// STUN returns the underlying server, e.g. to set credentials or read the
+// stats.
+func (s *Server) STUN() *stun.Server {
+	return s.server
+}
+
+// SetDrop sets the function deciding whether to drop the n-th response,
+// counting from 0. A nil function drops nothing.
+func (s *Server) SetDrop(drop func(n int) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop = drop
+}
+
+// SetDelay sets the delay of responses.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// SetDuplicate sets the number of extra copies sent of every response.
+func (s *Server) SetDuplicate(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duplicate = n
+}
+
+// Close closes the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// faultConn applies the faults of the server to the responses written.
+type faultConn struct {
+	*Conn
+	s *Server
+}
+
+func (c *faultConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	s := c.s
+	s.mu.Lock()
+	drop := s.drop != nil && s.drop(s.sent)
+	delay, copies := s.delay, s.duplicate+1
+	s.sent++
+	s.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	b = append([]byte(nil), b...)
+	send := func() {
+		for i := 0; i < copies; i++ {
+			c.Conn.WriteTo(b, addr)
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, send)
+	} else {
+		send()
+	}
+	return len(b), nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := a.WriteTo([]byte("ping"), b.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom error: %v", err)
+	}
+	if string(buf[:n]) != "ping" || addr.String() != a.LocalAddr().String() {
+		t.Errorf("read error: get %q from %v", buf[:n], addr)
+	}
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = b.ReadFrom(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("deadline error: expected timeout, get %v", err)
+	}
+}
+
+func TestNATFiltering(t *testing.T) {
+	tests := []struct {
+		filtering Behavior
+		otherIP   bool // packets from another IP pass
+		otherPort bool // packets from another port pass
+	}{
+		{EndpointIndependent, true, true},
+		{AddressDependent, false, true},
+		{AddressAndPortDependent, false, false},
+	}
+	for _, tt := range tests {
+		n := NewNetwork()
+		nat := n.NewNAT("198.51.100.1", EndpointIndependent, tt.filtering)
+		conn, _ := nat.Listen("10.0.0.2:5000")
+		peer, _ := n.Listen("203.0.113.1:3478")
+		otherPort, _ := n.Listen("203.0.113.1:3479")
+		otherIP, _ := n.Listen("203.0.113.2:3478")
+		conn.WriteTo([]byte("out"), peer.LocalAddr())
+		buf := make([]byte, 16)
+		_, public, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom error: %v", err)
+		}
+		if public.(*net.UDPAddr).IP.String() != "198.51.100.1" {
+			t.Errorf("mapping error: get %v", public)
+		}
+		for _, c := range []struct {
+			conn *Conn
+			pass bool
+		}{{peer, true}, {otherPort, tt.otherPort}, {otherIP, tt.otherIP}} {
+			c.conn.WriteTo([]byte("in"), public)
+			conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			_, _, err := conn.ReadFrom(buf)
+			if (err == nil) != c.pass {
+				t.Errorf("filtering %v error: packet from %v passed %v", tt.filtering, c.conn.LocalAddr(), err == nil)
+			}
+		}
+	}
+}
+
+func TestNATMapping(t *testing.T) {
+	n := NewNetwork()
+	nat := n.NewNAT("198.51.100.1", AddressAndPortDependent, AddressAndPortDependent)
+	conn, _ := nat.Listen("10.0.0.2:5000")
+	a, _ := n.Listen("203.0.113.1:3478")
+	b, _ := n.Listen("203.0.113.1:3479")
+	buf := make([]byte, 16)
+	conn.WriteTo([]byte("a"), a.LocalAddr())
+	conn.WriteTo([]byte("b"), b.LocalAddr())
+	_, fromA, _ := a.ReadFrom(buf)
+	_, fromB, _ := b.ReadFrom(buf)
+	if fromA.String() == fromB.String() {
+		t.Errorf("mapping error: same mapping %v for different remote ports", fromA)
+	}
+}
+
+func newClient(t *testing.T, nat *NAT, srv *Server) *stun.Client {
+	conn, err := nat.Listen("10.0.0.2:5000")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	c := stun.NewClientWithConnection(conn)
+	c.SetServerAddr(srv.Addr().String())
+	return c
+}
+
+func TestDiscoverFullCone(t *testing.T) {
+	n := NewNetwork()
+	srv, err := NewServer(n, "203.0.113.1", "203.0.113.2", 3478, 3479)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	defer srv.Close()
+	nat := n.NewNAT("198.51.100.1", EndpointIndependent, EndpointIndependent)
+	c := newClient(t, nat, srv)
+	typ, host, err := c.Discover()
+	if err != nil {
+		t.Fatalf("Discover error: %v", err)
+	}
+	if typ != stun.NATFull {
+		t.Errorf("NAT type error: expected %v, get %v", stun.NATFull, typ)
+	}
+	if host == nil || host.IP() != "198.51.100.1" {
+		t.Errorf("mapped address error: get %v", host)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	n := NewNetwork()
+	srv, err := NewServer(n, "203.0.113.1", "", 3478, 0)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	defer srv.Close()
+	srv.SetDrop(func(n int) bool { return n == 0 })
+	srv.SetDuplicate(1)
+	srv.SetDelay(time.Millisecond)
+	nat := n.NewNAT("198.51.100.1", EndpointIndependent, EndpointIndependent)
+	c := newClient(t, nat, srv)
+	var retransmits int
+	c.OnEvent(func(e stun.Event) {
+		if e.Type == stun.EventRetransmit {
+			retransmits++
+		}
+	})
+	for i := 0; i < 2; i++ {
+		host, err := c.Keepalive()
+		if err != nil {
+			t.Fatalf("Keepalive error: %v", err)
+		}
+		if host == nil || host.IP() != "198.51.100.1" {
+			t.Errorf("mapped address error: get %v", host)
+		}
+	}
+	if retransmits != 1 {
+		t.Errorf("retransmit error: expected 1, get %d", retransmits)
+	}
+}
+
+func TestDiscoverFiltering(t *testing.T) {
+	for _, tt := range []struct {
+		behavior  Behavior
+		filtering stun.FilteringBehavior
+		nat       stun.NATType
+	}{
+		{EndpointIndependent, stun.FilteringEndpointIndependent, stun.NATFull},
+		{AddressDependent, stun.FilteringAddressDependent, stun.NATRestricted},
+		{AddressAndPortDependent, stun.FilteringAddressPortDependent, stun.NATPortRestricted},
+		{PortDependent, stun.FilteringPortDependent, stun.NATRestricted},
+	} {
+		n := NewNetwork()
+		srv, err := NewServer(n, "203.0.113.1", "203.0.113.2", 3478, 3479)
+		if err != nil {
+			t.Fatalf("NewServer error: %v", err)
+		}
+		nat := n.NewNAT("198.51.100.1", EndpointIndependent, tt.behavior)
+		c := newClient(t, nat, srv)
+		c.SetTestTimeout(200 * time.Millisecond)
+		f, err := c.DiscoverFiltering(context.Background())
+		if err != nil || f != tt.filtering {
+			t.Errorf("DiscoverFiltering error: expected %v, get %v %v", tt.filtering, f, err)
+		}
+		// The classic discovery cannot tell port-dependent filtering
+		// from address-dependent filtering.
+		nat.Reset()
+		r, err := c.DiscoverResult()
+		if err != nil || r.NAT != tt.nat {
+			t.Errorf("DiscoverResult error: expected %v, get %v %v", tt.nat, r.NAT, err)
+		}
+		if tt.behavior != PortDependent && r.Filtering != tt.filtering {
+			t.Errorf("Filtering error: expected %v, get %v", tt.filtering, r.Filtering)
+		}
+		srv.Close()
+	}
+}